@@ -0,0 +1,36 @@
+package api
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/keydotcat/keycatd/models"
+)
+
+const demoteInactiveAdminsInterval = time.Hour
+
+func (ah apiHandler) demoteInactiveAdminsLoop(inactivity time.Duration) {
+	for {
+		if err := ah.demoteInactiveAdmins(inactivity); err != nil {
+			log.Printf("Could not demote inactive admins: %s", err)
+		}
+		time.Sleep(demoteInactiveAdminsInterval)
+	}
+}
+
+func (ah apiHandler) demoteInactiveAdmins(inactivity time.Duration) error {
+	ctx := models.AddDBToContext(context.Background(), ah.db)
+	demotions, err := models.DemoteInactiveAdmins(ctx, time.Now().UTC().Add(-inactivity))
+	for _, ad := range demotions {
+		if err := ah.mail.sendAdminDemotedMail(ad.User, ad.Team, ""); err != nil {
+			log.Printf("Could not send demotion mail to %s: %s", ad.User.Id, err)
+		}
+		for _, admin := range ad.Admins {
+			if err := ah.mail.sendAdminDemotedNoticeMail(admin, ad.User, ad.Team, ""); err != nil {
+				log.Printf("Could not send demotion notice to %s: %s", admin.Id, err)
+			}
+		}
+	}
+	return err
+}
@@ -1,41 +1,96 @@
 package api
 
 import (
-	"fmt"
+	"context"
+	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/keydotcat/keycatd/managers"
 	"github.com/keydotcat/keycatd/models"
 	"github.com/keydotcat/keycatd/util"
-	"github.com/tomasen/realip"
 )
 
-func (ah apiHandler) getSessionFromHeader(r *http.Request) *managers.Session {
+func (ah apiHandler) getSessionFromHeader(r *http.Request) (*managers.Session, error) {
 	authHdr := strings.Split(r.Header.Get("Authorization"), " ")
 	if len(authHdr) < 2 || authHdr[0] != "Bearer" {
-		return nil
+		return nil, nil
+	}
+	s, err := ah.sm.GetSession(authHdr[1])
+	if util.CheckErr(err, managers.ErrSessionStoreUnavailable) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// Extend the session and re-issue the csrf cookie if rolling sessions are enabled.
+// Refreshes are spaced by the refresh interval so the store isn't written on every request.
+func (ah apiHandler) refreshSession(w http.ResponseWriter, r *http.Request, s *managers.Session, csrfToken string) *managers.Session {
+	if !ah.options.rollingSessions || time.Since(s.LastAccess) < ah.options.sessionRefreshInterval {
+		return s
 	}
-	s, err := ah.sm.UpdateSession(authHdr[1], realip.FromRequest(r), r.UserAgent())
+	ns, err := ah.sm.UpdateSession(s.Id, ah.clientIP(r), r.UserAgent())
 	if err != nil {
 		return nil
 	}
-	return s
+	if ns.RequiresCSRF && len(csrfToken) > 0 {
+		ah.csrf.setToken(w, csrfToken)
+	}
+	return ns
+}
+
+// checkSessionLifetime returns an error with the reason in the session field if the session is over its max age
+// or has been idle for too long. The idle time only slides forward when the session is refreshed
+func (ah apiHandler) checkSessionLifetime(s *managers.Session) error {
+	if ah.options.sessionMaxAge > 0 && time.Since(s.CreatedAt) > ah.options.sessionMaxAge {
+		return sessionEndedErr(ErrSessionExpired, "expired")
+	}
+	if ah.options.sessionIdleTimeout > 0 && time.Since(s.LastAccess) > ah.options.sessionIdleTimeout {
+		return sessionEndedErr(ErrSessionIdle, "idle")
+	}
+	return nil
+}
+
+// sessionEndedErr tells clients why they have to log in again
+func sessionEndedErr(err error, reason string) error {
+	errs := util.NewErrorFields().(*util.Error)
+	errs.SetFieldError("session", reason)
+	return errs.SetErrorOrCamo(err)
 }
 
 func (ah apiHandler) authorizeRequest(w http.ResponseWriter, r *http.Request) *http.Request {
-	s := ah.getSessionFromHeader(r)
+	s, err := ah.getSessionFromHeader(r)
+	if err != nil {
+		httpErr(w, err)
+		return nil
+	}
 	if s == nil {
 		http.Error(w, "Invalid authorization header", http.StatusUnauthorized)
 		return nil
 	}
+	if err := ah.checkSessionLifetime(s); err != nil {
+		if derr := ah.sm.DeleteSession(s.Id); derr != nil {
+			log.Printf("Could not delete ended session: %s", derr)
+		}
+		httpErr(w, err)
+		return nil
+	}
+	csrfToken := ""
 	if s.RequiresCSRF {
-		if csrfToken, valid := ah.csrf.checkToken(w, r); !valid {
+		if !ah.origin.check(r) {
+			http.Error(w, "Invalid origin", http.StatusForbidden)
+			return nil
+		}
+		var valid bool
+		if csrfToken, valid = ah.csrf.checkToken(w, r); !valid {
 			http.Error(w, "Invalid CSRF token", http.StatusUnauthorized)
 			return nil
-		} else {
-			r = r.WithContext(ctxAddCsrf(r.Context(), csrfToken))
 		}
+		r = r.WithContext(ctxAddCsrf(r.Context(), csrfToken))
 	}
 	u, err := models.FindUser(r.Context(), s.User)
 	if util.CheckErr(err, models.ErrDoesntExist) {
@@ -45,17 +100,28 @@ func (ah apiHandler) authorizeRequest(w http.ResponseWriter, r *http.Request) *h
 	} else if err != nil {
 		panic(err)
 	}
-	return r.WithContext(ctxAddUser(ctxAddSession(r.Context(), s), u))
+	if u.IsSuspended() || u.AwaitingApproval {
+		http.Error(w, "Invalid authorization header", http.StatusUnauthorized)
+		return nil
+	}
+	idle := time.Since(s.LastAccess)
+	if s = ah.refreshSession(w, r, s, csrfToken); s == nil {
+		http.Error(w, "Invalid authorization header", http.StatusUnauthorized)
+		return nil
+	}
+	return r.WithContext(ctxAddSessionIdle(ctxAddUser(ctxAddSession(r.Context(), s), u), idle))
 }
 
 type authRegisterRequest struct {
-	Username       string `json:"id"`
-	Email          string `json:"email"`
-	Fullname       string `json:"fullname"`
-	Password       string `json:"password"`
-	KeyPack        []byte `json:"user_keys"`
-	VaultPublicKey []byte `json:"vault_public_keys"`
-	VaultKey       []byte `json:"vault_keys"`
+	Username       string          `json:"id"`
+	Email          string          `json:"email"`
+	Fullname       string          `json:"fullname"`
+	Password       string          `json:"password"`
+	KeyPack        []byte          `json:"user_keys"`
+	VaultPublicKey []byte          `json:"vault_public_keys"`
+	VaultKey       []byte          `json:"vault_keys"`
+	Kdf            *util.KDFParams `json:"kdf"`
+	PasswordCheck  *PasswordReport `json:"password_check"`
 }
 
 func (ah apiHandler) authRoot(w http.ResponseWriter, r *http.Request) error {
@@ -68,8 +134,18 @@ func (ah apiHandler) authRoot(w http.ResponseWriter, r *http.Request) error {
 		return ah.authConfirmEmail(w, r)
 	case "request_confirmation_token":
 		return ah.authRequestConfirmationToken(w, r)
+	case "email_available":
+		return ah.authEmailAvailable(w, r)
 	case "login":
 		return ah.authLogin(w, r)
+	case "webauthn_challenge":
+		return ah.authWebAuthnChallenge(w, r)
+	case "forgot_password":
+		return ah.authForgotPassword(w, r)
+	case "reset_password":
+		return ah.authResetPassword(w, r)
+	case "password_range":
+		return ah.authPasswordRange(w, r)
 	case "session":
 		return ah.authGetSession(w, r)
 	}
@@ -83,6 +159,7 @@ func (ah apiHandler) authRegister(w http.ResponseWriter, r *http.Request) error
 		return err
 	}
 	ctx := r.Context()
+	invited := false
 	if ah.options.onlyInvited {
 		invs, err := models.FindInvitesForEmail(ctx, apr.Email)
 		if err != nil {
@@ -91,14 +168,23 @@ func (ah apiHandler) authRegister(w http.ResponseWriter, r *http.Request) error
 		if len(invs) == 0 {
 			return util.NewErrorFrom(models.ErrUnauthorized)
 		}
+		invited = true
+	}
+	if err := ah.checkPassword(ctx, apr.PasswordCheck); err != nil {
+		return err
 	}
-	u, t, err := models.NewUser(
+	kdf := util.NewKDFParams()
+	if apr.Kdf != nil {
+		kdf = *apr.Kdf
+	}
+	u, t, err := models.NewUserWithKDF(
 		ctx,
 		apr.Username,
 		apr.Fullname,
 		apr.Email,
 		apr.Password,
 		apr.KeyPack,
+		kdf,
 		models.VaultKeyPair{
 			PublicKey: apr.VaultPublicKey,
 			Keys:      map[string][]byte{apr.Username: apr.VaultKey},
@@ -107,6 +193,14 @@ func (ah apiHandler) authRegister(w http.ResponseWriter, r *http.Request) error
 	if err != nil {
 		return err
 	}
+	if invited {
+		// The invitation already proved the address belongs to the user
+		if err := u.ConfirmEmail(ctx, t.Id); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
 	if err := ah.mail.sendConfirmationMail(u, t, r.Header.Get("X-Locale")); err != nil {
 		panic(err)
 	}
@@ -136,6 +230,9 @@ type authRequest struct {
 	Password    string `json:"password"`
 	RequireCSRF bool   `json:"want_csrf"`
 	Email       string `json:"email"`
+	TOTP        string `json:"totp"`
+	// Answer to the challenge from /auth/webauthn_challenge. Used instead of the totp code
+	WebAuthn *models.WebAuthnAssertion `json:"webauthn"`
 }
 
 // /auth/request_confirmation_token
@@ -152,11 +249,14 @@ func (ah apiHandler) authRequestConfirmationToken(w http.ResponseWriter, r *http
 		}
 		return err
 	}
-	t, err := u.GetVerificationToken(r.Context())
-	if err != nil {
+	t, err := u.ResendConfirmation(r.Context())
+	if util.CheckErr(err, models.ErrDoesntExist) || util.CheckErr(err, models.ErrConfirmationRateLimited) {
+		// Nothing pending or sent too recently. Answer the same as for unknown addresses
+		w.WriteHeader(http.StatusOK)
+		return nil
+	} else if err != nil {
 		return err
 	}
-	fmt.Println("Token is", t)
 	if err := ah.mail.sendConfirmationMail(u, t, r.Header.Get("X-Locale")); err != nil {
 		panic(err)
 	}
@@ -172,30 +272,139 @@ type authLoginResponse struct {
 	SecretKeys   []byte `json:"secret_key"`
 	RequiresCSRF bool   `json:"csrf_required"`
 	Csrf         string `json:"csrf,omitempty"`
+	AccessToken  string `json:"access_token"`
+	// New kdf params to derive the keys again with and send to PUT /user/kdf
+	KdfUpgrade *util.KDFParams `json:"kdf_upgrade,omitempty"`
 }
 
-// /auth/login
-func (ah apiHandler) authLogin(w http.ResponseWriter, r *http.Request) error {
-	aer := &authRequest{}
-	if err := jsonDecode(w, r, 1024, aer); err != nil {
+// loginFailed records the failure and returns the error for bad credentials
+func (ah apiHandler) loginFailed(id, ip string) error {
+	ah.metrics.Inc(managers.METRIC_LOGINS_FAILED)
+	if err := ah.loginLimiter.failed(id, ip); err != nil {
 		return err
 	}
-	u, err := models.FindUser(r.Context(), aer.Id)
+	return util.NewErrorFrom(models.ErrUnauthorized)
+}
+
+// checkLoginCredentials returns the user if the password is right and the account can log in
+func (ah apiHandler) checkLoginCredentials(ctx context.Context, aer *authRequest, ip string) (*models.User, error) {
+	if err := ah.loginLimiter.check(aer.Id, ip); err != nil {
+		return nil, err
+	}
+	u, err := models.FindUser(ctx, aer.Id)
 	if util.CheckErr(err, models.ErrDoesntExist) {
-		return util.NewErrorFrom(models.ErrUnauthorized)
+		return nil, ah.loginFailed(aer.Id, ip)
 	} else if err != nil {
-		return err
+		return nil, err
+	}
+	if err := u.CheckPassword(aer.Password); err != nil {
+		return nil, ah.loginFailed(aer.Id, ip)
+	}
+	if u.AuthSource == models.AUTH_SOURCE_SSO {
+		return nil, util.NewErrorFrom(models.ErrLocalAuthDisabled)
 	}
 	if !u.ConfirmedAt.Valid {
-		return util.NewErrorFrom(models.ErrUnauthorized)
+		return nil, util.NewErrorFrom(models.ErrEmailNotConfirmed)
 	}
-	if err := u.CheckPassword(aer.Password); err != nil {
-		return util.NewErrorFrom(models.ErrUnauthorized)
+	if u.IsSuspended() {
+		return nil, util.NewErrorFrom(models.ErrAccountSuspended)
+	}
+	if u.AwaitingApproval {
+		return nil, util.NewErrorFrom(models.ErrAwaitingApproval)
+	}
+	return u, nil
+}
+
+// checkSecondFactor verifies the security key assertion or the totp code if the user has any of them. Users with
+// security keys get ErrWebAuthnRequired when nothing is sent and the totp field flags if a code is also accepted
+func (ah apiHandler) checkSecondFactor(r *http.Request, u *models.User, aer *authRequest, ip string) error {
+	ctx := r.Context()
+	hasTOTP, err := u.HasTOTP(ctx)
+	if err != nil {
+		return err
+	}
+	hasWebAuthn, err := u.HasWebAuthn(ctx)
+	if err != nil {
+		return err
+	}
+	switch {
+	case hasWebAuthn && aer.WebAuthn != nil:
+		err = u.VerifyWebAuthn(ctx, aer.WebAuthn)
+	case hasTOTP && len(aer.TOTP) > 0:
+		err = u.VerifyTOTP(ctx, aer.TOTP)
+	case hasWebAuthn:
+		errs := util.NewErrorFields().(*util.Error)
+		if hasTOTP {
+			errs.SetFieldError("totp", "accepted")
+		}
+		return util.NewErrorFrom(errs.SetErrorOrCamo(ErrWebAuthnRequired))
+	case hasTOTP:
+		return util.NewErrorFrom(models.ErrTOTPRequired)
+	}
+	if util.CheckErr(err, models.ErrInvalidTOTPCode) || util.CheckErr(err, models.ErrInvalidWebAuthn) || util.CheckErr(err, models.ErrAuthenticatorCloned) {
+		ah.metrics.Inc(managers.METRIC_LOGINS_FAILED)
+		if ferr := ah.loginLimiter.failed(aer.Id, ip); ferr != nil {
+			return ferr
+		}
 	}
-	s, err := ah.sm.NewSession(u.Id, realip.FromRequest(r), r.UserAgent(), aer.RequireCSRF)
+	return err
+}
+
+// /auth/webauthn_challenge
+// Returns the challenge to sign with a security key in the next login. The password is checked so the registered
+// credentials are not exposed
+func (ah apiHandler) authWebAuthnChallenge(w http.ResponseWriter, r *http.Request) error {
+	aer := &authRequest{}
+	if err := jsonDecode(w, r, 1024, aer); err != nil {
+		return err
+	}
+	u, err := ah.checkLoginCredentials(r.Context(), aer, ah.clientIP(r))
 	if err != nil {
+		return err
+	}
+	opts, err := u.BeginWebAuthnLogin(r.Context())
+	if err != nil {
+		return err
+	}
+	return jsonResponse(w, opts)
+}
+
+// /auth/login
+func (ah apiHandler) authLogin(w http.ResponseWriter, r *http.Request) error {
+	aer := &authRequest{}
+	if err := jsonDecode(w, r, 8*1024, aer); err != nil {
+		return err
+	}
+	ip := ah.clientIP(r)
+	u, err := ah.checkLoginCredentials(r.Context(), aer, ip)
+	if err != nil {
+		return err
+	}
+	if err := ah.checkSecondFactor(r, u, aer, ip); err != nil {
+		return err
+	}
+	if err := ah.loginLimiter.succeeded(aer.Id); err != nil {
+		return err
+	}
+	if err := u.ClearResetTokens(r.Context()); err != nil {
+		return err
+	}
+	s, err := ah.sm.NewSession(u.Id, ip, r.UserAgent(), aer.RequireCSRF)
+	if util.CheckErr(err, managers.ErrSessionStoreUnavailable) {
+		return err
+	} else if err != nil {
 		panic(err)
 	}
+	accessToken, err := ah.jwt.sign(r.Context(), u.Id, s.Id)
+	if err != nil {
+		return err
+	}
+	ah.metrics.Inc(managers.METRIC_LOGINS_SUCCEEDED)
+	var kdfUpgrade *util.KDFParams
+	if u.NeedsKDFUpgrade() {
+		kdf := util.NewKDFParams()
+		kdfUpgrade = &kdf
+	}
 	return jsonResponse(w, authLoginResponse{
 		u.Id,
 		s.Id,
@@ -204,6 +413,8 @@ func (ah apiHandler) authLogin(w http.ResponseWriter, r *http.Request) error {
 		u.Key,
 		s.RequiresCSRF,
 		ah.csrf.generateNewToken(w),
+		accessToken,
+		kdfUpgrade,
 	})
 }
 
@@ -215,7 +426,10 @@ type authGetSessionResponse struct {
 
 // GET /auth/session/:token
 func (ah apiHandler) authGetSession(w http.ResponseWriter, r *http.Request) error {
-	currentSession := ah.getSessionFromHeader(r)
+	currentSession, err := ah.getSessionFromHeader(r)
+	if err != nil {
+		return err
+	}
 	if currentSession == nil {
 		http.Error(w, "Invalid authorization header", http.StatusUnauthorized)
 		return nil
@@ -227,3 +441,75 @@ func (ah apiHandler) authGetSession(w http.ResponseWriter, r *http.Request) erro
 		currentSession.StoreToken,
 	})
 }
+
+// /auth/forgot_password
+// Always answers OK so it cannot be used to find out which emails have an account
+func (ah apiHandler) authForgotPassword(w http.ResponseWriter, r *http.Request) error {
+	aer := &authRequest{}
+	if err := jsonDecode(w, r, 1024, aer); err != nil {
+		return err
+	}
+	ctx := r.Context()
+	u, err := models.FindUserByEmail(ctx, aer.Email)
+	if err != nil {
+		if util.CheckErr(err, models.ErrDoesntExist) {
+			w.WriteHeader(http.StatusOK)
+			return nil
+		}
+		return err
+	}
+	if !u.ConfirmedAt.Valid || u.IsSuspended() {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	token, err := u.GenerateResetToken(ctx)
+	if util.CheckErr(err, models.ErrLocalAuthDisabled) {
+		// Answer as for any other account so the auth source does not leak and tell the user where to go instead
+		if err := ah.mail.sendSSOPasswordNoticeMail(u, r.Header.Get("X-Locale")); err != nil {
+			panic(err)
+		}
+		w.WriteHeader(http.StatusOK)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := ah.mail.sendPasswordResetMail(u, token, r.Header.Get("X-Locale")); err != nil {
+		panic(err)
+	}
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+type authResetPasswordRequest struct {
+	Id            string          `json:"id"`
+	Token         string          `json:"token"`
+	Password      string          `json:"password"`
+	KeyPack       []byte          `json:"user_keys"`
+	PasswordCheck *PasswordReport `json:"password_check"`
+}
+
+// /auth/reset_password
+func (ah apiHandler) authResetPassword(w http.ResponseWriter, r *http.Request) error {
+	arr := &authResetPasswordRequest{}
+	if err := jsonDecode(w, r, 8192, arr); err != nil {
+		return err
+	}
+	ctx := r.Context()
+	u, err := models.FindUser(ctx, arr.Id)
+	if util.CheckErr(err, models.ErrDoesntExist) {
+		return util.NewErrorFrom(models.ErrInvalidResetToken)
+	} else if err != nil {
+		return err
+	}
+	if err := ah.checkPassword(ctx, arr.PasswordCheck); err != nil {
+		return err
+	}
+	if err := u.ResetPasswordWithToken(ctx, arr.Token, arr.Password, arr.KeyPack); err != nil {
+		return err
+	}
+	if err := ah.sm.DeleteAllSessions(u.Id); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
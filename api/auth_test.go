@@ -1,11 +1,17 @@
 package api
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
 	"testing"
 
+	"github.com/keydotcat/keycatd/managers"
 	"github.com/keydotcat/keycatd/models"
 	"github.com/keydotcat/keycatd/util"
+	"golang.org/x/crypto/ed25519"
 )
 
 func loginDummyUser() *models.User {
@@ -31,12 +37,19 @@ func TestRegister(t *testing.T) {
 		fullpack,
 		vkp.PublicKey,
 		vkp.Keys[uid],
+		nil,
+		nil,
 	}
 	r, err := PostRequest("/auth/register", arp)
 	CheckErrorAndResponse(t, r, err, 200)
 	ar := authRequest{Id: arp.Username, Password: arp.Password, RequireCSRF: true}
 	r, err = PostRequest("/auth/login", ar)
 	CheckErrorAndResponse(t, r, err, 401)
+	body := &bytes.Buffer{}
+	body.ReadFrom(r.Body)
+	if !strings.Contains(body.String(), models.ErrEmailNotConfirmed.Error()) {
+		t.Fatalf("Expected login to be blocked until the email is confirmed")
+	}
 	tokens := models.FindTokensForUser(getCtx(), arp.Username)
 	if len(tokens) != 1 {
 		t.Fatalf("Expected to find one token and found %d", len(tokens))
@@ -50,6 +63,8 @@ func TestRegister(t *testing.T) {
 	if u.Id != arp.Username {
 		t.Fatalf("Mismatch in the user id!: %s vs %s", arp.Username, u.Id)
 	}
+	r, err = PostRequest("/auth/login", ar)
+	CheckErrorAndResponse(t, r, err, 200)
 }
 
 func TestLogin(t *testing.T) {
@@ -67,3 +82,151 @@ func TestLogin(t *testing.T) {
 	}
 	activeCsrfToken = s.Csrf
 }
+
+func TestLoginFailureMetric(t *testing.T) {
+	activeSessionToken = ""
+	u := getDummyUser()
+	failed := apiH.metrics.Count(managers.METRIC_LOGINS_FAILED)
+	r, err := PostRequest("/auth/login", authRequest{Id: u.Id, Password: "wrong", RequireCSRF: true})
+	CheckErrorAndResponse(t, r, err, 401)
+	if n := apiH.metrics.Count(managers.METRIC_LOGINS_FAILED); n != failed+1 {
+		t.Fatalf("Expected %d failed logins and got %d", failed+1, n)
+	}
+	r, err = http.Get(strings.TrimSuffix(srv.URL, "/api") + "/metrics")
+	CheckErrorAndResponse(t, r, err, 200)
+	body := &bytes.Buffer{}
+	body.ReadFrom(r.Body)
+	line := fmt.Sprintf("%s %d\n", managers.METRIC_LOGINS_FAILED, failed+1)
+	if !strings.Contains(body.String(), line) {
+		t.Fatalf("Expected %q in the metrics:\n%s", line, body)
+	}
+}
+
+func TestLoginAccessTokenAndJWKS(t *testing.T) {
+	activeSessionToken = ""
+	u := getDummyUser()
+	ar := authRequest{Id: u.Id, Password: u.Id, RequireCSRF: true}
+	r, err := PostRequest("/auth/login", ar)
+	CheckErrorAndResponse(t, r, err, 200)
+	s := &authLoginResponse{}
+	if err := json.NewDecoder(r.Body).Decode(s); err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(s.AccessToken, ".")
+	if len(parts) != 3 {
+		t.Fatalf("Expected a signed token and got %s", s.AccessToken)
+	}
+	hdr := jwtHeader{}
+	raw, _ := b64.DecodeString(parts[0])
+	if err := json.Unmarshal(raw, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	claims := jwtClaims{}
+	raw, _ = b64.DecodeString(parts[1])
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != u.Id || claims.Session != s.Token {
+		t.Fatalf("Mismatch in the token claims: %+v", claims)
+	}
+	r, err = http.Get(strings.TrimSuffix(srv.URL, "/api") + "/.well-known/jwks.json")
+	CheckErrorAndResponse(t, r, err, 200)
+	set := jwks{}
+	if err := json.NewDecoder(r.Body).Decode(&set); err != nil {
+		t.Fatal(err)
+	}
+	var pub ed25519.PublicKey
+	for _, k := range set.Keys {
+		if k.Kid == hdr.Kid {
+			pub, _ = b64.DecodeString(k.X)
+		}
+	}
+	if len(pub) != ed25519.PublicKeySize {
+		t.Fatalf("Key %s used to sign the token is not in the key set", hdr.Kid)
+	}
+	sig, _ := b64.DecodeString(parts[2])
+	if !ed25519.Verify(pub, []byte(parts[0]+"."+parts[1]), sig) {
+		t.Fatalf("The token signature does not match the published key")
+	}
+}
+
+func TestLoginUpgradesWeakKdf(t *testing.T) {
+	activeSessionToken = ""
+	u := getDummyUser()
+	oldMemory := util.KDF_MEMORY
+	util.KDF_MEMORY = u.Kdf.Memory * 2
+	defer func() { util.KDF_MEMORY = oldMemory }()
+	ar := authRequest{Id: u.Id, Password: u.Id, RequireCSRF: true}
+	r, err := PostRequest("/auth/login", ar)
+	CheckErrorAndResponse(t, r, err, 200)
+	s := &authLoginResponse{}
+	if err := json.NewDecoder(r.Body).Decode(s); err != nil {
+		t.Fatal(err)
+	}
+	if s.KdfUpgrade == nil || s.KdfUpgrade.Memory != util.KDF_MEMORY {
+		t.Fatalf("Expected a kdf upgrade to %d KiB and got %+v", util.KDF_MEMORY, s.KdfUpgrade)
+	}
+	activeSessionToken = s.Token
+	activeCsrfToken = s.Csrf
+	_, _, fullpack := generateNewKeys()
+	req := userUpgradeKdfRequest{CurrentPassword: "wrong", Password: "newpass", KeyPack: fullpack, Kdf: *s.KdfUpgrade}
+	r, err = PutRequest("/user/kdf", req)
+	CheckErrorAndResponse(t, r, err, 401)
+	weak := *s.KdfUpgrade
+	weak.Memory = oldMemory
+	req.CurrentPassword = u.Id
+	req.Kdf = weak
+	r, err = PutRequest("/user/kdf", req)
+	CheckErrorAndResponse(t, r, err, 400)
+	req.Kdf = *s.KdfUpgrade
+	r, err = PutRequest("/user/kdf", req)
+	CheckErrorAndResponse(t, r, err, 200)
+	activeSessionToken = ""
+	r, err = PostRequest("/auth/login", authRequest{Id: u.Id, Password: "newpass", RequireCSRF: true})
+	CheckErrorAndResponse(t, r, err, 200)
+	s = &authLoginResponse{}
+	if err := json.NewDecoder(r.Body).Decode(s); err != nil {
+		t.Fatal(err)
+	}
+	if s.KdfUpgrade != nil {
+		t.Fatalf("The kdf was upgraded but the login still asks for it")
+	}
+}
+
+func TestLoginAwaitingApproval(t *testing.T) {
+	activeSessionToken = ""
+	approver := getDummyUser()
+	models.APPROVERS = []string{approver.Id}
+	models.REQUIRE_APPROVAL = true
+	u := getDummyUser()
+	models.REQUIRE_APPROVAL = false
+	defer func() { models.APPROVERS = []string{} }()
+	r, err := PostRequest("/auth/login", authRequest{Id: u.Id, Password: u.Id, RequireCSRF: true})
+	CheckErrorAndResponse(t, r, err, 403)
+	loginDummyUser()
+	r, err = PostRequest("/user/approval/"+u.Id, nil)
+	CheckErrorAndResponse(t, r, err, 401)
+	s, err := apiH.sm.NewSession(approver.Id, "1.1.1.1", "none", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	activeSessionToken = s.Id
+	r, err = GetRequest("/user/approval")
+	CheckErrorAndResponse(t, r, err, 200)
+	pending := []*models.User{}
+	if err := json.NewDecoder(r.Body).Decode(&pending); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, p := range pending {
+		found = found || p.Id == u.Id
+	}
+	if !found {
+		t.Fatalf("Expected %s in the approval queue", u.Id)
+	}
+	r, err = PostRequest("/user/approval/"+u.Id, nil)
+	CheckErrorAndResponse(t, r, err, 200)
+	activeSessionToken = ""
+	r, err = PostRequest("/auth/login", authRequest{Id: u.Id, Password: u.Id, RequireCSRF: true})
+	CheckErrorAndResponse(t, r, err, 200)
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+// Default siteverify endpoint. hCaptcha and Turnstile accept the same request so only the url changes
+const defaultCaptchaVerifyUrl = "https://www.google.com/recaptcha/api/siteverify"
+
+// captchaVerifier checks captcha responses against the provider's siteverify endpoint
+type captchaVerifier struct {
+	secret    string
+	verifyUrl string
+	client    *http.Client
+}
+
+func newCaptchaVerifier(c *ConfCaptcha) *captchaVerifier {
+	if c == nil {
+		return nil
+	}
+	verifyUrl := c.VerifyUrl
+	if len(verifyUrl) == 0 {
+		verifyUrl = defaultCaptchaVerifyUrl
+	}
+	return &captchaVerifier{c.Secret, verifyUrl, &http.Client{Timeout: 10 * time.Second}}
+}
+
+// verify returns ErrCaptchaRequired if the response is missing or not accepted by the provider.
+// A nil verifier accepts everything so callers don't need to check whether captchas are configured
+func (cv *captchaVerifier) verify(response, remoteIp string) error {
+	if cv == nil {
+		return nil
+	}
+	if len(response) == 0 {
+		return util.NewErrorFrom(ErrCaptchaRequired)
+	}
+	res, err := cv.client.PostForm(cv.verifyUrl, url.Values{
+		"secret":   {cv.secret},
+		"response": {response},
+		"remoteip": {remoteIp},
+	})
+	if err != nil {
+		return util.NewErrorf("Could not verify captcha: %s", err)
+	}
+	defer res.Body.Close()
+	result := struct {
+		Success bool `json:"success"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return util.NewErrorf("Could not verify captcha: %s", err)
+	}
+	if !result.Success {
+		return util.NewErrorFrom(ErrCaptchaRequired)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIPResolver finds the address of the client. Out of proxy mode it's always the socket peer since anyone can
+// send X-Forwarded-For. In proxy mode the X-Forwarded-For chain is walked from right to left skipping the trusted
+// proxies and the first untrusted hop is the client. Without trusted proxies only the socket peer is trusted
+type clientIPResolver struct {
+	proxyMode bool
+	trusted   []*net.IPNet
+}
+
+func newClientIPResolver(proxyMode bool, trustedProxies []string) (*clientIPResolver, error) {
+	trusted, err := parseCIDRs(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	return &clientIPResolver{proxyMode, trusted}, nil
+}
+
+func (cr *clientIPResolver) isTrusted(ip net.IP, hop int) bool {
+	if len(cr.trusted) == 0 {
+		return hop == 0
+	}
+	return inNets(ip, cr.trusted)
+}
+
+// resolve returns nil if the socket peer is not a valid address
+func (cr *clientIPResolver) resolve(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if !cr.proxyMode || ip == nil {
+		return ip
+	}
+	hops := []string{}
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0 && cr.isTrusted(ip, len(hops)-1-i); i-- {
+		next := net.ParseIP(strings.TrimSpace(hops[i]))
+		if next == nil {
+			// Whatever is left of a malformed hop cannot be trusted
+			break
+		}
+		ip = next
+	}
+	return ip
+}
+
+// clientIP returns the address of the client as a string or an empty string if it is not known
+func (ah apiHandler) clientIP(r *http.Request) string {
+	if ip := ah.clientIPs.resolve(r); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIPResolver(t *testing.T) {
+	cr, err := newClientIPResolver(true, []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		remote string
+		xff    string
+		client string
+	}{
+		{"10.0.0.1:4000", "", "10.0.0.1"},
+		{"10.0.0.1:4000", "8.8.8.8", "8.8.8.8"},
+		{"10.0.0.1:4000", "8.8.8.8, 10.0.0.2", "8.8.8.8"},
+		// The client can prepend whatever it wants but it's never past the first untrusted hop
+		{"10.0.0.1:4000", "1.1.1.1, 8.8.8.8, 10.0.0.2", "8.8.8.8"},
+		{"10.0.0.1:4000", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"10.0.0.1:4000", "garbage, 10.0.0.2", "10.0.0.2"},
+		// Spoofed header sent straight to the server
+		{"8.8.8.8:4000", "10.0.0.2", "8.8.8.8"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/api/team", nil)
+		r.RemoteAddr = c.remote
+		if len(c.xff) > 0 {
+			r.Header.Set("X-Forwarded-For", c.xff)
+		}
+		if ip := cr.resolve(r); ip.String() != c.client {
+			t.Errorf("Expected %s from %s with X-Forwarded-For '%s' and got %s", c.client, c.remote, c.xff, ip)
+		}
+	}
+}
+
+func TestClientIPResolverDefaults(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/team", nil)
+	r.RemoteAddr = "10.0.0.1:4000"
+	r.Header.Set("X-Forwarded-For", "1.1.1.1, 8.8.8.8")
+	direct, err := newClientIPResolver(false, []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := direct.resolve(r); ip.String() != "10.0.0.1" {
+		t.Errorf("X-Forwarded-For should be ignored out of proxy mode and got %s", ip)
+	}
+	proxied, err := newClientIPResolver(true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := proxied.resolve(r); ip.String() != "8.8.8.8" {
+		t.Errorf("Only the socket peer should be trusted without trusted proxies and got %s", ip)
+	}
+}
@@ -2,8 +2,15 @@ package api
 
 import (
 	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
 
+	"github.com/keydotcat/keycatd/db"
+	"github.com/keydotcat/keycatd/managers"
 	"github.com/keydotcat/keycatd/util"
+	"github.com/lib/pq"
 )
 
 type ConfMailSMTP struct {
@@ -17,69 +24,597 @@ type ConfMailSparkpost struct {
 	EU  bool
 }
 
+type ConfMailMailgun struct {
+	Domain string
+	Key    string
+	EU     bool
+}
+
+type ConfMailSES struct {
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// Optional configuration set to track deliveries, bounces and complaints
+	ConfigurationSet string
+}
+
+const (
+	sessionStoreDB     = "db"
+	sessionStoreMemory = "memory"
+	// How often expired sessions are dropped from the memory store
+	memorySessionSweepInterval = time.Minute
+)
+
 type ConfSessionRedis struct {
 	Server string
 	DBId   int
 }
 
+type ConfSessionRedisSentinel struct {
+	MasterName    string
+	SentinelAddrs []string
+	DBId          int
+}
+
 type ConfCsrf struct {
 	HashKey  string
 	BlockKey string
 }
 
+type ConfTLS struct {
+	CertFile     string
+	KeyFile      string
+	CipherSuites []string
+	MinVersion   string
+}
+
+type ConfWebhook struct {
+	Url string
+	// Key to sign the payloads with HMAC-SHA256
+	Secret string
+	// Only send the events of these vaults, as team/vault. Empty sends all events
+	Vaults []string
+	// Only send these event types. Empty sends all events
+	Events []string
+}
+
+type ConfOrigin struct {
+	Check   bool
+	Allowed []string
+}
+
+type ConfCORS struct {
+	// Origins of the browser clients allowed to call the api. * allows any origin but cannot be used with credentials
+	AllowedOrigins []string
+	// Let the allowed origins send the csrf cookie. The cookie is then sent cross-site so it needs https
+	AllowCredentials bool
+	// Defaults to GET, HEAD, POST, PUT, PATCH and DELETE
+	AllowedMethods []string
+}
+
+type ConfCaptcha struct {
+	Secret string
+	// Siteverify endpoint of the provider. Defaults to reCAPTCHA
+	VerifyUrl string
+}
+
+// ConfPasswordPolicy sets the checks new master passwords have to pass. The password never reaches the server so
+// clients report an estimate of its entropy and whether it was found in a breach
+type ConfPasswordPolicy struct {
+	// Minimum entropy in bits. 0 disables the check
+	MinEntropy float64
+	// Reject passwords the client finds in known breaches. Clients get the k-anonymity range of the password from
+	// GET /auth/password_range/:prefix, which the server proxies to the breach api
+	BreachCheck bool
+	// Range endpoint of the breach api. Defaults to HaveIBeenPwned
+	BreachCheckUrl string
+}
+
+// ConfKDF sets the argon2id params given to new accounts. Accounts with weaker params are asked to upgrade on login
+type ConfKDF struct {
+	Iterations int
+	// In KiB
+	Memory      int
+	Parallelism int
+}
+
+type ConfJWT struct {
+	TTL      time.Duration
+	Rotation time.Duration
+}
+
+// VaultPurgeImmediately disables restoring deleted vaults. Any negative VaultPurgeAfter does the same
+const VaultPurgeImmediately time.Duration = -1
+
 type Conf struct {
-	Url           string
-	Port          int
-	DB            string
-	DBMaxConns    int
-	DBType        string
-	OnlyInvited   bool
-	ProxyMode     bool
-	MailSMTP      *ConfMailSMTP
-	MailSparkpost *ConfMailSparkpost
-	MailFrom      string
-	SessionRedis  *ConfSessionRedis
-	Csrf          ConfCsrf
+	Url        string
+	Port       int
+	DB         string
+	DBMaxConns int
+	// Idle connections kept in the pool. 0 keeps the default of 2. Cannot be over DBMaxConns if it is set
+	DBMaxIdleConns int
+	// Close connections after they have been open this long so they get balanced after a db failover. 0 keeps them forever
+	DBConnMaxLifetime time.Duration
+	DBType            string
+	// Connection strings of read replicas of DB. Listings, secret fetches and searches are spread between them and
+	// everything else goes to DB. They use the same pool settings as DB
+	DBReadReplicas []string
+	OnlyInvited    bool
+	ProxyMode      bool
+	MailSMTP       *ConfMailSMTP
+	MailSparkpost  *ConfMailSparkpost
+	MailMailgun    *ConfMailMailgun
+	MailSES        *ConfMailSES
+	MailFrom       string
+	// Time to wait for queued mails to be sent on shutdown
+	MailDrainTimeout time.Duration
+	// Alert in the log and the webhooks when this many mails are waiting to be sent. 0 disables it
+	MailQueueAlertThreshold int
+	// Alert in the log and the webhooks when a mail has been waiting this long. 0 disables it
+	MailQueueAlertAge time.Duration
+	SessionRedis      *ConfSessionRedis
+	// Find the redis master through sentinel instead of connecting to a single server
+	SessionRedisSentinel *ConfSessionRedisSentinel
+	// Where sessions are kept if redis is not configured. memory (default) or db to share them between nodes and keep
+	// them across restarts
+	SessionStore string
+	// Fail to start if redis is down. Otherwise keep retrying in the background and refuse sessions until it is up
+	RedisRequiredAtStartup bool
+	Csrf                   ConfCsrf
+	// Keep the csrf token of browser sessions after a password, two factor or team ownership change. By default they
+	// get a new one
+	DisableCsrfRotation bool
+	JWT                 ConfJWT
+	TLS                 *ConfTLS
+	// Reject state-changing requests from browser sessions that don't come from an allowed origin
+	Origin ConfOrigin
+	// Let browser clients hosted on other origins call the api. No cross-origin access is allowed by default
+	CORS ConfCORS
+	// CIDRs of the proxies whose X-Forwarded-For hops are skipped to find the client in proxy mode. If it's empty only
+	// the socket peer is trusted
+	TrustedProxies []string
+	// Only serve clients from these CIDRs if not empty. The client address is taken from X-Forwarded-For in proxy mode
+	IPAllowList []string
+	// Never serve clients from these CIDRs, even if they are in IPAllowList
+	IPDenyList []string
+	// New accounts cannot log in or create teams until one of the Approvers accepts them
+	RequireApproval bool
+	// Ids of the users that can approve new accounts
+	Approvers []string
+	// Ids of the users that can suspend and unsuspend any account
+	SuspensionAdmins []string
+	// Endpoints that receive the team and vault events
+	Webhooks []ConfWebhook
+	// Serve /metrics on this port so it can be kept off the public interface
+	MetricsPort int
+	// Serve /metrics with the api when MetricsPort is not set. Off by default since the api is usually public
+	MetricsEnabled bool
+	// Block writes to vaults until they are re-keyed after a member removal
+	EnforceRekeyOnRemoval bool
+	// Max users that can be invited or added to a team per hour. 0 disables the limit
+	MaxInvitesPerTeamPerHour int
+	// Invitations can be accepted for this long. Defaults to 7 days
+	InviteTTL time.Duration
+	// Demote admins that have not done any admin action in this many days. 0 disables it
+	AdminInactivityDays int
+	// Remind accounts that have not verified their email after this long and delete them if they still have not
+	// after UnverifiedAccountGrace. 0 disables it
+	UnverifiedAccountTTL time.Duration
+	// How long after the reminder an unverified account is deleted. Defaults to 7 days
+	UnverifiedAccountGrace time.Duration
+	// How often expired tokens, invitations and share links are deleted. Defaults to an hour
+	CleanupInterval time.Duration
+	// Secret to derive fake kdf params for unknown emails. Defaults to the csrf hash key
+	KDFFakeSecret string
+	KDF           ConfKDF
+	// Secret used to encrypt the totp secrets in the db. Defaults to the csrf hash key
+	TOTPKey string
+	// Max size in bytes of the encrypted data of a secret. Defaults to 64KB
+	MaxSecretSize int
+	// Max versions kept for each secret. 0 keeps everything
+	SecretHistoryLimit int
+	// Reads of secrets are kept in the access log for this long. Defaults to 90 days
+	SecretAccessRetention time.Duration
+	// Deleted vaults can be restored for this long before they are purged. Defaults to 30 days. Set it to
+	// VaultPurgeImmediately to purge vaults as soon as they are deleted
+	VaultPurgeAfter time.Duration
+	// Keep reminding about secrets due for rotation every interval until they are changed instead of only once
+	SecretRotationRepeatReminders bool
+	// Max websocket and eventsource connections a user can keep open at the same time. 0 disables the limit
+	MaxRealtimeConnsPerUser int
+	// Responses to requests sent with an Idempotency-Key header are replayed to retries for this long. Defaults to a day
+	IdempotencyKeyTTL time.Duration
+	// Max number of expensive requests (exports, imports, bulk changes) served at the same time
+	HeavyOpConcurrency int
+	// Extend the session on each authenticated request instead of keeping a fixed lifetime
+	RollingSessions bool
+	// Minimum time between two refreshes of the same session
+	SessionRefreshInterval time.Duration
+	// Sessions end this long after login even if they are in use
+	SessionMaxAge time.Duration
+	// Rolling sessions end after being unused this long
+	SessionIdleTimeout time.Duration
+	// Minutes a new session has to wait before it can do destructive or sensitive changes. 0 disables it
+	NewSessionCoolingMinutes int
+	// Block logins for an account or from an ip after this many failures in LoginAttemptWindow. 0 disables it.
+	// Failures are counted in the session store if it is redis or memory and in each instance otherwise
+	LoginMaxAttempts   int
+	LoginAttemptWindow time.Duration
+	// Answer whether an email is already registered. Off by default to prevent account enumeration
+	ExposeEmailExistence bool
+	// Require a captcha on unauthenticated endpoints that can be abused for enumeration
+	Captcha *ConfCaptcha
+	// Checks for the master password on signup and password changes
+	PasswordPolicy *ConfPasswordPolicy
+	// Replaces the built-in password policy if set
+	CustomPasswordPolicy PasswordPolicy
+	// Locale and IANA timezone used for emails when the user has no preference
+	DefaultLocale   string
+	DefaultTimezone string
 }
 
-func (c Conf) validate() error {
-	if c.Port < 1 {
-		return util.NewErrorf("Invalid port defined in the configuration")
+// Misspelled cockroachdb db type accepted by older versions
+const legacyDBTypeCockroach = "cockroackdb"
+
+func (c *Conf) setDefaults() {
+	if c.DBType == legacyDBTypeCockroach {
+		log.Printf("DEPRECATED: db.type %s is misspelled and will stop working in the next release. Use %s instead", legacyDBTypeCockroach, db.DB_TYPE_COCKROACHDB)
+		c.DBType = db.DB_TYPE_COCKROACHDB
 	}
 	if len(c.Url) == 0 {
 		c.Url = fmt.Sprintf("http://localhost:%d", c.Port)
 	}
+	if c.JWT.TTL == 0 {
+		c.JWT.TTL = time.Hour
+	}
+	if c.JWT.Rotation == 0 {
+		c.JWT.Rotation = 24 * time.Hour
+	}
+	if c.MailDrainTimeout == 0 {
+		c.MailDrainTimeout = 10 * time.Second
+	}
+	if c.MaxSecretSize == 0 {
+		c.MaxSecretSize = 64 * 1024
+	}
+	if c.HeavyOpConcurrency == 0 {
+		c.HeavyOpConcurrency = 4
+	}
+	if c.KDF.Iterations == 0 {
+		c.KDF.Iterations = util.KDF_DEFAULT_ITERATIONS
+	}
+	if c.KDF.Memory == 0 {
+		c.KDF.Memory = util.KDF_DEFAULT_MEMORY
+	}
+	if c.KDF.Parallelism == 0 {
+		c.KDF.Parallelism = util.KDF_DEFAULT_PARALLELISM
+	}
+	if len(c.Origin.Allowed) == 0 && len(c.Url) > 0 {
+		c.Origin.Allowed = []string{c.Url}
+	}
+	if len(c.CORS.AllowedMethods) == 0 {
+		c.CORS.AllowedMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+	}
+	if len(c.DefaultLocale) == 0 {
+		c.DefaultLocale = "en"
+	}
+	if len(c.DefaultTimezone) == 0 {
+		c.DefaultTimezone = "UTC"
+	}
+	if c.SessionRefreshInterval == 0 {
+		c.SessionRefreshInterval = 5 * time.Minute
+	}
+	if c.UnverifiedAccountGrace == 0 {
+		c.UnverifiedAccountGrace = 7 * 24 * time.Hour
+	}
+	if c.InviteTTL == 0 {
+		c.InviteTTL = 7 * 24 * time.Hour
+	}
+	if c.VaultPurgeAfter == 0 {
+		c.VaultPurgeAfter = 30 * 24 * time.Hour
+	}
+	if c.SecretAccessRetention == 0 {
+		c.SecretAccessRetention = 90 * 24 * time.Hour
+	}
+	if c.IdempotencyKeyTTL == 0 {
+		c.IdempotencyKeyTTL = 24 * time.Hour
+	}
+	if c.CleanupInterval == 0 {
+		c.CleanupInterval = time.Hour
+	}
+	if len(c.SessionStore) == 0 && c.SessionRedis == nil && c.SessionRedisSentinel == nil {
+		c.SessionStore = sessionStoreMemory
+	}
+	if c.SessionMaxAge == 0 {
+		c.SessionMaxAge = 30 * 24 * time.Hour
+	}
+	if c.SessionIdleTimeout == 0 {
+		c.SessionIdleTimeout = 12 * time.Hour
+	}
+	if c.LoginAttemptWindow == 0 {
+		c.LoginAttemptWindow = 15 * time.Minute
+	}
+}
+
+// ConfigError describes a problem with a single configuration field
+type ConfigError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e ConfigError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// ConfigErrors holds every problem found in a configuration
+type ConfigErrors []ConfigError
+
+func (ce ConfigErrors) Error() string {
+	msgs := make([]string, len(ce))
+	for i, e := range ce {
+		msgs[i] = e.Error()
+	}
+	return "Invalid configuration: " + strings.Join(msgs, "; ")
+}
+
+func (c Conf) validate() error {
+	if errs := c.Validate(); len(errs) > 0 {
+		return util.NewErrorFrom(ConfigErrors(errs))
+	}
+	return nil
+}
+
+// Validate checks the whole configuration and returns all the problems found
+func (c Conf) Validate() []ConfigError {
+	c.setDefaults()
+	errs := []ConfigError{}
+	add := func(field, format string, args ...interface{}) {
+		errs = append(errs, ConfigError{field, fmt.Sprintf(format, args...)})
+	}
+	if c.Port < 1 {
+		add("port", "has to be greater than 0")
+	}
+	if c.MetricsPort < 0 {
+		add("metrics.port", "cannot be negative")
+	} else if c.MetricsPort > 0 && c.MetricsPort == c.Port {
+		add("metrics.port", "has to be different from the api port")
+	}
 	if len(c.DB) == 0 {
-		return util.NewErrorf("Invalid db configuration")
+		add("db", "is empty")
 	}
-	if c.DBType != "postgresql" && c.DBType != "cockroackdb" {
-		return util.NewErrorf("Invalid db type (%s)", c.DBType)
+	if c.DBType != db.DB_TYPE_POSTGRESQL && c.DBType != db.DB_TYPE_COCKROACHDB {
+		add("db.type", "unknown db type %s", c.DBType)
+	}
+	for _, dsn := range c.DBReadReplicas {
+		if len(dsn) == 0 {
+			add("db.read_replicas", "has an empty connection string")
+		} else if dsn == c.DB {
+			add("db.read_replicas", "cannot contain the primary db")
+		} else if _, err := pq.NewConnector(dsn); err != nil {
+			add("db.read_replicas", "has an invalid connection string: %s", err)
+		}
 	}
 	if len(c.MailFrom) == 0 {
-		return util.NewErrorf("Invalid mail.from")
+		add("mail.from", "is empty")
+	}
+	if c.MailQueueAlertThreshold < 0 {
+		add("mail.queue_alert_threshold", "cannot be negative")
+	} else if c.MailQueueAlertThreshold > mailQueueSize {
+		add("mail.queue_alert_threshold", "cannot be larger than the queue (%d)", mailQueueSize)
+	}
+	if c.MailQueueAlertAge < 0 {
+		add("mail.queue_alert_age", "cannot be negative")
 	}
 	if len(c.Csrf.HashKey) != 32 && len(c.Csrf.HashKey) != 64 {
-		return util.NewErrorf("Invalid csrf.hash_key. It has to be 32 or 64 characters long")
+		add("csrf.hash_key", "has to be 32 or 64 characters long")
 	}
 	bl := len(c.Csrf.BlockKey)
 	if bl != 0 && bl != 16 && bl != 24 && bl != 32 {
-		return util.NewErrorf("Invalid csrf.block_key. It has to be 16, 24 or 32 characters long, or 0 to disable encryption")
+		add("csrf.block_key", "has to be 16, 24 or 32 characters long, or 0 to disable encryption")
 	}
 	if !TEST_MODE {
 		smtp := c.MailSMTP != nil
 		spark := c.MailSparkpost != nil
-		if (!smtp && !spark) || (smtp && spark) {
-			return util.NewErrorf("Either configure mail.smtp (%t) or mail.sparkpost (%t)", smtp, spark)
+		mailgun := c.MailMailgun != nil
+		ses := c.MailSES != nil
+		providers := 0
+		for _, configured := range []bool{smtp, spark, mailgun, ses} {
+			if configured {
+				providers++
+			}
+		}
+		if providers != 1 {
+			add("mail", "configure exactly one of mail.smtp (%t), mail.sparkpost (%t), mail.mailgun (%t) or mail.ses (%t)", smtp, spark, mailgun, ses)
 		}
 		if smtp && len(c.MailSMTP.Server) == 0 {
-			return util.NewErrorf("Invalid mail.smtp.server")
+			add("mail.smtp.server", "is empty")
 		}
 		if spark && len(c.MailSparkpost.Key) == 0 {
-			return util.NewErrorf("Invalid mail.sparkpost.key")
+			add("mail.sparkpost.key", "is empty")
+		}
+		if mailgun && len(c.MailMailgun.Domain) == 0 {
+			add("mail.mailgun.domain", "is empty")
+		}
+		if mailgun && len(c.MailMailgun.Key) == 0 {
+			add("mail.mailgun.key", "is empty")
+		}
+		if ses && len(c.MailSES.Region) == 0 {
+			add("mail.ses.region", "is empty")
+		}
+		if ses && (len(c.MailSES.AccessKeyID) == 0 || len(c.MailSES.SecretAccessKey) == 0) {
+			add("mail.ses", "access_key_id and secret_access_key are required")
+		}
+	}
+	if c.DBMaxConns < 0 {
+		add("db.maxconns", "cannot be negative")
+	}
+	if c.DBMaxIdleConns < 0 {
+		add("db.maxidleconns", "cannot be negative")
+	} else if c.DBMaxConns > 0 && c.DBMaxIdleConns > c.DBMaxConns {
+		add("db.maxidleconns", "cannot be greater than db.maxconns")
+	}
+	if c.DBConnMaxLifetime < 0 {
+		add("db.connmaxlifetime", "cannot be negative")
+	}
+	if c.MaxRealtimeConnsPerUser < 0 {
+		add("realtime.max_conns_per_user", "cannot be negative")
+	}
+	if c.AdminInactivityDays < 0 {
+		add("team.admin_inactivity_days", "cannot be negative")
+	}
+	if c.MaxInvitesPerTeamPerHour < 0 {
+		add("team.max_invites_per_hour", "cannot be negative")
+	}
+	if c.InviteTTL < 0 {
+		add("team.invite_ttl", "cannot be negative")
+	}
+	if c.RequireApproval && len(c.Approvers) == 0 {
+		add("approval.approvers", "cannot be empty if approval is required")
+	}
+	if c.CleanupInterval < 0 {
+		add("cleanup_interval", "cannot be negative")
+	}
+	if c.IdempotencyKeyTTL < 0 {
+		add("idempotency_key_ttl", "cannot be negative")
+	}
+	if c.MaxSecretSize < 0 {
+		add("secret.max_size", "cannot be negative")
+	}
+	if c.SecretHistoryLimit < 0 {
+		add("secret.history_limit", "cannot be negative")
+	}
+	if c.SecretAccessRetention < 0 {
+		add("secret.access_retention", "cannot be negative")
+	}
+	if c.TLS != nil {
+		if len(c.TLS.CertFile) == 0 {
+			add("tls.cert_file", "is empty")
+		}
+		if len(c.TLS.KeyFile) == 0 {
+			add("tls.key_file", "is empty")
+		}
+		if _, err := c.TLS.TLSConfig(); err != nil {
+			add("tls", "%s", err)
+		}
+	}
+	if c.KDF.Iterations < util.KDF_MIN_ITERATIONS || c.KDF.Iterations > util.KDF_MAX_ITERATIONS {
+		add("kdf.iterations", "has to be between %d and %d", util.KDF_MIN_ITERATIONS, util.KDF_MAX_ITERATIONS)
+	}
+	if c.KDF.Memory < util.KDF_MIN_MEMORY || c.KDF.Memory > util.KDF_MAX_MEMORY {
+		add("kdf.memory", "has to be between %d and %d KiB", util.KDF_MIN_MEMORY, util.KDF_MAX_MEMORY)
+	}
+	if c.KDF.Parallelism < util.KDF_MIN_PARALLELISM || c.KDF.Parallelism > util.KDF_MAX_PARALLELISM {
+		add("kdf.parallelism", "has to be between %d and %d", util.KDF_MIN_PARALLELISM, util.KDF_MAX_PARALLELISM)
+	}
+	if c.HeavyOpConcurrency < 0 {
+		add("heavy_op_concurrency", "cannot be negative")
+	}
+	if c.JWT.TTL < 0 {
+		add("jwt.ttl", "cannot be negative")
+	}
+	if c.JWT.Rotation < 0 {
+		add("jwt.rotation", "cannot be negative")
+	}
+	if pp := c.PasswordPolicy; pp != nil {
+		if pp.MinEntropy < 0 {
+			add("password_policy.min_entropy", "cannot be negative")
+		}
+		if len(pp.BreachCheckUrl) > 0 {
+			if u, err := url.Parse(pp.BreachCheckUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+				add("password_policy.breach_check_url", "%s is not a valid http url", pp.BreachCheckUrl)
+			}
+		}
+	}
+	for i, wh := range c.Webhooks {
+		if u, err := url.Parse(wh.Url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			add(fmt.Sprintf("webhooks.%d.url", i), "%s is not a valid http url", wh.Url)
+		}
+		if len(wh.Secret) == 0 {
+			add(fmt.Sprintf("webhooks.%d.secret", i), "is empty")
+		}
+		for _, vs := range wh.Vaults {
+			if parts := strings.Split(vs, "/"); len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+				add(fmt.Sprintf("webhooks.%d.vaults", i), "%s is not a team/vault pair", vs)
+			}
+		}
+		for _, ev := range wh.Events {
+			if !managers.IsWebhookEvent(ev) {
+				add(fmt.Sprintf("webhooks.%d.events", i), "%s is not a known event", ev)
+			}
+		}
+	}
+	if _, err := parseCIDRs(c.TrustedProxies); err != nil {
+		add("trusted_proxies", "%s", err)
+	}
+	if _, err := parseCIDRs(c.IPAllowList); err != nil {
+		add("ip.allow", "%s", err)
+	}
+	if _, err := parseCIDRs(c.IPDenyList); err != nil {
+		add("ip.deny", "%s", err)
+	}
+	for _, o := range c.Origin.Allowed {
+		if len(normalizeOrigin(o)) == 0 {
+			add("origin.allowed", "%s is not a valid origin", o)
+		}
+	}
+	for _, o := range c.CORS.AllowedOrigins {
+		switch {
+		case o == "*" && c.CORS.AllowCredentials:
+			add("cors.allowed_origins", "* cannot be used with allow_credentials since browsers refuse it")
+		case o != "*" && len(normalizeOrigin(o)) == 0:
+			add("cors.allowed_origins", "%s is not a valid origin", o)
 		}
 	}
+	if _, err := time.LoadLocation(c.DefaultTimezone); err != nil {
+		add("default_timezone", "%s", err)
+	}
+	if c.NewSessionCoolingMinutes < 0 {
+		add("session.cooling_minutes", "cannot be negative")
+	}
+	if c.SessionRefreshInterval < 0 {
+		add("session.refresh_interval", "cannot be negative")
+	}
+	if c.SessionMaxAge < 0 {
+		add("session.max_age", "cannot be negative")
+	}
+	if c.SessionIdleTimeout < 0 {
+		add("session.idle_timeout", "cannot be negative")
+	}
+	if c.SessionIdleTimeout > c.SessionMaxAge {
+		add("session.idle_timeout", "cannot be longer than session.max_age")
+	}
+	// Idle time is measured with the last refresh of the session so shorter timeouts would kick active users out
+	if c.RollingSessions && c.SessionIdleTimeout <= c.SessionRefreshInterval {
+		add("session.idle_timeout", "has to be longer than session.refresh_interval")
+	}
+	if c.UnverifiedAccountTTL < 0 {
+		add("unverified_account_ttl", "cannot be negative")
+	}
+	if c.UnverifiedAccountGrace < 0 {
+		add("unverified_account_grace", "cannot be negative")
+	}
+	if c.LoginMaxAttempts < 0 {
+		add("login.max_attempts", "cannot be negative")
+	}
+	if c.LoginAttemptWindow < 0 {
+		add("login.attempt_window", "cannot be negative")
+	}
 	if c.SessionRedis != nil && len(c.SessionRedis.Server) == 0 {
-		return util.NewErrorf("Invalid session.redis.server")
+		add("session.redis.server", "is empty")
 	}
-	return nil
+	if c.SessionRedis != nil && c.SessionRedisSentinel != nil {
+		add("session.redis_sentinel", "cannot be configured together with session.redis")
+	}
+	if c.SessionRedisSentinel != nil && len(c.SessionRedisSentinel.MasterName) == 0 {
+		add("session.redis_sentinel.master_name", "is empty")
+	}
+	if c.SessionRedisSentinel != nil && len(c.SessionRedisSentinel.SentinelAddrs) == 0 {
+		add("session.redis_sentinel.sentinel_addrs", "is empty")
+	}
+	switch {
+	case len(c.SessionStore) > 0 && c.SessionStore != sessionStoreDB && c.SessionStore != sessionStoreMemory:
+		add("session.store", "has to be %s or %s", sessionStoreDB, sessionStoreMemory)
+	case (c.SessionRedis != nil || c.SessionRedisSentinel != nil) && c.SessionStore == sessionStoreMemory:
+		add("session.store", "cannot be %s when redis is configured", sessionStoreMemory)
+	}
+	return errs
 }
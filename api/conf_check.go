@@ -0,0 +1,69 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/keydotcat/keycatd/managers"
+)
+
+// Time to wait for each service when checking the configuration
+const confCheckTimeout = 10 * time.Second
+
+// newMailMgr returns the manager for the configured mail provider and the config section it comes from. The
+// manager is nil if there is no provider
+func newMailMgr(c Conf) (managers.MailMgr, string) {
+	switch {
+	case c.MailSMTP != nil:
+		return managers.NewMailMgrSMTP(c.MailSMTP.Server, c.MailSMTP.User, c.MailSMTP.Password, c.MailFrom), "mail.smtp"
+	case c.MailSparkpost != nil:
+		return managers.NewMailMgrSparkpost(c.MailSparkpost.Key, c.MailFrom, c.MailSparkpost.EU), "mail.sparkpost"
+	case c.MailMailgun != nil:
+		return managers.NewMailMgrMailgun(c.MailMailgun.Domain, c.MailMailgun.Key, c.MailFrom, c.MailMailgun.EU), "mail.mailgun"
+	case c.MailSES != nil:
+		return managers.NewMailMgrSES(c.MailSES.Region, c.MailSES.AccessKeyID, c.MailSES.SecretAccessKey, c.MailSES.ConfigurationSet, c.MailFrom), "mail.ses"
+	}
+	return nil, ""
+}
+
+// CheckConnections validates the configuration like Validate and then connects to the db and the mail provider
+// without starting anything. Connections are only tried if their settings are valid. Every problem found is returned
+func (c Conf) CheckConnections() []ConfigError {
+	c.setDefaults()
+	errs := c.Validate()
+	invalid := func(prefix string) bool {
+		for _, e := range errs {
+			if e.Field == prefix || strings.HasPrefix(e.Field, prefix+".") {
+				return true
+			}
+		}
+		return false
+	}
+	checkDB := !invalid("db")
+	mm, section := newMailMgr(c)
+	checkMail := mm != nil && !invalid("mail")
+	if checkDB {
+		if err := pingDB(c.DB); err != nil {
+			errs = append(errs, ConfigError{"db", "could not connect: " + err.Error()})
+		}
+	}
+	if mc, ok := mm.(managers.MailMgrChecker); ok && checkMail {
+		if err := mc.Check(); err != nil {
+			errs = append(errs, ConfigError{section, "could not connect: " + err.Error()})
+		}
+	}
+	return errs
+}
+
+func pingDB(dsn string) error {
+	dbp, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return err
+	}
+	defer dbp.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), confCheckTimeout)
+	defer cancel()
+	return dbp.PingContext(ctx)
+}
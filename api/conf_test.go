@@ -0,0 +1,351 @@
+package api
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfValidateReportsAllErrors(t *testing.T) {
+	c := Conf{
+		Port:                 0,
+		DB:                   "",
+		DBType:               "postgresql",
+		MailFrom:             "a@a.com",
+		Csrf:                 ConfCsrf{HashKey: "short"},
+		UnverifiedAccountTTL: -1,
+	}
+	errs := c.Validate()
+	fields := map[string]bool{}
+	for _, e := range errs {
+		fields[e.Field] = true
+	}
+	for _, f := range []string{"port", "db", "csrf.hash_key", "unverified_account_ttl"} {
+		if !fields[f] {
+			t.Errorf("Expected an error for %s in %v", f, errs)
+		}
+	}
+	err := c.validate()
+	if err == nil || !strings.Contains(err.Error(), "csrf.hash_key") || !strings.Contains(err.Error(), "port") {
+		t.Errorf("Expected the single error to mention every problem and got %v", err)
+	}
+	c.Port = 1
+	c.DB = "db"
+	c.Csrf.HashKey = "4d018d7e070ca9d5da7e767001bdaf90"
+	c.UnverifiedAccountTTL = 0
+	if errs := c.Validate(); len(errs) > 0 {
+		t.Errorf("Expected no errors and got %v", errs)
+	}
+}
+
+func TestConfCheckConnectionsReportsAllErrors(t *testing.T) {
+	c := Conf{
+		Port:     0,
+		DB:       "host=127.0.0.1 port=1 sslmode=disable connect_timeout=2",
+		DBType:   "postgresql",
+		MailFrom: "a@a.com",
+		MailSMTP: &ConfMailSMTP{Server: "127.0.0.1:1"},
+		Csrf:     ConfCsrf{HashKey: "4d018d7e070ca9d5da7e767001bdaf90"},
+	}
+	errs := c.CheckConnections()
+	fields := map[string]bool{}
+	for _, e := range errs {
+		fields[e.Field] = true
+	}
+	if len(errs) != 3 || !fields["port"] || !fields["db"] || !fields["mail.smtp"] {
+		t.Fatalf("Expected errors for port, db and mail.smtp and got %v", errs)
+	}
+	c.DB = ""
+	errs = c.CheckConnections()
+	if len(errs) != 3 || errs[1].Field != "db" || errs[1].Message != "is empty" {
+		t.Fatalf("Expected no connection to be tried with an empty db and got %v", errs)
+	}
+}
+
+func TestConfValidateDBPool(t *testing.T) {
+	c := Conf{
+		Port:           1,
+		DB:             "db",
+		DBType:         "postgresql",
+		MailFrom:       "a@a.com",
+		Csrf:           ConfCsrf{HashKey: "4d018d7e070ca9d5da7e767001bdaf90"},
+		DBMaxConns:     5,
+		DBMaxIdleConns: 10,
+	}
+	errs := c.Validate()
+	if len(errs) != 1 || errs[0].Field != "db.maxidleconns" {
+		t.Fatalf("Expected an error for db.maxidleconns and got %v", errs)
+	}
+	c.DBMaxIdleConns = 5
+	if errs := c.Validate(); len(errs) > 0 {
+		t.Errorf("Expected no errors and got %v", errs)
+	}
+	c.DBMaxConns = 0
+	c.DBMaxIdleConns = 10
+	if errs := c.Validate(); len(errs) > 0 {
+		t.Errorf("Expected no errors with an unlimited pool and got %v", errs)
+	}
+}
+
+func TestConfValidateIPLists(t *testing.T) {
+	c := Conf{
+		Port:        1,
+		DB:          "db",
+		DBType:      "postgresql",
+		MailFrom:    "a@a.com",
+		Csrf:        ConfCsrf{HashKey: "4d018d7e070ca9d5da7e767001bdaf90"},
+		IPAllowList: []string{"10.0.0.0/8", "192.168.1.1", "::1"},
+		IPDenyList:  []string{"10.0.0.0/33"},
+	}
+	errs := c.Validate()
+	if len(errs) != 1 || errs[0].Field != "ip.deny" {
+		t.Fatalf("Expected an error for ip.deny and got %v", errs)
+	}
+	c.IPDenyList = []string{"10.0.13.0/24"}
+	if errs := c.Validate(); len(errs) > 0 {
+		t.Errorf("Expected no errors and got %v", errs)
+	}
+}
+
+func TestConfValidateCORS(t *testing.T) {
+	c := Conf{
+		Port:     1,
+		DB:       "db",
+		DBType:   "postgresql",
+		MailFrom: "a@a.com",
+		Csrf:     ConfCsrf{HashKey: "4d018d7e070ca9d5da7e767001bdaf90"},
+		CORS:     ConfCORS{AllowedOrigins: []string{"*", "app.example.com"}, AllowCredentials: true},
+	}
+	errs := c.Validate()
+	if len(errs) != 2 || errs[0].Field != "cors.allowed_origins" || errs[1].Field != "cors.allowed_origins" {
+		t.Fatalf("Expected errors for the wildcard with credentials and the invalid origin and got %v", errs)
+	}
+	c.CORS.AllowedOrigins = []string{"*"}
+	c.CORS.AllowCredentials = false
+	if errs := c.Validate(); len(errs) > 0 {
+		t.Errorf("Expected no errors and got %v", errs)
+	}
+}
+
+func TestConfValidateKDF(t *testing.T) {
+	c := Conf{
+		Port:     1,
+		DB:       "db",
+		DBType:   "postgresql",
+		MailFrom: "a@a.com",
+		Csrf:     ConfCsrf{HashKey: "4d018d7e070ca9d5da7e767001bdaf90"},
+		KDF:      ConfKDF{Memory: 1024},
+	}
+	errs := c.Validate()
+	if len(errs) != 1 || errs[0].Field != "kdf.memory" {
+		t.Fatalf("Expected an error for kdf.memory and got %v", errs)
+	}
+	c.KDF = ConfKDF{Iterations: 1000}
+	errs = c.Validate()
+	if len(errs) != 1 || errs[0].Field != "kdf.iterations" {
+		t.Fatalf("Expected an error for kdf.iterations and got %v", errs)
+	}
+	c.KDF = ConfKDF{}
+	if errs := c.Validate(); len(errs) > 0 {
+		t.Errorf("Expected no errors with the default params and got %v", errs)
+	}
+}
+
+func TestConfValidateMailProviders(t *testing.T) {
+	TEST_MODE = false
+	defer func() { TEST_MODE = true }()
+	c := Conf{
+		Port:     1,
+		DB:       "db",
+		DBType:   "postgresql",
+		MailFrom: "a@a.com",
+		Csrf:     ConfCsrf{HashKey: "4d018d7e070ca9d5da7e767001bdaf90"},
+		MailSMTP: &ConfMailSMTP{Server: "localhost:25"},
+		MailMailgun: &ConfMailMailgun{
+			Domain: "mg.example.com",
+			Key:    "key",
+		},
+	}
+	hasMailErr := func() bool {
+		for _, e := range c.Validate() {
+			if e.Field == "mail" {
+				return true
+			}
+		}
+		return false
+	}
+	if !hasMailErr() {
+		t.Errorf("Expected a config with both mailgun and smtp to be rejected")
+	}
+	c.MailSMTP = nil
+	if hasMailErr() {
+		t.Errorf("Expected a config with only mailgun to be accepted")
+	}
+	c.MailMailgun = nil
+	if !hasMailErr() {
+		t.Errorf("Expected a config without mail providers to be rejected")
+	}
+}
+
+func TestConfValidateMailSES(t *testing.T) {
+	TEST_MODE = false
+	defer func() { TEST_MODE = true }()
+	c := Conf{
+		Port:     1,
+		DB:       "db",
+		DBType:   "postgresql",
+		MailFrom: "a@a.com",
+		Csrf:     ConfCsrf{HashKey: "4d018d7e070ca9d5da7e767001bdaf90"},
+		MailSES: &ConfMailSES{
+			AccessKeyID:     "AKIA",
+			SecretAccessKey: "secret",
+		},
+	}
+	hasErr := func(field string) bool {
+		for _, e := range c.Validate() {
+			if e.Field == field {
+				return true
+			}
+		}
+		return false
+	}
+	if !hasErr("mail.ses.region") {
+		t.Errorf("Expected a ses config without region to be rejected")
+	}
+	c.MailSES.Region = "eu-west-1"
+	if hasErr("mail.ses.region") || hasErr("mail") || hasErr("mail.ses") {
+		t.Errorf("Expected a complete ses config to be accepted: %v", c.Validate())
+	}
+}
+
+func TestConfValidateDBType(t *testing.T) {
+	for _, tc := range []struct {
+		dbType   string
+		valid    bool
+		resolved string
+	}{
+		{"postgresql", true, "postgresql"},
+		{"cockroachdb", true, "cockroachdb"},
+		{"cockroackdb", true, "cockroachdb"},
+		{"mysql", false, "mysql"},
+	} {
+		c := Conf{
+			Port:     1,
+			DB:       "db",
+			DBType:   tc.dbType,
+			MailFrom: "a@a.com",
+			Csrf:     ConfCsrf{HashKey: "4d018d7e070ca9d5da7e767001bdaf90"},
+		}
+		hasErr := false
+		for _, e := range c.Validate() {
+			if e.Field == "db.type" {
+				hasErr = true
+			}
+		}
+		if hasErr == tc.valid {
+			t.Errorf("Expected db type %s to be valid=%t", tc.dbType, tc.valid)
+		}
+		c.setDefaults()
+		if c.DBType != tc.resolved {
+			t.Errorf("Expected db type %s to resolve to %s and got %s", tc.dbType, tc.resolved, c.DBType)
+		}
+	}
+}
+
+func TestConfValidateReadReplicas(t *testing.T) {
+	for _, tc := range []struct {
+		dsn   string
+		valid bool
+	}{
+		{"host=replica1 dbname=keycat sslmode=disable", true},
+		{"postgres://keycat@replica2/keycat?sslmode=disable", true},
+		{"", false},
+		{"db", false},
+		{"host='replica1 dbname=keycat", false},
+		{"postgres://replica2:port/keycat", false},
+	} {
+		c := Conf{
+			Port:           1,
+			DB:             "db",
+			DBType:         "postgresql",
+			DBReadReplicas: []string{tc.dsn},
+			MailFrom:       "a@a.com",
+			Csrf:           ConfCsrf{HashKey: "4d018d7e070ca9d5da7e767001bdaf90"},
+		}
+		hasErr := false
+		for _, e := range c.Validate() {
+			if e.Field == "db.read_replicas" {
+				hasErr = true
+			}
+		}
+		if hasErr == tc.valid {
+			t.Errorf("Expected read replica %q to be valid=%t", tc.dsn, tc.valid)
+		}
+	}
+}
+
+func TestConfValidateSessionLifetime(t *testing.T) {
+	c := Conf{
+		Port:               1,
+		DB:                 "db",
+		DBType:             "postgresql",
+		MailFrom:           "a@a.com",
+		Csrf:               ConfCsrf{HashKey: "4d018d7e070ca9d5da7e767001bdaf90"},
+		RollingSessions:    true,
+		SessionMaxAge:      time.Hour,
+		SessionIdleTimeout: 2 * time.Hour,
+	}
+	hasErr := func() bool {
+		for _, e := range c.Validate() {
+			if e.Field == "session.idle_timeout" {
+				return true
+			}
+		}
+		return false
+	}
+	if !hasErr() {
+		t.Errorf("Expected an idle timeout longer than the max age to be rejected")
+	}
+	c.SessionIdleTimeout = time.Minute
+	if !hasErr() {
+		t.Errorf("Expected an idle timeout shorter than the refresh interval to be rejected")
+	}
+	c.SessionIdleTimeout = 30 * time.Minute
+	if hasErr() {
+		t.Errorf("Expected a valid idle timeout to be accepted: %v", c.Validate())
+	}
+}
+
+func TestConfValidateSessionStore(t *testing.T) {
+	c := Conf{
+		Port:     1,
+		DB:       "db",
+		DBType:   "postgresql",
+		MailFrom: "a@a.com",
+		Csrf:     ConfCsrf{HashKey: "4d018d7e070ca9d5da7e767001bdaf90"},
+	}
+	hasErr := func() bool {
+		for _, e := range c.Validate() {
+			if e.Field == "session.store" {
+				return true
+			}
+		}
+		return false
+	}
+	if hasErr() {
+		t.Errorf("Expected a config without redis to be accepted")
+	}
+	c.SessionStore = "memory"
+	if hasErr() {
+		t.Errorf("Expected the memory store to be accepted")
+	}
+	c.SessionRedis = &ConfSessionRedis{Server: "localhost:6379"}
+	if !hasErr() {
+		t.Errorf("Expected the memory store to be rejected with redis")
+	}
+	c.SessionRedis = nil
+	c.SessionStore = "nope"
+	if !hasErr() {
+		t.Errorf("Expected an unknown store to be rejected")
+	}
+}
@@ -15,6 +15,10 @@ const (
 	contextVaultKey   = contextType(iota)
 	contextSessionKey = contextType(iota)
 	contextCsrfKey    = contextType(iota)
+
+	contextSessionPolicyKey = contextType(iota)
+	contextSessionIdleKey   = contextType(iota)
+	contextTeamPolicyKey    = contextType(iota)
 )
 
 func ctxAddUser(ctx context.Context, u *models.User) context.Context {
@@ -53,6 +57,16 @@ func ctxGetVault(ctx context.Context) *models.Vault {
 	return d
 }
 
+func ctxAddTeamPolicy(ctx context.Context, p *models.TeamPolicy) context.Context {
+	return context.WithValue(ctx, contextTeamPolicyKey, p)
+}
+
+// ctxGetTeamPolicy returns nil out of the team requests
+func ctxGetTeamPolicy(ctx context.Context) *models.TeamPolicy {
+	p, _ := ctx.Value(contextTeamPolicyKey).(*models.TeamPolicy)
+	return p
+}
+
 func ctxAddSession(ctx context.Context, u *managers.Session) context.Context {
 	return context.WithValue(ctx, contextSessionKey, u)
 }
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Time browsers can cache a preflight answer
+const corsPreflightMaxAge = "600"
+
+// corsPolicy adds the CORS headers for the allowed origins. Requests from other origins get no CORS headers so
+// browsers don't let the page read the response
+type corsPolicy struct {
+	anyOrigin   bool
+	allowed     map[string]bool
+	credentials bool
+	methods     string
+}
+
+func newCorsPolicy(c ConfCORS) *corsPolicy {
+	cp := &corsPolicy{allowed: map[string]bool{}, credentials: c.AllowCredentials}
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			cp.anyOrigin = true
+		} else {
+			cp.allowed[normalizeOrigin(o)] = true
+		}
+	}
+	methods := make([]string, len(c.AllowedMethods))
+	for i, m := range c.AllowedMethods {
+		methods[i] = strings.ToUpper(m)
+	}
+	cp.methods = strings.Join(methods, ", ")
+	return cp
+}
+
+func (cp *corsPolicy) enabled() bool {
+	return cp.anyOrigin || len(cp.allowed) > 0
+}
+
+func (cp *corsPolicy) allowedOrigin(origin string) bool {
+	return cp.anyOrigin || cp.allowed[normalizeOrigin(origin)]
+}
+
+// handle sets the CORS headers and returns true if the request was a preflight that has already been answered
+func (cp *corsPolicy) handle(w http.ResponseWriter, r *http.Request) bool {
+	if !cp.enabled() {
+		return false
+	}
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	preflight := r.Method == "OPTIONS" && len(r.Header.Get("Access-Control-Request-Method")) > 0
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 || !cp.allowedOrigin(origin) {
+		if preflight {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return preflight
+	}
+	if cp.anyOrigin && !cp.credentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if cp.credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		// Rotated csrf tokens are sent in this header
+		h.Set("Access-Control-Expose-Headers", "X-Csrf-Token")
+		return false
+	}
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+	h.Set("Access-Control-Allow-Methods", cp.methods)
+	if reqHeaders := r.Header.Get("Access-Control-Request-Headers"); len(reqHeaders) > 0 {
+		h.Set("Access-Control-Allow-Headers", reqHeaders)
+	}
+	h.Set("Access-Control-Max-Age", corsPreflightMaxAge)
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
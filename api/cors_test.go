@@ -0,0 +1,52 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCorsPreflight(t *testing.T) {
+	c := Conf{CORS: ConfCORS{AllowedOrigins: []string{"https://app.example.com"}, AllowCredentials: true}}
+	c.setDefaults()
+	cp := newCorsPolicy(c.CORS)
+	r := httptest.NewRequest("OPTIONS", "/api/team", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	r.Header.Set("Access-Control-Request-Method", "POST")
+	r.Header.Set("Access-Control-Request-Headers", "Authorization, X-Csrf-Token")
+	w := httptest.NewRecorder()
+	if !cp.handle(w, r) {
+		t.Fatal("Expected the preflight to be answered")
+	}
+	h := w.Result().Header
+	if w.Code != 204 || h.Get("Access-Control-Allow-Origin") != "https://app.example.com" || h.Get("Access-Control-Allow-Credentials") != "true" {
+		t.Fatalf("Unexpected preflight response %d %v", w.Code, h)
+	}
+	if h.Get("Access-Control-Allow-Methods") != "GET, HEAD, POST, PUT, PATCH, DELETE" || h.Get("Access-Control-Allow-Headers") != "Authorization, X-Csrf-Token" {
+		t.Fatalf("Unexpected allowed methods or headers %v", h)
+	}
+	r = httptest.NewRequest("POST", "/api/team", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	w = httptest.NewRecorder()
+	if cp.handle(w, r) || w.Header().Get("Access-Control-Expose-Headers") != "X-Csrf-Token" {
+		t.Fatalf("Expected the request to go on with the csrf header exposed: %v", w.Header())
+	}
+}
+
+func TestCorsOriginNotAllowed(t *testing.T) {
+	cp := newCorsPolicy(ConfCORS{AllowedOrigins: []string{"https://app.example.com"}, AllowedMethods: []string{"get"}})
+	for _, method := range []string{"OPTIONS", "GET"} {
+		r := httptest.NewRequest(method, "/api/team", nil)
+		r.Header.Set("Origin", "https://evil.example.com")
+		r.Header.Set("Access-Control-Request-Method", "GET")
+		w := httptest.NewRecorder()
+		cp.handle(w, r)
+		for k := range w.Header() {
+			if k != "Vary" {
+				t.Errorf("Unexpected %s header for %s from an origin not allowed", k, method)
+			}
+		}
+	}
+	if newCorsPolicy(ConfCORS{}).handle(httptest.NewRecorder(), httptest.NewRequest("OPTIONS", "/api/team", nil)) {
+		t.Errorf("Expected preflights to be ignored when cors is not configured")
+	}
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"net/http"
+	"strings"
 
 	"github.com/gorilla/securecookie"
 	"github.com/keydotcat/keycatd/util"
@@ -11,10 +12,12 @@ const CSRF_COOKIE_NAME = "kc4d018d7e07"
 
 type csrf struct {
 	sc *securecookie.SecureCookie
+	// Send the cookie in cross-site requests too for clients allowed by the CORS credentials setting
+	crossSite bool
 }
 
 func newCsrf(hKey, bKey []byte) csrf {
-	return csrf{securecookie.New(hKey, bKey)}
+	return csrf{sc: securecookie.New(hKey, bKey)}
 }
 
 func (c csrf) checkToken(w http.ResponseWriter, r *http.Request) (string, bool) {
@@ -44,6 +47,11 @@ func (c csrf) getToken(w http.ResponseWriter, r *http.Request) (string, bool) {
 
 func (c csrf) generateNewToken(w http.ResponseWriter) string {
 	csrfToken := util.GenerateRandomToken(8)
+	c.setToken(w, csrfToken)
+	return csrfToken
+}
+
+func (c csrf) setToken(w http.ResponseWriter, csrfToken string) {
 	if encoded, err := c.sc.Encode(CSRF_COOKIE_NAME, csrfToken); err == nil {
 		cookie := &http.Cookie{
 			Name:     CSRF_COOKIE_NAME,
@@ -51,9 +59,44 @@ func (c csrf) generateNewToken(w http.ResponseWriter) string {
 			Path:     "/",
 			HttpOnly: true,
 		}
+		if c.crossSite {
+			cookie.SameSite = http.SameSiteNoneMode
+			cookie.Secure = true
+		}
 		http.SetCookie(w, cookie)
 	} else {
 		panic(err)
 	}
-	return csrfToken
+}
+
+// rotateToken replaces the csrf cookie of the client with a new token, overriding any csrf cookie already set in
+// this response. The new token is also sent in the X-Csrf-Token header so the client can use it right away
+func (c csrf) rotateToken(w http.ResponseWriter) string {
+	cookies := w.Header()["Set-Cookie"]
+	kept := cookies[:0]
+	for _, ck := range cookies {
+		if !strings.HasPrefix(ck, CSRF_COOKIE_NAME+"=") {
+			kept = append(kept, ck)
+		}
+	}
+	if len(kept) > 0 {
+		w.Header()["Set-Cookie"] = kept
+	} else {
+		w.Header().Del("Set-Cookie")
+	}
+	token := c.generateNewToken(w)
+	w.Header().Set("X-Csrf-Token", token)
+	return token
+}
+
+// rotateCsrfAfterPrivChange gives sessions that use csrf protection a new token after a password, two factor or
+// ownership change so a leaked token stops working. The previous token no longer matches the cookie
+func (ah apiHandler) rotateCsrfAfterPrivChange(w http.ResponseWriter, r *http.Request) {
+	if !ah.options.csrfRotateOnPrivChange {
+		return
+	}
+	if _, ok := r.Context().Value(contextCsrfKey).(string); !ok {
+		return
+	}
+	ah.csrf.rotateToken(w)
 }
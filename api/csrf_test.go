@@ -0,0 +1,46 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCsrfRotateAfterPasswordChange(t *testing.T) {
+	ah := apiHandler{csrf: newCsrf([]byte("4d018d7e070ca9d5da7e767001bdaf90"), []byte("4e3797182c94f05b384c81ed0246f6b4"))}
+	ah.options.csrfRotateOnPrivChange = true
+	oldToken := "oldtoken"
+	r := httptest.NewRequest("PATCH", "/user", nil)
+	r = r.WithContext(ctxAddCsrf(r.Context(), oldToken))
+	w := httptest.NewRecorder()
+	// The session refresh already set the old token in this response
+	ah.csrf.setToken(w, oldToken)
+	ah.rotateCsrfAfterPrivChange(w, r)
+	newToken := w.Header().Get("X-Csrf-Token")
+	if len(newToken) == 0 || newToken == oldToken {
+		t.Fatalf("Expected a new csrf token and got '%s'", newToken)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != CSRF_COOKIE_NAME {
+		t.Fatalf("Expected a single csrf cookie and got %v", cookies)
+	}
+	next := httptest.NewRequest("POST", "/team", nil)
+	next.AddCookie(cookies[0])
+	next.Header.Set("X-Csrf-Token", oldToken)
+	if _, ok := ah.csrf.checkToken(httptest.NewRecorder(), next); ok {
+		t.Error("Old csrf token is still valid after the rotation")
+	}
+	next.Header.Set("X-Csrf-Token", newToken)
+	if _, ok := ah.csrf.checkToken(httptest.NewRecorder(), next); !ok {
+		t.Error("New csrf token is not valid after the rotation")
+	}
+	// Sessions without csrf and disabled rotation don't get a new token
+	for _, req := range []*http.Request{httptest.NewRequest("PATCH", "/user", nil), r} {
+		ah.options.csrfRotateOnPrivChange = req != r
+		w = httptest.NewRecorder()
+		ah.rotateCsrfAfterPrivChange(w, req)
+		if len(w.Header().Get("X-Csrf-Token")) > 0 || len(w.Result().Cookies()) > 0 {
+			t.Error("Unexpected csrf rotation")
+		}
+	}
+}
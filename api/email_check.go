@@ -0,0 +1,60 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/keydotcat/keycatd/models"
+	"github.com/keydotcat/keycatd/util"
+)
+
+const (
+	emailCheckRateLimit  = 10
+	emailCheckRateWindow = time.Minute
+)
+
+type authEmailCheckRequest struct {
+	Email   string `json:"email"`
+	Captcha string `json:"captcha"`
+}
+
+// Unless the server is configured to expose email existence, available is always true and
+// ownership of the address is only proven later by the confirmation mail
+type authEmailCheckResponse struct {
+	Exposed   bool `json:"exposed"`
+	Available bool `json:"available"`
+}
+
+// POST /auth/email_available
+func (ah apiHandler) authEmailAvailable(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return util.NewErrorFrom(ErrNotFound)
+	}
+	ip := ah.clientIP(r)
+	if !ah.emailCheckLimiter.allow(ip) {
+		return util.NewErrorFrom(ErrTooManyRequests)
+	}
+	req := &authEmailCheckRequest{}
+	if err := jsonDecode(w, r, 1024, req); err != nil {
+		return err
+	}
+	if err := ah.captcha.verify(req.Captcha, ip); err != nil {
+		return err
+	}
+	email := strings.TrimSpace(req.Email)
+	if len(email) == 0 {
+		return util.NewErrorf("Missing email")
+	}
+	if !ah.options.exposeEmailExistence {
+		return jsonResponse(w, authEmailCheckResponse{false, true})
+	}
+	_, err := models.FindUserByEmail(r.Context(), email)
+	switch {
+	case util.CheckErr(err, models.ErrDoesntExist):
+		return jsonResponse(w, authEmailCheckResponse{true, true})
+	case err != nil:
+		return err
+	}
+	return jsonResponse(w, authEmailCheckResponse{true, false})
+}
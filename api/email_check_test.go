@@ -0,0 +1,67 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func checkEmailAvailable(t *testing.T, ah apiHandler, req authEmailCheckRequest, code int) *authEmailCheckResponse {
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/auth/email_available", bytes.NewBuffer(body))
+	r.Header.Set("Content-Type", "application/json")
+	ah.ServeHTTP(w, r)
+	if w.Code != code {
+		t.Fatalf("Unexpected response code: %d vs %d: %s", code, w.Code, w.Body.String())
+	}
+	res := &authEmailCheckResponse{}
+	if code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return res
+}
+
+func TestEmailAvailable(t *testing.T) {
+	u := getDummyUser()
+	ah := apiH
+	ah.emailCheckLimiter = newRateLimiter(emailCheckRateLimit, emailCheckRateWindow)
+	res := checkEmailAvailable(t, ah, authEmailCheckRequest{Email: u.Email}, 200)
+	if res.Exposed || !res.Available {
+		t.Fatalf("Email existence must not be exposed by default: %+v", res)
+	}
+	ah.options.exposeEmailExistence = true
+	res = checkEmailAvailable(t, ah, authEmailCheckRequest{Email: u.Email}, 200)
+	if !res.Exposed || res.Available {
+		t.Fatalf("Expected %s to be taken: %+v", u.Email, res)
+	}
+	res = checkEmailAvailable(t, ah, authEmailCheckRequest{Email: "x" + u.Email}, 200)
+	if !res.Exposed || !res.Available {
+		t.Fatalf("Expected x%s to be available: %+v", u.Email, res)
+	}
+	ah.emailCheckLimiter = newRateLimiter(1, time.Minute)
+	checkEmailAvailable(t, ah, authEmailCheckRequest{Email: u.Email}, 200)
+	checkEmailAvailable(t, ah, authEmailCheckRequest{Email: u.Email}, 429)
+}
+
+func TestEmailAvailableCaptcha(t *testing.T) {
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok := r.FormValue("secret") == "s3cr3t" && r.FormValue("response") == "good"
+		json.NewEncoder(w).Encode(map[string]bool{"success": ok})
+	}))
+	defer provider.Close()
+	ah := apiH
+	ah.emailCheckLimiter = newRateLimiter(emailCheckRateLimit, emailCheckRateWindow)
+	ah.captcha = newCaptchaVerifier(&ConfCaptcha{Secret: "s3cr3t", VerifyUrl: provider.URL})
+	checkEmailAvailable(t, ah, authEmailCheckRequest{Email: "a@b.cat"}, 400)
+	checkEmailAvailable(t, ah, authEmailCheckRequest{Email: "a@b.cat", Captcha: "bad"}, 400)
+	checkEmailAvailable(t, ah, authEmailCheckRequest{Email: "a@b.cat", Captcha: "good"}, 200)
+}
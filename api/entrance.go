@@ -1,10 +1,14 @@
 package api
 
 import (
+	"crypto/sha256"
 	"database/sql"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/keydotcat/keycatd/db"
 	"github.com/keydotcat/keycatd/managers"
@@ -14,33 +18,112 @@ import (
 
 var TEST_MODE = false
 
+// Waits between attempts to connect to redis when it's down at startup
+const (
+	redisRetryMinInterval = 500 * time.Millisecond
+	redisRetryMaxInterval = 30 * time.Second
+)
+
 type apiOptions struct {
-	onlyInvited bool
+	onlyInvited            bool
+	rollingSessions        bool
+	sessionRefreshInterval time.Duration
+	sessionCooling         time.Duration
+	exposeEmailExistence   bool
+	mailDrainTimeout       time.Duration
+	sessionMaxAge          time.Duration
+	sessionIdleTimeout     time.Duration
+	csrfRotateOnPrivChange bool
+	metricsOnApi           bool
 }
 
 type apiHandler struct {
-	db            *sql.DB
-	sm            managers.SessionMgr
-	mail          *mailer
-	csrf          csrf
-	staticHandler *StaticHandler
-	options       apiOptions
-	bcast         managers.BroadcasterMgr
+	db                *sql.DB
+	replicaDBs        []*sql.DB
+	readReplicas      *models.ReadReplicas
+	sm                managers.SessionMgr
+	mail              *mailer
+	csrf              csrf
+	staticHandler     *StaticHandler
+	options           apiOptions
+	bcast             managers.BroadcasterMgr
+	kdfLimiter        *rateLimiter
+	classifyLimiter   *rateLimiter
+	jwt               *jwtSigner
+	heavyOps          *heavyOpLimiter
+	origin            *originChecker
+	cors              *corsPolicy
+	ipFilter          *ipFilter
+	clientIPs         *clientIPResolver
+	realtimeConns     *realtimeConnLimiter
+	emailCheckLimiter *rateLimiter
+	captcha           *captchaVerifier
+	passwords         PasswordPolicy
+	breachRanges      *breachRanges
+	idempotency       *idempotencyKeys
+	loginLimiter      *loginLimiter
+	webhooks          managers.WebhookMgr
+	metrics           managers.MetricsMgr
+	secretReads       *secretReadLogger
+	closing           chan struct{}
 }
 
 func NewAPIHandler(c Conf) (http.Handler, error) {
+	c.setDefaults()
 	err := c.validate()
 	if err != nil {
 		return nil, err
 	}
-	ah := apiHandler{}
+	ah := apiHandler{closing: make(chan struct{})}
+	ah.metrics = managers.NewMetricsMgr()
 	ah.bcast = managers.NewInternalBroadcasterMgr()
 	ah.options.onlyInvited = c.OnlyInvited
+	ah.options.rollingSessions = c.RollingSessions
+	ah.options.sessionRefreshInterval = c.SessionRefreshInterval
+	ah.options.sessionCooling = time.Duration(c.NewSessionCoolingMinutes) * time.Minute
+	ah.options.exposeEmailExistence = c.ExposeEmailExistence
+	ah.options.mailDrainTimeout = c.MailDrainTimeout
+	ah.options.sessionMaxAge = c.SessionMaxAge
+	ah.options.csrfRotateOnPrivChange = !c.DisableCsrfRotation
+	ah.options.metricsOnApi = c.MetricsEnabled && c.MetricsPort == 0
+	// Fixed sessions are never refreshed so they can only be expired by age
+	if c.RollingSessions {
+		ah.options.sessionIdleTimeout = c.SessionIdleTimeout
+	}
+	managers.SESSION_MAX_AGE = ah.options.sessionMaxAge
+	managers.SESSION_IDLE_TIMEOUT = ah.options.sessionIdleTimeout
+	models.ENFORCE_REKEY_ON_REMOVAL = c.EnforceRekeyOnRemoval
+	models.MAX_INVITES_PER_TEAM_PER_HOUR = c.MaxInvitesPerTeamPerHour
+	models.INVITE_TTL = c.InviteTTL
+	models.REQUIRE_APPROVAL = c.RequireApproval
+	models.APPROVERS = c.Approvers
+	models.SUSPENSION_ADMINS = c.SuspensionAdmins
+	models.SECRET_HISTORY_LIMIT = c.SecretHistoryLimit
+	models.SECRET_ACCESS_RETENTION = c.SecretAccessRetention
+	models.MAX_SECRET_SIZE = c.MaxSecretSize
+	models.VAULT_PURGE_AFTER = c.VaultPurgeAfter
+	if c.VaultPurgeAfter < 0 {
+		models.VAULT_PURGE_AFTER = 0
+	}
+	models.RETRY_SERIALIZATION_FAILURES = c.DBType == db.DB_TYPE_COCKROACHDB
+	if u, err := url.Parse(c.Url); err == nil && len(u.Hostname()) > 0 {
+		models.WEBAUTHN_RP_ID = u.Hostname()
+		models.WEBAUTHN_ORIGIN = normalizeOrigin(c.Url)
+	}
 	ah.db, err = sql.Open("postgres", c.DB)
 	if err != nil {
 		return nil, util.NewErrorf("Could not connect to db '%s': %s", c.DB, err)
 	}
-	ah.db.SetMaxOpenConns(c.DBMaxConns)
+	configureDBPool(ah.db, c)
+	for _, dsn := range c.DBReadReplicas {
+		rdb, err := sql.Open("postgres", dsn)
+		if err != nil {
+			return nil, util.NewErrorf("Could not connect to read replica '%s': %s", dsn, err)
+		}
+		configureDBPool(rdb, c)
+		ah.replicaDBs = append(ah.replicaDBs, rdb)
+	}
+	ah.readReplicas = models.NewReadReplicas(ah.replicaDBs)
 	m := db.NewMigrateMgr(ah.db, c.DBType)
 	if err := m.LoadMigrations(); err != nil {
 		panic(err)
@@ -51,48 +134,182 @@ func NewAPIHandler(c Conf) (http.Handler, error) {
 		panic(err)
 	}
 	log.Printf("Executed migrations until %d (%d applied)", lid, ap)
-	switch {
-	case TEST_MODE:
-		ah.mail, err = newMailer(c.Url, TEST_MODE, managers.NewMailMgrNULL())
-	case c.MailSMTP != nil:
-		ah.mail, err = newMailer(c.Url, TEST_MODE, managers.NewMailMgrSMTP(c.MailSMTP.Server, c.MailSMTP.User, c.MailSMTP.Password, c.MailFrom))
-	case c.MailSparkpost != nil:
-		ah.mail, err = newMailer(c.Url, TEST_MODE, managers.NewMailMgrSparkpost(c.MailSparkpost.Key, c.MailFrom, c.MailSparkpost.EU))
-	default:
+	mm, _ := newMailMgr(c)
+	if TEST_MODE {
+		mm = managers.NewMailMgrNULL()
+	} else {
+		mm = managers.NewMailMgrQueue(mm, mailQueueSize, ah.metrics)
 	}
+	ah.mail, err = newMailer(c.Url, TEST_MODE, mm)
 	if err != nil {
 		return nil, util.NewErrorf("Could not create mailer: %s", err)
 	}
-	if c.SessionRedis != nil {
-		ah.sm, err = managers.NewSessionMgrRedis(c.SessionRedis.Server, c.SessionRedis.DBId)
-		if err != nil {
-			return nil, util.NewErrorf("Could not connect to redis at %s: %s", c.SessionRedis.Server, err)
-		}
-	} else {
-		ah.sm = managers.NewSessionMgrDB(ah.db)
+	if err := ah.mail.setDefaults(c.DefaultLocale, c.DefaultTimezone); err != nil {
+		return nil, err
+	}
+	if ah.sm, err = newSessionMgr(c, ah.db); err != nil {
+		return nil, err
 	}
 	var blockKey []byte
 	if len(c.Csrf.BlockKey) > 0 {
 		blockKey = []byte(c.Csrf.BlockKey)
 	}
 	ah.csrf = newCsrf([]byte(c.Csrf.HashKey), blockKey)
+	ah.csrf.crossSite = c.CORS.AllowCredentials
+	ah.kdfLimiter = newRateLimiter(kdfRateLimit, kdfRateWindow)
+	ah.classifyLimiter = newRateLimiter(classifyEmailsRateLimit, classifyEmailsRateWindow)
+	ah.emailCheckLimiter = newRateLimiter(emailCheckRateLimit, emailCheckRateWindow)
+	ah.loginLimiter = newLoginLimiter(ah.sm, c.LoginMaxAttempts, c.LoginAttemptWindow)
+	ah.idempotency = newIdempotencyKeys(ah.sm, c.IdempotencyKeyTTL)
+	ah.captcha = newCaptchaVerifier(c.Captcha)
+	ah.passwords = c.CustomPasswordPolicy
+	if ah.passwords == nil {
+		ah.passwords = NewPasswordPolicy(c.PasswordPolicy)
+	}
+	ah.breachRanges = newBreachRanges(c.PasswordPolicy)
+	ah.jwt = newJWTSigner(c.Url, c.JWT.TTL, c.JWT.Rotation)
+	ah.heavyOps = newHeavyOpLimiter(c.HeavyOpConcurrency)
+	ah.realtimeConns = newRealtimeConnLimiter(c.MaxRealtimeConnsPerUser)
+	ah.origin = newOriginChecker(c.Origin.Check, c.ProxyMode, c.Origin.Allowed)
+	ah.cors = newCorsPolicy(c.CORS)
+	if ah.clientIPs, err = newClientIPResolver(c.ProxyMode, c.TrustedProxies); err != nil {
+		return nil, util.NewErrorFrom(err)
+	}
+	if ah.ipFilter, err = newIPFilter(ah.clientIPs, c.IPAllowList, c.IPDenyList); err != nil {
+		return nil, util.NewErrorFrom(err)
+	}
+	totpKey := c.TOTPKey
+	if len(totpKey) == 0 {
+		totpKey = "totp:" + c.Csrf.HashKey
+	}
+	models.TOTP_ENCRYPTION_KEY = sha256.Sum256([]byte(totpKey))
+	util.KDF_ITERATIONS = uint32(c.KDF.Iterations)
+	util.KDF_MEMORY = uint32(c.KDF.Memory)
+	util.KDF_PARALLELISM = uint8(c.KDF.Parallelism)
+	if len(c.KDFFakeSecret) > 0 {
+		util.FAKE_KDF_SECRET = []byte(c.KDFFakeSecret)
+	} else {
+		util.FAKE_KDF_SECRET = []byte(c.Csrf.HashKey)
+	}
+	hooks := make([]managers.Webhook, len(c.Webhooks))
+	for i, wh := range c.Webhooks {
+		hooks[i] = managers.Webhook{Url: wh.Url, Secret: wh.Secret, Vaults: wh.Vaults, Events: wh.Events}
+	}
+	ah.webhooks = managers.NewWebhookMgr(hooks, webhookQueueSize)
+	if !TEST_MODE && (c.MailQueueAlertThreshold > 0 || c.MailQueueAlertAge > 0) {
+		go ah.mailQueueAlertLoop(&mailQueueAlert{threshold: c.MailQueueAlertThreshold, age: c.MailQueueAlertAge})
+	}
+	ah.secretReads = newSecretReadLogger(ah.db)
 	ah.staticHandler = NewStaticHandler()
+	if c.AdminInactivityDays > 0 {
+		go ah.demoteInactiveAdminsLoop(time.Duration(c.AdminInactivityDays) * 24 * time.Hour)
+	}
+	if c.SecretHistoryLimit > 0 {
+		go ah.pruneSecretHistoryLoop()
+	}
+	go ah.purgeDeletedVaultsLoop()
+	go ah.cleanupLoop(c.CleanupInterval)
+	go ah.secretRotationRemindersLoop(c.SecretRotationRepeatReminders)
+	if c.UnverifiedAccountTTL > 0 {
+		go ah.purgeUnverifiedAccountsLoop(c.UnverifiedAccountTTL, c.UnverifiedAccountGrace)
+	}
 	return ah, nil
 }
 
+func configureDBPool(dbp *sql.DB, c Conf) {
+	dbp.SetMaxOpenConns(c.DBMaxConns)
+	if c.DBMaxIdleConns > 0 {
+		dbp.SetMaxIdleConns(c.DBMaxIdleConns)
+	}
+	dbp.SetConnMaxLifetime(c.DBConnMaxLifetime)
+}
+
+func newSessionMgr(c Conf, dbp *sql.DB) (managers.SessionMgr, error) {
+	var connect func() (managers.SessionMgr, error)
+	var where string
+	switch {
+	case c.SessionRedis != nil:
+		where = c.SessionRedis.Server
+		connect = func() (managers.SessionMgr, error) {
+			return managers.NewSessionMgrRedis(c.SessionRedis.Server, c.SessionRedis.DBId)
+		}
+	case c.SessionRedisSentinel != nil:
+		where = fmt.Sprintf("master %s of sentinels %s", c.SessionRedisSentinel.MasterName, strings.Join(c.SessionRedisSentinel.SentinelAddrs, ","))
+		connect = func() (managers.SessionMgr, error) {
+			return managers.NewSessionMgrRedisSentinel(c.SessionRedisSentinel.MasterName, c.SessionRedisSentinel.SentinelAddrs, c.SessionRedisSentinel.DBId)
+		}
+	}
+	if connect != nil {
+		sm, err := connect()
+		if err == nil {
+			return sm, nil
+		}
+		if c.RedisRequiredAtStartup {
+			return nil, util.NewErrorf("Could not connect to redis at %s: %s", where, err)
+		}
+		log.Printf("Could not connect to redis at %s: %s. Starting without sessions until it is up", where, err)
+		return managers.NewSessionMgrRetry(connect, redisRetryMinInterval, redisRetryMaxInterval), nil
+	}
+	switch {
+	case c.SessionStore == sessionStoreMemory:
+		return managers.NewSessionMgrMemory(memorySessionSweepInterval), nil
+	}
+	return managers.NewSessionMgrDB(dbp), nil
+}
+
+// Shutdown sends the queued mails and webhooks, writes the pending secret reads and closes the session store and the database. Call it once the http server
+// has stopped serving requests. It returns the first error found but closes everything anyway
+func (ah apiHandler) Shutdown() error {
+	err := ah.mail.drain(ah.options.mailDrainTimeout)
+	if werr := ah.webhooks.Drain(ah.options.mailDrainTimeout); err == nil {
+		err = werr
+	}
+	if serr := ah.secretReads.drain(ah.options.mailDrainTimeout); err == nil {
+		err = serr
+	}
+	if c, ok := ah.sm.(managers.SessionMgrCloser); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := ah.db.Close(); err == nil {
+		err = cerr
+	}
+	for _, rdb := range ah.replicaDBs {
+		if cerr := rdb.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
 func (ah apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	r = r.WithContext(models.AddDBToContext(r.Context(), ah.db))
+	r = r.WithContext(models.AddReadReplicasToContext(models.AddDBToContext(r.Context(), ah.db), ah.readReplicas))
 	head, subPath := shiftPath(r.URL.Path)
+	// Health checks come from the load balancers so they are never filtered
+	if r.URL.Path != "/healthz" && !ah.ipFilter.check(r) {
+		httpErr(w, util.NewErrorFrom(ErrAddressNotAllowed))
+		return
+	}
+	if ah.cors.handle(w, r) {
+		return
+	}
 	if head == "api" {
 		r.URL.Path = subPath
 		ah.apiRoot(w, r)
+	} else if r.URL.Path == "/healthz" {
+		ah.healthz(w, r)
+	} else if r.URL.Path == "/metrics" && ah.options.metricsOnApi {
+		ah.metricsRoot(w, r)
+	} else if r.URL.Path == "/.well-known/jwks.json" {
+		ah.jwksRoot(w, r)
 	} else {
 		ah.staticHandler.ServeHTTP(w, r)
 	}
 }
 
 func (ah apiHandler) apiRoot(w http.ResponseWriter, r *http.Request) {
-	r = r.WithContext(models.AddDBToContext(r.Context(), ah.db))
+	r = r.WithContext(models.AddReadReplicasToContext(models.AddDBToContext(r.Context(), ah.db), ah.readReplicas))
 	var err error
 	head := ""
 	head, r.URL.Path = shiftPath(r.URL.Path)
@@ -102,6 +319,14 @@ func (ah apiHandler) apiRoot(w http.ResponseWriter, r *http.Request) {
 		err = ah.authRoot(w, r)
 	case "version":
 		err = ah.versionRoot(w, r)
+	case "share":
+		err = ah.shareRoot(w, r)
+	case "user":
+		if sub, _ := shiftPath(r.URL.Path); sub == "kdf" && r.Method == "GET" {
+			err = ah.userKdf(w, r)
+		} else {
+			err = ah.authenticatedRoot(w, r, head)
+		}
 	default:
 		err = ah.authenticatedRoot(w, r, head)
 	}
@@ -117,17 +342,19 @@ func (ah apiHandler) authenticatedRoot(w http.ResponseWriter, r *http.Request, h
 	if r == nil {
 		return nil
 	}
-	switch head {
-	case "session":
-		err = ah.sessionRoot(w, r)
-	case "user":
-		err = ah.userRoot(w, r)
-	case "team":
-		err = ah.teamRoot(w, r)
-	case "ws":
-		err = ah.wsRoot(w, r)
-	case "eventsource":
-		err = ah.eventSourceRoot(w, r)
-	}
-	return err
+	return ah.idempotency.serve(w, r, ctxGetUser(r.Context()).Id, "/"+head+r.URL.Path, func(w http.ResponseWriter, r *http.Request) error {
+		switch head {
+		case "session":
+			err = ah.sessionRoot(w, r)
+		case "user":
+			err = ah.userRoot(w, r)
+		case "team":
+			err = ah.teamRoot(w, r)
+		case "ws":
+			err = ah.wsRoot(w, r)
+		case "eventsource":
+			err = ah.eventSourceRoot(w, r)
+		}
+		return err
+	})
 }
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/keydotcat/keycatd/managers"
+	"github.com/keydotcat/keycatd/models"
+	"github.com/keydotcat/keycatd/util"
+)
+
+// Codes for errors that are not registered
+const (
+	errCodeInvalidFields = "INVALID_FIELDS"
+	errCodeBadRequest    = "BAD_REQUEST"
+)
+
+type errorCode struct {
+	err    error
+	code   string
+	status int
+}
+
+// errorCodes maps errors to the code and status sent to clients. Codes are part of the api so they must never change
+// once released. To add a new error append it here with a new code
+var errorCodes = []errorCode{
+	{ErrNotFound, "NOT_FOUND", http.StatusNotFound},
+	{ErrTooManyRequests, "TOO_MANY_REQUESTS", http.StatusTooManyRequests},
+	{ErrServerBusy, "SERVER_BUSY", http.StatusServiceUnavailable},
+	{ErrSessionCooling, "SESSION_COOLING", http.StatusForbidden},
+	{ErrSessionExpired, "SESSION_EXPIRED", http.StatusUnauthorized},
+	{ErrSessionIdle, "SESSION_IDLE", http.StatusUnauthorized},
+	{ErrTeamRequiresTOTP, "TEAM_REQUIRES_TOTP", http.StatusForbidden},
+	{ErrPolicyLooserThanInstance, "POLICY_LOOSER_THAN_INSTANCE", http.StatusBadRequest},
+	{ErrCaptchaRequired, "CAPTCHA_REQUIRED", http.StatusBadRequest},
+	{ErrTooManyAttempts, "TOO_MANY_ATTEMPTS", http.StatusTooManyRequests},
+	{ErrWebAuthnRequired, "WEBAUTHN_REQUIRED", http.StatusUnauthorized},
+	{ErrAddressNotAllowed, "ADDRESS_NOT_ALLOWED", http.StatusForbidden},
+	{ErrWeakPassword, "WEAK_PASSWORD", http.StatusBadRequest},
+	{ErrBreachCheckUnavailable, "BREACH_CHECK_UNAVAILABLE", http.StatusBadGateway},
+	{ErrIdempotencyKeyConflict, "IDEMPOTENCY_KEY_CONFLICT", http.StatusUnprocessableEntity},
+	{ErrIdempotentRequestRunning, "IDEMPOTENT_REQUEST_RUNNING", http.StatusConflict},
+	{managers.ErrSessionStoreUnavailable, "SESSION_STORE_UNAVAILABLE", http.StatusServiceUnavailable},
+	{models.ErrInvalidEmail, "INVALID_EMAIL", http.StatusBadRequest},
+	{models.ErrNotInTeam, "NOT_IN_TEAM", http.StatusBadRequest},
+	{models.ErrUnauthorized, "UNAUTHORIZED", http.StatusUnauthorized},
+	{models.ErrAlreadyInTeam, "ALREADY_IN_TEAM", http.StatusBadRequest},
+	{models.ErrAlreadyInvited, "ALREADY_INVITED", http.StatusBadRequest},
+	{models.ErrInviteExpired, "INVITE_EXPIRED", http.StatusGone},
+	{models.ErrAlreadyExists, "ALREADY_EXISTS", http.StatusBadRequest},
+	{models.ErrInvalidKeys, "INVALID_KEYS", http.StatusBadRequest},
+	{models.ErrMalformedKeys, "MALFORMED_KEYS", http.StatusBadRequest},
+	{models.ErrDoesntExist, "DOES_NOT_EXIST", http.StatusNotFound},
+	{models.ErrInvalidSignature, "INVALID_SIGNATURE", http.StatusBadRequest},
+	{models.ErrInvalidPublicKey, "INVALID_PUBLIC_KEY", http.StatusBadRequest},
+	{models.ErrInvalidAttributes, "INVALID_ATTRIBUTES", http.StatusBadRequest},
+	{models.ErrSecretTooLarge, "SECRET_TOO_LARGE", http.StatusRequestEntityTooLarge},
+	{models.ErrVaultQuotaExceeded, "VAULT_QUOTA_EXCEEDED", http.StatusForbidden},
+	{models.ErrRekeyPending, "REKEY_PENDING", http.StatusBadRequest},
+	{models.ErrMissingAllMembersKeys, "MISSING_ALL_MEMBERS_KEYS", http.StatusBadRequest},
+	{models.ErrAccountSuspended, "ACCOUNT_SUSPENDED", http.StatusUnauthorized},
+	{models.ErrInviteEmailMismatch, "INVITE_EMAIL_MISMATCH", http.StatusBadRequest},
+	{models.ErrDanglingReference, "DANGLING_REFERENCE", http.StatusBadRequest},
+	{models.ErrReferenceCycle, "REFERENCE_CYCLE", http.StatusBadRequest},
+	{models.ErrSecretReferenced, "SECRET_REFERENCED", http.StatusBadRequest},
+	{models.ErrInvalidResetToken, "INVALID_RESET_TOKEN", http.StatusBadRequest},
+	{models.ErrExpiredResetToken, "EXPIRED_RESET_TOKEN", http.StatusBadRequest},
+	{models.ErrResetKeyChanged, "RESET_KEY_CHANGED", http.StatusBadRequest},
+	{models.ErrTOTPRequired, "TOTP_REQUIRED", http.StatusUnauthorized},
+	{models.ErrInvalidTOTPCode, "INVALID_TOTP_CODE", http.StatusUnauthorized},
+	{models.ErrTOTPNotEnabled, "TOTP_NOT_ENABLED", http.StatusBadRequest},
+	{models.ErrNotTeamAdmin, "NOT_TEAM_ADMIN", http.StatusBadRequest},
+	{models.ErrCannotRemoveOwner, "CANNOT_REMOVE_OWNER", http.StatusBadRequest},
+	{models.ErrVaultNotFound, "VAULT_NOT_FOUND", http.StatusNotFound},
+	{models.ErrCannotDeleteDefaultVault, "CANNOT_DELETE_DEFAULT_VAULT", http.StatusBadRequest},
+	{models.ErrCannotRenameDefaultVault, "CANNOT_RENAME_DEFAULT_VAULT", http.StatusBadRequest},
+	{models.ErrVaultPurged, "VAULT_PURGED", http.StatusGone},
+	{models.ErrInviteRateLimited, "INVITE_RATE_LIMITED", http.StatusTooManyRequests},
+	{models.ErrLocalAuthDisabled, "LOCAL_AUTH_DISABLED", http.StatusBadRequest},
+	{models.ErrOwnerCannotLeave, "OWNER_CANNOT_LEAVE", http.StatusBadRequest},
+	{models.ErrInvalidRole, "INVALID_ROLE", http.StatusBadRequest},
+	{models.ErrPromotionRequiresKeys, "PROMOTION_REQUIRES_KEYS", http.StatusBadRequest},
+	{models.ErrEmailNotConfirmed, "EMAIL_NOT_CONFIRMED", http.StatusUnauthorized},
+	{models.ErrConfirmationRateLimited, "CONFIRMATION_RATE_LIMITED", http.StatusTooManyRequests},
+	{models.ErrBatchTooLarge, "BATCH_TOO_LARGE", http.StatusBadRequest},
+	{models.ErrOwnsTeams, "OWNS_TEAMS", http.StatusBadRequest},
+	{models.ErrWebAuthnNotEnabled, "WEBAUTHN_NOT_ENABLED", http.StatusBadRequest},
+	{models.ErrInvalidWebAuthn, "INVALID_WEBAUTHN", http.StatusUnauthorized},
+	{models.ErrAuthenticatorCloned, "AUTHENTICATOR_CLONED", http.StatusUnauthorized},
+	{models.ErrTooManyCredentials, "TOO_MANY_CREDENTIALS", http.StatusBadRequest},
+	{models.ErrSecondFactorRequired, "SECOND_FACTOR_REQUIRED", http.StatusUnauthorized},
+	{models.ErrAwaitingApproval, "AWAITING_APPROVAL", http.StatusForbidden},
+	{models.ErrShareLinkExpired, "SHARE_LINK_EXPIRED", http.StatusGone},
+	{models.ErrShareLinkExhausted, "SHARE_LINK_EXHAUSTED", http.StatusGone},
+	{models.ErrCannotRemovePrimaryEmail, "CANNOT_REMOVE_PRIMARY_EMAIL", http.StatusBadRequest},
+	{models.ErrRemovalNotStarted, "REMOVAL_NOT_STARTED", http.StatusConflict},
+	{models.ErrJustificationRequired, "JUSTIFICATION_REQUIRED", http.StatusForbidden},
+}
+
+// errorResponse is the body sent for failed requests. Error is the same as Message and is kept for older clients
+type errorResponse struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Error   string            `json:"error,omitempty"`
+	Fields  map[string]string `json:"error_fields,omitempty"`
+}
+
+// getErrorCode returns the code and status for err. Field errors without a registered cause are INVALID_FIELDS and
+// anything else is a BAD_REQUEST
+func getErrorCode(err error) (string, int) {
+	for _, ec := range errorCodes {
+		if util.CheckErr(err, ec.err) {
+			return ec.code, ec.status
+		}
+	}
+	if ue, ok := err.(*util.Error); ok && len(ue.Fields()) > 0 {
+		return errCodeInvalidFields, http.StatusBadRequest
+	}
+	return errCodeBadRequest, http.StatusBadRequest
+}
+
+func newErrorResponse(err error) (errorResponse, int) {
+	code, status := getErrorCode(err)
+	resp := errorResponse{Code: code, Message: err.Error(), Error: err.Error()}
+	if ue, ok := err.(*util.Error); ok {
+		if len(ue.Fields()) > 0 {
+			resp.Fields = ue.Fields()
+		}
+		if ue.Inner() != nil {
+			resp.Message = ue.Inner().Error()
+			resp.Error = resp.Message
+		} else {
+			resp.Message = "Invalid fields"
+			resp.Error = ""
+		}
+	}
+	return resp, status
+}
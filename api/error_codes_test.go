@@ -0,0 +1,60 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/keydotcat/keycatd/managers"
+	"github.com/keydotcat/keycatd/models"
+	"github.com/keydotcat/keycatd/util"
+)
+
+func TestErrorCodes(t *testing.T) {
+	fieldErr := util.NewErrorFields().(*util.Error)
+	fieldErr.SetFieldError("name", "invalid")
+	cases := []struct {
+		err    error
+		code   string
+		status int
+	}{
+		{util.NewErrorFrom(models.ErrAlreadyInvited), "ALREADY_INVITED", http.StatusBadRequest},
+		{util.NewErrorFrom(models.ErrAlreadyInTeam), "ALREADY_IN_TEAM", http.StatusBadRequest},
+		{models.ErrInvalidKeys, "INVALID_KEYS", http.StatusBadRequest},
+		{util.NewErrorFrom(models.ErrUnauthorized), "UNAUTHORIZED", http.StatusUnauthorized},
+		{util.NewErrorFrom(models.ErrVaultNotFound), "VAULT_NOT_FOUND", http.StatusNotFound},
+		{util.NewErrorFrom(ErrTooManyAttempts), "TOO_MANY_ATTEMPTS", http.StatusTooManyRequests},
+		{util.NewErrorFrom(ErrSessionCooling), "SESSION_COOLING", http.StatusForbidden},
+		{util.NewErrorFrom(managers.ErrSessionStoreUnavailable), "SESSION_STORE_UNAVAILABLE", http.StatusServiceUnavailable},
+		{fieldErr, errCodeInvalidFields, http.StatusBadRequest},
+		{util.NewErrorf("Something went wrong"), errCodeBadRequest, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		httpErr(w, c.err)
+		if w.Code != c.status {
+			t.Errorf("Expected status %d for %s and got %d", c.status, c.err, w.Code)
+		}
+		resp := errorResponse{}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Code != c.code {
+			t.Errorf("Expected code %s for %s and got %s", c.code, c.err, resp.Code)
+		}
+		if len(resp.Message) == 0 {
+			t.Errorf("Missing message for %s", c.err)
+		}
+	}
+	if resp, _ := newErrorResponse(fieldErr); resp.Fields["name"] != "invalid" || len(resp.Error) > 0 {
+		t.Errorf("Unexpected response for a field error: %+v", resp)
+	}
+	seen := map[string]bool{}
+	for _, ec := range errorCodes {
+		if seen[ec.code] {
+			t.Errorf("Code %s is registered more than once", ec.code)
+		}
+		seen[ec.code] = true
+	}
+}
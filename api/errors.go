@@ -3,3 +3,18 @@ package api
 import "errors"
 
 var ErrNotFound = errors.New("Not found")
+var ErrTooManyRequests = errors.New("Too many requests")
+var ErrServerBusy = errors.New("Server is busy. Try again later")
+var ErrSessionCooling = errors.New("This session is too recent to do that. Try again later")
+var ErrSessionExpired = errors.New("Session has expired. Please log in again")
+var ErrSessionIdle = errors.New("Session has been idle for too long. Please log in again")
+var ErrTeamRequiresTOTP = errors.New("This team requires two factor authentication")
+var ErrPolicyLooserThanInstance = errors.New("Team policies can only be stricter than the server settings")
+var ErrCaptchaRequired = errors.New("Missing or invalid captcha")
+var ErrTooManyAttempts = errors.New("Too many failed login attempts. Try again later")
+var ErrAddressNotAllowed = errors.New("Access is not allowed from this address")
+var ErrWebAuthnRequired = errors.New("A security key is required to log in")
+var ErrWeakPassword = errors.New("The password does not meet the password policy")
+var ErrBreachCheckUnavailable = errors.New("The breach api is not available. Try again later")
+var ErrIdempotencyKeyConflict = errors.New("The idempotency key was already used for a different request")
+var ErrIdempotentRequestRunning = errors.New("A request with this idempotency key is still running")
@@ -71,6 +71,11 @@ func (e eventSourceSender) sendMessage(msg []byte) error {
 
 // /eventsource
 func (ah apiHandler) eventSourceSubscribe(w http.ResponseWriter, r *http.Request) error {
+	uid := ctxGetUser(r.Context()).Id
+	if !ah.realtimeConns.tryAcquire(uid) {
+		return util.NewErrorFrom(ErrTooManyRequests)
+	}
+	defer ah.realtimeConns.release(uid)
 	ess, err := ah.makeEventSourceSender(w)
 	if err != nil {
 		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
@@ -0,0 +1,186 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/keydotcat/keycatd/models"
+)
+
+// exportWriter writes the json export piece by piece so that nothing bigger than a secret is kept in memory
+type exportWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *exportWriter) raw(s string) {
+	if ew.err == nil {
+		_, ew.err = io.WriteString(ew.w, s)
+	}
+}
+
+func (ew *exportWriter) value(v interface{}) {
+	if ew.err != nil {
+		return
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		ew.err = err
+		return
+	}
+	_, ew.err = ew.w.Write(b)
+}
+
+func (ew *exportWriter) field(name string, v interface{}) {
+	ew.value(name)
+	ew.raw(":")
+	ew.value(v)
+}
+
+// GET /user/export
+func (ah apiHandler) userExport(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	u := ctxGetUser(ctx)
+	teams, err := u.GetTeams(ctx)
+	if err != nil {
+		return err
+	}
+	// The justification is recorded once the data has been sent so it cannot fail then
+	if err := models.ValidateJustification(r.URL.Query().Get("justification")); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="keycat-export.json"`)
+	w.WriteHeader(http.StatusOK)
+	ew := &exportWriter{w: w}
+	ew.raw("{")
+	ew.field("user", u.Id)
+	ew.raw(`,"teams":[`)
+	for ti, t := range teams {
+		if ti > 0 {
+			ew.raw(",")
+		}
+		if err := ah.exportTeam(r, ew, u, t); err != nil {
+			log.Printf("Export for %s aborted: %s", u.Id, err)
+			return nil
+		}
+	}
+	ew.raw("]}")
+	if ew.err != nil {
+		log.Printf("Export for %s aborted: %s", u.Id, ew.err)
+	}
+	return nil
+}
+
+func (ah apiHandler) exportTeam(r *http.Request, ew *exportWriter, u *models.User, t *models.Team) error {
+	ctx := r.Context()
+	vaults, err := t.GetVaultsForUser(ctx, u)
+	if err != nil {
+		return err
+	}
+	ah.exportTeamHeader(ew, t)
+	for vi, v := range vaults {
+		if vi > 0 {
+			ew.raw(",")
+		}
+		if err := ah.exportVault(r, ew, u, v); err != nil {
+			return err
+		}
+	}
+	ew.raw("]}")
+	return ew.err
+}
+
+func (ah apiHandler) exportTeamHeader(ew *exportWriter, t *models.Team) {
+	ew.raw("{")
+	ew.field("id", t.Id)
+	ew.raw(",")
+	ew.field("name", t.Name)
+	ew.raw(`,"vaults":[`)
+}
+
+func (ah apiHandler) exportVault(r *http.Request, ew *exportWriter, u *models.User, v *models.Vault) error {
+	ctx := r.Context()
+	b, err := v.Export(ctx, u)
+	if err != nil {
+		return err
+	}
+	ew.raw("{")
+	ew.field("id", b.Vault)
+	ew.raw(",")
+	ew.field("public_key", b.PublicKey)
+	ew.raw(",")
+	ew.field("key", b.Key)
+	flagged, err := v.GetSecretIdsRequiringJustification(ctx)
+	if err != nil {
+		return err
+	}
+	justification := r.URL.Query().Get("justification")
+	ew.raw(`,"secrets":[`)
+	first := true
+	var read, justified []*models.Secret
+	err = v.StreamSecrets(ctx, func(s *models.Secret) error {
+		if !first {
+			ew.raw(",")
+		}
+		first = false
+		ref := &models.Secret{Team: s.Team, Vault: s.Vault, Id: s.Id}
+		if flagged[s.Id] {
+			if len(justification) == 0 {
+				// Exported without data like in the vault listing
+				s.Data = nil
+				ew.value(s)
+				return ew.err
+			}
+			justified = append(justified, ref)
+		}
+		ew.value(s)
+		read = append(read, ref)
+		return ew.err
+	})
+	ah.logSecretReads(r, read)
+	if len(justified) > 0 {
+		if jerr := models.RecordJustifiedReads(ctx, u, justified, justification); jerr != nil {
+			log.Printf("Could not record the justified export of %d secrets by %s: %s", len(justified), u.Id, jerr)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	ew.raw("]}")
+	return ew.err
+}
+
+// GET /team/:tid/vault/:vid/export
+// Uses the same format as the account export with only one team and vault
+func (ah apiHandler) vaultExport(w http.ResponseWriter, r *http.Request, t *models.Team, v *models.Vault) error {
+	ctx := r.Context()
+	u := ctxGetUser(ctx)
+	if _, err := v.Export(ctx, u); err != nil {
+		return err
+	}
+	// The justification is recorded once the data has been sent so it cannot fail then
+	if err := models.ValidateJustification(r.URL.Query().Get("justification")); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="keycat-vault-%s.json"`, v.Id))
+	w.WriteHeader(http.StatusOK)
+	ew := &exportWriter{w: w}
+	ew.raw("{")
+	ew.field("user", u.Id)
+	ew.raw(`,"teams":[`)
+	ah.exportTeamHeader(ew, t)
+	if err := ah.exportVault(r, ew, u, v); err != nil {
+		log.Printf("Export of vault %s for %s aborted: %s", v.Id, u.Id, err)
+		return nil
+	}
+	ew.raw("]}]}")
+	if ew.err != nil {
+		log.Printf("Export of vault %s for %s aborted: %s", v.Id, u.Id, ew.err)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/keydotcat/keycatd/managers"
+)
+
+const healthCheckTimeout = 2 * time.Second
+
+type healthzResponse struct {
+	Status  string `json:"status"`
+	Failing string `json:"failing,omitempty"`
+}
+
+// /healthz
+// Readiness probe. Answers 200 if the db and the redis session store (if any) respond and 503 otherwise
+func (ah apiHandler) healthz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+	if err := ah.db.PingContext(ctx); err != nil {
+		ah.healthzFail(w, "db", err)
+		return
+	}
+	if p, ok := ah.sm.(managers.SessionMgrPinger); ok {
+		if err := pingWithTimeout(ctx, p); err != nil {
+			ah.healthzFail(w, "redis", err)
+			return
+		}
+	}
+	jsonResponse(w, healthzResponse{Status: "ok"})
+}
+
+// pingWithTimeout stops waiting for the session store when the context expires. The redis client has no
+// per-call deadline so the ping itself keeps running in the background until it returns
+func pingWithTimeout(ctx context.Context, p managers.SessionMgrPinger) error {
+	done := make(chan error, 1)
+	go func() { done <- p.Ping() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// The error is only logged since the probe is public and it could leak connection details
+func (ah apiHandler) healthzFail(w http.ResponseWriter, dependency string, err error) {
+	log.Printf("Health check failed for %s: %s", dependency, err)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(healthzResponse{Status: "unavailable", Failing: dependency})
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHealthz(t *testing.T) {
+	w := httptest.NewRecorder()
+	apiH.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != 200 {
+		t.Fatalf("Unexpected response code: %d %s", w.Code, w.Body.String())
+	}
+	broken, err := sql.Open("postgres", "host=127.0.0.1 port=1 dbname=nope sslmode=disable connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broken.Close()
+	ah := apiH
+	ah.db = broken
+	w = httptest.NewRecorder()
+	ah.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != 503 {
+		t.Fatalf("Unexpected response code: %d vs 503", w.Code)
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		t.Fatalf("Expected a json body")
+	}
+	res := &healthzResponse{}
+	if err := json.NewDecoder(w.Body).Decode(res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Failing != "db" {
+		t.Fatalf("Expected the db to be the failing dependency and got %s", res.Failing)
+	}
+}
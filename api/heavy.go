@@ -0,0 +1,42 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+const heavyOpRetryAfter = 5
+
+// heavyOpLimiter bounds how many expensive requests run at the same time. Requests over the limit are rejected
+// right away instead of waiting for a free slot
+type heavyOpLimiter struct {
+	slots chan struct{}
+}
+
+func newHeavyOpLimiter(concurrency int) *heavyOpLimiter {
+	return &heavyOpLimiter{make(chan struct{}, concurrency)}
+}
+
+func (hl *heavyOpLimiter) tryAcquire() bool {
+	select {
+	case hl.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (hl *heavyOpLimiter) release() {
+	<-hl.slots
+}
+
+func (ah apiHandler) heavyOp(w http.ResponseWriter, op func() error) error {
+	if !ah.heavyOps.tryAcquire() {
+		w.Header().Set("Retry-After", strconv.Itoa(heavyOpRetryAfter))
+		return util.NewErrorFrom(ErrServerBusy)
+	}
+	defer ah.heavyOps.release()
+	return op()
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+func TestHeavyOpsAreShed(t *testing.T) {
+	ah := apiHandler{heavyOps: newHeavyOpLimiter(1)}
+	running := make(chan struct{})
+	done := make(chan struct{})
+	go ah.heavyOp(httptest.NewRecorder(), func() error {
+		close(running)
+		<-done
+		return nil
+	})
+	<-running
+	w := httptest.NewRecorder()
+	err := ah.heavyOp(w, func() error {
+		t.Fatalf("Heavy op should not have run")
+		return nil
+	})
+	if !util.CheckErr(err, ErrServerBusy) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrServerBusy, err)
+	}
+	httpErr(w, err)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d and got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Errorf("Missing Retry-After header")
+	}
+	close(done)
+	for !ah.heavyOps.tryAcquire() {
+	}
+	ah.heavyOps.release()
+	if err := ah.heavyOp(httptest.NewRecorder(), func() error { return nil }); err != nil {
+		t.Fatalf("Unexpected error once the slot was released: %s", err)
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/keydotcat/keycatd/models"
 	"github.com/keydotcat/keycatd/util"
 )
 
@@ -31,16 +30,11 @@ func httpErr(w http.ResponseWriter, err error) bool {
 	}
 	buf := util.BufPool.Get()
 	defer util.BufPool.Put(buf)
-	json.NewEncoder(buf).Encode(err)
+	resp, status := newErrorResponse(err)
+	json.NewEncoder(buf).Encode(resp)
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("Content-Length", strconv.Itoa(len(buf.String())))
-	if util.CheckErr(err, ErrNotFound) || util.CheckErr(err, models.ErrDoesntExist) {
-		w.WriteHeader(http.StatusNotFound)
-	} else if util.CheckErr(err, models.ErrUnauthorized) {
-		w.WriteHeader(http.StatusUnauthorized)
-	} else if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-	}
+	w.WriteHeader(status)
 	buf.WriteTo(w)
 	return true
 }
@@ -60,6 +54,10 @@ func jsonResponse(w http.ResponseWriter, obj interface{}) error {
 
 func jsonDecode(w http.ResponseWriter, r *http.Request, max int64, obj interface{}) error {
 	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, max)).Decode(obj); err != nil {
+		// Errors from our own decoders are meaningful for the client
+		if _, ok := err.(*util.Error); ok {
+			return err
+		}
 		log.Printf("[ERROR] Could not parse json: %s", err)
 		return util.NewErrorf("Could not parse request. Probably malformed")
 	}
@@ -131,6 +131,20 @@ func PatchRequest(path string, obj interface{}) (*http.Response, error) {
 	return httpDo(req)
 }
 
+func PutRequest(path string, obj interface{}) (*http.Response, error) {
+	body, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("PUT", srv.URL+path, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = http.Header{}
+	req.Header.Add("Content-Type", "application/json")
+	return httpDo(req)
+}
+
 func GetRequest(path string) (*http.Response, error) {
 	req, err := http.NewRequest("GET", srv.URL+path, nil)
 	if err != nil {
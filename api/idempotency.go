@@ -0,0 +1,168 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/keydotcat/keycatd/managers"
+	"github.com/keydotcat/keycatd/util"
+)
+
+// Header clients send to make a request that changes something safe to retry
+const idempotencyKeyHeader = "Idempotency-Key"
+
+const (
+	idempotencyKeyMaxLen = 255
+	// Bodies of requests with an idempotency key are read whole so retries can be compared with the original
+	idempotencyMaxBody = 32 << 20
+)
+
+// idempotencyKeys runs each request sent with an idempotency key only once per user. Responses are kept in the
+// session store when it supports it so retries that reach another instance are replayed too
+type idempotencyKeys struct {
+	store managers.IdempotencyStore
+	ttl   time.Duration
+}
+
+// Responses of these routes carry recovery codes, share link tokens or new keys and are never stored. Requests to
+// them run every time even if they have an idempotency key. A * matches any path segment and longer paths match too
+var idempotencyUnstoredRoutes = [][]string{
+	{"user", "totp"},
+	{"user", "webauthn"},
+	{"user", "keys"},
+	{"team", "*", "user", "*", "rekey"},
+	{"team", "*", "vault", "*", "rotate"},
+	{"team", "*", "vault", "*", "secret", "*", "share"},
+}
+
+// Headers that are never stored. Replaying them would hand out a csrf token that has been rotated since
+var idempotencyUnstoredHeaders = []string{"Set-Cookie", "X-Csrf-Token"}
+
+func isUnstoredRoute(route string) bool {
+	parts := strings.Split(strings.Trim(route, "/"), "/")
+	for _, pattern := range idempotencyUnstoredRoutes {
+		if len(parts) < len(pattern) {
+			continue
+		}
+		match := true
+		for i, p := range pattern {
+			if p != "*" && p != parts[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+func newIdempotencyKeys(sm managers.SessionMgr, ttl time.Duration) *idempotencyKeys {
+	store, ok := sm.(managers.IdempotencyStore)
+	if !ok {
+		store = managers.NewIdempotencyStoreMemory(memorySessionSweepInterval)
+	}
+	return &idempotencyKeys{store, ttl}
+}
+
+// responseRecorder passes the response through and keeps a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if rr.status == 0 {
+		rr.status = status
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	rr.body.Write(b)
+	return rr.ResponseWriter.Write(b)
+}
+
+// serve runs the handler unless the user already sent a request with the same key, in which case the stored response
+// is sent again. Reusing a key for a different request fails with ErrIdempotencyKeyConflict. Server errors are not
+// stored so the request can be retried. Requests without the header, that don't change anything or whose responses
+// are never stored are always run. route is the full path of the request
+func (ik *idempotencyKeys) serve(w http.ResponseWriter, r *http.Request, userId, route string, handler func(http.ResponseWriter, *http.Request) error) error {
+	key := r.Header.Get(idempotencyKeyHeader)
+	if len(key) == 0 || r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" || isUnstoredRoute(route) {
+		return handler(w, r)
+	}
+	if len(key) > idempotencyKeyMaxLen {
+		return util.NewErrorf("%s cannot be longer than %d characters", idempotencyKeyHeader, idempotencyKeyMaxLen)
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, idempotencyMaxBody))
+	if err != nil {
+		return util.NewErrorf("Could not read request: %s", err)
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s?%s\n", r.Method, route, r.URL.RawQuery)
+	h.Write(body)
+	rec := &managers.IdempotencyRecord{RequestHash: hex.EncodeToString(h.Sum(nil))}
+	storeKey := "idem:" + userId + ":" + key
+	stored, err := ik.store.ClaimIdempotencyKey(storeKey, rec, ik.ttl)
+	if err != nil {
+		return err
+	}
+	if stored != nil {
+		switch {
+		case stored.RequestHash != rec.RequestHash:
+			return util.NewErrorFrom(ErrIdempotencyKeyConflict)
+		case stored.Status == 0:
+			return util.NewErrorFrom(ErrIdempotentRequestRunning)
+		}
+		for k, v := range stored.Header {
+			w.Header()[k] = v
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(stored.Status)
+		w.Write(stored.Body)
+		return nil
+	}
+	saved := false
+	// Release the key if the handler panics or fails so the request can be sent again
+	defer func() {
+		if !saved {
+			if err := ik.store.ReleaseIdempotencyKey(storeKey); err != nil {
+				log.Printf("Could not release idempotency key: %s", err)
+			}
+		}
+	}()
+	rr := &responseRecorder{ResponseWriter: w}
+	httpErr(rr, handler(rr, r))
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	if rr.status >= 500 {
+		return nil
+	}
+	rec.Status = rr.status
+	rec.Header = rr.Header().Clone()
+	for _, h := range idempotencyUnstoredHeaders {
+		rec.Header.Del(h)
+	}
+	rec.Body = rr.body.Bytes()
+	if err := ik.store.SaveIdempotencyKey(storeKey, rec, ik.ttl); err != nil {
+		log.Printf("Could not store the response for an idempotency key: %s", err)
+		return nil
+	}
+	saved = true
+	return nil
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/keydotcat/keycatd/managers"
+)
+
+func TestIdempotencyKeyReplay(t *testing.T) {
+	ik := newIdempotencyKeys(managers.NewSessionMgrMemory(time.Hour), time.Hour)
+	runs := 0
+	createTeam := func(w http.ResponseWriter, r *http.Request) error {
+		runs++
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"id":"team%d","name":%q}`, runs, body)
+		return nil
+	}
+	send := func(user, key, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/team", bytes.NewBufferString(body))
+		r.Header.Set(idempotencyKeyHeader, key)
+		httpErr(w, ik.serve(w, r, user, "/team", createTeam))
+		return w
+	}
+	first := send("alice", "k1", "acme")
+	retry := send("alice", "k1", "acme")
+	if runs != 1 {
+		t.Fatalf("Expected the request to run once and it ran %d times", runs)
+	}
+	if retry.Code != first.Code || retry.Body.String() != first.Body.String() || retry.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("Replayed response differs: %d %s vs %d %s", retry.Code, retry.Body, first.Code, first.Body)
+	}
+	if retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("Expected the replay to be flagged")
+	}
+	// Keys belong to each user
+	send("bob", "k1", "acme")
+	if runs != 2 {
+		t.Fatalf("Expected keys of other users not to be replayed")
+	}
+}
+
+func TestIdempotencyKeyConflict(t *testing.T) {
+	ik := newIdempotencyKeys(managers.NewSessionMgrMemory(time.Hour), time.Hour)
+	runs := 0
+	handler := func(w http.ResponseWriter, r *http.Request) error {
+		runs++
+		if runs == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return nil
+		}
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	send := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/team/t1/invite", bytes.NewBufferString(body))
+		r.Header.Set(idempotencyKeyHeader, "k1")
+		httpErr(w, ik.serve(w, r, "alice", "/team/t1/invite", handler))
+		return w
+	}
+	// Server errors are not kept so the retry runs again
+	if w := send(`{"email":"a@b.cat"}`); w.Code != http.StatusInternalServerError {
+		t.Fatalf("Unexpected status %d", w.Code)
+	}
+	if w := send(`{"email":"a@b.cat"}`); w.Code != http.StatusOK || runs != 2 {
+		t.Fatalf("Expected the retry to run again: %d after %d runs", w.Code, runs)
+	}
+	w := send(`{"email":"c@d.cat"}`)
+	if code, status := getErrorCode(ErrIdempotencyKeyConflict); w.Code != status || !bytes.Contains(w.Body.Bytes(), []byte(code)) {
+		t.Fatalf("Expected %s for a different body and got %d: %s", code, w.Code, w.Body)
+	}
+	if runs != 2 {
+		t.Fatalf("Conflicting request was run")
+	}
+}
+
+func TestIdempotencyKeyUnstored(t *testing.T) {
+	ik := newIdempotencyKeys(managers.NewSessionMgrMemory(time.Hour), time.Hour)
+	runs := 0
+	handler := func(w http.ResponseWriter, r *http.Request) error {
+		runs++
+		w.Header().Set("X-Csrf-Token", fmt.Sprintf("token%d", runs))
+		http.SetCookie(w, &http.Cookie{Name: CSRF_COOKIE_NAME, Value: "cookie"})
+		fmt.Fprintf(w, `{"codes":["code%d"]}`, runs)
+		return nil
+	}
+	send := func(route, query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", route+query, bytes.NewBufferString("{}"))
+		r.Header.Set(idempotencyKeyHeader, "k1")
+		httpErr(w, ik.serve(w, r, "alice", route, handler))
+		return w
+	}
+	send("/user/totp", "")
+	send("/user/totp", "")
+	if runs != 2 {
+		t.Fatalf("Expected requests to unstored routes to always run and they ran %d times", runs)
+	}
+	send("/team/t1/vault/v1/secret/s1/share", "")
+	if runs != 3 {
+		t.Fatalf("Expected share link creation not to be stored")
+	}
+	send("/user/password", "?a=1")
+	w := send("/user/password", "?a=1")
+	if runs != 4 || w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("Expected the retry to be replayed after %d runs", runs)
+	}
+	if len(w.Header().Get("X-Csrf-Token")) > 0 || len(w.Header()["Set-Cookie"]) > 0 {
+		t.Fatalf("Csrf headers were replayed: %v", w.Header())
+	}
+	w = send("/user/password", "?a=2")
+	if code, _ := getErrorCode(ErrIdempotencyKeyConflict); runs != 4 || !bytes.Contains(w.Body.Bytes(), []byte(code)) {
+		t.Fatalf("Expected a different query to conflict and got %d: %s", w.Code, w.Body)
+	}
+}
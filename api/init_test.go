@@ -32,11 +32,12 @@ func initSRV() {
 		panic(err)
 	}
 	c := Conf{
-		Port:     1, //Not used
-		Url:      "http://" + ln.Addr().String(),
-		DB:       thelpers.GetDBConnString(),
-		DBType:   thelpers.GetTestDBType(),
-		MailFrom: "blackhole@key.cat",
+		Port:           1, //Not used
+		Url:            "http://" + ln.Addr().String(),
+		DB:             thelpers.GetDBConnString(),
+		DBType:         thelpers.GetTestDBType(),
+		MailFrom:       "blackhole@key.cat",
+		MetricsEnabled: true,
 		SessionRedis: &ConfSessionRedis{
 			Server: "localhost:6379",
 			DBId:   10,
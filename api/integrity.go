@@ -0,0 +1,76 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/keydotcat/keycatd/managers"
+	"github.com/keydotcat/keycatd/models"
+	"github.com/keydotcat/keycatd/util"
+)
+
+// VerifyKeyIntegrity checks the key wrapping of the given team, or of all teams if tid is empty. It only reads from the db
+func VerifyKeyIntegrity(c Conf, tid string) (map[string][]models.KeyIntegrityIssue, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("postgres", c.DB)
+	if err != nil {
+		return nil, util.NewErrorf("Could not connect to db '%s': %s", c.DB, err)
+	}
+	defer db.Close()
+	ctx := models.AddDBToContext(context.Background(), db)
+	var teams []*models.Team
+	if len(tid) > 0 {
+		t, err := models.FindTeam(ctx, tid)
+		if err != nil {
+			return nil, err
+		}
+		teams = []*models.Team{t}
+	} else {
+		teams, err = models.FindAllTeams(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	report := map[string][]models.KeyIntegrityIssue{}
+	for _, t := range teams {
+		issues, err := t.VerifyKeyIntegrity(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(issues) > 0 {
+			report[t.Id] = issues
+		}
+	}
+	return report, nil
+}
+
+// RepairSessionStore cleans up the configured session store
+func RepairSessionStore(c Conf) (managers.SessionRepairReport, error) {
+	if err := c.validate(); err != nil {
+		return managers.SessionRepairReport{}, err
+	}
+	c.setDefaults()
+	if c.SessionStore == sessionStoreMemory {
+		return managers.SessionRepairReport{}, util.NewErrorf("Memory sessions only live in the running server and cannot be repaired")
+	}
+	db, err := sql.Open("postgres", c.DB)
+	if err != nil {
+		return managers.SessionRepairReport{}, util.NewErrorf("Could not connect to db '%s': %s", c.DB, err)
+	}
+	defer db.Close()
+	c.RedisRequiredAtStartup = true
+	sm, err := newSessionMgr(c, db)
+	if err != nil {
+		return managers.SessionRepairReport{}, err
+	}
+	ctx := models.AddDBToContext(context.Background(), db)
+	return managers.RepairSessionStore(sm, func(uid string) (bool, error) {
+		_, err := models.FindUser(ctx, uid)
+		if util.CheckErr(err, models.ErrDoesntExist) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+}
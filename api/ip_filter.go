@@ -0,0 +1,73 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ipFilter rejects requests from addresses in the deny list or, if the allow list is not empty, from addresses not
+// in it. The deny list wins if an address is in both
+type ipFilter struct {
+	resolver *clientIPResolver
+	allow    []*net.IPNet
+	deny     []*net.IPNet
+}
+
+func newIPFilter(resolver *clientIPResolver, allow, deny []string) (*ipFilter, error) {
+	f := &ipFilter{resolver: resolver}
+	var err error
+	if f.allow, err = parseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// parseCIDRs accepts CIDRs and single addresses, which are taken as a /32 or /128
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if ip := net.ParseIP(c); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func inNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns false if the request comes from an address that is not allowed
+func (f *ipFilter) check(r *http.Request) bool {
+	if len(f.allow) == 0 && len(f.deny) == 0 {
+		return true
+	}
+	ip := f.resolver.resolve(r)
+	if ip == nil {
+		return false
+	}
+	if inNets(ip, f.deny) {
+		return false
+	}
+	return len(f.allow) == 0 || inNets(ip, f.allow)
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIPFilter(t *testing.T) {
+	f, err := newIPFilter(&clientIPResolver{}, []string{"10.0.0.0/8", "192.168.1.7"}, []string{"10.0.13.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		remote  string
+		allowed bool
+	}{
+		{"10.1.2.3:4000", true},
+		{"192.168.1.7:4000", true},
+		{"192.168.1.8:4000", false},
+		{"10.0.13.5:4000", false},
+		{"8.8.8.8:4000", false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/api/team", nil)
+		r.RemoteAddr = c.remote
+		if f.check(r) != c.allowed {
+			t.Errorf("Expected %s to be allowed=%t", c.remote, c.allowed)
+		}
+	}
+	open, err := newIPFilter(&clientIPResolver{}, nil, []string{"10.0.13.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/api/team", nil)
+	r.RemoteAddr = "8.8.8.8:4000"
+	if !open.check(r) {
+		t.Errorf("An empty allow list should allow everything not denied")
+	}
+}
+
+func TestIPFilterForwardedFor(t *testing.T) {
+	for _, proxyMode := range []bool{false, true} {
+		f, err := newIPFilter(&clientIPResolver{proxyMode: proxyMode}, []string{"10.0.0.0/8"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("GET", "/api/team", nil)
+		r.RemoteAddr = "8.8.8.8:4000"
+		r.Header.Set("X-Forwarded-For", "10.1.2.3")
+		if f.check(r) != proxyMode {
+			t.Errorf("X-Forwarded-For should only be used in proxy mode (proxy mode %t)", proxyMode)
+		}
+		r = httptest.NewRequest("GET", "/api/team", nil)
+		r.RemoteAddr = "10.1.2.3:4000"
+		r.Header.Set("X-Forwarded-For", "8.8.8.8")
+		if f.check(r) == proxyMode {
+			t.Errorf("The proxy address should only be used without proxy mode (proxy mode %t)", proxyMode)
+		}
+		r = httptest.NewRequest("GET", "/api/team", nil)
+		r.RemoteAddr = "8.8.4.4:4000"
+		r.Header.Set("X-Forwarded-For", "10.9.9.9, 8.8.8.8")
+		if f.check(r) {
+			t.Errorf("Hops sent by the client should be ignored (proxy mode %t)", proxyMode)
+		}
+	}
+}
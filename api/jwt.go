@@ -0,0 +1,118 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/keydotcat/keycatd/models"
+	"github.com/keydotcat/keycatd/util"
+	"golang.org/x/crypto/ed25519"
+)
+
+var b64 = base64.RawURLEncoding
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	Session   string `json:"sid"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+// jwtSigner issues tokens signed with the newest signing key. Keys are rotated every rotation period and are kept
+// around for an extra ttl so that tokens signed with a previous key still validate during the overlap
+type jwtSigner struct {
+	issuer   string
+	ttl      time.Duration
+	rotation time.Duration
+}
+
+func newJWTSigner(issuer string, ttl, rotation time.Duration) *jwtSigner {
+	return &jwtSigner{issuer, ttl, rotation}
+}
+
+func (js *jwtSigner) validKeys(ctx context.Context) ([]*models.SigningKey, error) {
+	return models.GetSigningKeysSince(ctx, time.Now().UTC().Add(-js.rotation-js.ttl))
+}
+
+func (js *jwtSigner) currentKey(ctx context.Context) (*models.SigningKey, error) {
+	keys, err := js.validKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	if len(keys) > 0 && now.Sub(keys[0].CreatedAt) < js.rotation {
+		return keys[0], nil
+	}
+	if err := models.DeleteSigningKeysBefore(ctx, now.Add(-js.rotation-js.ttl)); err != nil {
+		return nil, err
+	}
+	return models.CreateSigningKey(ctx)
+}
+
+func (js *jwtSigner) sign(ctx context.Context, user, session string) (string, error) {
+	sk, err := js.currentKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	hdr, err := json.Marshal(jwtHeader{"EdDSA", "JWT", sk.Id})
+	if err != nil {
+		return "", util.NewErrorFrom(err)
+	}
+	claims, err := json.Marshal(jwtClaims{js.issuer, user, session, now.Unix(), now.Add(js.ttl).Unix()})
+	if err != nil {
+		return "", util.NewErrorFrom(err)
+	}
+	payload := b64.EncodeToString(hdr) + "." + b64.EncodeToString(claims)
+	sig := ed25519.Sign(ed25519.PrivateKey(sk.PrivateKey), []byte(payload))
+	return payload + "." + b64.EncodeToString(sig), nil
+}
+
+func (js *jwtSigner) keySet(ctx context.Context) (jwks, error) {
+	keys, err := js.validKeys(ctx)
+	if err != nil {
+		return jwks{}, err
+	}
+	set := jwks{Keys: make([]jwk, len(keys))}
+	for i, k := range keys {
+		set.Keys[i] = jwk{"OKP", "Ed25519", b64.EncodeToString(k.PublicKey()), k.Id, "EdDSA", "sig"}
+	}
+	return set, nil
+}
+
+// GET /.well-known/jwks.json
+func (ah apiHandler) jwksRoot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		httpErr(w, util.NewErrorFrom(ErrNotFound))
+		return
+	}
+	set, err := ah.jwt.keySet(r.Context())
+	if err != nil {
+		httpErr(w, err)
+		return
+	}
+	jsonResponse(w, set)
+}
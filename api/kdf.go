@@ -0,0 +1,39 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/keydotcat/keycatd/models"
+	"github.com/keydotcat/keycatd/util"
+)
+
+const (
+	kdfRateLimit  = 30
+	kdfRateWindow = time.Minute
+)
+
+// GET /user/kdf?email=
+func (ah apiHandler) userKdf(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return util.NewErrorFrom(ErrNotFound)
+	}
+	if !ah.kdfLimiter.allow(ah.clientIP(r)) {
+		return util.NewErrorFrom(ErrTooManyRequests)
+	}
+	email := strings.TrimSpace(r.URL.Query().Get("email"))
+	if len(email) == 0 {
+		return util.NewErrorf("Missing email")
+	}
+	u, err := models.FindUserByEmail(r.Context(), email)
+	switch {
+	case util.CheckErr(err, models.ErrDoesntExist):
+		return jsonResponse(w, util.FakeKDFParams(email))
+	case err != nil:
+		return err
+	case u.Kdf.IsEmpty():
+		return jsonResponse(w, util.FakeKDFParams(email))
+	}
+	return jsonResponse(w, u.Kdf)
+}
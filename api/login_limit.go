@@ -0,0 +1,72 @@
+package api
+
+import (
+	"strings"
+	"time"
+
+	"github.com/keydotcat/keycatd/managers"
+	"github.com/keydotcat/keycatd/util"
+)
+
+// Extra wait before answering a blocked login attempt to slow down brute forcing
+const loginBlockedDelay = time.Second
+
+// loginLimiter blocks logins for an account or from an ip after too many failures in a window. Counts are kept in
+// the session store when it supports it so the limit is shared by every instance
+type loginLimiter struct {
+	counter     managers.AttemptCounter
+	maxAttempts int
+	window      time.Duration
+	delay       time.Duration
+}
+
+func newLoginLimiter(sm managers.SessionMgr, maxAttempts int, window time.Duration) *loginLimiter {
+	counter, ok := sm.(managers.AttemptCounter)
+	if !ok {
+		counter = managers.NewAttemptCounterMemory()
+	}
+	return &loginLimiter{counter, maxAttempts, window, loginBlockedDelay}
+}
+
+func (ll *loginLimiter) keys(id, ip string) []string {
+	return []string{"login:u:" + strings.ToLower(id), "login:ip:" + ip}
+}
+
+// check fails with ErrTooManyAttempts if the account or the ip are over the limit
+func (ll *loginLimiter) check(id, ip string) error {
+	if ll.maxAttempts < 1 {
+		return nil
+	}
+	for _, k := range ll.keys(id, ip) {
+		attempts, err := ll.counter.Attempts(k)
+		if err != nil {
+			return err
+		}
+		if attempts >= ll.maxAttempts {
+			time.Sleep(ll.delay)
+			return util.NewErrorFrom(ErrTooManyAttempts)
+		}
+	}
+	return nil
+}
+
+func (ll *loginLimiter) failed(id, ip string) error {
+	if ll.maxAttempts < 1 {
+		return nil
+	}
+	for _, k := range ll.keys(id, ip) {
+		if _, err := ll.counter.AddAttempt(k, ll.window); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// succeeded clears the failures of the account. Failures from the ip are kept so a valid login does not unlock
+// guessing other accounts
+func (ll *loginLimiter) succeeded(id string) error {
+	if ll.maxAttempts < 1 {
+		return nil
+	}
+	return ll.counter.ResetAttempts(ll.keys(id, "")[0])
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keydotcat/keycatd/managers"
+	"github.com/keydotcat/keycatd/util"
+)
+
+func TestLoginLimiter(t *testing.T) {
+	sm := managers.NewSessionMgrMemory(time.Hour)
+	ll := newLoginLimiter(sm, 3, time.Minute)
+	ll.delay = 0
+	for i := 0; i < 3; i++ {
+		if err := ll.check("user", "1.1.1.1"); err != nil {
+			t.Fatalf("Attempt %d should be allowed: %s", i, err)
+		}
+		if err := ll.failed("user", "1.1.1.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ll.check("USER", "2.2.2.2"); !util.CheckErr(err, ErrTooManyAttempts) {
+		t.Fatalf("Account should be blocked from any ip: %v", err)
+	}
+	if err := ll.check("other", "1.1.1.1"); !util.CheckErr(err, ErrTooManyAttempts) {
+		t.Fatalf("Ip should be blocked for any account: %v", err)
+	}
+	if err := ll.check("other", "2.2.2.2"); err != nil {
+		t.Fatalf("Other accounts and ips should not be blocked: %s", err)
+	}
+	if err := ll.succeeded("user"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ll.check("user", "2.2.2.2"); err != nil {
+		t.Fatalf("A successful login should reset the account: %s", err)
+	}
+	if err := ll.check("user", "1.1.1.1"); !util.CheckErr(err, ErrTooManyAttempts) {
+		t.Fatalf("A successful login should not reset the ip: %v", err)
+	}
+}
+
+func TestLoginLimiterWindow(t *testing.T) {
+	ll := newLoginLimiter(managers.NewSessionMgrDB(nil), 1, 10*time.Millisecond)
+	ll.delay = 0
+	if err := ll.failed("user", "1.1.1.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ll.check("user", "2.2.2.2"); !util.CheckErr(err, ErrTooManyAttempts) {
+		t.Fatalf("Expected the account to be blocked: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := ll.check("user", "1.1.1.1"); err != nil {
+		t.Fatalf("Failures should expire with the window: %s", err)
+	}
+	if err := newLoginLimiter(nil, 0, time.Minute).failed("user", "1.1.1.1"); err != nil {
+		t.Fatalf("A disabled limiter should not count: %s", err)
+	}
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/keydotcat/keycatd/managers"
+)
+
+const mailQueueAlertInterval = time.Minute
+
+// mailQueueAlert fires once when the mail queue backs up and once more when it recovers so a provider outage does
+// not flood the log and the webhooks
+type mailQueueAlert struct {
+	threshold int
+	age       time.Duration
+	firing    bool
+}
+
+// update returns the event to send if the state of the alert changed with the current backlog
+func (mqa *mailQueueAlert) update(pending int, oldest time.Duration) string {
+	backlog := (mqa.threshold > 0 && pending >= mqa.threshold) || (mqa.age > 0 && oldest >= mqa.age)
+	if backlog == mqa.firing {
+		return ""
+	}
+	mqa.firing = backlog
+	if backlog {
+		return managers.WEBHOOK_EVENT_MAIL_QUEUE_BACKLOG
+	}
+	return managers.WEBHOOK_EVENT_MAIL_QUEUE_RECOVERED
+}
+
+func (ah apiHandler) mailQueueAlertLoop(mqa *mailQueueAlert) {
+	ticker := time.NewTicker(mailQueueAlertInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ah.closing:
+			return
+		case <-ticker.C:
+		}
+		pending, oldest := ah.mail.pending()
+		event := mqa.update(pending, oldest)
+		if len(event) == 0 {
+			continue
+		}
+		target := fmt.Sprintf("%d mails pending, oldest waiting %s", pending, oldest.Round(time.Second))
+		log.Printf("Mail queue alert %s: %s", event, target)
+		ah.webhooks.Send(managers.WebhookEvent{Event: event, Target: target, CreatedAt: time.Now().UTC()})
+	}
+}
@@ -0,0 +1,35 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keydotcat/keycatd/managers"
+)
+
+func TestMailQueueAlert(t *testing.T) {
+	mqa := &mailQueueAlert{threshold: 10, age: time.Minute}
+	steps := []struct {
+		pending int
+		oldest  time.Duration
+		event   string
+	}{
+		{0, 0, ""},
+		{9, 59 * time.Second, ""},
+		{10, time.Second, managers.WEBHOOK_EVENT_MAIL_QUEUE_BACKLOG},
+		// Still backed up. It does not fire again
+		{1, time.Minute, ""},
+		{1, time.Second, managers.WEBHOOK_EVENT_MAIL_QUEUE_RECOVERED},
+		{0, 0, ""},
+	}
+	for i, s := range steps {
+		if event := mqa.update(s.pending, s.oldest); event != s.event {
+			t.Fatalf("Step %d: expected event %q and got %q", i, s.event, event)
+		}
+	}
+	// Disabled checks never fire
+	mqa = &mailQueueAlert{age: time.Minute}
+	if event := mqa.update(1000, 0); event != "" {
+		t.Fatalf("Expected no alert without a threshold and got %q", event)
+	}
+}
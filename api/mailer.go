@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/keydotcat/keycatd/managers"
 	"github.com/keydotcat/keycatd/models"
@@ -13,13 +14,18 @@ import (
 	"github.com/keydotcat/keycatd/util"
 )
 
+// Mails waiting to be sent before requests that send mails start blocking
+const mailQueueSize = 1000
+
 type mailer struct {
-	templatesDir string
-	rootUrl      string
-	lock         *sync.Mutex
-	TestMode     bool
-	t            *template.Template
-	mailMgr      managers.MailMgr
+	templatesDir  string
+	rootUrl       string
+	lock          *sync.Mutex
+	TestMode      bool
+	t             *template.Template
+	mailMgr       managers.MailMgr
+	defaultLocale string
+	location      *time.Location
 }
 
 func newMailer(rootUrl string, testMode bool, mm managers.MailMgr) (*mailer, error) {
@@ -28,6 +34,8 @@ func newMailer(rootUrl string, testMode bool, mm managers.MailMgr) (*mailer, err
 	m.rootUrl = rootUrl
 	m.lock = &sync.Mutex{}
 	m.mailMgr = mm
+	m.defaultLocale = "en"
+	m.location = time.UTC
 	if err := m.compile(); err != nil {
 		return nil, err
 	}
@@ -37,7 +45,7 @@ func newMailer(rootUrl string, testMode bool, mm managers.MailMgr) (*mailer, err
 func (mm *mailer) compile() error {
 	mm.lock.Lock()
 	defer mm.lock.Unlock()
-	mm.t = template.New("mail_base")
+	mm.t = template.New("mail_base").Funcs(template.FuncMap{"localTime": mm.localTime})
 	return static.Walk(mm.templatesDir, func(path string, info os.FileInfo, err error) error {
 		ext := filepath.Ext(path)
 		if ext == ".tmpl" {
@@ -54,13 +62,34 @@ func (mm *mailer) compile() error {
 	})
 }
 
+// setDefaults sets the locale and timezone used when the user has no preference
+func (mm *mailer) setDefaults(locale, timezone string) error {
+	if mm.t.Lookup(locale+"/confirm_account") == nil {
+		return util.NewErrorf("No mail templates found for locale %s", locale)
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return util.NewErrorf("Invalid timezone %s: %s", timezone, err)
+	}
+	mm.defaultLocale = locale
+	mm.location = loc
+	return nil
+}
+
+func (mm *mailer) localTime(t time.Time) string {
+	return t.In(mm.location).Format("2006-01-02 15:04 MST")
+}
+
 type mailUserTeamTokenData struct {
 	FullName string
 	HostUrl  string
 	Team     string
+	Vault    string
+	Secret   string
 	Token    string
 	Email    string
 	Username string
+	Date     time.Time
 }
 
 func (mm *mailer) send(muttd mailUserTeamTokenData, locale, templateName, subject string) error {
@@ -69,7 +98,13 @@ func (mm *mailer) send(muttd mailUserTeamTokenData, locale, templateName, subjec
 	}
 	buf := util.BufPool.Get()
 	defer util.BufPool.Put(buf)
+	if len(locale) == 0 {
+		locale = mm.defaultLocale
+	}
 	tpl := mm.t.Lookup(fmt.Sprintf("%s/%s", locale, templateName))
+	if tpl == nil {
+		tpl = mm.t.Lookup(fmt.Sprintf("%s/%s", mm.defaultLocale, templateName))
+	}
 	if tpl == nil {
 		tpl = mm.t.Lookup("en/" + templateName)
 	}
@@ -83,6 +118,22 @@ func (mm *mailer) send(muttd mailUserTeamTokenData, locale, templateName, subjec
 	return mm.mailMgr.SendMail(muttd.Email, subject, buf.String())
 }
 
+// drain waits for the queued mails to be sent if the mail manager sends them in the background
+func (mm *mailer) drain(timeout time.Duration) error {
+	if d, ok := mm.mailMgr.(managers.MailMgrDrainer); ok {
+		return d.Drain(timeout)
+	}
+	return nil
+}
+
+// pending returns how many mails are waiting to be sent and for how long the oldest one has been waiting
+func (mm *mailer) pending() (int, time.Duration) {
+	if p, ok := mm.mailMgr.(managers.MailMgrPending); ok {
+		return p.Pending(), p.OldestPending()
+	}
+	return 0, 0
+}
+
 func (mm *mailer) sendConfirmationMail(u *models.User, token *models.Token, locale string) error {
 	email := u.Email
 	if u.UnconfirmedEmail != "" {
@@ -92,11 +143,56 @@ func (mm *mailer) sendConfirmationMail(u *models.User, token *models.Token, loca
 	return mm.send(muttd, locale, "confirm_account", "Confirm your email")
 }
 
+// sendEmailVerificationMail sends the token to verify an additional email to the address being added
+func (mm *mailer) sendEmailVerificationMail(u *models.User, token *models.Token, locale string) error {
+	muttd := mailUserTeamTokenData{FullName: u.FullName, HostUrl: mm.rootUrl, Token: token.Id, Username: u.Id, Email: token.Extra}
+	return mm.send(muttd, locale, "verify_email", "Verify your new key.cat email")
+}
+
 func (mm *mailer) sendInvitationMail(t *models.Team, u *models.User, i *models.Invite, locale string) error {
-	muttd := mailUserTeamTokenData{FullName: u.FullName, HostUrl: mm.rootUrl, Email: i.Email, Team: t.Name}
+	muttd := mailUserTeamTokenData{FullName: u.FullName, HostUrl: mm.rootUrl, Email: i.Email, Team: t.Name, Token: i.Token}
 	return mm.send(muttd, locale, "invite_user", fmt.Sprintf("%s has invited you to join key.cat", u.FullName))
 }
 
+func (mm *mailer) sendPasswordResetMail(u *models.User, token, locale string) error {
+	muttd := mailUserTeamTokenData{FullName: u.FullName, HostUrl: mm.rootUrl, Token: token, Username: u.Id, Email: u.Email}
+	return mm.send(muttd, locale, "forgotten_password", "Reset your key.cat password")
+}
+
+func (mm *mailer) sendSSOPasswordNoticeMail(u *models.User, locale string) error {
+	muttd := mailUserTeamTokenData{FullName: u.FullName, HostUrl: mm.rootUrl, Username: u.Id, Email: u.Email}
+	return mm.send(muttd, locale, "sso_password_notice", "Your key.cat password is managed by your identity provider")
+}
+
+func (mm *mailer) sendUnverifiedReminderMail(u *models.User, token *models.Token, purgeAt time.Time, locale string) error {
+	email := u.Email
+	if u.UnconfirmedEmail != "" {
+		email = u.UnconfirmedEmail
+	}
+	muttd := mailUserTeamTokenData{FullName: u.FullName, HostUrl: mm.rootUrl, Token: token.Id, Username: u.Id, Email: email, Date: purgeAt}
+	return mm.send(muttd, locale, "unverified_account_reminder", "Confirm your key.cat account before it is removed")
+}
+
+func (mm *mailer) sendAccountApprovedMail(u *models.User, locale string) error {
+	muttd := mailUserTeamTokenData{FullName: u.FullName, HostUrl: mm.rootUrl, Username: u.Id, Email: u.Email}
+	return mm.send(muttd, locale, "account_approved", "Your key.cat account has been approved")
+}
+
+func (mm *mailer) sendAdminDemotedMail(u *models.User, t *models.Team, locale string) error {
+	muttd := mailUserTeamTokenData{FullName: u.FullName, HostUrl: mm.rootUrl, Team: t.Name, Username: u.Id, Email: u.Email}
+	return mm.send(muttd, locale, "admin_demoted", fmt.Sprintf("You are no longer an admin of %s", t.Name))
+}
+
+func (mm *mailer) sendAdminDemotedNoticeMail(admin, demoted *models.User, t *models.Team, locale string) error {
+	muttd := mailUserTeamTokenData{FullName: admin.FullName, HostUrl: mm.rootUrl, Team: t.Name, Username: demoted.Id, Email: admin.Email}
+	return mm.send(muttd, locale, "admin_demoted_notice", fmt.Sprintf("%s is no longer an admin of %s", demoted.Id, t.Name))
+}
+
+func (mm *mailer) sendSecretRotationReminderMail(u *models.User, t *models.Team, s *models.Secret, locale string) error {
+	muttd := mailUserTeamTokenData{FullName: u.FullName, HostUrl: mm.rootUrl, Team: t.Name, Vault: s.Vault, Secret: s.Id, Username: u.Id, Email: u.Email, Date: s.RotatedAt}
+	return mm.send(muttd, locale, "secret_rotation_reminder", fmt.Sprintf("A secret in %s is due for rotation", t.Name))
+}
+
 func (mm *mailer) sendTestEmail(to string) error {
 	muttd := mailUserTeamTokenData{Email: to}
 	return mm.send(muttd, "en", "test_email", "KeyCat test email")
@@ -107,15 +203,11 @@ func SendTestEmail(c Conf, to string) error {
 	if err != nil {
 		return err
 	}
-	var m *mailer
-	switch {
-	case c.MailSMTP != nil:
-		m, err = newMailer(c.Url, TEST_MODE, managers.NewMailMgrSMTP(c.MailSMTP.Server, c.MailSMTP.User, c.MailSMTP.Password, c.MailFrom))
-	case c.MailSparkpost != nil:
-		m, err = newMailer(c.Url, TEST_MODE, managers.NewMailMgrSparkpost(c.MailSparkpost.Key, c.MailFrom, c.MailSparkpost.EU))
-	default:
+	mm, _ := newMailMgr(c)
+	if mm == nil {
 		return util.NewErrorf("No mail was configured")
 	}
+	m, err := newMailer(c.Url, TEST_MODE, mm)
 	if err != nil {
 		return util.NewErrorf("Could not create mailer: %s", err)
 	}
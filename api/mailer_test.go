@@ -0,0 +1,29 @@
+package api
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keydotcat/keycatd/managers"
+)
+
+func TestMailerDefaults(t *testing.T) {
+	m, err := newMailer("http://localhost", true, managers.NewMailMgrNULL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.setDefaults("xx", "UTC"); err == nil {
+		t.Errorf("Expected an error for a locale without templates")
+	}
+	if err := m.setDefaults("en", "Nowhere/Atlantis"); err == nil {
+		t.Errorf("Expected an error for an unknown timezone")
+	}
+	if err := m.setDefaults("en", "Asia/Tokyo"); err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2018, 1, 1, 20, 0, 0, 0, time.UTC)
+	if got := m.localTime(ts); !strings.HasPrefix(got, "2018-01-02 05:00") {
+		t.Errorf("Expected the time in the default timezone and got %s", got)
+	}
+}
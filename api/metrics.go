@@ -0,0 +1,60 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/keydotcat/keycatd/managers"
+)
+
+type metricCounter struct {
+	name string
+	help string
+}
+
+var metricCounters = []metricCounter{
+	{managers.METRIC_LOGINS_SUCCEEDED, "Successful logins"},
+	{managers.METRIC_LOGINS_FAILED, "Logins rejected for a wrong password or second factor"},
+	{managers.METRIC_INVITES_SENT, "Invitation mails sent"},
+	{managers.METRIC_MAILS_FAILED, "Mail send attempts that failed"},
+	{managers.METRIC_MAILS_DEAD_LETTERED, "Mails dropped after the last send attempt failed"},
+}
+
+// /metrics
+// Counters and resource usage in the prometheus text format. It's served on its own port if Conf.MetricsPort is set
+// and with the api only if Conf.MetricsEnabled is on
+func (ah apiHandler) metricsRoot(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	write := func(name, kind, help string, value interface{}) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+	}
+	for _, mc := range metricCounters {
+		write(mc.name, "counter", mc.help, ah.metrics.Count(mc.name))
+	}
+	if c, ok := ah.sm.(managers.SessionMgrCounter); ok {
+		if n, err := c.CountSessions(); err != nil {
+			log.Printf("Could not count the sessions for the metrics: %s", err)
+		} else {
+			write("keycat_sessions_active", "gauge", "Sessions kept by the session store", n)
+		}
+	}
+	if s, ok := ah.sm.(managers.SessionMgrSentinel); ok {
+		if master := s.CurrentMaster(); len(master) > 0 {
+			fmt.Fprintf(bw, "# HELP keycat_redis_master Redis server taking the session writes\n# TYPE keycat_redis_master gauge\n")
+			fmt.Fprintf(bw, "keycat_redis_master{addr=%q} 1\n", master)
+		}
+	}
+	st := ah.stats()
+	write("keycat_db_max_open_connections", "gauge", "Max connections the db pool can open", st.DB.MaxOpenConnections)
+	write("keycat_db_open_connections", "gauge", "Connections open in the db pool", st.DB.OpenConnections)
+	write("keycat_db_in_use_connections", "gauge", "Connections of the db pool being used", st.DB.InUse)
+	write("keycat_db_idle_connections", "gauge", "Idle connections in the db pool", st.DB.Idle)
+	write("keycat_db_wait_count_total", "counter", "Times a query waited for a free connection", st.DB.WaitCount)
+	write("keycat_db_wait_duration_seconds_total", "counter", "Time spent waiting for a free connection", st.DB.WaitDuration.Seconds())
+	write("keycat_mail_queue_length", "gauge", "Mails waiting to be sent", st.MailQueue)
+	write("keycat_mail_queue_oldest_seconds", "gauge", "Time the oldest pending mail has been waiting", st.MailQueueAge.Seconds())
+}
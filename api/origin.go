@@ -0,0 +1,62 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type originChecker struct {
+	enabled   bool
+	proxyMode bool
+	allowed   map[string]bool
+}
+
+func newOriginChecker(enabled, proxyMode bool, allowed []string) *originChecker {
+	oc := &originChecker{enabled, proxyMode, map[string]bool{}}
+	for _, o := range allowed {
+		oc.allowed[normalizeOrigin(o)] = true
+	}
+	return oc
+}
+
+func normalizeOrigin(o string) string {
+	u, err := url.Parse(o)
+	if err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+		return ""
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
+
+func requestOrigin(r *http.Request) string {
+	if o := r.Header.Get("Origin"); len(o) > 0 && o != "null" {
+		return normalizeOrigin(o)
+	}
+	return normalizeOrigin(r.Referer())
+}
+
+// check returns false for state-changing requests that do not come from an allowed origin
+func (oc *originChecker) check(r *http.Request) bool {
+	if !oc.enabled {
+		return true
+	}
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	o := requestOrigin(r)
+	if len(o) == 0 {
+		return false
+	}
+	if oc.allowed[o] {
+		return true
+	}
+	if oc.proxyMode {
+		proto := r.Header.Get("X-Forwarded-Proto")
+		host := r.Header.Get("X-Forwarded-Host")
+		if len(proto) > 0 && len(host) > 0 && o == strings.ToLower(proto+"://"+host) {
+			return true
+		}
+	}
+	return false
+}
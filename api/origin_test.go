@@ -0,0 +1,49 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOriginCheck(t *testing.T) {
+	oc := newOriginChecker(true, false, []string{"https://keycat.example.com/"})
+	cases := []struct {
+		method  string
+		origin  string
+		referer string
+		valid   bool
+	}{
+		{"POST", "https://keycat.example.com", "", true},
+		{"DELETE", "", "https://keycat.example.com/team/abc", true},
+		{"POST", "https://evil.example.com", "", false},
+		{"PATCH", "", "https://evil.example.com/keycat.example.com", false},
+		{"PUT", "", "", false},
+		{"POST", "null", "", false},
+		{"GET", "", "", true},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, "/api/team", nil)
+		if len(c.origin) > 0 {
+			r.Header.Set("Origin", c.origin)
+		}
+		if len(c.referer) > 0 {
+			r.Header.Set("Referer", c.referer)
+		}
+		if oc.check(r) != c.valid {
+			t.Errorf("Expected %s with origin '%s' and referer '%s' to be valid=%t", c.method, c.origin, c.referer, c.valid)
+		}
+	}
+	r := httptest.NewRequest("POST", "/api/team", nil)
+	r.Header.Set("Origin", "https://proxied.example.com")
+	r.Header.Set("X-Forwarded-Proto", "https")
+	r.Header.Set("X-Forwarded-Host", "proxied.example.com")
+	if oc.check(r) {
+		t.Errorf("Expected forwarded hosts to be ignored outside proxy mode")
+	}
+	if !newOriginChecker(true, true, nil).check(r) {
+		t.Errorf("Expected the forwarded host to be allowed in proxy mode")
+	}
+	if !newOriginChecker(false, false, nil).check(httptest.NewRequest("POST", "/api/team", nil)) {
+		t.Errorf("Expected a disabled checker to allow everything")
+	}
+}
@@ -0,0 +1,150 @@
+package api
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+// Default range endpoint of the HaveIBeenPwned passwords api
+const defaultBreachCheckUrl = "https://api.pwnedpasswords.com/range/"
+
+const (
+	// Hex characters of the SHA-1 of the password in a range query. 5 characters match hundreds of leaked hashes
+	// so the server learns nothing useful about the password
+	breachRangePrefixLen = 5
+	breachRangeRateLimit = 30
+	breachRangeWindow    = time.Minute
+	// Ranges are a few tens of kilobytes even with padding
+	breachRangeMaxBody = 1 << 20
+)
+
+var reValidRangePrefix = regexp.MustCompile("^[0-9A-F]{5}$")
+
+// PasswordReport is what the client tells about a new master password. The server never sees the password or its
+// hash so it has to trust what the client found
+type PasswordReport struct {
+	EntropyBits float64 `json:"entropy_bits"`
+	// Whether the client found the SHA-1 of the password in the range returned by GET /auth/password_range/:prefix.
+	// Only needed for breach checks
+	Breached *bool `json:"breached"`
+}
+
+// PasswordPolicy decides if a master password is good enough for signups and password changes. It returns
+// ErrWeakPassword with the failed checks as field errors
+type PasswordPolicy interface {
+	Check(ctx context.Context, pr *PasswordReport) error
+}
+
+// passwordPolicy requires a minimum entropy and, if breachCheck is set, that the client reports the password was not
+// found in its breach range
+type passwordPolicy struct {
+	minEntropy  float64
+	breachCheck bool
+}
+
+// NewPasswordPolicy returns the built-in policy. It returns nil if the conf doesn't enable any check
+func NewPasswordPolicy(c *ConfPasswordPolicy) PasswordPolicy {
+	if c == nil || (c.MinEntropy <= 0 && !c.BreachCheck) {
+		return nil
+	}
+	return &passwordPolicy{c.MinEntropy, c.BreachCheck}
+}
+
+func (pp *passwordPolicy) Check(ctx context.Context, pr *PasswordReport) error {
+	errs := util.NewErrorFields().(*util.Error)
+	if pr == nil {
+		errs.SetFieldError("password_check", "missing")
+		return util.NewErrorFrom(errs.SetErrorOrCamo(ErrWeakPassword))
+	}
+	if pr.EntropyBits < pp.minEntropy {
+		errs.SetFieldError("password_check.entropy_bits", "too low")
+	}
+	if pp.breachCheck {
+		if pr.Breached == nil {
+			errs.SetFieldError("password_check.breached", "missing")
+		} else if *pr.Breached {
+			errs.SetFieldError("password_check.breached", "breached")
+		}
+	}
+	return util.NewErrorFrom(errs.SetErrorOrCamo(ErrWeakPassword))
+}
+
+// breachRanges proxies range queries to the breach api so clients only need to reach the server. The client sends
+// the first breachRangePrefixLen characters of the SHA-1 of the password and matches the rest of the hash against
+// the SUFFIX:COUNT lines of the answer itself
+type breachRanges struct {
+	url     string
+	client  *http.Client
+	limiter *rateLimiter
+}
+
+// newBreachRanges returns nil if breach checks are off
+func newBreachRanges(c *ConfPasswordPolicy) *breachRanges {
+	if c == nil || !c.BreachCheck {
+		return nil
+	}
+	br := &breachRanges{c.BreachCheckUrl, &http.Client{Timeout: 10 * time.Second}, newRateLimiter(breachRangeRateLimit, breachRangeWindow)}
+	if len(br.url) == 0 {
+		br.url = defaultBreachCheckUrl
+	}
+	return br
+}
+
+func (br *breachRanges) fetch(ctx context.Context, prefix string) ([]byte, error) {
+	req, err := http.NewRequest("GET", br.url+prefix, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Padding hides the size of the answer from anyone watching the traffic
+	req.Header.Set("Add-Padding", "true")
+	res, err := br.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, util.NewErrorf("breach api returned %s", res.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(res.Body, breachRangeMaxBody))
+}
+
+// GET /auth/password_range/:prefix
+// Answers with the lines of the breach api. Padding lines have a count of 0
+func (ah apiHandler) authPasswordRange(w http.ResponseWriter, r *http.Request) error {
+	if ah.breachRanges == nil || r.Method != "GET" {
+		return util.NewErrorFrom(ErrNotFound)
+	}
+	if !ah.breachRanges.limiter.allow(ah.clientIP(r)) {
+		return util.NewErrorFrom(ErrTooManyRequests)
+	}
+	prefix, _ := shiftPath(r.URL.Path)
+	prefix = strings.ToUpper(prefix)
+	if !reValidRangePrefix.MatchString(prefix) {
+		return util.NewErrorFrom(ErrNotFound)
+	}
+	body, err := ah.breachRanges.fetch(r.Context(), prefix)
+	if err != nil {
+		log.Printf("Could not get a range from the breach api: %s", err)
+		return util.NewErrorFrom(ErrBreachCheckUnavailable)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.Write(body)
+	return nil
+}
+
+// checkPassword runs the password policy if there is one
+func (ah apiHandler) checkPassword(ctx context.Context, pr *PasswordReport) error {
+	if ah.passwords == nil {
+		return nil
+	}
+	return ah.passwords.Check(ctx, pr)
+}
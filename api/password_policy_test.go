@@ -0,0 +1,85 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+func TestPasswordPolicyEntropy(t *testing.T) {
+	if NewPasswordPolicy(&ConfPasswordPolicy{}) != nil {
+		t.Fatal("Expected no policy if no check is enabled")
+	}
+	pp := NewPasswordPolicy(&ConfPasswordPolicy{MinEntropy: 50})
+	ctx := context.Background()
+	if err := pp.Check(ctx, nil); !util.CheckErr(err, ErrWeakPassword) || !util.CheckFieldErr(err, "password_check", "missing") {
+		t.Fatalf("Expected a missing report to be rejected: %s", err)
+	}
+	err := pp.Check(ctx, &PasswordReport{EntropyBits: 28})
+	if !util.CheckErr(err, ErrWeakPassword) || !util.CheckFieldErr(err, "password_check.entropy_bits", "too low") {
+		t.Fatalf("Expected a low entropy password to be rejected: %s", err)
+	}
+	if err := pp.Check(ctx, &PasswordReport{EntropyBits: 64}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPasswordPolicyBreached(t *testing.T) {
+	pp := NewPasswordPolicy(&ConfPasswordPolicy{BreachCheck: true})
+	ctx := context.Background()
+	yes, no := true, false
+	if err := pp.Check(ctx, &PasswordReport{EntropyBits: 80}); !util.CheckFieldErr(err, "password_check.breached", "missing") {
+		t.Fatalf("Expected the breach check to be required: %s", err)
+	}
+	err := pp.Check(ctx, &PasswordReport{EntropyBits: 80, Breached: &yes})
+	if !util.CheckErr(err, ErrWeakPassword) || !util.CheckFieldErr(err, "password_check.breached", "breached") {
+		t.Fatalf("Expected a breached password to be rejected: %s", err)
+	}
+	if err := pp.Check(ctx, &PasswordReport{EntropyBits: 80, Breached: &no}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPasswordRangeProxy(t *testing.T) {
+	var ranges []string
+	breachApi := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.URL.Path)
+		if r.Header.Get("Add-Padding") != "true" {
+			t.Errorf("Expected the range to be padded")
+		}
+		fmt.Fprint(w, "1E4C9B93F3F0682250B6CF8331B7EE68FD8:3861493\r\n")
+		fmt.Fprint(w, "1F2B668E8AABEF1C59E9EC6F82E3F3CD786:0\r\n")
+	}))
+	defer breachApi.Close()
+	ah := apiHandler{clientIPs: &clientIPResolver{}}
+	if w := httptest.NewRecorder(); !httpErr(w, ah.authPasswordRange(w, httptest.NewRequest("GET", "/5BAA6", nil))) || w.Code != http.StatusNotFound {
+		t.Fatalf("Expected no range endpoint without breach checks")
+	}
+	ah.breachRanges = newBreachRanges(&ConfPasswordPolicy{BreachCheck: true, BreachCheckUrl: breachApi.URL + "/range/"})
+	get := func(prefix string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/"+prefix, nil)
+		r.RemoteAddr = "1.2.3.4:1000"
+		httpErr(w, ah.authPasswordRange(w, r))
+		return w
+	}
+	w := get("5baa6")
+	if w.Code != http.StatusOK || w.Body.String() != "1E4C9B93F3F0682250B6CF8331B7EE68FD8:3861493\r\n1F2B668E8AABEF1C59E9EC6F82E3F3CD786:0\r\n" {
+		t.Fatalf("Unexpected range %d: %s", w.Code, w.Body)
+	}
+	if len(ranges) != 1 || ranges[0] != "/range/5BAA6" {
+		t.Fatalf("Expected the range prefix to be sent: %v", ranges)
+	}
+	for _, prefix := range []string{"5BAA61E4C9", "5BAA", "ZZZZZ"} {
+		if w := get(prefix); w.Code != http.StatusNotFound {
+			t.Errorf("Expected prefix %s to be refused and got %d", prefix, w.Code)
+		}
+	}
+	if len(ranges) != 1 {
+		t.Fatalf("Invalid prefixes reached the breach api: %v", ranges)
+	}
+}
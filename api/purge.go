@@ -0,0 +1,128 @@
+package api
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/keydotcat/keycatd/models"
+	"github.com/keydotcat/keycatd/util"
+)
+
+const (
+	purgeUnverifiedInterval    = time.Hour
+	pruneSecretHistoryInterval = time.Hour
+	pruneSecretHistoryBatch    = 1000
+	purgeDeletedVaultsInterval = time.Hour
+)
+
+func (ah apiHandler) purgeUnverifiedAccountsLoop(ttl, grace time.Duration) {
+	for {
+		if err := ah.remindUnverifiedAccounts(ttl, grace); err != nil {
+			log.Printf("Could not remind unverified accounts: %s", err)
+		}
+		ctx := models.AddDBToContext(context.Background(), ah.db)
+		if n, err := models.PurgeUnverifiedRemindedBefore(ctx, time.Now().UTC().Add(-grace)); err != nil {
+			log.Printf("Could not purge unverified accounts: %s", err)
+		} else if n > 0 {
+			log.Printf("Purged %d unverified accounts", n)
+		}
+		time.Sleep(purgeUnverifiedInterval)
+	}
+}
+
+// remindUnverifiedAccounts sends a fresh confirmation link to the accounts that are ttl old and still unverified.
+// They are only purged once the grace period after a delivered reminder is over
+func (ah apiHandler) remindUnverifiedAccounts(ttl, grace time.Duration) error {
+	ctx := models.AddDBToContext(context.Background(), ah.db)
+	users, err := models.FindUnverifiedUsersToRemind(ctx, time.Now().UTC().Add(-ttl))
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		t, err := u.ResendConfirmation(ctx)
+		if util.CheckErr(err, models.ErrConfirmationRateLimited) {
+			// A confirmation was just sent. It will be reminded in the next round
+			continue
+		} else if err != nil {
+			log.Printf("Could not renew the confirmation token of %s: %s", u.Id, err)
+			continue
+		}
+		if err := ah.mail.sendUnverifiedReminderMail(u, t, time.Now().UTC().Add(grace), ""); err != nil {
+			log.Printf("Could not send purge reminder to %s: %s", u.Id, err)
+			continue
+		}
+		if err := u.SetPurgeReminded(ctx); err != nil && !util.CheckErr(err, models.ErrDoesntExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ah apiHandler) pruneSecretHistoryLoop() {
+	for {
+		ctx := models.AddDBToContext(context.Background(), ah.db)
+		if n, err := models.PruneSecretHistory(ctx, pruneSecretHistoryBatch); err != nil {
+			log.Printf("Could not prune secret history: %s", err)
+		} else if n > 0 {
+			log.Printf("Pruned %d old secret versions", n)
+		}
+		time.Sleep(pruneSecretHistoryInterval)
+	}
+}
+
+func (ah apiHandler) purgeDeletedVaultsLoop() {
+	for {
+		ctx := models.AddDBToContext(context.Background(), ah.db)
+		if n, err := models.PurgeDeletedVaults(ctx); err != nil {
+			log.Printf("Could not purge deleted vaults: %s", err)
+		} else if n > 0 {
+			log.Printf("Purged %d deleted vaults", n)
+		}
+		time.Sleep(purgeDeletedVaultsInterval)
+	}
+}
+
+// cleanupLoop deletes the expired tokens, invitations, share links and secret accesses every interval until the
+// server shuts down
+func (ah apiHandler) cleanupLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		ah.cleanup()
+		select {
+		case <-ah.closing:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (ah apiHandler) cleanup() {
+	ctx := models.AddDBToContext(context.Background(), ah.db)
+	if n, err := models.DeleteExpiredTokens(ctx); err != nil {
+		log.Printf("Could not delete expired tokens: %s", err)
+	} else if n > 0 {
+		log.Printf("Deleted %d expired tokens", n)
+	}
+	if n, err := models.DeleteExpiredInvites(ctx); err != nil {
+		log.Printf("Could not delete expired invitations: %s", err)
+	} else if n > 0 {
+		log.Printf("Deleted %d expired invitations", n)
+	}
+	if n, err := models.DeleteOldInviteLogs(ctx); err != nil {
+		log.Printf("Could not delete old invitation logs: %s", err)
+	} else if n > 0 {
+		log.Printf("Deleted %d old invitation logs", n)
+	}
+	if n, err := models.DeleteExpiredShareLinks(ctx); err != nil {
+		log.Printf("Could not delete expired share links: %s", err)
+	} else if n > 0 {
+		log.Printf("Deleted %d expired share links", n)
+	}
+	if n, err := models.DeleteOldSecretAccesses(ctx); err != nil {
+		log.Printf("Could not delete old secret accesses: %s", err)
+	} else if n > 0 {
+		log.Printf("Deleted %d old secret accesses", n)
+	}
+}
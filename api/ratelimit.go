@@ -0,0 +1,47 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+type rateLimitEntry struct {
+	hits  int
+	start time.Time
+}
+
+// rateLimiter allows up to max hits per key in each window
+type rateLimiter struct {
+	lock    *sync.Mutex
+	max     int
+	window  time.Duration
+	entries map[string]*rateLimitEntry
+}
+
+func newRateLimiter(max int, window time.Duration) *rateLimiter {
+	return &rateLimiter{&sync.Mutex{}, max, window, map[string]*rateLimitEntry{}}
+}
+
+func (rl *rateLimiter) allow(key string) bool {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	now := time.Now()
+	if len(rl.entries) > 10000 {
+		rl.cleanup(now)
+	}
+	e, ok := rl.entries[key]
+	if !ok || now.Sub(e.start) > rl.window {
+		rl.entries[key] = &rateLimitEntry{1, now}
+		return true
+	}
+	e.hits++
+	return e.hits <= rl.max
+}
+
+func (rl *rateLimiter) cleanup(now time.Time) {
+	for k, e := range rl.entries {
+		if now.Sub(e.start) > rl.window {
+			delete(rl.entries, k)
+		}
+	}
+}
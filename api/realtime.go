@@ -0,0 +1,36 @@
+package api
+
+import (
+	"sync"
+)
+
+// realtimeConnLimiter bounds how many websocket or eventsource connections a single user can keep open
+type realtimeConnLimiter struct {
+	max   int
+	lock  *sync.Mutex
+	conns map[string]int
+}
+
+func newRealtimeConnLimiter(max int) *realtimeConnLimiter {
+	return &realtimeConnLimiter{max, &sync.Mutex{}, map[string]int{}}
+}
+
+func (rl *realtimeConnLimiter) tryAcquire(uid string) bool {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	if rl.max > 0 && rl.conns[uid] >= rl.max {
+		return false
+	}
+	rl.conns[uid]++
+	return true
+}
+
+func (rl *realtimeConnLimiter) release(uid string) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	if rl.conns[uid] <= 1 {
+		delete(rl.conns, uid)
+		return
+	}
+	rl.conns[uid]--
+}
@@ -0,0 +1,34 @@
+package api
+
+import "testing"
+
+func TestRealtimeConnLimiter(t *testing.T) {
+	rl := newRealtimeConnLimiter(2)
+	for i := 0; i < 2; i++ {
+		if !rl.tryAcquire("u1") {
+			t.Fatalf("Connection %d should have been accepted", i)
+		}
+	}
+	if rl.tryAcquire("u1") {
+		t.Fatalf("Connection over the limit should have been rejected")
+	}
+	if !rl.tryAcquire("u2") {
+		t.Fatalf("The limit should be per user")
+	}
+	rl.release("u1")
+	if !rl.tryAcquire("u1") {
+		t.Fatalf("Connection should have been accepted after a release")
+	}
+	rl.release("u1")
+	rl.release("u1")
+	rl.release("u2")
+	if len(rl.conns) != 0 {
+		t.Errorf("Expected no tracked users after releasing every connection and got %d", len(rl.conns))
+	}
+	unlimited := newRealtimeConnLimiter(0)
+	for i := 0; i < 100; i++ {
+		if !unlimited.tryAcquire("u1") {
+			t.Fatalf("A limit of 0 should not reject connections")
+		}
+	}
+}
@@ -2,6 +2,8 @@ package api
 
 import (
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/keydotcat/keycatd/managers"
 	"github.com/keydotcat/keycatd/models"
@@ -15,14 +17,18 @@ func (ah apiHandler) teamSecretRoot(w http.ResponseWriter, r *http.Request, t *m
 	if len(head) == 0 {
 		switch r.Method {
 		case "GET":
-			return ah.teamSecretGetAll(w, r, t)
+			return ah.heavyOp(w, func() error { return ah.teamSecretGetAll(w, r, t) })
 		}
+	} else if sub, _ := shiftPath(r.URL.Path); sub == "access" && r.Method == "GET" {
+		return ah.teamGetSecretAccessLog(w, r, t, head)
 	}
 	return util.NewErrorFrom(ErrNotFound)
 }
 
 type teamSecretListWrap struct {
 	Secrets []*models.Secret `json:"secrets"`
+	// Secrets sent without data because reading them requires a justification
+	Withheld []string `json:"withheld,omitempty"`
 }
 
 // GET /team/:tid/secret
@@ -33,11 +39,21 @@ func (ah apiHandler) teamSecretGetAll(w http.ResponseWriter, r *http.Request, t
 	if err != nil {
 		return err
 	}
-	return jsonResponse(w, teamSecretListWrap{s})
+	served, withheld, err := ah.withholdJustifiedSecrets(r, s)
+	if err != nil {
+		return err
+	}
+	ah.logSecretReads(r, served)
+	return jsonResponse(w, teamSecretListWrap{s, withheld})
 }
 
 // /team/:tid/vault/:vid/secret
 func (ah apiHandler) validVaultSecretRoot(w http.ResponseWriter, r *http.Request, t *models.Team, v *models.Vault) error {
+	if r.Method != "GET" {
+		if err := t.CheckWriteAccess(r.Context(), ctxGetUser(r.Context())); err != nil {
+			return err
+		}
+	}
 	var head string
 	head, r.URL.Path = shiftPath(r.URL.Path)
 	if len(head) == 0 {
@@ -47,6 +63,30 @@ func (ah apiHandler) validVaultSecretRoot(w http.ResponseWriter, r *http.Request
 		case "POST":
 			return ah.vaultCreateSecret(w, r, t, v)
 		}
+	} else if sub, _ := shiftPath(r.URL.Path); sub == "references" {
+		switch r.Method {
+		case "GET":
+			return ah.vaultGetSecretReferences(w, r, v, head)
+		case "PUT":
+			return ah.vaultSetSecretReferences(w, r, v, head)
+		}
+	} else if sub, _ := shiftPath(r.URL.Path); sub == "share" && r.Method == "POST" {
+		return ah.vaultShareSecret(w, r, v, head)
+	} else if sub, _ := shiftPath(r.URL.Path); sub == "justification" && r.Method == "PUT" {
+		return ah.vaultSetSecretJustification(w, r, v, head)
+	} else if sub, _ := shiftPath(r.URL.Path); sub == "rotation" {
+		switch r.Method {
+		case "PUT":
+			return ah.vaultSetSecretRotation(w, r, v, head)
+		}
+	} else if sub, rest := shiftPath(r.URL.Path); sub == "history" {
+		version, _ := shiftPath(rest)
+		switch {
+		case len(version) == 0 && r.Method == "GET":
+			return ah.vaultGetSecretHistory(w, r, v, head)
+		case len(version) > 0 && r.Method == "POST":
+			return ah.vaultRestoreSecretVersion(w, r, v, head, version)
+		}
 	} else {
 		switch r.Method {
 		case "DELETE":
@@ -58,64 +98,208 @@ func (ah apiHandler) validVaultSecretRoot(w http.ResponseWriter, r *http.Request
 	return util.NewErrorFrom(ErrNotFound)
 }
 
+// GET /team/:tid/vault/:vid/secret
+// Only the secrets listed in ?ids=a,b,c are returned if it is set. Secrets that require a justification are only
+// returned with ?justification=<reason>. Listing the whole vault withholds their data and fetching them by id fails
 func (ah apiHandler) vaultGetSecrets(w http.ResponseWriter, r *http.Request, t *models.Team, v *models.Vault) error {
 	ctx := r.Context()
+	if ids := r.URL.Query().Get("ids"); len(ids) > 0 {
+		sb, err := v.GetSecretsByIds(ctx, ctxGetUser(ctx), strings.Split(ids, ","))
+		if err != nil {
+			return err
+		}
+		if err := ah.requireJustification(r, sb.Secrets); err != nil {
+			return err
+		}
+		ah.logSecretReads(r, sb.Secrets)
+		return jsonResponse(w, sb)
+	}
 	secrets, err := v.GetSecrets(ctx)
 	if err != nil {
 		return err
 	}
-	return jsonResponse(w, teamSecretListWrap{secrets})
+	served, withheld, err := ah.withholdJustifiedSecrets(r, secrets)
+	if err != nil {
+		return err
+	}
+	ah.logSecretReads(r, served)
+	return jsonResponse(w, teamSecretListWrap{secrets, withheld})
+
+}
 
+// secretRequestMaxSize is enough for the base64 encoding of the largest secret and the rest of the fields
+func secretRequestMaxSize() int64 {
+	return int64(models.MAX_SECRET_SIZE)*4/3 + 4*1024
 }
 
 type vaultCreateSecretRequest struct {
-	Team  string `json:"team"`
-	Vault string `json:"vault"`
-	Data  []byte `json:"data"`
+	Team         string `json:"team"`
+	Vault        string `json:"vault"`
+	Data         []byte `json:"data"`
+	RotationDays int    `json:"rotation_days"`
 }
 
 func (ah apiHandler) vaultCreateSecret(w http.ResponseWriter, r *http.Request, t *models.Team, v *models.Vault) error {
 	ctx := r.Context()
 	vscr := &vaultCreateSecretRequest{}
-	if err := jsonDecode(w, r, 16*1024, vscr); err != nil {
+	if err := jsonDecode(w, r, secretRequestMaxSize(), vscr); err != nil {
 		return err
 	}
-	s := &models.Secret{Data: vscr.Data}
-	if err := v.AddSecret(ctx, s); err != nil {
+	s := &models.Secret{Data: vscr.Data, RotationDays: vscr.RotationDays}
+	if err := v.AddSecret(ctx, ctxGetUser(ctx), s); err != nil {
 		return err
 	}
 	ah.bcast.Send(v.Team, v.Id, managers.BCAST_ACTION_SECRET_NEW, s)
+	ah.vaultWebhook(managers.WEBHOOK_EVENT_SECRET_CREATED, v, ctxGetUser(ctx).Id, s.Id)
 	return jsonResponse(w, s)
 }
 
+type vaultSecretReferencesResponse struct {
+	References   []string `json:"references"`
+	ReferencedBy []string `json:"referenced_by"`
+}
+
+// GET /team/:tid/vault/:vid/secret/:sid/references
+func (ah apiHandler) vaultGetSecretReferences(w http.ResponseWriter, r *http.Request, v *models.Vault, sid string) error {
+	ctx := r.Context()
+	if _, err := v.GetSecret(ctx, sid); err != nil {
+		return err
+	}
+	refs, err := v.GetSecretReferences(ctx, sid)
+	if err != nil {
+		return err
+	}
+	by, err := v.GetReferencingSecrets(ctx, sid)
+	if err != nil {
+		return err
+	}
+	return jsonResponse(w, vaultSecretReferencesResponse{refs, by})
+}
+
+type vaultSecretRotationRequest struct {
+	RotationDays int `json:"rotation_days"`
+}
+
+// PUT /team/:tid/vault/:vid/secret/:sid/rotation
+func (ah apiHandler) vaultSetSecretRotation(w http.ResponseWriter, r *http.Request, v *models.Vault, sid string) error {
+	req := &vaultSecretRotationRequest{}
+	if err := jsonDecode(w, r, 1024, req); err != nil {
+		return err
+	}
+	s, err := v.SetSecretRotation(r.Context(), sid, req.RotationDays)
+	if err != nil {
+		return err
+	}
+	ah.broadcastSecrets(r.Context(), v.Team, v.Id, managers.BCAST_ACTION_SECRET_CHANGE, s)
+	return jsonResponse(w, s)
+}
+
+type vaultSecretHistoryResponse struct {
+	Secrets []*models.Secret `json:"secrets"`
+}
+
+// GET /team/:tid/vault/:vid/secret/:sid/history
+func (ah apiHandler) vaultGetSecretHistory(w http.ResponseWriter, r *http.Request, v *models.Vault, sid string) error {
+	history, err := v.GetSecretHistory(r.Context(), sid)
+	if err != nil {
+		return err
+	}
+	if err := ah.requireJustification(r, history[:1]); err != nil {
+		return err
+	}
+	ah.logSecretReads(r, history[:1])
+	return jsonResponse(w, vaultSecretHistoryResponse{history})
+}
+
+// POST /team/:tid/vault/:vid/secret/:sid/history/:version
+func (ah apiHandler) vaultRestoreSecretVersion(w http.ResponseWriter, r *http.Request, v *models.Vault, sid, version string) error {
+	vnum, err := strconv.ParseUint(version, 10, 32)
+	if err != nil {
+		return util.NewErrorFrom(ErrNotFound)
+	}
+	ctx := r.Context()
+	s, err := v.RestoreSecretVersion(ctx, sid, uint32(vnum))
+	if err != nil {
+		return err
+	}
+	ah.broadcastSecrets(ctx, v.Team, v.Id, managers.BCAST_ACTION_SECRET_CHANGE, s)
+	ah.vaultWebhook(managers.WEBHOOK_EVENT_SECRET_UPDATED, v, ctxGetUser(ctx).Id, s.Id)
+	return jsonResponse(w, s)
+}
+
+type vaultSetSecretReferencesRequest struct {
+	References []string `json:"references"`
+}
+
+// PUT /team/:tid/vault/:vid/secret/:sid/references
+func (ah apiHandler) vaultSetSecretReferences(w http.ResponseWriter, r *http.Request, v *models.Vault, sid string) error {
+	ctx := r.Context()
+	req := &vaultSetSecretReferencesRequest{}
+	if err := jsonDecode(w, r, 16*1024, req); err != nil {
+		return err
+	}
+	if err := v.SetSecretReferences(ctx, sid, req.References); err != nil {
+		return err
+	}
+	// Read back from the primary since replicas may lag behind the write
+	return ah.vaultGetSecretReferences(w, r.WithContext(models.ForcePrimaryReads(ctx)), v, sid)
+}
+
+// DELETE /team/:tid/vault/:vid/secret/:sid
+// Secrets referenced by others are only deleted with ?force=true
 func (ah apiHandler) vaultDeleteSecret(w http.ResponseWriter, r *http.Request, t *models.Team, v *models.Vault, sid string) error {
 	ctx := r.Context()
-	if err := v.DeleteSecret(ctx, sid); err != nil {
+	if err := ah.checkSessionCooling(r); err != nil {
+		return err
+	}
+	if r.URL.Query().Get("force") != "true" {
+		by, err := v.GetReferencingSecrets(ctx, sid)
+		if err != nil {
+			return err
+		}
+		if len(by) > 0 {
+			return util.NewErrorFrom(models.ErrSecretReferenced)
+		}
+	}
+	if err := v.DeleteSecret(ctx, ctxGetUser(ctx), sid); err != nil {
 		return err
 	}
 	ah.bcast.Send(v.Team, v.Id, managers.BCAST_ACTION_SECRET_REMOVE, &models.Secret{Id: sid})
+	ah.vaultWebhook(managers.WEBHOOK_EVENT_SECRET_DELETED, v, ctxGetUser(ctx).Id, sid)
 	return jsonResponse(w, v)
 }
 
 func (ah apiHandler) vaultUpdateSecret(w http.ResponseWriter, r *http.Request, t *models.Team, v *models.Vault, sid string) error {
 	ctx := r.Context()
 	vscr := &vaultCreateSecretRequest{}
-	if err := jsonDecode(w, r, 16*1024, vscr); err != nil {
+	if err := jsonDecode(w, r, secretRequestMaxSize(), vscr); err != nil {
 		return err
 	}
 	s := &models.Secret{Id: sid, Data: vscr.Data}
 	if len(vscr.Vault) == 0 || (t.Id == vscr.Team && v.Id == vscr.Vault) {
 		//Modify secret
 		if len(vscr.Data) > 0 {
-			if err := v.UpdateSecret(ctx, s); err != nil {
+			if err := v.UpdateSecret(ctx, ctxGetUser(ctx), s); err != nil {
 				return err
 			}
-			ah.bcast.Send(v.Team, v.Id, managers.BCAST_ACTION_SECRET_CHANGE, s)
+			ah.broadcastSecrets(ctx, v.Team, v.Id, managers.BCAST_ACTION_SECRET_CHANGE, s)
+			ah.vaultWebhook(managers.WEBHOOK_EVENT_SECRET_UPDATED, v, ctxGetUser(ctx).Id, s.Id)
 		}
 		return jsonResponse(w, s)
 	} else {
 		//Move it to a different team/vault
 		u := ctxGetUser(r.Context())
+		if len(vscr.Team) == 0 || vscr.Team == t.Id {
+			ms, err := t.MoveSecret(ctx, u, sid, v.Id, vscr.Vault, vscr.Data)
+			if err != nil {
+				return err
+			}
+			ah.bcast.Send(v.Team, v.Id, managers.BCAST_ACTION_SECRET_REMOVE, &models.Secret{Id: sid})
+			ah.broadcastSecrets(ctx, t.Id, ms.Vault, managers.BCAST_ACTION_SECRET_NEW, ms)
+			ah.vaultWebhook(managers.WEBHOOK_EVENT_SECRET_DELETED, v, u.Id, sid)
+			ah.vaultWebhook(managers.WEBHOOK_EVENT_SECRET_CREATED, &models.Vault{Team: t.Id, Id: ms.Vault}, u.Id, ms.Id)
+			return jsonResponse(w, ms)
+		}
 		var targetTeam = t
 		if len(vscr.Team) != 0 {
 			var err error
@@ -123,6 +307,9 @@ func (ah apiHandler) vaultUpdateSecret(w http.ResponseWriter, r *http.Request, t
 			if err != nil {
 				return err
 			}
+			if err := targetTeam.CheckWriteAccess(ctx, u); err != nil {
+				return err
+			}
 		}
 		targetVault, err := targetTeam.GetVaultForUser(r.Context(), vscr.Vault, u)
 		if err != nil {
@@ -132,19 +319,24 @@ func (ah apiHandler) vaultUpdateSecret(w http.ResponseWriter, r *http.Request, t
 			return err
 		}
 		ah.bcast.Send(v.Team, v.Id, managers.BCAST_ACTION_SECRET_REMOVE, &models.Secret{Id: sid})
-		ah.bcast.Send(targetTeam.Id, targetVault.Id, managers.BCAST_ACTION_SECRET_NEW, s)
+		ah.broadcastSecrets(ctx, targetTeam.Id, targetVault.Id, managers.BCAST_ACTION_SECRET_NEW, s)
+		ah.vaultWebhook(managers.WEBHOOK_EVENT_SECRET_DELETED, v, u.Id, sid)
+		ah.vaultWebhook(managers.WEBHOOK_EVENT_SECRET_CREATED, targetVault, u.Id, s.Id)
 		return jsonResponse(w, s)
 	}
 }
 
 // /team/:tid/vault/:vid/secrets
 func (ah apiHandler) validVaultSecretsRoot(w http.ResponseWriter, r *http.Request, t *models.Team, v *models.Vault) error {
+	if err := t.CheckWriteAccess(r.Context(), ctxGetUser(r.Context())); err != nil {
+		return err
+	}
 	var head string
 	head, r.URL.Path = shiftPath(r.URL.Path)
 	if len(head) == 0 {
 		switch r.Method {
 		case "POST":
-			return ah.vaultCreateSecretList(w, r, t, v)
+			return ah.heavyOp(w, func() error { return ah.vaultCreateSecretList(w, r, t, v) })
 		}
 	}
 	return util.NewErrorFrom(ErrNotFound)
@@ -160,11 +352,13 @@ func (ah apiHandler) vaultCreateSecretList(w http.ResponseWriter, r *http.Reques
 	for i, vc := range vl.Secrets {
 		sl[i] = &models.Secret{Data: vc.Data}
 	}
-	if err := v.AddSecretList(ctx, sl); err != nil {
+	if err := v.AddSecretList(ctx, ctxGetUser(ctx), sl); err != nil {
 		return err
 	}
+	actor := ctxGetUser(ctx).Id
 	for _, s := range sl {
 		ah.bcast.Send(v.Team, v.Id, managers.BCAST_ACTION_SECRET_NEW, s)
+		ah.vaultWebhook(managers.WEBHOOK_EVENT_SECRET_CREATED, v, actor, s.Id)
 	}
-	return jsonResponse(w, teamSecretListWrap{sl})
+	return jsonResponse(w, teamSecretListWrap{Secrets: sl})
 }
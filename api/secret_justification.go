@@ -0,0 +1,94 @@
+package api
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/keydotcat/keycatd/managers"
+	"github.com/keydotcat/keycatd/models"
+	"github.com/keydotcat/keycatd/util"
+)
+
+// withholdJustifiedSecrets clears the data of the secrets that require a justification unless the request sends
+// one in ?justification=. Justified reads are written to the team audit log. Returns the secrets that are served
+// and the ids of the ones that were withheld
+func (ah apiHandler) withholdJustifiedSecrets(r *http.Request, secrets []*models.Secret) ([]*models.Secret, []string, error) {
+	ctx := r.Context()
+	flagged, err := models.SecretsRequiringJustification(ctx, secrets)
+	if err != nil || len(flagged) == 0 {
+		return secrets, nil, err
+	}
+	if j := r.URL.Query().Get("justification"); len(j) > 0 {
+		return secrets, nil, models.RecordJustifiedReads(ctx, ctxGetUser(ctx), flagged, j)
+	}
+	hidden := map[*models.Secret]bool{}
+	withheld := make([]string, len(flagged))
+	for i, s := range flagged {
+		s.Data = nil
+		hidden[s] = true
+		withheld[i] = s.Id
+	}
+	served := make([]*models.Secret, 0, len(secrets)-len(flagged))
+	for _, s := range secrets {
+		if !hidden[s] {
+			served = append(served, s)
+		}
+	}
+	return served, withheld, nil
+}
+
+// requireJustification fails with ErrJustificationRequired if any of the secrets needs a justification that the
+// request does not have
+func (ah apiHandler) requireJustification(r *http.Request, secrets []*models.Secret) error {
+	_, withheld, err := ah.withholdJustifiedSecrets(r, secrets)
+	if err != nil {
+		return err
+	}
+	if len(withheld) > 0 {
+		errs := util.NewErrorFields().(*util.Error)
+		errs.SetFieldError("justification", strings.Join(withheld, ","))
+		return errs.SetErrorOrCamo(models.ErrJustificationRequired)
+	}
+	return nil
+}
+
+// broadcastSecrets sends the secrets to the realtime streams. Secrets that require a justification go without their
+// data so clients have to fetch them with one
+func (ah apiHandler) broadcastSecrets(ctx context.Context, team, vault string, action managers.BroadcastAction, secrets ...*models.Secret) {
+	flagged, err := models.SecretsRequiringJustification(ctx, secrets)
+	if err != nil {
+		log.Printf("Could not check the justification flag of %d secrets. Sending them without data: %s", len(secrets), err)
+		flagged = secrets
+	}
+	hidden := map[*models.Secret]bool{}
+	for _, s := range flagged {
+		hidden[s] = true
+	}
+	for _, s := range secrets {
+		if hidden[s] {
+			c := *s
+			c.Data = nil
+			s = &c
+		}
+		ah.bcast.Send(team, vault, action, s)
+	}
+}
+
+type vaultSecretJustificationRequest struct {
+	Required bool `json:"required"`
+}
+
+// PUT /team/:tid/vault/:vid/secret/:sid/justification
+func (ah apiHandler) vaultSetSecretJustification(w http.ResponseWriter, r *http.Request, v *models.Vault, sid string) error {
+	req := &vaultSecretJustificationRequest{}
+	if err := jsonDecode(w, r, 1024, req); err != nil {
+		return err
+	}
+	ctx := r.Context()
+	if err := v.SetSecretJustification(ctx, ctxGetUser(ctx), sid, req.Required); err != nil {
+		return err
+	}
+	return jsonResponse(w, req)
+}
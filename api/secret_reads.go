@@ -0,0 +1,172 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/keydotcat/keycatd/models"
+	"github.com/keydotcat/keycatd/util"
+)
+
+const (
+	secretReadQueueSize     = 10000
+	secretReadBatchSize     = 500
+	secretReadFlushInterval = 5 * time.Second
+)
+
+// secretReadLogger writes the reads of secrets in batches from the background so reads don't wait on extra
+// inserts. Reads are dropped and logged if the queue is full or the batch cannot be written, so a slow db can lose
+// at most a queue worth of entries but never slows down or fails the reads themselves
+type secretReadLogger struct {
+	db     *sql.DB
+	queue  chan models.SecretAccess
+	flush  chan chan struct{}
+	lock   *sync.RWMutex
+	closed bool
+	done   chan struct{}
+}
+
+func newSecretReadLogger(db *sql.DB) *secretReadLogger {
+	l := &secretReadLogger{
+		db:    db,
+		queue: make(chan models.SecretAccess, secretReadQueueSize),
+		flush: make(chan chan struct{}),
+		lock:  &sync.RWMutex{},
+		done:  make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+func (l *secretReadLogger) record(accesses []models.SecretAccess) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if l.closed {
+		return
+	}
+	for i, a := range accesses {
+		select {
+		case l.queue <- a:
+		default:
+			log.Printf("Secret read queue is full. Dropping %d reads", len(accesses)-i)
+			return
+		}
+	}
+}
+
+func (l *secretReadLogger) run() {
+	defer close(l.done)
+	ticker := time.NewTicker(secretReadFlushInterval)
+	defer ticker.Stop()
+	batch := make([]models.SecretAccess, 0, secretReadBatchSize)
+	write := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx := models.AddDBToContext(context.Background(), l.db)
+		if err := models.RecordSecretAccesses(ctx, batch); err != nil {
+			log.Printf("Could not record %d secret reads: %s", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case a, ok := <-l.queue:
+			if !ok {
+				write()
+				return
+			}
+			if batch = append(batch, a); len(batch) >= secretReadBatchSize {
+				write()
+			}
+		case <-ticker.C:
+			write()
+		case ack := <-l.flush:
+			for pending := len(l.queue); pending > 0; pending-- {
+				batch = append(batch, <-l.queue)
+			}
+			write()
+			close(ack)
+		}
+	}
+}
+
+// sync writes every read queued so far
+func (l *secretReadLogger) sync() {
+	ack := make(chan struct{})
+	select {
+	case l.flush <- ack:
+		<-ack
+	case <-l.done:
+	}
+}
+
+// drain writes the queued reads and stops the logger. It waits up to timeout
+func (l *secretReadLogger) drain(timeout time.Duration) error {
+	l.lock.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.queue)
+	}
+	l.lock.Unlock()
+	select {
+	case <-l.done:
+		return nil
+	case <-time.After(timeout):
+		return util.NewErrorf("Secret read log did not drain in %s", timeout)
+	}
+}
+
+// logSecretReads records that the user of the request read the secrets of the teams that audit reads. Team requests
+// use the policy loaded for the request and the rest load the policy of each team of the secrets
+func (ah apiHandler) logSecretReads(r *http.Request, secrets []*models.Secret) {
+	ctx := r.Context()
+	uid := ctxGetUser(ctx).Id
+	if p := ctxGetTeamPolicy(ctx); p != nil {
+		ah.recordSecretReads(p, uid, secrets)
+		return
+	}
+	byTeam := map[string][]*models.Secret{}
+	for _, s := range secrets {
+		byTeam[s.Team] = append(byTeam[s.Team], s)
+	}
+	for tid, ts := range byTeam {
+		p, err := (&models.Team{Id: tid}).GetPolicy(ctx)
+		if err != nil {
+			log.Printf("Could not load the policy of team %s to log %d secret reads: %s", tid, len(ts), err)
+			continue
+		}
+		ah.recordSecretReads(p, uid, ts)
+	}
+}
+
+// recordSecretReads records that uid read the secrets if the policy audits reads
+func (ah apiHandler) recordSecretReads(p *models.TeamPolicy, uid string, secrets []*models.Secret) {
+	if p == nil || !p.AuditReads || len(secrets) == 0 {
+		return
+	}
+	now := time.Now().UTC()
+	accesses := make([]models.SecretAccess, len(secrets))
+	for i, s := range secrets {
+		accesses[i] = models.SecretAccess{Team: p.Team, Vault: s.Vault, Secret: s.Id, User: uid, AccessedAt: now}
+	}
+	ah.secretReads.record(accesses)
+}
+
+type secretAccessLogResponse struct {
+	Accesses []*models.SecretAccess `json:"accesses"`
+}
+
+// GET /team/:tid/secret/:sid/access
+func (ah apiHandler) teamGetSecretAccessLog(w http.ResponseWriter, r *http.Request, t *models.Team, sid string) error {
+	ctx := r.Context()
+	entries, err := t.GetSecretAccessLog(ctx, ctxGetUser(ctx), sid)
+	if err != nil {
+		return err
+	}
+	return jsonResponse(w, secretAccessLogResponse{entries})
+}
@@ -0,0 +1,33 @@
+package api
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/keydotcat/keycatd/models"
+)
+
+const secretRotationRemindersInterval = time.Hour
+
+func (ah apiHandler) secretRotationRemindersLoop(repeat bool) {
+	for {
+		if err := ah.sendSecretRotationReminders(repeat); err != nil {
+			log.Printf("Could not send secret rotation reminders: %s", err)
+		}
+		time.Sleep(secretRotationRemindersInterval)
+	}
+}
+
+func (ah apiHandler) sendSecretRotationReminders(repeat bool) error {
+	ctx := models.AddDBToContext(context.Background(), ah.db)
+	reminders, err := models.FindSecretRotationReminders(ctx, time.Now().UTC(), repeat)
+	for _, sr := range reminders {
+		for _, u := range sr.Users {
+			if err := ah.mail.sendSecretRotationReminderMail(u, sr.Team, sr.Secret, ""); err != nil {
+				log.Printf("Could not send rotation reminder to %s: %s", u.Id, err)
+			}
+		}
+	}
+	return err
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/keydotcat/keycatd/models"
 )
@@ -97,3 +98,118 @@ func TestAddSecretList(t *testing.T) {
 	}
 
 }
+
+func TestAuditSecretReads(t *testing.T) {
+	u := loginDummyUser()
+	ctx := getCtx()
+	teams, err := u.GetTeams(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	team := teams[0]
+	vs, err := team.GetVaultsFullForUser(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := vs[0]
+	s := &models.Secret{Data: signAndPack(unsealVaultKey(&v.Vault, v.Key), a32b)}
+	if err := v.Vault.AddSecret(ctx, u, s); err != nil {
+		t.Fatal(err)
+	}
+	r, err := GetRequest(fmt.Sprintf("/team/%s/vault/%s/secret", team.Id, v.Id))
+	CheckErrorAndResponse(t, r, err, 200)
+	apiH.secretReads.sync()
+	accesses, err := team.GetSecretAccessLog(ctx, u, s.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accesses) != 0 {
+		t.Fatalf("Reads were recorded without auditing them: %d", len(accesses))
+	}
+	if err := team.SetPolicy(ctx, u, &models.TeamPolicy{AuditReads: true}); err != nil {
+		t.Fatal(err)
+	}
+	r, err = GetRequest(fmt.Sprintf("/team/%s/vault/%s/secret", team.Id, v.Id))
+	CheckErrorAndResponse(t, r, err, 200)
+	apiH.secretReads.sync()
+	r, err = GetRequest(fmt.Sprintf("/team/%s/secret/%s/access", team.Id, s.Id))
+	CheckErrorAndResponse(t, r, err, 200)
+	sal := &secretAccessLogResponse{}
+	if err := json.NewDecoder(r.Body).Decode(sal); err != nil {
+		t.Fatal(err)
+	}
+	if len(sal.Accesses) != 1 || sal.Accesses[0].User != u.Id || sal.Accesses[0].Vault != v.Id {
+		t.Fatalf("Expected one read by %s and got %+v", u.Id, sal.Accesses)
+	}
+	r, err = GetRequest("/user/search?q=" + v.Id)
+	CheckErrorAndResponse(t, r, err, 200)
+	apiH.secretReads.sync()
+	if accesses, err = team.GetSecretAccessLog(ctx, u, s.Id); err != nil {
+		t.Fatal(err)
+	}
+	if len(accesses) != 2 {
+		t.Fatalf("Expected the search to be recorded as a read and got %d reads", len(accesses))
+	}
+}
+
+func TestSecretJustification(t *testing.T) {
+	u := loginDummyUser()
+	ctx := getCtx()
+	teams, err := u.GetTeams(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	team := teams[0]
+	vs, err := team.GetVaultsFullForUser(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := vs[0]
+	vcsr := &vaultCreateSecretRequest{Data: signAndPack(unsealVaultKey(&v.Vault, v.Key), a32b)}
+	r, err := PostRequest(fmt.Sprintf("/team/%s/vault/%s/secret", team.Id, v.Id), vcsr)
+	CheckErrorAndResponse(t, r, err, 200)
+	s := &models.Secret{}
+	if err := json.NewDecoder(r.Body).Decode(s); err != nil {
+		t.Fatal(err)
+	}
+	secretUrl := fmt.Sprintf("/team/%s/vault/%s/secret", team.Id, v.Id)
+	r, err = PutRequest(fmt.Sprintf("%s/%s/justification", secretUrl, s.Id), vaultSecretJustificationRequest{Required: true})
+	CheckErrorAndResponse(t, r, err, 200)
+	r, err = GetRequest(fmt.Sprintf("%s?ids=%s", secretUrl, s.Id))
+	CheckErrorAndResponse(t, r, err, 403)
+	r, err = GetRequest(fmt.Sprintf("%s?ids=%s&justification=incident", secretUrl, s.Id))
+	CheckErrorAndResponse(t, r, err, 200)
+	sb := &models.SecretBatch{}
+	if err := json.NewDecoder(r.Body).Decode(sb); err != nil {
+		t.Fatal(err)
+	}
+	if len(sb.Secrets) != 1 || len(sb.Secrets[0].Data) == 0 {
+		t.Fatalf("Expected the justified read to return the secret data: %v", sb.Secrets)
+	}
+	// Listing the vault hands out the secret without its data
+	r, err = GetRequest(secretUrl)
+	CheckErrorAndResponse(t, r, err, 200)
+	sl := &teamSecretListWrap{}
+	if err := json.NewDecoder(r.Body).Decode(sl); err != nil {
+		t.Fatal(err)
+	}
+	if len(sl.Withheld) != 1 || sl.Withheld[0] != s.Id {
+		t.Fatalf("Expected %s to be withheld and got %v", s.Id, sl.Withheld)
+	}
+	for _, ls := range sl.Secrets {
+		if ls.Id == s.Id && len(ls.Data) > 0 {
+			t.Fatalf("Expected the data of %s to be withheld", s.Id)
+		}
+	}
+	logs, err := team.GetAuditLog(ctx, u, time.Time{}, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, l := range logs {
+		found = found || (l.Action == models.TEAM_AUDIT_SECRET_JUSTIFIED_READ && l.Target == s.Id+": incident")
+	}
+	if !found {
+		t.Fatalf("Expected the justified read in the audit log")
+	}
+}
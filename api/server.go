@@ -0,0 +1,148 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Server serves the api and knows how to stop it without cutting in-flight requests
+type Server struct {
+	ah        apiHandler
+	srv       *http.Server
+	metrics   *http.Server
+	tls       *ConfTLS
+	closeDeps func() error
+	closing   chan struct{}
+	closeOnce *sync.Once
+	inFlight  *sync.WaitGroup
+}
+
+// NewServer creates the api handler for the configuration and wraps it with the middlewares, outermost first
+func NewServer(c Conf, middlewares ...func(http.Handler) http.Handler) (*Server, error) {
+	h, err := NewAPIHandler(c)
+	if err != nil {
+		return nil, err
+	}
+	ah := h.(apiHandler)
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	s := newServer(fmt.Sprintf(":%d", c.Port), h, ah.closing, ah.Shutdown)
+	s.ah = ah
+	s.tls = c.TLS
+	if c.MetricsPort > 0 {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", ah.metricsRoot)
+		s.metrics = &http.Server{Addr: fmt.Sprintf(":%d", c.MetricsPort), Handler: mux}
+	}
+	return s, nil
+}
+
+func newServer(addr string, h http.Handler, closing chan struct{}, closeDeps func() error) *Server {
+	s := &Server{
+		closeDeps: closeDeps,
+		closing:   closing,
+		closeOnce: &sync.Once{},
+		inFlight:  &sync.WaitGroup{},
+	}
+	s.srv = &http.Server{
+		Addr:           addr,
+		Handler:        s.track(h),
+		ReadTimeout:    10 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+	return s
+}
+
+// track counts the requests being served. Hijacked connections like websockets are not tracked by the http server
+// so they have to be counted here to wait for them
+func (s *Server) track(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.inFlight.Add(1)
+		defer s.inFlight.Done()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Addr is the address the server listens at
+func (s *Server) Addr() string {
+	return s.srv.Addr
+}
+
+// Stats returns the db pool stats and the mail queue depth
+func (s *Server) Stats() Stats {
+	return s.ah.stats()
+}
+
+// ListenAndServe serves until Shutdown is called. It returns nil if the server was stopped by Shutdown. The metrics
+// are served in the background if they have their own port
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.srv.Addr)
+	if err != nil {
+		return err
+	}
+	if s.metrics != nil {
+		ml, err := net.Listen("tcp", s.metrics.Addr)
+		if err != nil {
+			l.Close()
+			return err
+		}
+		go func() {
+			if err := s.metrics.Serve(ml); err != nil && err != http.ErrServerClosed {
+				log.Printf("Metrics server stopped: %s", err)
+			}
+		}()
+	}
+	return s.Serve(l)
+}
+
+// Serve serves the requests coming from the listener. TLS is used if it's configured
+func (s *Server) Serve(l net.Listener) (err error) {
+	if s.tls != nil {
+		if s.srv.TLSConfig, err = s.tls.TLSConfig(); err != nil {
+			return err
+		}
+		err = s.srv.ServeTLS(l, s.tls.CertFile, s.tls.KeyFile)
+	} else {
+		err = s.srv.Serve(l)
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops accepting connections, tells the realtime connections to finish and waits for the in-flight
+// requests until ctx is done. Then it sends the queued mails and closes the session store and the database.
+// It returns the first error found
+func (s *Server) Shutdown(ctx context.Context) error {
+	var first error
+	keep := func(err error) {
+		if first == nil && err != nil {
+			first = err
+		}
+	}
+	s.closeOnce.Do(func() { close(s.closing) })
+	keep(s.srv.Shutdown(ctx))
+	if s.metrics != nil {
+		keep(s.metrics.Shutdown(ctx))
+	}
+	done := make(chan struct{})
+	go func() {
+		s.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		keep(ctx.Err())
+	}
+	keep(s.closeDeps())
+	return first
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestShutdownWaitsForInFlightRequests(t *testing.T) {
+	started := make(chan struct{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+	closed := false
+	s := newServer("127.0.0.1:0", h, make(chan struct{}), func() error {
+		closed = true
+		return nil
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(l) }()
+	type result struct {
+		body string
+		err  error
+	}
+	res := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String() + "/slow")
+		if err != nil {
+			res <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		res <- result{string(b), err}
+	}()
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Could not shut down: %s", err)
+	}
+	if !closed {
+		t.Errorf("Dependencies were not closed")
+	}
+	r := <-res
+	if r.err != nil || r.body != "done" {
+		t.Fatalf("In-flight request did not finish: %s %s", r.body, r.err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Serve returned an error after shutdown: %s", err)
+	}
+	if _, err := http.Get("http://" + l.Addr().String() + "/slow"); err == nil {
+		t.Errorf("Server accepted a request after shutdown")
+	}
+}
+
+func TestShutdownGivesUpAfterGracePeriod(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	s := newServer("127.0.0.1:0", h, make(chan struct{}), func() error { return nil })
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	go http.Get("http://" + l.Addr().String() + "/stuck")
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected %s and got %v", context.DeadlineExceeded, err)
+	}
+}
@@ -1,19 +1,35 @@
 package api
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"net/http"
+	"time"
 
 	"github.com/keydotcat/keycatd/managers"
 	"github.com/keydotcat/keycatd/models"
 	"github.com/keydotcat/keycatd/util"
 )
 
+// checkSessionCooling refuses sensitive operations from sessions created less than the cooling period ago.
+// The period is the strictest of the instance setting and the policies of the teams the request touches
+func (ah apiHandler) checkSessionCooling(r *http.Request) error {
+	if ctxGetSession(r.Context()).IsCooling(ctxGetSessionPolicy(r.Context(), ah).cooling) {
+		return util.NewErrorFrom(ErrSessionCooling)
+	}
+	return nil
+}
+
 func (ah apiHandler) sessionRoot(w http.ResponseWriter, r *http.Request) error {
 	var head string
 	head, r.URL.Path = shiftPath(r.URL.Path)
 	if len(head) == 0 {
-		//TODO: list all sessions
-		return util.NewErrorFrom(ErrNotFound)
+		switch r.Method {
+		case "GET":
+			return ah.sessionList(w, r)
+		case "DELETE":
+			return ah.sessionDeleteAll(w, r)
+		}
 	} else {
 		switch r.Method {
 		case "GET":
@@ -25,6 +41,85 @@ func (ah apiHandler) sessionRoot(w http.ResponseWriter, r *http.Request) error {
 	return util.NewErrorFrom(ErrNotFound)
 }
 
+// sessionHandle identifies a session in listings. Session ids are the bearer tokens so they are never listed
+func sessionHandle(id string) string {
+	h := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(h[:])
+}
+
+type sessionListEntry struct {
+	Handle       string    `json:"handle"`
+	Current      bool      `json:"current"`
+	Agent        string    `json:"agent"`
+	RequiresCSRF bool      `json:"csrf_required"`
+	LastAccess   time.Time `json:"last_access"`
+	LastIp       string    `json:"last_ip"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type sessionListResponse struct {
+	Sessions []sessionListEntry `json:"sessions"`
+}
+
+// GET /session
+func (ah apiHandler) sessionList(w http.ResponseWriter, r *http.Request) error {
+	current := ctxGetSession(r.Context())
+	sessions, err := ah.sm.GetAllSessions(ctxGetUser(r.Context()).Id)
+	if err != nil {
+		return err
+	}
+	slr := sessionListResponse{make([]sessionListEntry, len(sessions))}
+	for i, s := range sessions {
+		slr.Sessions[i] = sessionListEntry{sessionHandle(s.Id), s.Id == current.Id, s.Agent, s.RequiresCSRF, s.LastAccess, s.LastIp, s.CreatedAt}
+	}
+	return jsonResponse(w, slr)
+}
+
+// findSessionByHandle returns the id of the session of the user with the handle
+func (ah apiHandler) findSessionByHandle(uid, handle string) (string, error) {
+	sessions, err := ah.sm.GetAllSessions(uid)
+	if err != nil {
+		return "", err
+	}
+	for _, s := range sessions {
+		if sessionHandle(s.Id) == handle {
+			return s.Id, nil
+		}
+	}
+	return "", util.NewErrorFrom(models.ErrDoesntExist)
+}
+
+// DELETE /session
+// Logs out every session of the user, including the current one
+func (ah apiHandler) sessionDeleteAll(w http.ResponseWriter, r *http.Request) error {
+	if err := ah.checkSessionCooling(r); err != nil {
+		return err
+	}
+	if err := ah.sm.DeleteAllSessions(ctxGetUser(r.Context()).Id); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// deleteOtherSessions logs out every session of the user but the current one
+func (ah apiHandler) deleteOtherSessions(r *http.Request) error {
+	current := ctxGetSession(r.Context())
+	sessions, err := ah.sm.GetAllSessions(current.User)
+	if err != nil {
+		return err
+	}
+	for _, s := range sessions {
+		if s.Id == current.Id {
+			continue
+		}
+		if err := ah.sm.DeleteSession(s.Id); err != nil && !util.CheckErr(err, models.ErrDoesntExist) {
+			return err
+		}
+	}
+	return nil
+}
+
 type sessionGetTokenResponse struct {
 	*managers.Session
 	StoreToken string `json:"store_token,omitempty"`
@@ -48,11 +143,21 @@ func (ah apiHandler) sessionGetToken(w http.ResponseWriter, r *http.Request, tid
 }
 
 // DELETE /session/:token
+// Other sessions are revoked with the handle returned by GET /session
 func (ah apiHandler) sessionDeleteToken(w http.ResponseWriter, r *http.Request, tid string) error {
-	if len(tid) == 0 {
-		currentSession := ctxGetSession(r.Context())
+	currentSession := ctxGetSession(r.Context())
+	if len(tid) == 0 || tid == sessionHandle(currentSession.Id) {
 		tid = currentSession.Id
 	}
+	if tid != currentSession.Id {
+		if err := ah.checkSessionCooling(r); err != nil {
+			return err
+		}
+		var err error
+		if tid, err = ah.findSessionByHandle(currentSession.User, tid); err != nil {
+			return err
+		}
+	}
 	if err := ah.sm.DeleteSession(tid); err != nil {
 		return err
 	}
@@ -2,7 +2,14 @@ package api
 
 import (
 	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/keydotcat/keycatd/managers"
+	"github.com/keydotcat/keycatd/util"
 )
 
 func TestGetAndDeleteSessions(t *testing.T) {
@@ -34,3 +41,183 @@ func TestGetAndDeleteSessions(t *testing.T) {
 	r, err = GetRequest("/session/" + s.Id)
 	CheckErrorAndResponse(t, r, err, 404)
 }
+
+func TestListAndRevokeSessions(t *testing.T) {
+	u := loginDummyUser()
+	s, err := apiH.sm.NewSession(u.Id, "1.1.1.1", "none", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := apiH.sm.NewSession(getDummyUser().Id, "1.1.1.1", "none", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := GetRequest("/session")
+	CheckErrorAndResponse(t, r, err, 200)
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slr := &sessionListResponse{}
+	if err := json.Unmarshal(body, slr); err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]bool{}
+	for _, ls := range slr.Sessions {
+		found[ls.Handle] = true
+		if ls.Current != (ls.Handle == sessionHandle(activeSessionToken)) {
+			t.Errorf("Wrong current session flag for %s", ls.Handle)
+		}
+	}
+	if len(slr.Sessions) != 2 || !found[sessionHandle(s.Id)] || !found[sessionHandle(activeSessionToken)] {
+		t.Fatalf("Expected to list the 2 sessions of the user and got %d", len(slr.Sessions))
+	}
+	if strings.Contains(string(body), s.Id) {
+		t.Fatalf("Session tokens were listed")
+	}
+	r, err = DeleteRequest("/session/" + sessionHandle(other.Id))
+	CheckErrorAndResponse(t, r, err, 404)
+	if _, err := apiH.sm.GetSession(other.Id); err != nil {
+		t.Fatalf("Session of another user was revoked: %s", err)
+	}
+	r, err = DeleteRequest("/session/" + s.Id)
+	CheckErrorAndResponse(t, r, err, 404)
+	r, err = DeleteRequest("/session/" + sessionHandle(s.Id))
+	CheckErrorAndResponse(t, r, err, 200)
+	r, err = GetRequest("/session/" + s.Id)
+	CheckErrorAndResponse(t, r, err, 404)
+}
+
+func TestRollingSessionRefresh(t *testing.T) {
+	u := loginDummyUser()
+	s, err := apiH.sm.NewSession(u.Id, "1.1.1.1", "none", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ah := apiH
+	ah.options.rollingSessions = true
+	ah.options.sessionRefreshInterval = time.Hour
+	r := httptest.NewRequest("GET", "/api/user", nil)
+	w := httptest.NewRecorder()
+	ns := ah.refreshSession(w, r, s, "")
+	if ns == nil || !ns.LastAccess.Equal(s.LastAccess) {
+		t.Fatalf("Expected the session not to be refreshed within the interval")
+	}
+	ah.options.sessionRefreshInterval = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	ns = ah.refreshSession(w, r, s, "")
+	if ns == nil || !ns.LastAccess.After(s.LastAccess) {
+		t.Fatalf("Expected the session to be refreshed")
+	}
+	ah.options.rollingSessions = false
+	fs := ah.refreshSession(w, r, ns, "")
+	if !fs.LastAccess.Equal(ns.LastAccess) {
+		t.Errorf("Expected fixed sessions not to be refreshed")
+	}
+	if err := apiH.sm.DeleteSession(s.Id); err != nil {
+		t.Fatal(err)
+	}
+	ah.options.rollingSessions = true
+	if ah.refreshSession(w, r, ns, "") != nil {
+		t.Errorf("Expected deleted sessions not to be refreshed")
+	}
+}
+
+func TestSessionCooling(t *testing.T) {
+	u := loginDummyUser()
+	s, err := apiH.sm.NewSession(u.Id, "1.1.1.1", "none", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ah := apiH
+	r := httptest.NewRequest("DELETE", "/api/team", nil)
+	r = r.WithContext(ctxAddSession(r.Context(), s))
+	if err := ah.checkSessionCooling(r); err != nil {
+		t.Fatalf("Expected no cooling when disabled and got %s", err)
+	}
+	ah.options.sessionCooling = time.Hour
+	if err := ah.checkSessionCooling(r); !util.CheckErr(err, ErrSessionCooling) {
+		t.Fatalf("Expected error %s and got %s", ErrSessionCooling, err)
+	}
+	s.CreatedAt = s.CreatedAt.Add(-2 * time.Hour)
+	if err := ah.checkSessionCooling(r); err != nil {
+		t.Fatalf("Expected old sessions not to be cooling and got %s", err)
+	}
+}
+
+func TestSessionLifetime(t *testing.T) {
+	ah := apiH
+	ah.options.sessionMaxAge = 30 * 24 * time.Hour
+	ah.options.sessionIdleTimeout = 12 * time.Hour
+	ah.options.rollingSessions = true
+	ah.options.sessionRefreshInterval = time.Nanosecond
+	u := loginDummyUser()
+	s, err := apiH.sm.NewSession(u.Id, "1.1.1.1", "none", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ah.checkSessionLifetime(s); err != nil {
+		t.Fatalf("New session rejected: %s", err)
+	}
+	s.LastAccess = time.Now().Add(-13 * time.Hour)
+	err = ah.checkSessionLifetime(s)
+	if !util.CheckErr(err, ErrSessionIdle) || !util.CheckFieldErr(err, "session", "idle") {
+		t.Fatalf("Expected idle session to be rejected and got %v", err)
+	}
+	// Using the session slides the idle timeout forward
+	s.LastAccess = time.Now().Add(-11 * time.Hour)
+	r := httptest.NewRequest("GET", "/api/user", nil)
+	ns := ah.refreshSession(httptest.NewRecorder(), r, s, "")
+	if ns == nil {
+		t.Fatal("Expected the session to be refreshed")
+	}
+	ns.LastAccess = ns.LastAccess.Add(-2 * time.Hour)
+	if err := ah.checkSessionLifetime(ns); err != nil {
+		t.Fatalf("Refreshed session rejected: %s", err)
+	}
+	// Max age is counted from login no matter how active the session is
+	ns.CreatedAt = time.Now().Add(-31 * 24 * time.Hour)
+	ns.LastAccess = time.Now()
+	err = ah.checkSessionLifetime(ns)
+	if !util.CheckErr(err, ErrSessionExpired) || !util.CheckFieldErr(err, "session", "expired") {
+		t.Fatalf("Expected old session to be rejected and got %v", err)
+	}
+	w := httptest.NewRecorder()
+	httpErr(w, err)
+	if w.Code != 401 {
+		t.Fatalf("Expected 401 and got %d", w.Code)
+	}
+}
+
+func TestSessionStoreSelection(t *testing.T) {
+	c := Conf{}
+	c.setDefaults()
+	if c.SessionStore != sessionStoreMemory {
+		t.Fatalf("Expected the memory store by default and got %q", c.SessionStore)
+	}
+	sm, err := newSessionMgr(c, apiH.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbStore := managers.NewSessionMgrDB(apiH.db)
+	s, err := sm.NewSession(getDummyUser().Id, "1.1.1.1", "none", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dbStore.GetSession(s.Id); err == nil {
+		t.Fatal("Expected the default memory store to keep sessions out of the db")
+	}
+	if _, err := sm.GetSession(s.Id); err != nil {
+		t.Fatal(err)
+	}
+	c.SessionStore = sessionStoreDB
+	if sm, err = newSessionMgr(c, apiH.db); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = sm.NewSession(getDummyUser().Id, "1.1.1.1", "none", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dbStore.GetSession(s.Id); err != nil {
+		t.Fatalf("Expected the db store when it is chosen: %s", err)
+	}
+}
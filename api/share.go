@@ -0,0 +1,65 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/keydotcat/keycatd/models"
+	"github.com/keydotcat/keycatd/util"
+)
+
+type vaultShareSecretRequest struct {
+	Data       []byte `json:"data"`
+	MaxUses    int    `json:"max_uses"`
+	TTLSeconds int    `json:"ttl_seconds"`
+}
+
+type vaultShareSecretResponse struct {
+	Token string `json:"token"`
+	Url   string `json:"url"`
+	*models.ShareLink
+}
+
+// POST /team/:tid/vault/:vid/secret/:sid/share
+// data is the secret encrypted with a new key that is given to the recipient apart from the link
+func (ah apiHandler) vaultShareSecret(w http.ResponseWriter, r *http.Request, v *models.Vault, sid string) error {
+	req := &vaultShareSecretRequest{}
+	if err := jsonDecode(w, r, secretRequestMaxSize(), req); err != nil {
+		return err
+	}
+	ctx := r.Context()
+	opts := models.ShareLinkOptions{Data: req.Data, MaxUses: req.MaxUses, TTL: time.Duration(req.TTLSeconds) * time.Second}
+	token, sl, err := v.CreateShareLink(ctx, ctxGetUser(ctx), sid, opts)
+	if err != nil {
+		return err
+	}
+	return jsonResponse(w, vaultShareSecretResponse{token, ah.mail.rootUrl + "/#/share/" + token, sl})
+}
+
+// Anyone with the token can open a link so only the shared copy is returned and nothing about the team
+type shareOpenResponse struct {
+	Data          []byte    `json:"data"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	RemainingUses int       `json:"remaining_uses"`
+}
+
+// /share/:token
+// Opening a link is a POST so link previews don't use it up
+func (ah apiHandler) shareRoot(w http.ResponseWriter, r *http.Request) error {
+	token, _ := shiftPath(r.URL.Path)
+	if len(token) == 0 || r.Method != "POST" {
+		return util.NewErrorFrom(ErrNotFound)
+	}
+	ctx := r.Context()
+	sl, err := models.ResolveShareLink(ctx, token)
+	if err != nil {
+		return err
+	}
+	if p, err := (&models.Team{Id: sl.Team}).GetPolicy(ctx); err != nil {
+		log.Printf("Could not load the policy of team %s to log a share link read: %s", sl.Team, err)
+	} else {
+		ah.recordSecretReads(p, sl.Reader(), []*models.Secret{{Vault: sl.Vault, Id: sl.Secret}})
+	}
+	return jsonResponse(w, shareOpenResponse{sl.Data, sl.ExpiresAt, sl.RemainingUses})
+}
@@ -0,0 +1,20 @@
+package api
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Stats has the state of the resources that can run out under load
+type Stats struct {
+	DB sql.DBStats `json:"db"`
+	// Mails waiting to be sent
+	MailQueue int `json:"mail_queue"`
+	// How long the oldest of them has been waiting
+	MailQueueAge time.Duration `json:"mail_queue_age"`
+}
+
+func (ah apiHandler) stats() Stats {
+	pending, oldest := ah.mail.pending()
+	return Stats{DB: ah.db.Stats(), MailQueue: pending, MailQueueAge: oldest}
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+)
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) { return fakeConn{}, nil }
+
+type fakeConn struct{}
+
+func (fakeConn) Prepare(query string) (driver.Stmt, error) { return nil, errors.New("not implemented") }
+func (fakeConn) Close() error                              { return nil }
+func (fakeConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not implemented") }
+
+func init() {
+	sql.Register("keycat-fake", fakeDriver{})
+}
+
+func TestDBPoolLimitsApplied(t *testing.T) {
+	dbp, err := sql.Open("keycat-fake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbp.Close()
+	configureDBPool(dbp, Conf{DBMaxConns: 3, DBMaxIdleConns: 1, DBConnMaxLifetime: 10 * time.Millisecond})
+	ctx := context.Background()
+	conns := []*sql.Conn{}
+	for i := 0; i < 3; i++ {
+		conn, err := dbp.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	ah := apiHandler{db: dbp, mail: &mailer{}}
+	if st := ah.stats(); st.DB.MaxOpenConnections != 3 || st.DB.InUse != 3 {
+		t.Fatalf("Expected 3 connections in use out of 3 and got %d out of %d", st.DB.InUse, st.DB.MaxOpenConnections)
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	if st := ah.stats(); st.DB.Idle != 1 || st.DB.MaxIdleClosed != 2 {
+		t.Fatalf("Expected 1 idle connection and 2 closed and got %d and %d", st.DB.Idle, st.DB.MaxIdleClosed)
+	}
+	time.Sleep(50 * time.Millisecond)
+	conn, err := dbp.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if st := ah.stats(); st.DB.MaxLifetimeClosed == 0 {
+		t.Errorf("Expected the idle connection to be closed after its lifetime")
+	}
+}
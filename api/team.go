@@ -2,7 +2,10 @@ package api
 
 import (
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/keydotcat/keycatd/managers"
 	"github.com/keydotcat/keycatd/models"
 	"github.com/keydotcat/keycatd/util"
 )
@@ -25,19 +28,27 @@ func (ah apiHandler) teamRoot(w http.ResponseWriter, r *http.Request) error {
 		if err != nil {
 			return err
 		}
+		p, err := t.GetPolicy(r.Context())
+		if err != nil {
+			return err
+		}
+		if r, err = ah.enforceTeamPolicies(r, p); err != nil {
+			return err
+		}
+		r = r.WithContext(ctxAddTeamPolicy(r.Context(), p))
 		return ah.validTeamRoot(w, r, t)
 	}
 }
 
 type teamGetAllResponse struct {
-	Teams []*models.Team `json:"teams"`
+	Teams []models.TeamMembership `json:"teams"`
 }
 
 // GET /team
 func (ah apiHandler) teamGetAll(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	currentUser := ctxGetUser(ctx)
-	teams, err := currentUser.GetTeams(ctx)
+	teams, err := currentUser.GetTeamsWithRole(ctx)
 	if err != nil {
 		return err
 	}
@@ -75,6 +86,8 @@ func (ah apiHandler) validTeamRoot(w http.ResponseWriter, r *http.Request, t *mo
 		switch r.Method {
 		case "GET":
 			return ah.teamGetInfo(w, r, t)
+		case "PATCH":
+			return ah.teamRename(w, r, t)
 		default:
 			return util.NewErrorFrom(ErrNotFound)
 		}
@@ -86,6 +99,43 @@ func (ah apiHandler) validTeamRoot(w http.ResponseWriter, r *http.Request, t *mo
 			return ah.vaultRoot(w, r, t)
 		case "secret":
 			return ah.teamSecretRoot(w, r, t)
+		case "bulk_invite":
+			if r.Method == "POST" {
+				return ah.heavyOp(w, func() error { return ah.teamBulkInvite(w, r, t) })
+			}
+		case "email_status":
+			if r.Method == "POST" {
+				return ah.heavyOp(w, func() error { return ah.teamClassifyEmails(w, r, t) })
+			}
+		case "audit":
+			if r.Method == "GET" {
+				return ah.teamGetAuditLog(w, r, t)
+			}
+		case "invite":
+			email, _ := shiftPath(r.URL.Path)
+			switch {
+			case r.Method == "GET" && len(email) == 0:
+				return ah.teamGetPendingInvites(w, r, t)
+			case r.Method == "DELETE" && len(email) > 0:
+				return ah.teamRevokeInvite(w, r, t, email)
+			}
+		case "policy":
+			switch r.Method {
+			case "GET":
+				return ah.teamGetPolicy(w, r, t)
+			case "PUT":
+				if err := ah.checkSessionCooling(r); err != nil {
+					return err
+				}
+				return ah.teamSetPolicy(w, r, t)
+			}
+		case "leave":
+			if r.Method == "POST" {
+				if err := ah.checkSessionCooling(r); err != nil {
+					return err
+				}
+				return ah.teamLeave(w, r, t)
+			}
 		}
 	}
 	return util.NewErrorFrom(ErrNotFound)
@@ -102,6 +152,23 @@ func (ah apiHandler) teamGetInfo(w http.ResponseWriter, r *http.Request, t *mode
 	return jsonResponse(w, tf)
 }
 
+type renameRequest struct {
+	Name string `json:"name"`
+}
+
+// PATCH /team/:tid
+func (ah apiHandler) teamRename(w http.ResponseWriter, r *http.Request, t *models.Team) error {
+	req := &renameRequest{}
+	if err := jsonDecode(w, r, 1024, req); err != nil {
+		return err
+	}
+	ctx := r.Context()
+	if err := t.Rename(ctx, ctxGetUser(ctx), req.Name); err != nil {
+		return err
+	}
+	return ah.teamGetInfo(w, r, t)
+}
+
 func (ah apiHandler) validTeamUserRoot(w http.ResponseWriter, r *http.Request, t *models.Team) error {
 	var head string
 	head, r.URL.Path = shiftPath(r.URL.Path)
@@ -111,16 +178,32 @@ func (ah apiHandler) validTeamUserRoot(w http.ResponseWriter, r *http.Request, t
 			return ah.teamInviteUser(w, r, t)
 		}
 	} else {
-		switch r.Method {
-		case "PATCH":
+		var action string
+		action, r.URL.Path = shiftPath(r.URL.Path)
+		if r.Method != "GET" && action != "access" {
+			if err := ah.checkSessionCooling(r); err != nil {
+				return err
+			}
+		}
+		switch {
+		case len(action) == 0 && r.Method == "PATCH":
 			return ah.teamModifyUser(w, r, t, head)
+		case len(action) == 0 && r.Method == "DELETE":
+			return ah.teamRemoveUser(w, r, t, head)
+		case action == "rekey" && r.Method == "POST":
+			return ah.heavyOp(w, func() error { return ah.teamRekeyRemovedUser(w, r, t, head) })
+		case action == "access" && r.Method == "POST":
+			return ah.teamGrantUserAccess(w, r, t, head)
+		case action == "owner" && r.Method == "POST":
+			return ah.teamTransferOwnership(w, r, t, head)
 		}
 	}
 	return util.NewErrorFrom(ErrNotFound)
 }
 
 type teamInviteUserRequest struct {
-	Invite string `json:"invite"`
+	Invite string            `json:"invite"`
+	Keys   map[string][]byte `json:"keys"`
 }
 
 // POST /team/:tid/user
@@ -128,10 +211,10 @@ func (ah apiHandler) teamInviteUser(w http.ResponseWriter, r *http.Request, t *m
 	ctx := r.Context()
 	u := ctxGetUser(ctx)
 	tcr := &teamInviteUserRequest{}
-	if err := jsonDecode(w, r, 1024, tcr); err != nil {
+	if err := jsonDecode(w, r, 16*1024, tcr); err != nil {
 		return err
 	}
-	invite, err := t.AddOrInviteUserByEmail(ctx, u, tcr.Invite)
+	invite, err := t.AddOrInviteUserByEmail(ctx, u, tcr.Invite, tcr.Keys)
 	if err != nil && !util.CheckErr(err, models.ErrAlreadyInvited) {
 		return err
 	}
@@ -139,6 +222,10 @@ func (ah apiHandler) teamInviteUser(w http.ResponseWriter, r *http.Request, t *m
 		if err := ah.mail.sendInvitationMail(t, u, invite, r.Header.Get("X-Locale")); err != nil {
 			panic(err)
 		}
+		ah.metrics.Inc(managers.METRIC_INVITES_SENT)
+		ah.webhook(managers.WEBHOOK_EVENT_USER_INVITED, t, u.Id, invite.Email)
+	} else if err == nil {
+		ah.webhook(managers.WEBHOOK_EVENT_USER_ADDED, t, u.Id, tcr.Invite)
 	}
 	tf, err := t.GetTeamFull(ctx, u)
 	if err != nil {
@@ -149,6 +236,7 @@ func (ah apiHandler) teamInviteUser(w http.ResponseWriter, r *http.Request, t *m
 
 type teamModifyUserRequest struct {
 	Admin bool              `json:"admin"`
+	Role  string            `json:"role"`
 	Keys  map[string][]byte `json:"keys"`
 }
 
@@ -169,9 +257,12 @@ func (ah apiHandler) teamModifyUser(w http.ResponseWriter, r *http.Request, t *m
 	if err != nil {
 		return err
 	}
-	if tiur.Admin {
+	switch {
+	case tiur.Admin || tiur.Role == models.TEAM_ROLE_ADMIN:
 		err = t.PromoteUser(ctx, admin, u, models.VaultKeyPair{Keys: tiur.Keys})
-	} else {
+	case len(tiur.Role) > 0:
+		err = t.SetUserRole(ctx, admin, u, tiur.Role)
+	default:
 		err = t.DemoteUser(ctx, admin, u)
 	}
 	if err != nil {
@@ -183,3 +274,218 @@ func (ah apiHandler) teamModifyUser(w http.ResponseWriter, r *http.Request, t *m
 	}
 	return jsonResponse(w, teamModifyUserResponse{t.Id, tuf})
 }
+
+type teamRemoveUserResponse struct {
+	Vaults []*models.Vault `json:"vaults"`
+}
+
+// DELETE /team/:tid/user/:uid
+func (ah apiHandler) teamRemoveUser(w http.ResponseWriter, r *http.Request, t *models.Team, uid string) error {
+	ctx := r.Context()
+	admin := ctxGetUser(ctx)
+	u, err := models.FindUser(ctx, uid)
+	if err != nil {
+		return err
+	}
+	vs, err := t.BeginRemoveUser(ctx, admin, u)
+	if err != nil {
+		return err
+	}
+	ah.webhook(managers.WEBHOOK_EVENT_USER_REMOVED, t, admin.Id, u.Id)
+	return jsonResponse(w, teamRemoveUserResponse{vs})
+}
+
+type teamRekeyRemovedUserRequest struct {
+	Vaults map[string]models.VaultRewrap `json:"vaults"`
+}
+
+// POST /team/:tid/user/:uid/rekey
+func (ah apiHandler) teamRekeyRemovedUser(w http.ResponseWriter, r *http.Request, t *models.Team, uid string) error {
+	trr := &teamRekeyRemovedUserRequest{}
+	if err := jsonDecode(w, r, 10*1024*1024, trr); err != nil {
+		return err
+	}
+	ctx := r.Context()
+	admin := ctxGetUser(ctx)
+	u, err := models.FindUser(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if err := t.FinalizeRemoveUser(ctx, admin, u, trr.Vaults); err != nil {
+		return err
+	}
+	tuf, err := t.GetUsersAfiliationFull(ctx)
+	if err != nil {
+		return err
+	}
+	return jsonResponse(w, teamModifyUserResponse{t.Id, tuf})
+}
+
+// POST /team/:tid/user/:uid/owner
+func (ah apiHandler) teamTransferOwnership(w http.ResponseWriter, r *http.Request, t *models.Team, uid string) error {
+	ctx := r.Context()
+	owner := ctxGetUser(ctx)
+	u, err := models.FindUser(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if err := t.TransferOwnership(ctx, owner, u); err != nil {
+		return err
+	}
+	ah.webhook(managers.WEBHOOK_EVENT_OWNER_TRANSFERRED, t, owner.Id, u.Id)
+	ah.rotateCsrfAfterPrivChange(w, r)
+	tf, err := t.GetTeamFull(ctx, owner)
+	if err != nil {
+		return err
+	}
+	return jsonResponse(w, tf)
+}
+
+type teamGrantUserAccessRequest struct {
+	Keys map[string][]byte `json:"keys"`
+}
+
+// POST /team/:tid/user/:uid/access
+func (ah apiHandler) teamGrantUserAccess(w http.ResponseWriter, r *http.Request, t *models.Team, uid string) error {
+	tgr := &teamGrantUserAccessRequest{}
+	if err := jsonDecode(w, r, 16*1024, tgr); err != nil {
+		return err
+	}
+	ctx := r.Context()
+	admin := ctxGetUser(ctx)
+	u, err := models.FindUser(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if err := t.GrantAllMembersAccess(ctx, admin, u, tgr.Keys); err != nil {
+		return err
+	}
+	tuf, err := t.GetUsersAfiliationFull(ctx)
+	if err != nil {
+		return err
+	}
+	return jsonResponse(w, teamModifyUserResponse{t.Id, tuf})
+}
+
+const (
+	classifyEmailsMax        = 100
+	classifyEmailsRateLimit  = 10
+	classifyEmailsRateWindow = time.Minute
+)
+
+type teamClassifyEmailsRequest struct {
+	Emails []string `json:"emails"`
+}
+
+type teamClassifyEmailsResponse struct {
+	Emails map[string]string `json:"emails"`
+}
+
+// POST /team/:tid/email_status
+func (ah apiHandler) teamClassifyEmails(w http.ResponseWriter, r *http.Request, t *models.Team) error {
+	tcr := &teamClassifyEmailsRequest{}
+	if err := jsonDecode(w, r, 32*1024, tcr); err != nil {
+		return err
+	}
+	if len(tcr.Emails) > classifyEmailsMax {
+		return util.NewErrorf("Too many emails. Up to %d can be checked at once", classifyEmailsMax)
+	}
+	ctx := r.Context()
+	u := ctxGetUser(ctx)
+	if !ah.classifyLimiter.allow(u.Id) {
+		return util.NewErrorFrom(ErrTooManyRequests)
+	}
+	status, err := t.ClassifyEmails(ctx, u, tcr.Emails)
+	if err != nil {
+		return err
+	}
+	return jsonResponse(w, teamClassifyEmailsResponse{status})
+}
+
+type teamBulkInviteRequest struct {
+	Emails []string `json:"emails"`
+}
+
+type teamBulkInviteResponse struct {
+	Results []*models.BulkInviteResult `json:"results"`
+}
+
+// GET /team/:tid/invite
+func (ah apiHandler) teamGetPendingInvites(w http.ResponseWriter, r *http.Request, t *models.Team) error {
+	ctx := r.Context()
+	pending, err := t.GetPendingInvites(ctx, ctxGetUser(ctx))
+	if err != nil {
+		return err
+	}
+	return jsonResponse(w, pending)
+}
+
+// DELETE /team/:tid/invite/:email
+func (ah apiHandler) teamRevokeInvite(w http.ResponseWriter, r *http.Request, t *models.Team, email string) error {
+	ctx := r.Context()
+	if err := t.RevokeInvite(ctx, ctxGetUser(ctx), email); err != nil {
+		return err
+	}
+	return ah.teamGetInfo(w, r, t)
+}
+
+// POST /team/:tid/bulk_invite
+func (ah apiHandler) teamBulkInvite(w http.ResponseWriter, r *http.Request, t *models.Team) error {
+	tbr := &teamBulkInviteRequest{}
+	if err := jsonDecode(w, r, 32*1024, tbr); err != nil {
+		return err
+	}
+	ctx := r.Context()
+	u := ctxGetUser(ctx)
+	results, err := t.BulkAddOrInvite(ctx, u, tbr.Emails)
+	if err != nil {
+		return err
+	}
+	for _, res := range results {
+		if res.Status == models.EMAIL_STATUS_ADDED {
+			ah.webhook(managers.WEBHOOK_EVENT_USER_ADDED, t, u.Id, res.Email)
+		}
+		if res.Invite == nil {
+			continue
+		}
+		if err := ah.mail.sendInvitationMail(t, u, res.Invite, r.Header.Get("X-Locale")); err != nil {
+			panic(err)
+		}
+		ah.metrics.Inc(managers.METRIC_INVITES_SENT)
+		ah.webhook(managers.WEBHOOK_EVENT_USER_INVITED, t, u.Id, res.Email)
+	}
+	return jsonResponse(w, teamBulkInviteResponse{results})
+}
+
+// POST /team/:tid/leave
+func (ah apiHandler) teamLeave(w http.ResponseWriter, r *http.Request, t *models.Team) error {
+	if err := t.Leave(r.Context(), ctxGetUser(r.Context())); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+type teamAuditLogResponse struct {
+	Entries []*models.TeamAuditLog `json:"entries"`
+}
+
+// GET /team/:tid/audit?since=<RFC3339>&after=<id>&limit=<n>
+// Send the created_at and id of the last entry as since and after to get the next page
+func (ah apiHandler) teamGetAuditLog(w http.ResponseWriter, r *http.Request, t *models.Team) error {
+	ctx := r.Context()
+	q := r.URL.Query()
+	var since time.Time
+	if v := q.Get("since"); len(v) > 0 {
+		var err error
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			return util.NewErrorFrom(models.ErrInvalidAttributes)
+		}
+	}
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	entries, err := t.GetAuditLog(ctx, ctxGetUser(ctx), since, q.Get("after"), limit)
+	if err != nil {
+		return err
+	}
+	return jsonResponse(w, teamAuditLogResponse{entries})
+}
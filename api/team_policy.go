@@ -0,0 +1,132 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/keydotcat/keycatd/models"
+	"github.com/keydotcat/keycatd/util"
+)
+
+// sessionPolicy is the effective session policy for a request. It starts with the instance settings and each
+// team the request touches can only make it stricter
+type sessionPolicy struct {
+	requireTOTP bool
+	cooling     time.Duration
+	idle        time.Duration
+}
+
+func (ah apiHandler) instanceSessionPolicy() sessionPolicy {
+	return sessionPolicy{cooling: ah.options.sessionCooling, idle: ah.options.sessionIdleTimeout}
+}
+
+func (sp sessionPolicy) tighten(p *models.TeamPolicy) sessionPolicy {
+	sp.requireTOTP = sp.requireTOTP || p.RequireTOTP
+	if c := time.Duration(p.SessionCoolingMinutes) * time.Minute; c > sp.cooling {
+		sp.cooling = c
+	}
+	if i := time.Duration(p.SessionIdleMinutes) * time.Minute; i > 0 && (sp.idle == 0 || i < sp.idle) {
+		sp.idle = i
+	}
+	return sp
+}
+
+// enforceTeamPolicies computes the effective policy from the instance settings and the given team policies, checks
+// the current session against it and stores it in the request context for later checks like the session cooling
+func (ah apiHandler) enforceTeamPolicies(r *http.Request, policies ...*models.TeamPolicy) (*http.Request, error) {
+	ctx := r.Context()
+	sp := ctxGetSessionPolicy(ctx, ah)
+	for _, p := range policies {
+		sp = sp.tighten(p)
+	}
+	if sp.idle > 0 && ctxGetSessionIdle(ctx) > sp.idle {
+		return r, sessionEndedErr(ErrSessionIdle, "idle")
+	}
+	if sp.requireTOTP {
+		hasTOTP, err := ctxGetUser(ctx).HasTOTP(ctx)
+		if err != nil {
+			return r, err
+		}
+		if !hasTOTP {
+			return r, util.NewErrorFrom(ErrTeamRequiresTOTP)
+		}
+	}
+	return r.WithContext(ctxAddSessionPolicy(ctx, sp)), nil
+}
+
+// enforceAllTeamPolicies applies the policies of every team of the user. Used by requests that read data of all
+// the teams at once
+func (ah apiHandler) enforceAllTeamPolicies(r *http.Request) (*http.Request, error) {
+	policies, err := ctxGetUser(r.Context()).GetTeamPolicies(r.Context())
+	if err != nil {
+		return r, err
+	}
+	return ah.enforceTeamPolicies(r, policies...)
+}
+
+// teamsFailingPolicies returns the teams whose policy the current session does not satisfy. Used by the realtime
+// streams so a team the session cannot access only hides its own events instead of closing the stream
+func (ah apiHandler) teamsFailingPolicies(r *http.Request, policies []*models.TeamPolicy) (map[string]bool, error) {
+	failing := map[string]bool{}
+	for _, p := range policies {
+		_, err := ah.enforceTeamPolicies(r, p)
+		switch {
+		case util.CheckErr(err, ErrSessionIdle) || util.CheckErr(err, ErrTeamRequiresTOTP):
+			failing[p.Team] = true
+		case err != nil:
+			return nil, err
+		}
+	}
+	return failing, nil
+}
+
+func ctxAddSessionPolicy(ctx context.Context, sp sessionPolicy) context.Context {
+	return context.WithValue(ctx, contextSessionPolicyKey, sp)
+}
+
+func ctxGetSessionPolicy(ctx context.Context, ah apiHandler) sessionPolicy {
+	sp, ok := ctx.Value(contextSessionPolicyKey).(sessionPolicy)
+	if !ok {
+		return ah.instanceSessionPolicy()
+	}
+	return sp
+}
+
+func ctxAddSessionIdle(ctx context.Context, idle time.Duration) context.Context {
+	return context.WithValue(ctx, contextSessionIdleKey, idle)
+}
+
+func ctxGetSessionIdle(ctx context.Context) time.Duration {
+	idle, _ := ctx.Value(contextSessionIdleKey).(time.Duration)
+	return idle
+}
+
+// GET /team/:tid/policy
+func (ah apiHandler) teamGetPolicy(w http.ResponseWriter, r *http.Request, t *models.Team) error {
+	p, err := t.GetPolicy(r.Context())
+	if err != nil {
+		return err
+	}
+	return jsonResponse(w, p)
+}
+
+// PUT /team/:tid/policy
+func (ah apiHandler) teamSetPolicy(w http.ResponseWriter, r *http.Request, t *models.Team) error {
+	p := &models.TeamPolicy{}
+	if err := jsonDecode(w, r, 1024, p); err != nil {
+		return err
+	}
+	if cooling := time.Duration(p.SessionCoolingMinutes) * time.Minute; cooling > 0 && cooling < ah.options.sessionCooling {
+		return util.NewErrorFrom(ErrPolicyLooserThanInstance)
+	}
+	// Idle time is measured with the last refresh of the session so shorter timeouts would kick active users out
+	if idle := time.Duration(p.SessionIdleMinutes) * time.Minute; idle > 0 && idle <= ah.options.sessionRefreshInterval {
+		return util.NewErrorf("session_idle_minutes has to be longer than the session refresh interval (%s)", ah.options.sessionRefreshInterval)
+	}
+	ctx := r.Context()
+	if err := t.SetPolicy(ctx, ctxGetUser(ctx), p); err != nil {
+		return err
+	}
+	return jsonResponse(w, p)
+}
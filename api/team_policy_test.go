@@ -0,0 +1,24 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keydotcat/keycatd/models"
+)
+
+func TestSessionPolicyTighten(t *testing.T) {
+	sp := sessionPolicy{cooling: 10 * time.Minute}
+	sp = sp.tighten(&models.TeamPolicy{SessionCoolingMinutes: 5, SessionIdleMinutes: 60})
+	if sp.cooling != 10*time.Minute || sp.idle != time.Hour || sp.requireTOTP {
+		t.Fatalf("Team policy loosened the instance one: %+v", sp)
+	}
+	sp = sp.tighten(&models.TeamPolicy{RequireTOTP: true, SessionCoolingMinutes: 30})
+	if sp.cooling != 30*time.Minute || sp.idle != time.Hour || !sp.requireTOTP {
+		t.Fatalf("Unexpected effective policy: %+v", sp)
+	}
+	sp = sp.tighten(&models.TeamPolicy{SessionIdleMinutes: 20})
+	if sp.cooling != 30*time.Minute || sp.idle != 20*time.Minute || !sp.requireTOTP {
+		t.Fatalf("Unexpected effective policy: %+v", sp)
+	}
+}
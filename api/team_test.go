@@ -42,4 +42,9 @@ func TestGetAllTeams(t *testing.T) {
 	if len(teams)+1 != len(sga.Teams) {
 		t.Fatalf("Unexpected number of teams: %d vs %d", len(teams)+1, len(sga.Teams))
 	}
+	for _, tm := range sga.Teams {
+		if tm.Role != models.TEAM_ROLE_OWNER {
+			t.Errorf("Expected to be the owner of team %s and got role %s", tm.Id, tm.Role)
+		}
+	}
 }
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"crypto/tls"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+var tlsDefaultCipherSuites = []string{
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+}
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Only the suites that go considers secure are accepted
+func tlsCipherSuiteIds(names []string) ([]uint16, error) {
+	known := map[string]uint16{}
+	for _, cs := range tls.CipherSuites() {
+		known[cs.Name] = cs.ID
+	}
+	ids := make([]uint16, len(names))
+	for i, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, util.NewErrorf("Unknown or insecure tls cipher suite %s", name)
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
+
+// TLSConfig builds the tls configuration for the server from the tls section of the config
+func (c ConfTLS) TLSConfig() (*tls.Config, error) {
+	suites := c.CipherSuites
+	if len(suites) == 0 {
+		suites = tlsDefaultCipherSuites
+	}
+	ids, err := tlsCipherSuiteIds(suites)
+	if err != nil {
+		return nil, err
+	}
+	minVersion := c.MinVersion
+	if len(minVersion) == 0 {
+		minVersion = "1.2"
+	}
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, util.NewErrorf("Invalid tls.min_version %s. It has to be 1.2 or 1.3", minVersion)
+	}
+	return &tls.Config{
+		MinVersion:               version,
+		CipherSuites:             ids,
+		PreferServerCipherSuites: true,
+	}, nil
+}
@@ -0,0 +1,37 @@
+package api
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestTLSConfig(t *testing.T) {
+	c := ConfTLS{CertFile: "cert", KeyFile: "key"}
+	tc, err := c.TLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc.MinVersion != tls.VersionTLS12 || len(tc.CipherSuites) != len(tlsDefaultCipherSuites) {
+		t.Errorf("Unexpected default tls config")
+	}
+	c.CipherSuites = []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}
+	c.MinVersion = "1.3"
+	tc, err = c.TLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc.MinVersion != tls.VersionTLS13 || len(tc.CipherSuites) != 1 || tc.CipherSuites[0] != tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384 {
+		t.Errorf("Tls config does not match the configuration")
+	}
+	for _, suite := range []string{"TLS_RSA_WITH_RC4_128_SHA", "TLS_MADE_UP"} {
+		c.CipherSuites = []string{suite}
+		if _, err = c.TLSConfig(); err == nil {
+			t.Errorf("Expected %s to be rejected", suite)
+		}
+	}
+	c.CipherSuites = nil
+	c.MinVersion = "1.0"
+	if _, err = c.TLSConfig(); err == nil {
+		t.Errorf("Expected tls 1.0 to be rejected")
+	}
+}
@@ -2,7 +2,10 @@ package api
 
 import (
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/keydotcat/keycatd/models"
 	"github.com/keydotcat/keycatd/util"
 )
 
@@ -15,7 +18,52 @@ func (ah apiHandler) userRoot(w http.ResponseWriter, r *http.Request) error {
 			return ah.userGetInfo(w, r)
 		case "PUT", "PATCH":
 			return ah.userUpdate(w, r)
+		case "DELETE":
+			return ah.userDelete(w, r)
 		}
+	} else if head == "export" && r.Method == "GET" {
+		var err error
+		if r, err = ah.enforceAllTeamPolicies(r); err != nil {
+			return err
+		}
+		if err := ah.checkSessionCooling(r); err != nil {
+			return err
+		}
+		return ah.heavyOp(w, func() error { return ah.userExport(w, r) })
+	} else if head == "search" && r.Method == "GET" {
+		var err error
+		if r, err = ah.enforceAllTeamPolicies(r); err != nil {
+			return err
+		}
+		return ah.userSearchSecrets(w, r)
+	} else if head == "totp" {
+		if err := ah.checkSessionCooling(r); err != nil {
+			return err
+		}
+		switch r.Method {
+		case "POST":
+			return ah.userEnableTOTP(w, r)
+		case "DELETE":
+			return ah.userDisableTOTP(w, r)
+		}
+	} else if head == "kdf" && r.Method == "PUT" {
+		return ah.userUpgradeKdf(w, r)
+	} else if head == "keys" && r.Method == "PUT" {
+		if err := ah.checkSessionCooling(r); err != nil {
+			return err
+		}
+		return ah.userRotateKeys(w, r)
+	} else if head == "webauthn" {
+		return ah.userWebAuthnRoot(w, r)
+	} else if head == "email" {
+		return ah.userEmailRoot(w, r)
+	} else if head == "approval" {
+		return ah.userApprovalRoot(w, r)
+	} else if head == "suspension" {
+		return ah.userSuspensionRoot(w, r)
+	} else if head == "invitation" && r.Method == "POST" {
+		token, _ := shiftPath(r.URL.Path)
+		return ah.userAcceptInvitation(w, r, token)
 	}
 	return util.NewErrorFrom(ErrNotFound)
 }
@@ -31,10 +79,53 @@ func (ah apiHandler) userGetInfo(w http.ResponseWriter, r *http.Request) error {
 	return jsonResponse(w, uf)
 }
 
+// DELETE /user
+func (ah apiHandler) userDelete(w http.ResponseWriter, r *http.Request) error {
+	if err := ah.checkSessionCooling(r); err != nil {
+		return err
+	}
+	ctx := r.Context()
+	u := ctxGetUser(ctx)
+	if err := u.Delete(ctx); err != nil {
+		return err
+	}
+	if err := ah.sm.DeleteAllSessions(u.Id); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+type userSearchSecretsResponse struct {
+	Results []*models.SecretSearchResult `json:"results"`
+}
+
+// GET /user/search?q=<query>&limit=<n>
+func (ah apiHandler) userSearchSecrets(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	q := r.URL.Query()
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	res, err := ctxGetUser(ctx).SearchSecrets(ctx, q.Get("q"), limit)
+	if err != nil {
+		return err
+	}
+	found := []*models.Secret{}
+	for _, sr := range res {
+		found = append(found, sr.Secrets...)
+	}
+	served, _, err := ah.withholdJustifiedSecrets(r, found)
+	if err != nil {
+		return err
+	}
+	ah.logSecretReads(r, served)
+	return jsonResponse(w, userSearchSecretsResponse{res})
+}
+
 type userUpdateRequest struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
-	KeyPack  []byte `json:"user_keys"`
+	Email         string          `json:"email"`
+	Password      string          `json:"password"`
+	KeyPack       []byte          `json:"user_keys"`
+	PasswordCheck *PasswordReport `json:"password_check"`
 }
 
 func (ah apiHandler) userUpdate(w http.ResponseWriter, r *http.Request) error {
@@ -44,6 +135,9 @@ func (ah apiHandler) userUpdate(w http.ResponseWriter, r *http.Request) error {
 	}
 	ctx := r.Context()
 	u := ctxGetUser(ctx)
+	if err := ah.checkSessionCooling(r); err != nil {
+		return err
+	}
 	if len(uur.Email) > 3 {
 		t, err := u.ChangeEmail(ctx, uur.Email)
 		if err != nil {
@@ -56,12 +150,132 @@ func (ah apiHandler) userUpdate(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 	if len(uur.Password) > 0 {
+		if err := ah.checkPassword(ctx, uur.PasswordCheck); err != nil {
+			return err
+		}
 		err := u.ChangePassword(ctx, uur.Password, uur.KeyPack)
 		if err != nil {
 			return err
 		}
+		if err := ah.deleteOtherSessions(r); err != nil {
+			return err
+		}
+		ah.rotateCsrfAfterPrivChange(w, r)
 		w.WriteHeader(http.StatusOK)
 		return nil
 	}
 	return util.NewErrorFrom(ErrNotFound)
 }
+
+type userUpgradeKdfRequest struct {
+	CurrentPassword string         `json:"current_password"`
+	Password        string         `json:"password"`
+	KeyPack         []byte         `json:"user_keys"`
+	Kdf             util.KDFParams `json:"kdf"`
+}
+
+// PUT /user/kdf
+// Called after a login that answered with kdf_upgrade. The current password is required instead of waiting for the
+// session cooling since it happens right after logging in
+func (ah apiHandler) userUpgradeKdf(w http.ResponseWriter, r *http.Request) error {
+	req := &userUpgradeKdfRequest{}
+	if err := jsonDecode(w, r, 8192, req); err != nil {
+		return err
+	}
+	ctx := r.Context()
+	u := ctxGetUser(ctx)
+	if err := u.CheckPassword(req.CurrentPassword); err != nil {
+		return err
+	}
+	if err := u.UpgradeKDF(ctx, req.Password, req.KeyPack, req.Kdf); err != nil {
+		return err
+	}
+	ah.rotateCsrfAfterPrivChange(w, r)
+	return ah.userGetInfo(w, r)
+}
+
+type userRotateKeysRequest struct {
+	UserKeys  []byte            `json:"user_keys"`
+	VaultKeys map[string][]byte `json:"vault_keys"`
+}
+
+// PUT /user/keys
+// vault_keys are indexed by team id and vault id joined with a slash
+func (ah apiHandler) userRotateKeys(w http.ResponseWriter, r *http.Request) error {
+	req := &userRotateKeysRequest{}
+	if err := jsonDecode(w, r, 1024*1024, req); err != nil {
+		return err
+	}
+	ctx := r.Context()
+	u := ctxGetUser(ctx)
+	if err := u.RotateKeyPair(ctx, req.UserKeys, req.VaultKeys); err != nil {
+		return err
+	}
+	ah.rotateCsrfAfterPrivChange(w, r)
+	return ah.userGetInfo(w, r)
+}
+
+// POST /user/invitation/:token
+func (ah apiHandler) userAcceptInvitation(w http.ResponseWriter, r *http.Request, token string) error {
+	ctx := r.Context()
+	u := ctxGetUser(ctx)
+	i, err := models.FindInviteByToken(ctx, token)
+	if err != nil {
+		return err
+	}
+	t, err := models.FindTeam(ctx, i.Team)
+	if err != nil {
+		return err
+	}
+	if err := t.AcceptInvitation(ctx, u, token); err != nil {
+		return err
+	}
+	return jsonResponse(w, t)
+}
+
+type userTOTPRequest struct {
+	Secret string `json:"secret"`
+	Code   string `json:"code"`
+}
+
+type userEnableTOTPResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// POST /user/totp
+// The code proves the client has set up the secret correctly before enabling it
+func (ah apiHandler) userEnableTOTP(w http.ResponseWriter, r *http.Request) error {
+	req := &userTOTPRequest{}
+	if err := jsonDecode(w, r, 1024, req); err != nil {
+		return err
+	}
+	secret, err := util.DecodeTOTPSecret(req.Secret)
+	if err != nil {
+		return err
+	}
+	if _, ok := util.CheckTOTP(secret, req.Code, time.Now()); !ok {
+		return util.NewErrorFrom(models.ErrInvalidTOTPCode)
+	}
+	ctx := r.Context()
+	codes, err := ctxGetUser(ctx).EnableTOTP(ctx, req.Secret)
+	if err != nil {
+		return err
+	}
+	ah.rotateCsrfAfterPrivChange(w, r)
+	return jsonResponse(w, userEnableTOTPResponse{codes})
+}
+
+// DELETE /user/totp
+func (ah apiHandler) userDisableTOTP(w http.ResponseWriter, r *http.Request) error {
+	req := &userTOTPRequest{}
+	if err := jsonDecode(w, r, 1024, req); err != nil {
+		return err
+	}
+	ctx := r.Context()
+	if err := ctxGetUser(ctx).DisableTOTP(ctx, req.Code); err != nil {
+		return err
+	}
+	ah.rotateCsrfAfterPrivChange(w, r)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/keydotcat/keycatd/models"
+	"github.com/keydotcat/keycatd/util"
+)
+
+func (ah apiHandler) userApprovalRoot(w http.ResponseWriter, r *http.Request) error {
+	var head string
+	head, r.URL.Path = shiftPath(r.URL.Path)
+	switch {
+	case len(head) == 0 && r.Method == "GET":
+		return ah.userListAwaitingApproval(w, r)
+	case len(head) > 0 && r.Method == "POST":
+		return ah.userApprove(w, r, head)
+	}
+	return util.NewErrorFrom(ErrNotFound)
+}
+
+// GET /user/approval
+func (ah apiHandler) userListAwaitingApproval(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	us, err := models.FindUsersAwaitingApproval(ctx, ctxGetUser(ctx))
+	if err != nil {
+		return err
+	}
+	return jsonResponse(w, us)
+}
+
+// POST /user/approval/:uid
+func (ah apiHandler) userApprove(w http.ResponseWriter, r *http.Request, uid string) error {
+	ctx := r.Context()
+	u, err := models.FindUser(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if err := u.Approve(ctx, ctxGetUser(ctx)); err != nil {
+		return err
+	}
+	if err := ah.mail.sendAccountApprovedMail(u, r.Header.Get("X-Locale")); err != nil {
+		panic(err)
+	}
+	return jsonResponse(w, u)
+}
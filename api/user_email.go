@@ -0,0 +1,120 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/keydotcat/keycatd/models"
+	"github.com/keydotcat/keycatd/util"
+)
+
+// /user/email
+// Adding, promoting or removing an address can hand the account over to someone else so they wait for the session
+// cooling like the other account changes
+func (ah apiHandler) userEmailRoot(w http.ResponseWriter, r *http.Request) error {
+	var head string
+	head, r.URL.Path = shiftPath(r.URL.Path)
+	if len(head) == 0 && r.Method == "GET" {
+		return ah.userGetEmails(w, r)
+	}
+	if err := ah.checkSessionCooling(r); err != nil {
+		return err
+	}
+	switch {
+	case len(head) == 0 && r.Method == "POST":
+		return ah.userAddEmail(w, r)
+	case len(head) == 0 && r.Method == "DELETE":
+		return ah.userRemoveEmail(w, r)
+	case head == "verify" && r.Method == "POST":
+		return ah.userVerifyEmail(w, r)
+	case head == "primary" && r.Method == "PUT":
+		return ah.userSetPrimaryEmail(w, r)
+	}
+	return util.NewErrorFrom(ErrNotFound)
+}
+
+type userEmailRequest struct {
+	Email string `json:"email"`
+}
+
+type userEmailVerifyRequest struct {
+	Token string `json:"token"`
+}
+
+type userEmailsResponse struct {
+	Email  string              `json:"email"`
+	Emails []*models.UserEmail `json:"emails"`
+}
+
+func (ah apiHandler) writeUserEmails(w http.ResponseWriter, r *http.Request, u *models.User) error {
+	ues, err := u.GetEmails(r.Context())
+	if err != nil {
+		return err
+	}
+	return jsonResponse(w, userEmailsResponse{u.Email, ues})
+}
+
+// GET /user/email
+func (ah apiHandler) userGetEmails(w http.ResponseWriter, r *http.Request) error {
+	return ah.writeUserEmails(w, r, ctxGetUser(r.Context()))
+}
+
+// POST /user/email
+// The address is only added once the token mailed to it is sent to /user/email/verify
+func (ah apiHandler) userAddEmail(w http.ResponseWriter, r *http.Request) error {
+	uer := &userEmailRequest{}
+	if err := jsonDecode(w, r, 1024, uer); err != nil {
+		return err
+	}
+	ctx := r.Context()
+	u := ctxGetUser(ctx)
+	t, err := u.AddEmail(ctx, uer.Email)
+	if err != nil {
+		return err
+	}
+	if err := ah.mail.sendEmailVerificationMail(u, t, r.Header.Get("X-Locale")); err != nil {
+		panic(err)
+	}
+	return ah.writeUserEmails(w, r, u)
+}
+
+// POST /user/email/verify
+func (ah apiHandler) userVerifyEmail(w http.ResponseWriter, r *http.Request) error {
+	uevr := &userEmailVerifyRequest{}
+	if err := jsonDecode(w, r, 1024, uevr); err != nil {
+		return err
+	}
+	ctx := r.Context()
+	u := ctxGetUser(ctx)
+	if _, err := u.VerifyEmail(ctx, uevr.Token); err != nil {
+		return err
+	}
+	return ah.writeUserEmails(w, r, u)
+}
+
+// PUT /user/email/primary
+func (ah apiHandler) userSetPrimaryEmail(w http.ResponseWriter, r *http.Request) error {
+	uer := &userEmailRequest{}
+	if err := jsonDecode(w, r, 1024, uer); err != nil {
+		return err
+	}
+	ctx := r.Context()
+	u := ctxGetUser(ctx)
+	if err := u.SetPrimaryEmail(ctx, uer.Email); err != nil {
+		return err
+	}
+	return ah.writeUserEmails(w, r, u)
+}
+
+// DELETE /user/email
+func (ah apiHandler) userRemoveEmail(w http.ResponseWriter, r *http.Request) error {
+	uer := &userEmailRequest{}
+	if err := jsonDecode(w, r, 1024, uer); err != nil {
+		return err
+	}
+	ctx := r.Context()
+	u := ctxGetUser(ctx)
+	if err := u.RemoveEmail(ctx, uer.Email); err != nil {
+		return err
+	}
+	return ah.writeUserEmails(w, r, u)
+}
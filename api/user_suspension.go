@@ -0,0 +1,57 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/keydotcat/keycatd/models"
+	"github.com/keydotcat/keycatd/util"
+)
+
+func (ah apiHandler) userSuspensionRoot(w http.ResponseWriter, r *http.Request) error {
+	var head string
+	head, r.URL.Path = shiftPath(r.URL.Path)
+	switch {
+	case len(head) > 0 && r.Method == "POST":
+		return ah.userSuspend(w, r, head)
+	case len(head) > 0 && r.Method == "DELETE":
+		return ah.userUnsuspend(w, r, head)
+	}
+	return util.NewErrorFrom(ErrNotFound)
+}
+
+type userSuspendRequest struct {
+	Reason string `json:"reason"`
+}
+
+// POST /user/suspension/:uid
+func (ah apiHandler) userSuspend(w http.ResponseWriter, r *http.Request, uid string) error {
+	usr := &userSuspendRequest{}
+	if err := jsonDecode(w, r, 4096, usr); err != nil {
+		return err
+	}
+	ctx := r.Context()
+	u, err := models.FindUser(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if err := u.Suspend(ctx, ctxGetUser(ctx), usr.Reason); err != nil {
+		return err
+	}
+	if err := ah.sm.DeleteAllSessions(u.Id); err != nil {
+		return err
+	}
+	return jsonResponse(w, u)
+}
+
+// DELETE /user/suspension/:uid
+func (ah apiHandler) userUnsuspend(w http.ResponseWriter, r *http.Request, uid string) error {
+	ctx := r.Context()
+	u, err := models.FindUser(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if err := u.Unsuspend(ctx, ctxGetUser(ctx)); err != nil {
+		return err
+	}
+	return jsonResponse(w, u)
+}
@@ -1,10 +1,15 @@
 package api
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/keydotcat/keycatd/models"
+	"github.com/keydotcat/keycatd/util"
 )
 
 func TestGetUserInfo(t *testing.T) {
@@ -19,3 +24,132 @@ func TestGetUserInfo(t *testing.T) {
 		t.Errorf("Mismatch in the user. Expected %s and got %s", uf.Id, u.Id)
 	}
 }
+
+func TestGetUserKdf(t *testing.T) {
+	activeSessionToken = ""
+	u := getDummyUser()
+	r, err := GetRequest("/user/kdf?email=" + url.QueryEscape(u.Email))
+	CheckErrorAndResponse(t, r, err, 200)
+	kdf := util.KDFParams{}
+	if err := json.NewDecoder(r.Body).Decode(&kdf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(kdf.Salt, u.Kdf.Salt) {
+		t.Errorf("Mismatch in the kdf salt")
+	}
+	salts := [][]byte{}
+	for i := 0; i < 2; i++ {
+		r, err = GetRequest("/user/kdf?email=unknown@nowhere.net")
+		CheckErrorAndResponse(t, r, err, 200)
+		fake := util.KDFParams{}
+		if err := json.NewDecoder(r.Body).Decode(&fake); err != nil {
+			t.Fatal(err)
+		}
+		if fake.Algorithm != u.Kdf.Algorithm || len(fake.Salt) != len(u.Kdf.Salt) {
+			t.Errorf("Fake kdf params differ in shape from real ones")
+		}
+		salts = append(salts, fake.Salt)
+	}
+	if !bytes.Equal(salts[0], salts[1]) {
+		t.Errorf("Fake kdf salt is not deterministic")
+	}
+}
+
+type userExportTest struct {
+	User  string `json:"user"`
+	Teams []struct {
+		Id     string `json:"id"`
+		Vaults []struct {
+			Id      string           `json:"id"`
+			Secrets []*models.Secret `json:"secrets"`
+		} `json:"vaults"`
+	} `json:"teams"`
+}
+
+func TestUserExport(t *testing.T) {
+	u := loginDummyUser()
+	ctx := getCtx()
+	teams, err := u.GetTeams(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vs, err := teams[0].GetVaultsFullForUser(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := GetRequest("/user/export")
+	CheckErrorAndResponse(t, r, err, 200)
+	if r.Header.Get("Content-Disposition") == "" {
+		t.Errorf("Missing Content-Disposition header")
+	}
+	ue := &userExportTest{}
+	if err := json.NewDecoder(r.Body).Decode(ue); err != nil {
+		t.Fatal(err)
+	}
+	if ue.User != u.Id || len(ue.Teams) != 1 || len(ue.Teams[0].Vaults) != len(vs) {
+		t.Fatalf("Unexpected export contents: %+v", ue)
+	}
+}
+
+func TestVaultExport(t *testing.T) {
+	u := loginDummyUser()
+	ctx := getCtx()
+	teams, err := u.GetTeams(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vs, err := teams[0].GetVaultsFullForUser(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := GetRequest(fmt.Sprintf("/team/%s/vault/%s/export", teams[0].Id, vs[0].Id))
+	CheckErrorAndResponse(t, r, err, 200)
+	ue := &userExportTest{}
+	if err := json.NewDecoder(r.Body).Decode(ue); err != nil {
+		t.Fatal(err)
+	}
+	if ue.User != u.Id || len(ue.Teams) != 1 || len(ue.Teams[0].Vaults) != 1 || ue.Teams[0].Vaults[0].Id != vs[0].Id {
+		t.Fatalf("Unexpected export contents: %+v", ue)
+	}
+	r, err = GetRequest(fmt.Sprintf("/team/%s/vault/nope/export", teams[0].Id))
+	CheckErrorAndResponse(t, r, err, 404)
+}
+
+func TestUserEmails(t *testing.T) {
+	u := loginDummyUser()
+	email := "E_" + util.GenerateRandomToken(10) + "@nowhere.net"
+	r, err := PostRequest("/user/email", userEmailRequest{email})
+	CheckErrorAndResponse(t, r, err, 200)
+	// Same pending token that was mailed
+	tok, err := u.AddEmail(getCtx(), email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = PostRequest("/user/email/verify", userEmailVerifyRequest{tok.Id})
+	CheckErrorAndResponse(t, r, err, 200)
+	uer := &userEmailsResponse{}
+	if err := json.NewDecoder(r.Body).Decode(uer); err != nil {
+		t.Fatal(err)
+	}
+	if len(uer.Emails) != 1 || uer.Emails[0].Email != strings.ToLower(email) {
+		t.Fatalf("Expected the new email to be added and got %+v", uer.Emails)
+	}
+	r, err = PutRequest("/user/email/primary", userEmailRequest{email})
+	CheckErrorAndResponse(t, r, err, 200)
+	if err := json.NewDecoder(r.Body).Decode(uer); err != nil {
+		t.Fatal(err)
+	}
+	if uer.Email != strings.ToLower(email) || len(uer.Emails) != 1 || uer.Emails[0].Email != u.Email {
+		t.Fatalf("Expected %s to be the primary email and got %+v", email, uer)
+	}
+	r, err = DeleteRequestWithBody("/user/email", userEmailRequest{email})
+	CheckErrorAndResponse(t, r, err, 400)
+	r, err = DeleteRequestWithBody("/user/email", userEmailRequest{u.Email})
+	CheckErrorAndResponse(t, r, err, 200)
+	if err := json.NewDecoder(r.Body).Decode(uer); err != nil {
+		t.Fatal(err)
+	}
+	if len(uer.Emails) != 0 {
+		t.Fatalf("Expected the old email to be removed and got %+v", uer.Emails)
+	}
+}
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"encoding/base64"
+	"net/http"
+
+	"github.com/keydotcat/keycatd/models"
+	"github.com/keydotcat/keycatd/util"
+)
+
+func (ah apiHandler) userWebAuthnRoot(w http.ResponseWriter, r *http.Request) error {
+	var head string
+	head, r.URL.Path = shiftPath(r.URL.Path)
+	if len(head) == 0 && r.Method == "GET" {
+		return ah.userListWebAuthn(w, r)
+	}
+	if err := ah.checkSessionCooling(r); err != nil {
+		return err
+	}
+	switch {
+	case len(head) == 0 && r.Method == "POST":
+		return ah.userRegisterWebAuthn(w, r)
+	case head == "challenge" && r.Method == "POST":
+		return ah.userWebAuthnChallenge(w, r)
+	case head == "verify_challenge" && r.Method == "POST":
+		return ah.userWebAuthnVerifyChallenge(w, r)
+	case len(head) > 0 && r.Method == "DELETE":
+		return ah.userDeleteWebAuthn(w, r, head)
+	}
+	return util.NewErrorFrom(ErrNotFound)
+}
+
+// GET /user/webauthn
+func (ah apiHandler) userListWebAuthn(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	uws, err := ctxGetUser(ctx).GetWebAuthnCredentials(ctx)
+	if err != nil {
+		return err
+	}
+	return jsonResponse(w, uws)
+}
+
+// POST /user/webauthn/challenge
+func (ah apiHandler) userWebAuthnChallenge(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	opts, err := ctxGetUser(ctx).BeginWebAuthnRegistration(ctx)
+	if err != nil {
+		return err
+	}
+	return jsonResponse(w, opts)
+}
+
+// POST /user/webauthn/verify_challenge
+// Returns the challenge to sign with any registered security key to prove its possession before removing a key
+func (ah apiHandler) userWebAuthnVerifyChallenge(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	opts, err := ctxGetUser(ctx).BeginWebAuthnLogin(ctx)
+	if err != nil {
+		return err
+	}
+	return jsonResponse(w, opts)
+}
+
+type userRegisterWebAuthnRequest struct {
+	Name              string `json:"name"`
+	ClientDataJSON    []byte `json:"client_data_json"`
+	AttestationObject []byte `json:"attestation_object"`
+}
+
+// POST /user/webauthn
+// Registers the credential created for the last challenge from /user/webauthn/challenge
+func (ah apiHandler) userRegisterWebAuthn(w http.ResponseWriter, r *http.Request) error {
+	req := &userRegisterWebAuthnRequest{}
+	if err := jsonDecode(w, r, 16*1024, req); err != nil {
+		return err
+	}
+	ctx := r.Context()
+	uw, err := ctxGetUser(ctx).FinishWebAuthnRegistration(ctx, req.Name, req.ClientDataJSON, req.AttestationObject)
+	if err != nil {
+		return err
+	}
+	ah.rotateCsrfAfterPrivChange(w, r)
+	return jsonResponse(w, uw)
+}
+
+type userDeleteWebAuthnRequest struct {
+	// Answer to the challenge from /user/webauthn/verify_challenge
+	WebAuthn *models.WebAuthnAssertion `json:"webauthn"`
+	TOTP     string                    `json:"totp"`
+}
+
+// DELETE /user/webauthn/:credential_id
+// The credential id is base64url encoded. The body has to prove the second factor with a security key or a totp code
+func (ah apiHandler) userDeleteWebAuthn(w http.ResponseWriter, r *http.Request, credId string) error {
+	id, err := base64.RawURLEncoding.DecodeString(credId)
+	if err != nil {
+		return util.NewErrorFrom(ErrNotFound)
+	}
+	req := &userDeleteWebAuthnRequest{}
+	if err := jsonDecode(w, r, 8*1024, req); err != nil {
+		return err
+	}
+	ctx := r.Context()
+	if err := ctxGetUser(ctx).DeleteWebAuthn(ctx, id, req.WebAuthn, req.TOTP); err != nil {
+		return err
+	}
+	ah.rotateCsrfAfterPrivChange(w, r)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
@@ -3,6 +3,7 @@ package api
 import (
 	"net/http"
 
+	"github.com/keydotcat/keycatd/managers"
 	"github.com/keydotcat/keycatd/models"
 	"github.com/keydotcat/keycatd/util"
 )
@@ -19,6 +20,9 @@ func (ah apiHandler) vaultRoot(w http.ResponseWriter, r *http.Request, t *models
 			return ah.vaultCreate(w, r, t)
 		}
 	} else {
+		if r.URL.Path == "/restore" && r.Method == "POST" {
+			return ah.vaultRestore(w, r, t, vid)
+		}
 		u := ctxGetUser(r.Context())
 		v, err := t.GetVaultForUser(r.Context(), vid, u)
 		if err != nil {
@@ -44,8 +48,9 @@ func (ah apiHandler) vaultList(w http.ResponseWriter, r *http.Request, t *models
 }
 
 type vaultCreateRequest struct {
-	Name string              `json:"name"`
-	Keys models.VaultKeyPair `json:"vault_keys"`
+	Name       string              `json:"name"`
+	Keys       models.VaultKeyPair `json:"vault_keys"`
+	AllMembers bool                `json:"all_members"`
 }
 
 func (ah apiHandler) vaultCreate(w http.ResponseWriter, r *http.Request, t *models.Team) error {
@@ -55,10 +60,17 @@ func (ah apiHandler) vaultCreate(w http.ResponseWriter, r *http.Request, t *mode
 	}
 	ctx := r.Context()
 	u := ctxGetUser(ctx)
-	v, err := t.CreateVault(ctx, u, vcr.Name, vcr.Keys)
+	var v *models.Vault
+	var err error
+	if vcr.AllMembers {
+		v, err = t.CreateAllMembersVault(ctx, u, vcr.Name, vcr.Keys)
+	} else {
+		v, err = t.CreateVault(ctx, u, vcr.Name, vcr.Keys)
+	}
 	if err != nil {
 		return err
 	}
+	ah.vaultWebhook(managers.WEBHOOK_EVENT_VAULT_CREATED, v, u.Id, v.Id)
 	vf, err := v.GetVaultFullForUser(ctx, u)
 	if err != nil {
 		return err
@@ -71,7 +83,15 @@ func (ah apiHandler) validVaultRoot(w http.ResponseWriter, r *http.Request, t *m
 	var head string
 	head, r.URL.Path = shiftPath(r.URL.Path)
 	if len(head) == 0 {
-		//Not yet here
+		switch r.Method {
+		case "DELETE":
+			if err := ah.checkSessionCooling(r); err != nil {
+				return err
+			}
+			return ah.vaultDelete(w, r, t, v)
+		case "PATCH":
+			return ah.vaultRename(w, r, t, v)
+		}
 	} else {
 		switch head {
 		case "user":
@@ -80,17 +100,123 @@ func (ah apiHandler) validVaultRoot(w http.ResponseWriter, r *http.Request, t *m
 			return ah.validVaultSecretRoot(w, r, t, v)
 		case "secrets":
 			return ah.validVaultSecretsRoot(w, r, t, v)
+		case "quota":
+			if r.Method != "PUT" {
+				break
+			}
+			return ah.vaultSetQuota(w, r, t, v)
+		case "rotate":
+			if r.Method != "POST" {
+				break
+			}
+			if err := ah.checkSessionCooling(r); err != nil {
+				return err
+			}
+			return ah.heavyOp(w, func() error { return ah.vaultRotateKey(w, r, t, v) })
+		case "export":
+			if r.Method != "GET" {
+				break
+			}
+			if err := ah.checkSessionCooling(r); err != nil {
+				return err
+			}
+			return ah.heavyOp(w, func() error { return ah.vaultExport(w, r, t, v) })
 		}
 	}
 	return util.NewErrorFrom(ErrNotFound)
 }
 
+// POST /team/:tid/vault/:vid/rotate
+func (ah apiHandler) vaultRotateKey(w http.ResponseWriter, r *http.Request, t *models.Team, v *models.Vault) error {
+	rw := &models.VaultRewrap{}
+	if err := jsonDecode(w, r, 10*1024*1024, rw); err != nil {
+		return err
+	}
+	ctx := r.Context()
+	nv, err := t.RotateVaultKey(ctx, ctxGetUser(ctx), v.Id, rw.Keys, rw.Secrets)
+	if err != nil {
+		return err
+	}
+	ah.broadcastSecrets(ctx, nv.Team, nv.Id, managers.BCAST_ACTION_SECRET_CHANGE, rw.Secrets...)
+	return jsonResponse(w, nv)
+}
+
+// DELETE /team/:tid/vault/:vid
+func (ah apiHandler) vaultDelete(w http.ResponseWriter, r *http.Request, t *models.Team, v *models.Vault) error {
+	ctx := r.Context()
+	u := ctxGetUser(ctx)
+	if err := t.DeleteVault(ctx, u, v.Id); err != nil {
+		return err
+	}
+	ah.vaultWebhook(managers.WEBHOOK_EVENT_VAULT_DELETED, v, u.Id, v.Id)
+	return ah.vaultList(w, r, t)
+}
+
+// POST /team/:tid/vault/:vid/restore
+func (ah apiHandler) vaultRestore(w http.ResponseWriter, r *http.Request, t *models.Team, vid string) error {
+	ctx := r.Context()
+	u := ctxGetUser(ctx)
+	v, err := t.RestoreVault(ctx, u, vid)
+	if err != nil {
+		return err
+	}
+	vf, err := v.GetVaultFullForUser(ctx, u)
+	if err != nil {
+		return err
+	}
+	return jsonResponse(w, vf)
+}
+
+type vaultQuotaRequest struct {
+	Quota int64 `json:"quota"`
+}
+
+// PUT /team/:tid/vault/:vid/quota
+func (ah apiHandler) vaultSetQuota(w http.ResponseWriter, r *http.Request, t *models.Team, v *models.Vault) error {
+	req := &vaultQuotaRequest{}
+	if err := jsonDecode(w, r, 1024, req); err != nil {
+		return err
+	}
+	ctx := r.Context()
+	u := ctxGetUser(ctx)
+	nv, err := t.SetVaultQuota(ctx, u, v.Id, req.Quota)
+	if err != nil {
+		return err
+	}
+	vf, err := nv.GetVaultFullForUser(ctx, u)
+	if err != nil {
+		return err
+	}
+	return jsonResponse(w, vf)
+}
+
+// PATCH /team/:tid/vault/:vid
+func (ah apiHandler) vaultRename(w http.ResponseWriter, r *http.Request, t *models.Team, v *models.Vault) error {
+	req := &renameRequest{}
+	if err := jsonDecode(w, r, 1024, req); err != nil {
+		return err
+	}
+	ctx := r.Context()
+	u := ctxGetUser(ctx)
+	nv, err := t.RenameVault(ctx, u, v.Id, req.Name)
+	if err != nil {
+		return err
+	}
+	vf, err := nv.GetVaultFullForUser(ctx, u)
+	if err != nil {
+		return err
+	}
+	return jsonResponse(w, vf)
+}
+
 // /team/:tid/vault/:vid/user
 func (ah apiHandler) validVaultUserRoot(w http.ResponseWriter, r *http.Request, t *models.Team, v *models.Vault) error {
 	var uid string
 	uid, r.URL.Path = shiftPath(r.URL.Path)
 	if len(uid) == 0 {
 		switch r.Method {
+		case "GET":
+			return ah.vaultMembers(w, r, t, v)
 		case "POST":
 			return ah.vaultAddUser(w, r, t, v)
 		}
@@ -103,6 +229,20 @@ func (ah apiHandler) validVaultUserRoot(w http.ResponseWriter, r *http.Request,
 	return util.NewErrorFrom(ErrNotFound)
 }
 
+type vaultMembersResponse struct {
+	Members []*models.VaultMember `json:"members"`
+}
+
+// GET /team/:tid/vault/:vid/user
+func (ah apiHandler) vaultMembers(w http.ResponseWriter, r *http.Request, t *models.Team, v *models.Vault) error {
+	ctx := r.Context()
+	vms, err := t.GetVaultMembers(ctx, ctxGetUser(ctx), v.Id)
+	if err != nil {
+		return err
+	}
+	return jsonResponse(w, vaultMembersResponse{vms})
+}
+
 // POST /team/:tid/vault/:vid/user
 func (ah apiHandler) vaultAddUser(w http.ResponseWriter, r *http.Request, t *models.Team, v *models.Vault) error {
 	var keys map[string][]byte
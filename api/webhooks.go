@@ -0,0 +1,33 @@
+package api
+
+import (
+	"time"
+
+	"github.com/keydotcat/keycatd/managers"
+	"github.com/keydotcat/keycatd/models"
+)
+
+const webhookQueueSize = 1000
+
+// webhook sends the event to the configured webhooks without waiting for the delivery
+func (ah apiHandler) webhook(event string, t *models.Team, actor, target string) {
+	ah.webhooks.Send(managers.WebhookEvent{
+		Event:     event,
+		Team:      t.Id,
+		Actor:     actor,
+		Target:    target,
+		CreatedAt: time.Now().UTC(),
+	})
+}
+
+// vaultWebhook sends an event of the vault so hooks scoped to it receive it
+func (ah apiHandler) vaultWebhook(event string, v *models.Vault, actor, target string) {
+	ah.webhooks.Send(managers.WebhookEvent{
+		Event:     event,
+		Team:      v.Team,
+		Vault:     v.Id,
+		Actor:     actor,
+		Target:    target,
+		CreatedAt: time.Now().UTC(),
+	})
+}
@@ -65,6 +65,21 @@ func (ah apiHandler) broadcastEventListenLoop(r *http.Request, eb eventSender) e
 	if err != nil {
 		return err
 	}
+	policies, err := currentUser.GetTeamPolicies(ctx)
+	if err != nil {
+		return err
+	}
+	failing, err := ah.teamsFailingPolicies(r, policies)
+	if err != nil {
+		return err
+	}
+	for tid := range failing {
+		delete(tv, tid)
+	}
+	teamPolicies := map[string]*models.TeamPolicy{}
+	for _, p := range policies {
+		teamPolicies[p.Team] = p
+	}
 	buf := util.BufPool.Get()
 	verMsg := managers.BroadcastPayload{
 		Action:       managers.BCAST_ACTION_VAULT_VERSION,
@@ -88,6 +103,8 @@ func (ah apiHandler) broadcastEventListenLoop(r *http.Request, eb eventSender) e
 	alive := true
 	for alive {
 		select {
+		case <-ah.closing:
+			alive = false
 		case <-time.After(time.Second * 30):
 			if err := eb.sendPing(); err != nil {
 				alive = false
@@ -109,6 +126,8 @@ func (ah apiHandler) broadcastEventListenLoop(r *http.Request, eb eventSender) e
 			}
 			if err := eb.sendMessage(b.Message); err != nil {
 				alive = false
+			} else if len(b.Secret) > 0 {
+				ah.recordSecretReads(teamPolicies[b.Team], currentUser.Id, []*models.Secret{{Team: b.Team, Vault: b.Vault, Id: b.Secret}})
 			}
 		}
 	}
@@ -134,6 +153,12 @@ func (ah apiHandler) wsSubscribe(w http.ResponseWriter, r *http.Request) error {
 		return util.NewErrorFrom(err)
 	}
 	defer ws.Close()
+	uid := ctxGetUser(r.Context()).Id
+	if !ah.realtimeConns.tryAcquire(uid) {
+		msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Too many open connections")
+		return ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	}
+	defer ah.realtimeConns.release(uid)
 	go receiveWsPongs(ws)
 	return ah.broadcastEventListenLoop(r, webSocketSender{ws})
 }
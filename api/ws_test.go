@@ -8,6 +8,7 @@ import (
 
 	"github.com/gorilla/websocket"
 	"github.com/keydotcat/keycatd/managers"
+	"github.com/keydotcat/keycatd/models"
 )
 
 func connectWs(path string, t *testing.T) *websocket.Conn {
@@ -65,3 +66,35 @@ func TestGetWSNotifications(t *testing.T) {
 		t.Errorf("Missing secret")
 	}
 }
+
+func TestWSHidesTeamsFailingPolicy(t *testing.T) {
+	u := loginDummyUser()
+	ctx := getCtx()
+	owner := getDummyUser()
+	teams, err := owner.GetTeams(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	team := teams[0]
+	if _, err = owner.EnableTOTP(ctx, "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"); err != nil {
+		t.Fatal(err)
+	}
+	if err = team.SetPolicy(ctx, owner, &models.TeamPolicy{RequireTOTP: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = team.AddOrInviteUserByEmail(ctx, owner, u.Email, nil); err != nil {
+		t.Fatal(err)
+	}
+	ws := connectWs("/ws", t)
+	defer ws.Close()
+	bp := &managers.BroadcastPayload{}
+	if err := ws.ReadJSON(bp); err != nil {
+		t.Fatalf("Could not read the msg: %s", err)
+	}
+	if _, ok := bp.VaultVersion[team.Id]; ok {
+		t.Errorf("Got the vaults of a team whose policy the session does not satisfy")
+	}
+	if len(bp.VaultVersion) != 1 {
+		t.Errorf("Expected only the vaults of the user's own team and got %d teams", len(bp.VaultVersion))
+	}
+}
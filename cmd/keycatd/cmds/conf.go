@@ -1,70 +1,389 @@
 package cmds
 
 import (
+	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/keydotcat/keycatd/api"
+	"github.com/keydotcat/keycatd/db"
+	"github.com/spf13/cast"
 	"github.com/spf13/viper"
 )
 
+// Formats the config file can be written in, detected by its extension
+var confFormats = []string{"json", "toml", "yaml", "yml"}
+
+// processConf loads the configuration and exits printing every problem found if it cannot be used
 func processConf(cfgFile string) api.Conf {
+	c, err := loadConf(cfgFile)
+	if errs, ok := err.(api.ConfigErrors); ok {
+		exitWithConfErrors(errs)
+	} else if err != nil {
+		log.Fatalf("Fatal error while loading config file: %s \n", err)
+	}
+	return c
+}
+
+func exitWithConfErrors(errs []api.ConfigError) {
+	for _, e := range errs {
+		fmt.Printf("%s: %s\n", e.Field, e.Message)
+	}
+	os.Exit(1)
+}
+
+// confFormat returns the format of the config file from its extension
+func confFormat(cfgFile string) (string, error) {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(cfgFile), "."))
+	for _, f := range confFormats {
+		if ext == f {
+			return f, nil
+		}
+	}
+	return "", fmt.Errorf("Unknown format for config file %s. It has to end in .%s", cfgFile, strings.Join(confFormats, ", ."))
+}
+
+// loadConf reads the config file, overrides it with the environment and validates it. If no file is given keycatd.json,
+// keycatd.toml or keycatd.yaml is searched in /etc/keycatd and in the current directory. Keys that keycatd does not know
+// are logged so old or misspelled settings are noticed, but they don't stop the start. Values of the wrong type and
+// invalid settings are returned together as api.ConfigErrors with the path of each key
+func loadConf(cfgFile string) (api.Conf, error) {
+	v := viper.New()
 	if cfgFile != "" {
-		viper.SetConfigFile(cfgFile)
+		format, err := confFormat(cfgFile)
+		if err != nil {
+			return api.Conf{}, err
+		}
+		v.SetConfigFile(cfgFile)
+		v.SetConfigType(format)
 	} else {
-		viper.SetConfigName("keycatd")
-		viper.AddConfigPath("/etc/keycatd")
-		viper.AddConfigPath(".")
-	}
-	viper.SetDefault("port", 27623)
-	viper.SetDefault("url", "http://localhost:27623")
-	viper.SetDefault("db", "keycat")
-	viper.SetDefault("db.maxconns", 0)
-	viper.SetDefault("db.type", "postgresql")
-	viper.SetDefault("only_invited", false)
-	viper.SetDefault("csrf.hash_key", "")
-	viper.SetDefault("csrf.block_key", "")
-	viper.SetDefault("session.redis.server", "")
-	viper.SetDefault("session.redis.db_id", 0)
-	viper.SetDefault("mail.from", "")
-	viper.SetDefault("mail.smtp.server", "")
-	viper.SetDefault("mail.smtp.user", "")
-	viper.SetDefault("mail.smtp.password", "")
-	viper.SetDefault("mail.sparkpost.key", "")
-	viper.SetDefault("mail.sparkpost.eu", false)
-	viper.SetEnvPrefix("KEYCATD")
-	viper.AutomaticEnv()
-	err := viper.ReadInConfig()
-	if err != nil {
-		log.Fatalf("Fatal error while loading config file: %s \n", err)
+		v.SetConfigName("keycatd")
+		v.AddConfigPath("/etc/keycatd")
+		v.AddConfigPath(".")
+	}
+	v.SetDefault("port", 27623)
+	v.SetDefault("url", "http://localhost:27623")
+	v.SetDefault("db", "keycat")
+	v.SetDefault("db.maxconns", 0)
+	v.SetDefault("db.maxidleconns", 0)
+	v.SetDefault("db.connmaxlifetime", 0)
+	v.SetDefault("db.type", db.DB_TYPE_POSTGRESQL)
+	v.SetDefault("db.read_replicas", []string{})
+	v.SetDefault("only_invited", false)
+	v.SetDefault("approval.required", false)
+	v.SetDefault("approval.approvers", []string{})
+	v.SetDefault("suspension.admins", []string{})
+	v.SetDefault("proxy_mode", false)
+	v.SetDefault("trusted_proxies", []string{})
+	v.SetDefault("enforce_rekey_on_removal", false)
+	v.SetDefault("unverified_account_ttl", "0")
+	v.SetDefault("unverified_account_grace", "168h")
+	v.SetDefault("cleanup_interval", "1h")
+	v.SetDefault("metrics.port", 0)
+	v.SetDefault("metrics.enabled", false)
+	v.SetDefault("team.max_invites_per_hour", 0)
+	v.SetDefault("realtime.max_conns_per_user", 10)
+	v.SetDefault("secret.history_limit", 20)
+	v.SetDefault("secret.max_size", 64*1024)
+	v.SetDefault("secret.access_retention", "2160h")
+	v.SetDefault("vault.purge_after", "720h")
+	v.SetDefault("secret.rotation_repeat_reminders", true)
+	v.SetDefault("team.admin_inactivity_days", 0)
+	v.SetDefault("team.invite_ttl", "168h")
+	v.SetDefault("kdf.fake_secret", "")
+	v.SetDefault("kdf.iterations", 3)
+	v.SetDefault("kdf.memory", 64*1024)
+	v.SetDefault("kdf.parallelism", 4)
+	v.SetDefault("expose_email_existence", false)
+	v.SetDefault("captcha.secret", "")
+	v.SetDefault("captcha.verify_url", "")
+	v.SetDefault("password_policy.min_entropy", 0)
+	v.SetDefault("password_policy.breach_check", false)
+	v.SetDefault("password_policy.breach_check_url", "")
+	v.SetDefault("totp.key", "")
+	v.SetDefault("heavy_op_concurrency", 4)
+	v.SetDefault("idempotency_key_ttl", "24h")
+	v.SetDefault("tls.cert_file", "")
+	v.SetDefault("tls.key_file", "")
+	v.SetDefault("tls.cipher_suites", []string{})
+	v.SetDefault("tls.min_version", "1.2")
+	v.SetDefault("jwt.ttl", "1h")
+	v.SetDefault("jwt.rotation", "24h")
+	v.SetDefault("origin.check", false)
+	v.SetDefault("origin.allowed", []string{})
+	v.SetDefault("cors.allowed_origins", []string{})
+	v.SetDefault("cors.allow_credentials", false)
+	v.SetDefault("cors.allowed_methods", []string{})
+	v.SetDefault("ip.allow", []string{})
+	v.SetDefault("ip.deny", []string{})
+	v.SetDefault("csrf.hash_key", "")
+	v.SetDefault("csrf.block_key", "")
+	v.SetDefault("csrf.rotate_on_priv_change", true)
+	v.SetDefault("default_locale", "en")
+	v.SetDefault("default_timezone", "UTC")
+	v.SetDefault("session.rolling", true)
+	v.SetDefault("session.refresh_interval", "5m")
+	v.SetDefault("session.max_age", "720h")
+	v.SetDefault("session.idle_timeout", "12h")
+	v.SetDefault("session.cooling_minutes", 0)
+	v.SetDefault("session.store", "")
+	v.SetDefault("login.max_attempts", 5)
+	v.SetDefault("login.attempt_window", "15m")
+	v.SetDefault("session.redis.server", "")
+	v.SetDefault("session.redis.db_id", 0)
+	v.SetDefault("session.redis.required_at_startup", true)
+	v.SetDefault("session.redis_sentinel.master_name", "")
+	v.SetDefault("session.redis_sentinel.sentinel_addrs", []string{})
+	v.SetDefault("session.redis_sentinel.db_id", 0)
+	v.SetDefault("mail.from", "")
+	v.SetDefault("mail.drain_timeout", "10s")
+	v.SetDefault("mail.queue_alert_threshold", 0)
+	v.SetDefault("mail.queue_alert_age", "0")
+	v.SetDefault("mail.smtp.server", "")
+	v.SetDefault("mail.smtp.user", "")
+	v.SetDefault("mail.smtp.password", "")
+	v.SetDefault("mail.sparkpost.key", "")
+	v.SetDefault("mail.sparkpost.eu", false)
+	v.SetDefault("mail.mailgun.domain", "")
+	v.SetDefault("mail.mailgun.key", "")
+	v.SetDefault("mail.mailgun.eu", false)
+	v.SetDefault("mail.ses.region", "")
+	v.SetDefault("mail.ses.access_key_id", "")
+	v.SetDefault("mail.ses.secret_access_key", "")
+	v.SetDefault("mail.ses.configuration_set", "")
+	known := knownConfKeys(v.AllKeys())
+	// Settings are overridden by KEYCATD_ and the key in upper case with _ instead of dots, eg. KEYCATD_MAIL_SMTP_PASSWORD
+	v.SetEnvPrefix("KEYCATD")
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+	if err := v.ReadInConfig(); err != nil {
+		return api.Conf{}, err
 	}
+	for _, key := range unknownConfKeys(v.AllKeys(), known) {
+		log.Printf("Ignoring unknown setting %s in %s", key, v.ConfigFileUsed())
+	}
+	cr := &confReader{v: v}
 	c := api.Conf{}
-	c.Url = viper.GetString("url")
-	c.Port = viper.GetInt("port")
-	c.DB = viper.GetString("db")
-	c.DBType = viper.GetString("db.type")
+	c.Url = cr.str("url")
+	c.Port = cr.int("port")
+	c.DB = cr.str("db")
+	c.DBType = cr.str("db.type")
 	if len(c.DBType) == 0 {
-		c.DBType = "postgresql"
-	}
-	c.DBMaxConns = viper.GetInt("db.maxconns")
-	c.OnlyInvited = viper.GetBool("only_invited")
-	c.MailFrom = viper.GetString("mail.from")
-	c.Csrf.HashKey = viper.GetString("csrf.hash_key")
-	c.Csrf.BlockKey = viper.GetString("csrf.block_key")
-	if len(viper.GetString("mail.smtp.server")) > 0 {
+		c.DBType = db.DB_TYPE_POSTGRESQL
+	}
+	c.DBMaxConns = cr.int("db.maxconns")
+	c.DBMaxIdleConns = cr.int("db.maxidleconns")
+	c.DBConnMaxLifetime = cr.duration("db.connmaxlifetime")
+	c.DBReadReplicas = cr.list("db.read_replicas")
+	c.OnlyInvited = cr.bool("only_invited")
+	c.RequireApproval = cr.bool("approval.required")
+	c.Approvers = cr.list("approval.approvers")
+	c.SuspensionAdmins = cr.list("suspension.admins")
+	c.ProxyMode = cr.bool("proxy_mode")
+	c.TrustedProxies = cr.list("trusted_proxies")
+	c.EnforceRekeyOnRemoval = cr.bool("enforce_rekey_on_removal")
+	c.UnverifiedAccountTTL = cr.duration("unverified_account_ttl")
+	c.UnverifiedAccountGrace = cr.duration("unverified_account_grace")
+	c.CleanupInterval = cr.duration("cleanup_interval")
+	c.MetricsPort = cr.int("metrics.port")
+	c.MetricsEnabled = cr.bool("metrics.enabled")
+	c.MailDrainTimeout = cr.duration("mail.drain_timeout")
+	c.MailQueueAlertThreshold = cr.int("mail.queue_alert_threshold")
+	c.MailQueueAlertAge = cr.duration("mail.queue_alert_age")
+	c.MaxInvitesPerTeamPerHour = cr.int("team.max_invites_per_hour")
+	c.InviteTTL = cr.duration("team.invite_ttl")
+	c.MaxRealtimeConnsPerUser = cr.int("realtime.max_conns_per_user")
+	c.SecretHistoryLimit = cr.int("secret.history_limit")
+	c.MaxSecretSize = cr.int("secret.max_size")
+	c.SecretAccessRetention = cr.duration("secret.access_retention")
+	c.VaultPurgeAfter = cr.duration("vault.purge_after")
+	c.SecretRotationRepeatReminders = cr.bool("secret.rotation_repeat_reminders")
+	c.AdminInactivityDays = cr.int("team.admin_inactivity_days")
+	c.KDFFakeSecret = cr.str("kdf.fake_secret")
+	c.KDF.Iterations = cr.int("kdf.iterations")
+	c.KDF.Memory = cr.int("kdf.memory")
+	c.KDF.Parallelism = cr.int("kdf.parallelism")
+	c.ExposeEmailExistence = cr.bool("expose_email_existence")
+	c.TOTPKey = cr.str("totp.key")
+	c.HeavyOpConcurrency = cr.int("heavy_op_concurrency")
+	c.IdempotencyKeyTTL = cr.duration("idempotency_key_ttl")
+	c.DefaultLocale = cr.str("default_locale")
+	c.DefaultTimezone = cr.str("default_timezone")
+	c.RollingSessions = cr.bool("session.rolling")
+	c.SessionRefreshInterval = cr.duration("session.refresh_interval")
+	c.SessionMaxAge = cr.duration("session.max_age")
+	c.SessionIdleTimeout = cr.duration("session.idle_timeout")
+	c.NewSessionCoolingMinutes = cr.int("session.cooling_minutes")
+	c.LoginMaxAttempts = cr.int("login.max_attempts")
+	c.LoginAttemptWindow = cr.duration("login.attempt_window")
+	c.JWT.TTL = cr.duration("jwt.ttl")
+	c.JWT.Rotation = cr.duration("jwt.rotation")
+	c.Origin.Check = cr.bool("origin.check")
+	c.Origin.Allowed = cr.list("origin.allowed")
+	c.CORS.AllowedOrigins = cr.list("cors.allowed_origins")
+	c.CORS.AllowCredentials = cr.bool("cors.allow_credentials")
+	c.CORS.AllowedMethods = cr.list("cors.allowed_methods")
+	c.IPAllowList = cr.list("ip.allow")
+	c.IPDenyList = cr.list("ip.deny")
+	c.MailFrom = cr.str("mail.from")
+	c.Csrf.HashKey = cr.str("csrf.hash_key")
+	c.Csrf.BlockKey = cr.str("csrf.block_key")
+	c.DisableCsrfRotation = !cr.bool("csrf.rotate_on_priv_change")
+	if len(cr.str("mail.smtp.server")) > 0 {
 		c.MailSMTP = &api.ConfMailSMTP{
-			Server:   viper.GetString("mail.smtp.server"),
-			User:     viper.GetString("mail.smtp.user"),
-			Password: viper.GetString("mail.smtp.password"),
+			Server:   cr.str("mail.smtp.server"),
+			User:     cr.str("mail.smtp.user"),
+			Password: cr.str("mail.smtp.password"),
 		}
 	}
-	if len(viper.GetString("mail.sparkpost.key")) > 0 {
+	if len(cr.str("mail.sparkpost.key")) > 0 {
 		c.MailSparkpost = &api.ConfMailSparkpost{
-			Key: viper.GetString("mail.sparkpost.key"),
-			EU:  viper.GetBool("mail.sparkpost.eu"),
+			Key: cr.str("mail.sparkpost.key"),
+			EU:  cr.bool("mail.sparkpost.eu"),
 		}
 	}
-	if srv := viper.GetString("session.redis.server"); len(srv) > 0 {
-		c.SessionRedis = &api.ConfSessionRedis{srv, viper.GetInt("session.redis.db_id")}
+	if len(cr.str("mail.mailgun.key")) > 0 {
+		c.MailMailgun = &api.ConfMailMailgun{
+			Domain: cr.str("mail.mailgun.domain"),
+			Key:    cr.str("mail.mailgun.key"),
+			EU:     cr.bool("mail.mailgun.eu"),
+		}
 	}
-	return c
+	if len(cr.str("mail.ses.access_key_id")) > 0 {
+		c.MailSES = &api.ConfMailSES{
+			Region:           cr.str("mail.ses.region"),
+			AccessKeyID:      cr.str("mail.ses.access_key_id"),
+			SecretAccessKey:  cr.str("mail.ses.secret_access_key"),
+			ConfigurationSet: cr.str("mail.ses.configuration_set"),
+		}
+	}
+	if secret := cr.str("captcha.secret"); len(secret) > 0 {
+		c.Captcha = &api.ConfCaptcha{Secret: secret, VerifyUrl: cr.str("captcha.verify_url")}
+	}
+	if minEntropy, breachCheck := cr.float("password_policy.min_entropy"), cr.bool("password_policy.breach_check"); minEntropy != 0 || breachCheck {
+		c.PasswordPolicy = &api.ConfPasswordPolicy{MinEntropy: minEntropy, BreachCheck: breachCheck, BreachCheckUrl: cr.str("password_policy.breach_check_url")}
+	}
+	if cert := cr.str("tls.cert_file"); len(cert) > 0 {
+		c.TLS = &api.ConfTLS{
+			CertFile:     cert,
+			KeyFile:      cr.str("tls.key_file"),
+			CipherSuites: cr.list("tls.cipher_suites"),
+			MinVersion:   cr.str("tls.min_version"),
+		}
+	}
+	c.SessionStore = cr.str("session.store")
+	if srv := cr.str("session.redis.server"); len(srv) > 0 {
+		c.SessionRedis = &api.ConfSessionRedis{srv, cr.int("session.redis.db_id")}
+	}
+	if addrs := cr.list("session.redis_sentinel.sentinel_addrs"); len(addrs) > 0 {
+		c.SessionRedisSentinel = &api.ConfSessionRedisSentinel{
+			MasterName:    cr.str("session.redis_sentinel.master_name"),
+			SentinelAddrs: addrs,
+			DBId:          cr.int("session.redis_sentinel.db_id"),
+		}
+	}
+	c.RedisRequiredAtStartup = cr.bool("session.redis.required_at_startup")
+	if err := v.UnmarshalKey("webhooks", &c.Webhooks); err != nil {
+		cr.fail("webhooks", "has to be a list of url and secret pairs")
+	}
+	if len(cr.errs) > 0 {
+		return c, cr.errs
+	}
+	if errs := c.Validate(); len(errs) > 0 {
+		return c, api.ConfigErrors(errs)
+	}
+	return c, nil
+}
+
+// knownConfKeys returns the keys with a default and the sections that hold them
+func knownConfKeys(defaults []string) map[string]bool {
+	known := map[string]bool{"webhooks": true}
+	for _, key := range defaults {
+		parts := strings.Split(key, ".")
+		for i := range parts {
+			known[strings.Join(parts[:i+1], ".")] = true
+		}
+	}
+	return known
+}
+
+// unknownConfKeys returns the keys in the config file that are not known, sorted
+func unknownConfKeys(keys []string, known map[string]bool) []string {
+	unknown := []string{}
+	for _, key := range keys {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// confReader reads typed values and keeps an error with the key of each value that has the wrong type. Keys without a
+// value read as the zero value
+type confReader struct {
+	v    *viper.Viper
+	errs api.ConfigErrors
+}
+
+func (cr *confReader) fail(key, format string, args ...interface{}) {
+	cr.errs = append(cr.errs, api.ConfigError{Field: key, Message: fmt.Sprintf(format, args...)})
+}
+
+func (cr *confReader) str(key string) string {
+	val := cr.v.Get(key)
+	s, err := cast.ToStringE(val)
+	if val != nil && err != nil {
+		cr.fail(key, "has to be a string, got %v", val)
+	}
+	return s
+}
+
+func (cr *confReader) int(key string) int {
+	val := cr.v.Get(key)
+	n, err := cast.ToIntE(val)
+	if val != nil && err != nil {
+		cr.fail(key, "has to be an integer, got %v", val)
+	}
+	return n
+}
+
+func (cr *confReader) float(key string) float64 {
+	val := cr.v.Get(key)
+	f, err := cast.ToFloat64E(val)
+	if val != nil && err != nil {
+		cr.fail(key, "has to be a number, got %v", val)
+	}
+	return f
+}
+
+func (cr *confReader) bool(key string) bool {
+	val := cr.v.Get(key)
+	b, err := cast.ToBoolE(val)
+	if val != nil && err != nil {
+		cr.fail(key, "has to be true or false, got %v", val)
+	}
+	return b
+}
+
+func (cr *confReader) duration(key string) time.Duration {
+	val := cr.v.Get(key)
+	d, err := cast.ToDurationE(val)
+	if val != nil && err != nil {
+		cr.fail(key, "has to be a duration like 15m or 12h, got %v", val)
+	}
+	return d
+}
+
+func (cr *confReader) list(key string) []string {
+	val := cr.v.Get(key)
+	l, err := cast.ToStringSliceE(val)
+	if val != nil && err != nil {
+		cr.fail(key, "has to be a list of strings, got %v", val)
+	}
+	return l
 }
@@ -0,0 +1,181 @@
+package cmds
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/keydotcat/keycatd/api"
+)
+
+var testConfs = map[string]string{
+	"json": `{
+	"port": 8080,
+	"db": "dbname=keycat",
+	"trusted_proxies": ["10.0.0.0/8"],
+	"session": {"max_age": "48h", "redis": {"server": "localhost:6379", "db_id": 2}},
+	"mail": {"from": "a@a.com", "smtp": {"server": "localhost:1025"}},
+	"csrf": {"hash_key": "4d018d7e070ca9d5da7e767001bdaf90"},
+	"webhooks": [{"url": "https://hooks.example.com", "secret": "s"}]
+}`,
+	"toml": `port = 8080
+db = "dbname=keycat"
+trusted_proxies = ["10.0.0.0/8"]
+[session]
+	max_age = "48h"
+	[session.redis]
+	server = "localhost:6379"
+	db_id = 2
+[mail]
+	from = "a@a.com"
+	[mail.smtp]
+	server = "localhost:1025"
+[csrf]
+	hash_key = "4d018d7e070ca9d5da7e767001bdaf90"
+[[webhooks]]
+	url = "https://hooks.example.com"
+	secret = "s"
+`,
+	"yaml": `port: 8080
+db: dbname=keycat
+trusted_proxies: ["10.0.0.0/8"]
+session:
+  max_age: 48h
+  redis:
+    server: localhost:6379
+    db_id: 2
+mail:
+  from: a@a.com
+  smtp:
+    server: localhost:1025
+csrf:
+  hash_key: 4d018d7e070ca9d5da7e767001bdaf90
+webhooks:
+  - url: https://hooks.example.com
+    secret: s
+`,
+}
+
+func writeTestConf(t *testing.T, name, data string) string {
+	dir, err := ioutil.TempDir("", "keycatd-conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(p, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLoadConfFormats(t *testing.T) {
+	confs := map[string]api.Conf{}
+	for format, data := range testConfs {
+		p := writeTestConf(t, "keycatd."+format, data)
+		defer os.RemoveAll(filepath.Dir(p))
+		c, err := loadConf(p)
+		if err != nil {
+			t.Fatalf("Could not load %s config: %s", format, err)
+		}
+		confs[format] = c
+	}
+	c := confs["toml"]
+	if c.Port != 8080 || c.DB != "dbname=keycat" || c.SessionMaxAge != 48*time.Hour || c.MailSMTP == nil {
+		t.Fatalf("Unexpected config loaded: %+v", c)
+	}
+	if c.SessionRedis == nil || c.SessionRedis.DBId != 2 || len(c.Webhooks) != 1 || c.Webhooks[0].Secret != "s" {
+		t.Fatalf("Sections were not loaded: %+v", c)
+	}
+	if c.VaultPurgeAfter != 720*time.Hour {
+		t.Errorf("Defaults were not used for missing keys: %s", c.VaultPurgeAfter)
+	}
+	for format, other := range confs {
+		if !reflect.DeepEqual(c, other) {
+			t.Errorf("The %s config differs from the toml one:\n%+v\n%+v", format, other, c)
+		}
+	}
+}
+
+func TestLoadConfErrors(t *testing.T) {
+	p := writeTestConf(t, "keycatd.ini", "port = 8080")
+	defer os.RemoveAll(filepath.Dir(p))
+	if _, err := loadConf(p); err == nil {
+		t.Errorf("Expected an error for an unknown format")
+	}
+	p = writeTestConf(t, "keycatd.toml", `port = "many"
+db = "dbname=keycat"
+old_setting = true
+[mail]
+	from = "a@a.com"
+	[mail.smtp]
+	server = "localhost:1025"
+[session]
+	max_age = "forever"
+[csrf]
+	hash_key = "4d018d7e070ca9d5da7e767001bdaf90"
+`)
+	defer os.RemoveAll(filepath.Dir(p))
+	_, err := loadConf(p)
+	errs, ok := err.(api.ConfigErrors)
+	if !ok || len(errs) != 2 || errs[0].Field != "port" || errs[1].Field != "session.max_age" {
+		t.Fatalf("Expected errors for port and session.max_age and got %v", err)
+	}
+}
+
+func TestUnknownConfKeys(t *testing.T) {
+	known := knownConfKeys([]string{"port", "session.redis.server", "mail.from"})
+	unknown := unknownConfKeys([]string{"port", "session.redis.server", "session.redis", "mail.form", "webhooks", "color"}, known)
+	if !reflect.DeepEqual(unknown, []string{"color", "mail.form"}) {
+		t.Fatalf("Unexpected unknown keys %v", unknown)
+	}
+}
+
+func TestLoadConfEnv(t *testing.T) {
+	p := writeTestConf(t, "keycatd.toml", testConfs["toml"])
+	defer os.RemoveAll(filepath.Dir(p))
+	env := map[string]string{
+		"KEYCATD_DB":                 "dbname=env",
+		"KEYCATD_SESSION_MAX_AGE":    "12h",
+		"KEYCATD_MAIL_SMTP_PASSWORD": "envpass",
+		"KEYCATD_ORIGIN_ALLOWED":     "https://a.example.com https://b.example.com",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	c, err := loadConf(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.DB != "dbname=env" || c.SessionMaxAge != 12*time.Hour || c.Port != 8080 {
+		t.Errorf("Environment did not override the config: %+v", c)
+	}
+	if c.MailSMTP == nil || c.MailSMTP.Server != "localhost:1025" || c.MailSMTP.Password != "envpass" {
+		t.Errorf("Unexpected smtp config %+v", c.MailSMTP)
+	}
+	if len(c.Origin.Allowed) != 2 || c.Origin.Allowed[1] != "https://b.example.com" {
+		t.Errorf("Unexpected allowed origins %v", c.Origin.Allowed)
+	}
+}
+
+func TestLoadConfEnvMalformed(t *testing.T) {
+	p := writeTestConf(t, "keycatd.toml", testConfs["toml"])
+	defer os.RemoveAll(filepath.Dir(p))
+	os.Setenv("KEYCATD_PORT", "abc")
+	defer os.Unsetenv("KEYCATD_PORT")
+	_, err := loadConf(p)
+	errs, ok := err.(api.ConfigErrors)
+	if !ok {
+		t.Fatalf("Expected config errors and got %v", err)
+	}
+	found := false
+	for _, e := range errs {
+		found = found || e.Field == "port"
+	}
+	if !found {
+		t.Fatalf("Expected an error for port and got %v", errs)
+	}
+}
@@ -0,0 +1,25 @@
+package cmds
+
+import (
+	"log"
+
+	"github.com/keydotcat/keycatd/api"
+	"github.com/spf13/cobra"
+)
+
+func RepairSessionsCmd(cmd *cobra.Command, args []string) {
+	flags := cmd.Flags()
+	cfgfile, err := flags.GetString("config")
+	if err != nil {
+		log.Fatalf("Could not get config file: %s", err)
+		return
+	}
+	c := processConf(cfgfile)
+	report, err := api.RepairSessionStore(c)
+	if err != nil {
+		log.Fatalf("Could not repair the session store: %s", err)
+		return
+	}
+	log.Printf("Scanned %d sessions: removed %d malformed and %d orphaned sessions, and %d stale index entries",
+		report.Scanned, report.Malformed, report.Orphaned, report.StaleIndexEntries)
+}
@@ -1,36 +1,42 @@
 package cmds
 
 import (
-	"fmt"
+	"context"
 	"log"
-	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/keydotcat/keycatd/api"
-	"github.com/rs/cors"
 	"github.com/spf13/cobra"
 )
 
+// Time given to in-flight requests to finish on shutdown
+const shutdownGracePeriod = 10 * time.Second
+
 func runServer(c api.Conf) {
-	apiHandler, err := api.NewAPIHandler(c)
+	s, err := api.NewServer(c)
 	if err != nil {
 		log.Fatalf("Could not parse configuration: %s", err)
 	}
-	handler := cors.New(cors.Options{
-		AllowOriginFunc:  func(origin string) bool { return true },
-		AllowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodPatch, http.MethodHead, http.MethodPut},
-		AllowedHeaders:   []string{"*"},
-		AllowCredentials: true,
-	}).Handler(apiHandler)
-	s := &http.Server{
-		Addr:           fmt.Sprintf(":%d", c.Port),
-		Handler:        handler,
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
-		MaxHeaderBytes: 1 << 20,
+	stopped := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		log.Printf("Received %s. Shutting down", <-sig)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownGracePeriod)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			log.Printf("Could not stop the server cleanly: %s", err)
+		}
+		close(stopped)
+	}()
+	log.Printf("Listening at %s", s.Addr())
+	if err := s.ListenAndServe(); err != nil {
+		log.Fatal(err)
 	}
-	log.Printf("Listening at %s", s.Addr)
-	log.Fatal(s.ListenAndServe())
+	<-stopped
 }
 
 func RunCmd(cmd *cobra.Command, args []string) {
@@ -40,6 +46,18 @@ func RunCmd(cmd *cobra.Command, args []string) {
 		log.Fatalf("Could not get config file: %s", err)
 		return
 	}
+	checkOnly, err := flags.GetBool("check-config")
+	if err != nil {
+		log.Fatalf("Could not get check-config flag: %s", err)
+		return
+	}
 	c := processConf(cfgFile)
+	if checkOnly {
+		if errs := c.CheckConnections(); len(errs) > 0 {
+			exitWithConfErrors(errs)
+		}
+		log.Println("Configuration is valid")
+		return
+	}
 	runServer(c)
 }
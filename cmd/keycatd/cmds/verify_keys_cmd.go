@@ -0,0 +1,40 @@
+package cmds
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/keydotcat/keycatd/api"
+	"github.com/spf13/cobra"
+)
+
+func VerifyKeysCmd(cmd *cobra.Command, args []string) {
+	flags := cmd.Flags()
+	cfgfile, err := flags.GetString("config")
+	if err != nil {
+		log.Fatalf("Could not get config file: %s", err)
+		return
+	}
+	tid, err := flags.GetString("team")
+	if err != nil {
+		log.Fatalf("Could not get team: %s", err)
+		return
+	}
+	c := processConf(cfgfile)
+	report, err := api.VerifyKeyIntegrity(c, tid)
+	if err != nil {
+		log.Fatalf("Could not verify key integrity: %s", err)
+		return
+	}
+	if len(report) == 0 {
+		log.Println("All vault keys match the team memberships")
+		return
+	}
+	for team, issues := range report {
+		for _, issue := range issues {
+			fmt.Printf("team %s vault %s user %s: %s\n", team, issue.Vault, issue.User, issue.Problem)
+		}
+	}
+	os.Exit(1)
+}
@@ -13,6 +13,7 @@ func main() {
 	}
 
 	rootCmd.PersistentFlags().String("config", "", "Configuration file (default is ./keycatd.yaml)")
+	rootCmd.Flags().Bool("check-config", false, "Report every problem in the configuration, including the db and mail provider connections, and exit")
 	var testMailCmd = &cobra.Command{
 		Use:   "testmail",
 		Short: "Send a test mail to verify email parameters",
@@ -21,6 +22,21 @@ func main() {
 	testMailCmd.Flags().String("to", "", "Who to send the test mail to")
 	rootCmd.AddCommand(testMailCmd)
 
+	var verifyKeysCmd = &cobra.Command{
+		Use:   "verify-keys",
+		Short: "Report vaults whose keys do not match the team memberships",
+		Run:   cmds.VerifyKeysCmd,
+	}
+	verifyKeysCmd.Flags().String("team", "", "Only verify this team (default is all teams)")
+	rootCmd.AddCommand(verifyKeysCmd)
+
+	var repairSessionsCmd = &cobra.Command{
+		Use:   "repair-sessions",
+		Short: "Remove malformed and orphaned entries from the session store",
+		Run:   cmds.RepairSessionsCmd,
+	}
+	rootCmd.AddCommand(repairSessionsCmd)
+
 	var versionCmd = &cobra.Command{
 		Use:   "version",
 		Short: "Print the keycatd version",
@@ -0,0 +1,10 @@
+DROP TABLE IF EXISTS "vault_rekey" CASCADE;
+CREATE TABLE "vault_rekey" (
+	"team" TEXT NOT NULL,
+	"vault" TEXT NOT NULL,
+	"user" TEXT NOT NULL,
+	"created_at" TIMESTAMP WITH TIME ZONE NOT NULL,
+	CONSTRAINT "pk_vault_rekey" PRIMARY KEY ("team", "vault", "user"),
+	CONSTRAINT "fk_vault_rekey_vault" FOREIGN KEY ("team", "vault") REFERENCES "vault" ON DELETE CASCADE
+);
+CREATE INDEX "idx_vault_rekey_team_user" ON "vault_rekey" ("team", "user");
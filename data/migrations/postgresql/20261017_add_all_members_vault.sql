@@ -0,0 +1 @@
+ALTER TABLE "vault" ADD COLUMN "all_members" BOOL NOT NULL DEFAULT false;
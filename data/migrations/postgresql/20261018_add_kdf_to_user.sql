@@ -0,0 +1 @@
+ALTER TABLE "user" ADD COLUMN "kdf" TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS "signing_key" CASCADE;
+CREATE TABLE "signing_key" (
+	"id" TEXT NOT NULL,
+	"private_key" BYTEA NOT NULL,
+	"created_at" TIMESTAMP WITH TIME ZONE NOT NULL,
+	CONSTRAINT "pk_signing_key" PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_signing_key_created_at" ON "signing_key" ("created_at");
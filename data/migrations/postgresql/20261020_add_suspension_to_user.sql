@@ -0,0 +1,2 @@
+ALTER TABLE "user" ADD COLUMN "suspended_at" TIMESTAMP WITH TIME ZONE NULL;
+ALTER TABLE "user" ADD COLUMN "suspended_reason" TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,3 @@
+ALTER TABLE "invite" ADD COLUMN "token" TEXT NOT NULL DEFAULT '';
+UPDATE "invite" SET "token" = md5(random()::text || "team" || "email");
+CREATE UNIQUE INDEX "idx_invite_token" ON "invite" ("token");
@@ -0,0 +1,10 @@
+DROP TABLE IF EXISTS "secret_reference" CASCADE;
+CREATE TABLE "secret_reference" (
+	"team" TEXT NOT NULL,
+	"vault" TEXT NOT NULL,
+	"secret" TEXT NOT NULL,
+	"target" TEXT NOT NULL,
+	CONSTRAINT "pk_secret_reference" PRIMARY KEY ("team", "vault", "secret", "target"),
+	CONSTRAINT "fk_secret_reference_vault" FOREIGN KEY ("team", "vault") REFERENCES "vault" ON DELETE CASCADE
+);
+CREATE INDEX "idx_secret_reference_target" ON "secret_reference" ("team", "vault", "target");
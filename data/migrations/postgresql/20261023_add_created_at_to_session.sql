@@ -0,0 +1,2 @@
+ALTER TABLE "session" ADD COLUMN "created_at" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now();
+UPDATE "session" SET "created_at" = "last_access";
@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS "user_totp" CASCADE;
+CREATE TABLE "user_totp" (
+	"user" TEXT NOT NULL,
+	"secret" BYTEA NOT NULL,
+	"last_step" BIGINT NOT NULL,
+	"created_at" TIMESTAMP WITH TIME ZONE NOT NULL,
+	CONSTRAINT "pk_user_totp" PRIMARY KEY ("user"),
+	CONSTRAINT "fk_user_totp_user" FOREIGN KEY ("user") REFERENCES "user" ON DELETE CASCADE
+);
@@ -0,0 +1 @@
+ALTER TABLE "user" ADD COLUMN "auth_source" TEXT NOT NULL DEFAULT 'local';
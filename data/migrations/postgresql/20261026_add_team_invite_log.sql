@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS "team_invite_log" CASCADE;
+CREATE TABLE "team_invite_log" (
+	"team" TEXT NOT NULL,
+	"created_at" TIMESTAMP WITH TIME ZONE NOT NULL,
+	CONSTRAINT "fk_team_invite_log_team" FOREIGN KEY ("team") REFERENCES "team" ON DELETE CASCADE
+);
+CREATE INDEX "idx_team_invite_log_team" ON "team_invite_log" ("team", "created_at");
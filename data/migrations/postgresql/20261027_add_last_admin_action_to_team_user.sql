@@ -0,0 +1 @@
+ALTER TABLE "team_user" ADD COLUMN "last_admin_action" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now();
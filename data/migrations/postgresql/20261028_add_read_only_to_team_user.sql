@@ -0,0 +1 @@
+ALTER TABLE "team_user" ADD COLUMN "read_only" BOOL NOT NULL DEFAULT false;
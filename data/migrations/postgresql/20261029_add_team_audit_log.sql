@@ -0,0 +1,12 @@
+DROP TABLE IF EXISTS "team_audit_log" CASCADE;
+CREATE TABLE "team_audit_log" (
+	"id" TEXT NOT NULL,
+	"team" TEXT NOT NULL,
+	"actor" TEXT NOT NULL,
+	"target" TEXT NOT NULL,
+	"action" TEXT NOT NULL,
+	"created_at" TIMESTAMP WITH TIME ZONE NOT NULL,
+	CONSTRAINT "pk_team_audit_log" PRIMARY KEY ("id"),
+	CONSTRAINT "fk_team_audit_log_team" FOREIGN KEY ("team") REFERENCES "team" ON DELETE CASCADE
+);
+CREATE INDEX "idx_team_audit_log_team" ON "team_audit_log" ("team", "created_at");
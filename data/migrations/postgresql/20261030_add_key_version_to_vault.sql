@@ -0,0 +1 @@
+ALTER TABLE "vault" ADD COLUMN "key_version" INT NOT NULL DEFAULT 1;
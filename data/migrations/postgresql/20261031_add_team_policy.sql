@@ -0,0 +1,10 @@
+DROP TABLE IF EXISTS "team_policy" CASCADE;
+CREATE TABLE "team_policy" (
+	"team" TEXT NOT NULL,
+	"require_totp" BOOL NOT NULL DEFAULT false,
+	"session_cooling_minutes" INT NOT NULL DEFAULT 0,
+	"session_idle_minutes" INT NOT NULL DEFAULT 0,
+	"updated_at" TIMESTAMP WITH TIME ZONE NOT NULL,
+	CONSTRAINT "pk_team_policy" PRIMARY KEY ("team"),
+	CONSTRAINT "fk_team_policy_team" FOREIGN KEY ("team") REFERENCES "team" ON DELETE CASCADE
+);
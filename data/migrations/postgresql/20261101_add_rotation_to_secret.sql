@@ -0,0 +1,4 @@
+ALTER TABLE "secret" ADD COLUMN "rotation_days" INT NOT NULL DEFAULT 0;
+ALTER TABLE "secret" ADD COLUMN "rotated_at" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now();
+ALTER TABLE "secret" ADD COLUMN "rotation_reminded_at" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now();
+UPDATE "secret" SET "rotated_at" = "created_at", "rotation_reminded_at" = "created_at";
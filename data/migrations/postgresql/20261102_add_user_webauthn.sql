@@ -0,0 +1,12 @@
+DROP TABLE IF EXISTS "user_webauthn" CASCADE;
+CREATE TABLE "user_webauthn" (
+	"user" TEXT NOT NULL,
+	"credential_id" BYTEA NOT NULL,
+	"public_key" BYTEA NOT NULL,
+	"sign_count" BIGINT NOT NULL,
+	"name" TEXT NOT NULL,
+	"created_at" TIMESTAMP WITH TIME ZONE NOT NULL,
+	"last_used_at" TIMESTAMP WITH TIME ZONE NOT NULL,
+	CONSTRAINT "pk_user_webauthn" PRIMARY KEY ("user", "credential_id"),
+	CONSTRAINT "fk_user_webauthn_user" FOREIGN KEY ("user") REFERENCES "user" ON DELETE CASCADE
+);
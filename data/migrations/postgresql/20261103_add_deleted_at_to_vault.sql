@@ -0,0 +1 @@
+ALTER TABLE "vault" ADD COLUMN "deleted_at" TIMESTAMP WITH TIME ZONE;
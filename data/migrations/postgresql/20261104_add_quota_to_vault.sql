@@ -0,0 +1,6 @@
+ALTER TABLE "vault" ADD COLUMN "quota" BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE "vault" ADD COLUMN "used_bytes" BIGINT NOT NULL DEFAULT 0;
+UPDATE "vault" SET "used_bytes" = COALESCE((
+	SELECT SUM(LENGTH("s"."data")) FROM (
+		SELECT DISTINCT ON ("team", "vault", "id") "team", "vault", "data" FROM "secret" ORDER BY "team", "vault", "id", "version" DESC
+	) AS "s" WHERE "s"."team" = "vault"."team" AND "s"."vault" = "vault"."id"), 0);
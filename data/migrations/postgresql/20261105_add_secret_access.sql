@@ -0,0 +1,11 @@
+ALTER TABLE "team_policy" ADD COLUMN "audit_reads" BOOL NOT NULL DEFAULT false;
+DROP TABLE IF EXISTS "secret_access" CASCADE;
+CREATE TABLE "secret_access" (
+	"team" TEXT NOT NULL,
+	"vault" TEXT NOT NULL,
+	"secret" TEXT NOT NULL,
+	"user" TEXT NOT NULL,
+	"accessed_at" TIMESTAMP WITH TIME ZONE NOT NULL,
+	CONSTRAINT "fk_secret_access_team" FOREIGN KEY ("team") REFERENCES "team" ON DELETE CASCADE
+);
+CREATE INDEX "idx_secret_access_secret" ON "secret_access" ("team", "secret", "accessed_at");
@@ -0,0 +1 @@
+ALTER TABLE "user" ADD COLUMN "awaiting_approval" BOOL NOT NULL DEFAULT false;
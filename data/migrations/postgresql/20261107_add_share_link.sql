@@ -0,0 +1,16 @@
+DROP TABLE IF EXISTS "share_link" CASCADE;
+CREATE TABLE "share_link" (
+	"id" TEXT NOT NULL,
+	"team" TEXT NOT NULL,
+	"vault" TEXT NOT NULL,
+	"secret" TEXT NOT NULL,
+	"creator" TEXT NOT NULL,
+	"data" BYTEA NOT NULL,
+	"remaining_uses" INT NOT NULL,
+	"expires_at" TIMESTAMP WITH TIME ZONE NOT NULL,
+	"created_at" TIMESTAMP WITH TIME ZONE NOT NULL,
+	CONSTRAINT "pk_share_link" PRIMARY KEY ("id"),
+	CONSTRAINT "fk_share_link_vault" FOREIGN KEY ("team", "vault") REFERENCES "vault" ON DELETE CASCADE
+);
+CREATE INDEX "idx_share_link_secret" ON "share_link" ("team", "vault", "secret");
+CREATE INDEX "idx_share_link_expires_at" ON "share_link" ("expires_at");
@@ -0,0 +1 @@
+ALTER TABLE "invite" ADD COLUMN "invited_by" TEXT NOT NULL DEFAULT '';
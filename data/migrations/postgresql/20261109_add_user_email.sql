@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS "user_email" CASCADE;
+CREATE TABLE "user_email" (
+	"email" TEXT NOT NULL,
+	"user" TEXT NOT NULL,
+	"created_at" TIMESTAMP WITH TIME ZONE NOT NULL,
+	CONSTRAINT "pk_user_email" PRIMARY KEY ("email"),
+	CONSTRAINT "fk_user_email_user" FOREIGN KEY ("user") REFERENCES "user" ON DELETE CASCADE
+);
+CREATE INDEX "idx_user_email_user" ON "user_email" ("user");
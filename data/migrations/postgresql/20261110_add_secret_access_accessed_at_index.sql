@@ -0,0 +1 @@
+CREATE INDEX "idx_secret_access_accessed_at" ON "secret_access" ("accessed_at");
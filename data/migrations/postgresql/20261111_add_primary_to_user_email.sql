@@ -0,0 +1,7 @@
+ALTER TABLE "user_email" ADD COLUMN "primary" BOOL NOT NULL DEFAULT false;
+UPDATE "user" SET "email" = lower("email") WHERE "email" <> lower("email") AND NOT EXISTS (
+	SELECT 1 FROM "user" "other" WHERE "other"."id" <> "user"."id" AND lower("other"."email") = lower("user"."email"));
+UPDATE "user" SET "unconfirmed_email" = lower("unconfirmed_email");
+UPDATE "user_email" SET "email" = lower("email") WHERE "email" <> lower("email") AND NOT EXISTS (
+	SELECT 1 FROM "user_email" "other" WHERE "other"."email" <> "user_email"."email" AND lower("other"."email") = lower("user_email"."email"));
+INSERT INTO "user_email" ("email", "user", "primary", "created_at") SELECT "email", "id", true, COALESCE("created_at", now()) FROM "user" ON CONFLICT DO NOTHING;
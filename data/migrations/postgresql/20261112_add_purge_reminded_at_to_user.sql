@@ -0,0 +1 @@
+ALTER TABLE "user" ADD COLUMN "purge_reminded_at" TIMESTAMP WITH TIME ZONE;
@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS "secret_justification" CASCADE;
+CREATE TABLE "secret_justification" (
+	"team" TEXT NOT NULL,
+	"vault" TEXT NOT NULL,
+	"secret" TEXT NOT NULL,
+	"created_at" TIMESTAMP WITH TIME ZONE NOT NULL,
+	CONSTRAINT "pk_secret_justification" PRIMARY KEY ("team", "vault", "secret"),
+	CONSTRAINT "fk_secret_justification_vault" FOREIGN KEY ("team", "vault") REFERENCES "vault" ON DELETE CASCADE
+);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS "idx_team_audit_log_team";
+CREATE INDEX "idx_team_audit_log_team" ON "team_audit_log" ("team", "created_at", "id");
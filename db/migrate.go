@@ -13,6 +13,11 @@ import (
 	"github.com/keydotcat/keycatd/util"
 )
 
+const (
+	DB_TYPE_POSTGRESQL  = "postgresql"
+	DB_TYPE_COCKROACHDB = "cockroachdb"
+)
+
 type MigrateMgr struct {
 	db         *sql.DB
 	dbType     string
@@ -127,9 +132,9 @@ func (m *MigrateMgr) applyMigration(mid int) error {
 func (m *MigrateMgr) checkIfMigrationsTableExists() (bool, error) {
 	var query string
 	switch m.dbType {
-	case "cockroach":
+	case DB_TYPE_COCKROACHDB:
 		query = "SHOW TABLES"
-	case "postgresql":
+	case DB_TYPE_POSTGRESQL:
 		query = `SELECT tablename FROM pg_catalog.pg_tables WHERE schemaname != 'pg_catalog' AND schemaname != 'information_schema'`
 	default:
 		return false, util.NewErrorf("Unknown database type: %s", m.dbType)
@@ -154,9 +159,9 @@ func (m *MigrateMgr) checkIfMigrationsTableExists() (bool, error) {
 func (m *MigrateMgr) createMigrationsTable() error {
 	var query string
 	switch m.dbType {
-	case "cockroach":
+	case DB_TYPE_COCKROACHDB:
 		query = `CREATE TABLE "db_migrations" ("Id" INT NOT NULL, "CreatedAt" TIMESTAMP WITH TIME ZONE NOT NULL, CONSTRAINT "primary" PRIMARY KEY ("Id" DESC), FAMILY "primary" ("Id", "CreatedAt") )`
-	case "postgresql":
+	case DB_TYPE_POSTGRESQL:
 		query = `CREATE TABLE "db_migrations" ("Id" INT NOT NULL, "CreatedAt" TIMESTAMP WITH TIME ZONE NOT NULL, CONSTRAINT "primary" PRIMARY KEY ("Id") )`
 	default:
 		return util.NewErrorf("Unknown database type: %s", m.dbType)
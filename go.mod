@@ -9,9 +9,8 @@ require (
 	github.com/gorilla/websocket v1.4.2
 	github.com/lib/pq v1.10.1
 	github.com/mediocregopher/radix/v3 v3.7.0
-	github.com/rs/cors v1.7.0
+	github.com/spf13/cast v1.3.0
 	github.com/spf13/cobra v1.1.3
 	github.com/spf13/viper v1.7.1
-	github.com/tomasen/realip v0.0.0-20180522021738-f0c99a92ddce
 	golang.org/x/crypto v0.0.0-20210421170649-83a5a9bb288b
 )
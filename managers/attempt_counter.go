@@ -0,0 +1,83 @@
+package managers
+
+import (
+	"sync"
+	"time"
+)
+
+// AttemptCounter counts attempts per key in fixed windows that start with the first attempt. Session stores that
+// implement it keep the counts next to the sessions so every instance using the store sees the same counts
+type AttemptCounter interface {
+	// AddAttempt records an attempt and returns how many there are in the current window
+	AddAttempt(key string, window time.Duration) (int, error)
+	// Attempts returns how many attempts there are in the current window
+	Attempts(key string) (int, error)
+	ResetAttempts(key string) error
+}
+
+type attemptEntry struct {
+	count     int
+	expiresAt time.Time
+}
+
+// attemptCounterMemory keeps the counts in the process memory so they are not shared between instances
+type attemptCounterMemory struct {
+	lock    *sync.Mutex
+	entries map[string]*attemptEntry
+}
+
+func NewAttemptCounterMemory() AttemptCounter {
+	return newAttemptCounterMemory()
+}
+
+func newAttemptCounterMemory() *attemptCounterMemory {
+	return &attemptCounterMemory{&sync.Mutex{}, map[string]*attemptEntry{}}
+}
+
+func (ac *attemptCounterMemory) AddAttempt(key string, window time.Duration) (int, error) {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+	now := time.Now()
+	if len(ac.entries) > 10000 {
+		ac.cleanup(now)
+	}
+	e, ok := ac.entries[key]
+	if !ok || now.After(e.expiresAt) {
+		e = &attemptEntry{0, now.Add(window)}
+		ac.entries[key] = e
+	}
+	e.count++
+	return e.count, nil
+}
+
+func (ac *attemptCounterMemory) Attempts(key string) (int, error) {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+	e, ok := ac.entries[key]
+	if !ok || time.Now().After(e.expiresAt) {
+		return 0, nil
+	}
+	return e.count, nil
+}
+
+func (ac *attemptCounterMemory) ResetAttempts(key string) error {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+	delete(ac.entries, key)
+	return nil
+}
+
+// expireAttempts drops the counters whose window is over
+func (ac *attemptCounterMemory) expireAttempts(now time.Time) {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+	ac.cleanup(now)
+}
+
+func (ac *attemptCounterMemory) cleanup(now time.Time) {
+	for k, e := range ac.entries {
+		if now.After(e.expiresAt) {
+			delete(ac.entries, k)
+		}
+	}
+}
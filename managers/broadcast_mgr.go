@@ -16,8 +16,10 @@ const (
 )
 
 type Broadcast struct {
-	Team    string
-	Vault   string
+	Team  string
+	Vault string
+	// Id of the secret whose data is sent in the message. Empty if the message has no secret data
+	Secret  string
 	Message []byte
 }
 
@@ -41,5 +43,10 @@ func createBroadcast(team, vault string, action BroadcastAction, secret *models.
 	if err != nil {
 		panic(err)
 	}
-	return &Broadcast{team, vault, msg}
+	sid := ""
+	// Secrets sent without data are not read by the subscribers
+	if secret != nil && action != BCAST_ACTION_SECRET_REMOVE && len(secret.Data) > 0 {
+		sid = secret.Id
+	}
+	return &Broadcast{team, vault, sid, msg}
 }
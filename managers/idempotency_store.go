@@ -0,0 +1,143 @@
+package managers
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var ErrIdempotencyStoreFull = errors.New("Idempotency store is full")
+
+// Bytes of responses the memory store keeps. Responses that don't fit are not stored
+const idempotencyMemoryMaxBytes = 64 << 20
+
+// IdempotencyRecord is what is kept for an idempotency key. Records without a status belong to requests that are
+// still running
+type IdempotencyRecord struct {
+	// Hash of the request that claimed the key so a different request reusing it can be refused
+	RequestHash string      `json:"request_hash"`
+	Status      int         `json:"status,omitempty"`
+	Header      http.Header `json:"header,omitempty"`
+	Body        []byte      `json:"body,omitempty"`
+}
+
+// IdempotencyStore keeps the responses to requests sent with an idempotency key. Session stores that implement it
+// keep them next to the sessions so a retry is replayed even if it reaches another instance
+type IdempotencyStore interface {
+	// ClaimIdempotencyKey stores rec under the key for ttl if the key is free and returns nil. If the key is taken it
+	// returns the stored record instead
+	ClaimIdempotencyKey(key string, rec *IdempotencyRecord, ttl time.Duration) (*IdempotencyRecord, error)
+	// SaveIdempotencyKey replaces the record of a claimed key
+	SaveIdempotencyKey(key string, rec *IdempotencyRecord, ttl time.Duration) error
+	// ReleaseIdempotencyKey frees the key so the request can be run again
+	ReleaseIdempotencyKey(key string) error
+}
+
+type idempotencyEntry struct {
+	rec       IdempotencyRecord
+	expiresAt time.Time
+}
+
+func (rec *IdempotencyRecord) size() int {
+	n := len(rec.RequestHash) + len(rec.Body)
+	for k, vs := range rec.Header {
+		for _, v := range vs {
+			n += len(k) + len(v)
+		}
+	}
+	return n
+}
+
+// idempotencyStoreMemory keeps the records in the process memory so they are not shared between instances. It
+// keeps up to maxBytes of records
+type idempotencyStoreMemory struct {
+	lock     *sync.Mutex
+	entries  map[string]*idempotencyEntry
+	size     int
+	maxBytes int
+}
+
+// NewIdempotencyStoreMemory returns a memory store that drops the expired records every sweepInterval
+func NewIdempotencyStoreMemory(sweepInterval time.Duration) IdempotencyStore {
+	is := newIdempotencyStoreMemory()
+	go func() {
+		for now := range time.Tick(sweepInterval) {
+			is.expireIdempotencyKeys(now)
+		}
+	}()
+	return is
+}
+
+func newIdempotencyStoreMemory() *idempotencyStoreMemory {
+	return &idempotencyStoreMemory{lock: &sync.Mutex{}, entries: map[string]*idempotencyEntry{}, maxBytes: idempotencyMemoryMaxBytes}
+}
+
+func (is *idempotencyStoreMemory) put(key string, rec *IdempotencyRecord, expiresAt time.Time) {
+	is.remove(key)
+	is.entries[key] = &idempotencyEntry{*rec, expiresAt}
+	is.size += rec.size()
+}
+
+func (is *idempotencyStoreMemory) remove(key string) {
+	if e, ok := is.entries[key]; ok {
+		is.size -= e.rec.size()
+		delete(is.entries, key)
+	}
+}
+
+func (is *idempotencyStoreMemory) ClaimIdempotencyKey(key string, rec *IdempotencyRecord, ttl time.Duration) (*IdempotencyRecord, error) {
+	is.lock.Lock()
+	defer is.lock.Unlock()
+	now := time.Now()
+	if len(is.entries) > 10000 {
+		is.cleanupIdempotencyKeys(now)
+	}
+	if e, ok := is.entries[key]; ok && now.Before(e.expiresAt) {
+		stored := e.rec
+		return &stored, nil
+	}
+	is.put(key, rec, now.Add(ttl))
+	return nil, nil
+}
+
+// SaveIdempotencyKey fails with ErrIdempotencyStoreFull if the record does not fit
+func (is *idempotencyStoreMemory) SaveIdempotencyKey(key string, rec *IdempotencyRecord, ttl time.Duration) error {
+	is.lock.Lock()
+	defer is.lock.Unlock()
+	now := time.Now()
+	grow := rec.size()
+	if e, ok := is.entries[key]; ok {
+		grow -= e.rec.size()
+	}
+	if is.size+grow > is.maxBytes {
+		is.cleanupIdempotencyKeys(now)
+		if is.size+grow > is.maxBytes {
+			return ErrIdempotencyStoreFull
+		}
+	}
+	is.put(key, rec, now.Add(ttl))
+	return nil
+}
+
+func (is *idempotencyStoreMemory) ReleaseIdempotencyKey(key string) error {
+	is.lock.Lock()
+	defer is.lock.Unlock()
+	is.remove(key)
+	return nil
+}
+
+// expireIdempotencyKeys drops the records that have expired
+func (is *idempotencyStoreMemory) expireIdempotencyKeys(now time.Time) {
+	is.lock.Lock()
+	defer is.lock.Unlock()
+	is.cleanupIdempotencyKeys(now)
+}
+
+func (is *idempotencyStoreMemory) cleanupIdempotencyKeys(now time.Time) {
+	for k, e := range is.entries {
+		if !now.Before(e.expiresAt) {
+			is.remove(k)
+		}
+	}
+}
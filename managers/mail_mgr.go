@@ -3,3 +3,9 @@ package managers
 type MailMgr interface {
 	SendMail(to string, subject string, data string) error
 }
+
+// MailMgrChecker is implemented by mail managers that can verify they reach the provider with valid credentials
+// without sending any mail
+type MailMgrChecker interface {
+	Check() error
+}
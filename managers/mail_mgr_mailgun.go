@@ -0,0 +1,63 @@
+package managers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+func NewMailMgrMailgun(domain, key, from string, eu bool) MailMgr {
+	return mailMgrMailgun{domain, key, from, eu}
+}
+
+type mailMgrMailgun struct {
+	Domain string
+	Key    string
+	From   string
+	EU     bool
+}
+
+func (m mailMgrMailgun) SendMail(to, subject, data string) error {
+	form := url.Values{}
+	form.Set("from", fmt.Sprintf("Key.cat <%s>", m.From))
+	form.Set("to", to)
+	form.Set("subject", subject)
+	form.Set("html", data)
+	var endpoint string
+	if m.EU {
+		endpoint = "https://api.eu.mailgun.net/v3/%s/messages"
+	} else {
+		endpoint = "https://api.mailgun.net/v3/%s/messages"
+	}
+	req, _ := http.NewRequest("POST", fmt.Sprintf(endpoint, m.Domain), strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("api", m.Key)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return util.NewErrorFrom(err)
+	}
+
+	defer resp.Body.Close()
+	resp_body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return util.NewError(string(resp_body))
+	}
+	return nil
+}
+
+// Check fetches the domain to verify the key can send from it
+func (m mailMgrMailgun) Check() error {
+	endpoint := "https://api.mailgun.net/v3/domains/%s"
+	if m.EU {
+		endpoint = "https://api.eu.mailgun.net/v3/domains/%s"
+	}
+	req, _ := http.NewRequest("GET", fmt.Sprintf(endpoint, m.Domain), nil)
+	req.SetBasicAuth("api", m.Key)
+	return checkMailProvider(req)
+}
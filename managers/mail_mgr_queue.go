@@ -0,0 +1,145 @@
+package managers
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+var ErrMailQueueClosed = errors.New("Mail queue is closed")
+
+const (
+	mailQueueMaxAttempts = 5
+	mailQueueBackoff     = time.Second
+)
+
+// MailMgrDrainer is implemented by mail managers that send in the background. Drain stops accepting new mails
+// and waits up to timeout for the pending ones to be sent
+type MailMgrDrainer interface {
+	Drain(timeout time.Duration) error
+}
+
+// MailMgrPending is implemented by mail managers that queue the mails. Pending is the number of mails waiting
+// to be sent and OldestPending how long the first of them has been waiting
+type MailMgrPending interface {
+	Pending() int
+	OldestPending() time.Duration
+}
+
+type queuedMail struct {
+	to       string
+	subject  string
+	data     string
+	queuedAt time.Time
+}
+
+// mailMgrQueue sends mails in the background so requests don't wait for the mail provider. Failed sends are
+// retried with exponential backoff. A single worker sends the mails so a throttling provider slows down the
+// whole queue instead of getting more requests
+type mailMgrQueue struct {
+	mm          MailMgr
+	metrics     MetricsMgr
+	queue       chan queuedMail
+	lock        *sync.RWMutex
+	closed      bool
+	done        chan struct{}
+	maxAttempts int
+	backoff     time.Duration
+	// When the mail being sent was queued. The queue is FIFO so it is the oldest pending one
+	sendingLock  *sync.Mutex
+	sendingSince time.Time
+}
+
+// NewMailMgrQueue queues the mails for mm. Failed attempts are counted in METRIC_MAILS_FAILED and mails dropped
+// after the last attempt in METRIC_MAILS_DEAD_LETTERED
+func NewMailMgrQueue(mm MailMgr, size int, metrics MetricsMgr) MailMgr {
+	mq := &mailMgrQueue{
+		mm:          mm,
+		metrics:     metrics,
+		queue:       make(chan queuedMail, size),
+		lock:        &sync.RWMutex{},
+		done:        make(chan struct{}),
+		maxAttempts: mailQueueMaxAttempts,
+		backoff:     mailQueueBackoff,
+		sendingLock: &sync.Mutex{},
+	}
+	go mq.run()
+	return mq
+}
+
+// SendMail enqueues the mail. It only blocks if the queue is full
+func (mq *mailMgrQueue) SendMail(to, subject, data string) error {
+	mq.lock.RLock()
+	defer mq.lock.RUnlock()
+	if mq.closed {
+		return util.NewErrorFrom(ErrMailQueueClosed)
+	}
+	mq.queue <- queuedMail{to, subject, data, time.Now()}
+	return nil
+}
+
+func (mq *mailMgrQueue) run() {
+	defer close(mq.done)
+	for m := range mq.queue {
+		mq.setSendingSince(m.queuedAt)
+		mq.send(m)
+		mq.setSendingSince(time.Time{})
+	}
+}
+
+func (mq *mailMgrQueue) setSendingSince(t time.Time) {
+	mq.sendingLock.Lock()
+	defer mq.sendingLock.Unlock()
+	mq.sendingSince = t
+}
+
+// send tries to send the mail up to maxAttempts times and returns how many attempts were done
+func (mq *mailMgrQueue) send(m queuedMail) int {
+	wait := mq.backoff
+	var err error
+	for attempt := 1; attempt <= mq.maxAttempts; attempt++ {
+		if err = mq.mm.SendMail(m.to, m.subject, m.data); err == nil {
+			return attempt
+		}
+		mq.metrics.Inc(METRIC_MAILS_FAILED)
+		if attempt < mq.maxAttempts {
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+	// The body is not logged since it may contain tokens
+	log.Printf("Dropping mail to %s (%s) after %d attempts: %s", m.to, m.subject, mq.maxAttempts, err)
+	mq.metrics.Inc(METRIC_MAILS_DEAD_LETTERED)
+	return mq.maxAttempts
+}
+
+func (mq *mailMgrQueue) Pending() int {
+	return len(mq.queue)
+}
+
+func (mq *mailMgrQueue) OldestPending() time.Duration {
+	mq.sendingLock.Lock()
+	defer mq.sendingLock.Unlock()
+	if mq.sendingSince.IsZero() {
+		return 0
+	}
+	return time.Since(mq.sendingSince)
+}
+
+func (mq *mailMgrQueue) Drain(timeout time.Duration) error {
+	mq.lock.Lock()
+	if !mq.closed {
+		mq.closed = true
+		close(mq.queue)
+	}
+	mq.lock.Unlock()
+	select {
+	case <-mq.done:
+		return nil
+	case <-time.After(timeout):
+		return util.NewErrorf("Mail queue did not drain in %s. %d mails were not sent", timeout, len(mq.queue))
+	}
+}
@@ -0,0 +1,94 @@
+package managers
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type flakyMailMgr struct {
+	failures int
+	attempts int
+	sent     int
+}
+
+func (f *flakyMailMgr) SendMail(to, subject, data string) error {
+	f.attempts++
+	if f.attempts <= f.failures {
+		return errors.New("flaky")
+	}
+	f.sent++
+	return nil
+}
+
+func TestMailQueueRetries(t *testing.T) {
+	flaky := &flakyMailMgr{failures: 2}
+	mq := NewMailMgrQueue(flaky, 10, NewMetricsMgr()).(*mailMgrQueue)
+	mq.backoff = time.Millisecond
+	if err := mq.SendMail("a@a.com", "subject", "data"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mq.Drain(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if flaky.attempts != 3 || flaky.sent != 1 {
+		t.Fatalf("Expected 3 attempts and 1 mail sent and got %d attempts and %d sent", flaky.attempts, flaky.sent)
+	}
+	if err := mq.SendMail("a@a.com", "subject", "data"); err == nil {
+		t.Fatal("Drained queues should not accept mails")
+	}
+}
+
+func TestMailQueueGivesUp(t *testing.T) {
+	flaky := &flakyMailMgr{failures: 100}
+	mq := NewMailMgrQueue(flaky, 10, NewMetricsMgr()).(*mailMgrQueue)
+	mq.backoff = time.Millisecond
+	if attempts := mq.send(queuedMail{to: "a@a.com", subject: "subject", data: "data"}); attempts != mailQueueMaxAttempts {
+		t.Fatalf("Expected %d attempts and got %d", mailQueueMaxAttempts, attempts)
+	}
+	if flaky.sent != 0 || flaky.attempts != mailQueueMaxAttempts {
+		t.Fatalf("Unexpected sends: %+v", flaky)
+	}
+	if failed := mq.metrics.Count(METRIC_MAILS_FAILED); failed != mailQueueMaxAttempts {
+		t.Fatalf("Expected %d failed attempts and got %d", mailQueueMaxAttempts, failed)
+	}
+	if dropped := mq.metrics.Count(METRIC_MAILS_DEAD_LETTERED); dropped != 1 {
+		t.Fatalf("Expected 1 dead lettered mail and got %d", dropped)
+	}
+}
+
+type blockingMailMgr struct {
+	release chan struct{}
+}
+
+func (b *blockingMailMgr) SendMail(to, subject, data string) error {
+	<-b.release
+	return nil
+}
+
+func TestMailQueueOldestPending(t *testing.T) {
+	blocking := &blockingMailMgr{make(chan struct{})}
+	mq := NewMailMgrQueue(blocking, 10, NewMetricsMgr()).(*mailMgrQueue)
+	if age := mq.OldestPending(); age != 0 {
+		t.Fatalf("Expected an empty queue to have no pending age and got %s", age)
+	}
+	for i := 0; i < 3; i++ {
+		if err := mq.SendMail("a@a.com", "subject", "data"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	if age := mq.OldestPending(); age < 20*time.Millisecond {
+		t.Fatalf("Expected the oldest mail to be pending for at least 20ms and got %s", age)
+	}
+	if pending := mq.Pending(); pending != 2 {
+		t.Fatalf("Expected 2 mails waiting behind the one being sent and got %d", pending)
+	}
+	close(blocking.release)
+	if err := mq.Drain(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if age := mq.OldestPending(); age != 0 {
+		t.Fatalf("Expected no pending age after draining and got %s", age)
+	}
+}
@@ -0,0 +1,176 @@
+package managers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+// ErrMailThrottled is returned when the mail provider refuses a message because the sending rate is exceeded.
+// The message can be retried later
+var ErrMailThrottled = errors.New("Mail provider is throttling requests")
+
+func NewMailMgrSES(region, accessKeyId, secretAccessKey, configurationSet, from string) MailMgr {
+	return mailMgrSES{region, accessKeyId, secretAccessKey, configurationSet, from, &http.Client{Timeout: 30 * time.Second}}
+}
+
+type mailMgrSES struct {
+	Region           string
+	AccessKeyId      string
+	SecretAccessKey  string
+	ConfigurationSet string
+	From             string
+	client           *http.Client
+}
+
+type sesContent struct {
+	Data    string
+	Charset string
+}
+
+type sesSendEmailRequest struct {
+	FromEmailAddress string
+	Destination      struct {
+		ToAddresses []string
+	}
+	Content struct {
+		Simple struct {
+			Subject sesContent
+			Body    struct {
+				Html sesContent
+			}
+		}
+	}
+	ConfigurationSetName string `json:",omitempty"`
+}
+
+func (m mailMgrSES) SendMail(to, subject, data string) error {
+	msg := sesSendEmailRequest{}
+	msg.FromEmailAddress = fmt.Sprintf("Key.cat <%s>", m.From)
+	msg.Destination.ToAddresses = []string{to}
+	msg.Content.Simple.Subject = sesContent{subject, "UTF-8"}
+	msg.Content.Simple.Body.Html = sesContent{data, "UTF-8"}
+	msg.ConfigurationSetName = m.ConfigurationSet
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return util.NewErrorFrom(err)
+	}
+	endpoint := fmt.Sprintf("https://email.%s.amazonaws.com/v2/email/outbound-emails", m.Region)
+	req, _ := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	signAWSv4(req, body, m.Region, "ses", m.AccessKeyId, m.SecretAccessKey, time.Now())
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return util.NewErrorFrom(err)
+	}
+	defer resp.Body.Close()
+	resp_body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	if isSESThrottled(resp, resp_body) {
+		return util.NewErrorFrom(ErrMailThrottled)
+	}
+	return util.NewError(string(resp_body))
+}
+
+// Check fetches the account details to verify the credentials and the region
+func (m mailMgrSES) Check() error {
+	req, _ := http.NewRequest("GET", fmt.Sprintf("https://email.%s.amazonaws.com/v2/email/account", m.Region), nil)
+	signAWSv4(req, nil, m.Region, "ses", m.AccessKeyId, m.SecretAccessKey, time.Now())
+	return checkMailProvider(req)
+}
+
+// SES answers throttled requests with a 429 or with a throttling error type in the body
+func isSESThrottled(resp *http.Response, body []byte) bool {
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	errType := resp.Header.Get("X-Amzn-ErrorType")
+	if len(errType) == 0 {
+		e := struct {
+			Type string `json:"__type"`
+			Code string `json:"code"`
+		}{}
+		json.Unmarshal(body, &e)
+		errType = e.Type + e.Code
+	}
+	for _, t := range []string{"Throttling", "TooManyRequests", "MaxSendRateExceeded"} {
+		if strings.Contains(errType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// signAWSv4 adds the AWS signature version 4 headers to the request. The host, the date and the
+// content type if there's one are signed
+func signAWSv4(req *http.Request, body []byte, region, service, accessKeyId, secretAccessKey string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{
+		"host":       req.URL.Host,
+		"x-amz-date": amzDate,
+	}
+	if ct := req.Header.Get("Content-Type"); len(ct) > 0 {
+		headers["content-type"] = ct
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + strings.TrimSpace(headers[name]) + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if len(path) == 0 {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.Query().Encode(),
+		canonicalHeaders,
+		signedHeaders,
+		sha256Hex(body),
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKeyId, scope, signedHeaders, signature))
+}
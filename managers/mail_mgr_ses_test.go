@@ -0,0 +1,37 @@
+package managers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSignAWSv4(t *testing.T) {
+	// get-vanilla from the AWS signature v4 test suite
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	now, _ := time.Parse("20060102T150405Z", "20150830T123600Z")
+	signAWSv4(req, []byte{}, "us-east-1", "service", "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", now)
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if auth := req.Header.Get("Authorization"); auth != expected {
+		t.Fatalf("Unexpected signature:\n%s\n%s", auth, expected)
+	}
+}
+
+func TestSESThrottled(t *testing.T) {
+	for _, tc := range []struct {
+		code      int
+		body      string
+		throttled bool
+	}{
+		{429, `{"message":"Too many requests"}`, true},
+		{400, `{"__type":"ThrottlingException"}`, true},
+		{400, `{"__type":"MessageRejected"}`, false},
+	} {
+		rec := httptest.NewRecorder()
+		rec.WriteHeader(tc.code)
+		if isSESThrottled(rec.Result(), []byte(tc.body)) != tc.throttled {
+			t.Errorf("Expected throttled %t for %d %s", tc.throttled, tc.code, tc.body)
+		}
+	}
+}
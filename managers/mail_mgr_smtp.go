@@ -1,13 +1,19 @@
 package managers
 
 import (
+	"crypto/tls"
 	"io"
+	"net"
 	"net/smtp"
 	"strings"
+	"time"
 
 	"github.com/keydotcat/keycatd/util"
 )
 
+// How long Check waits for the server to answer
+var smtpCheckTimeout = 10 * time.Second
+
 func NewMailMgrSMTP(server, user, pass, from string) MailMgr {
 	return mailMgrSMTP{server, user, pass, from}
 }
@@ -55,6 +61,37 @@ func (s mailMgrSMTP) SendMail(to, subject, data string) error {
 	return nil
 }
 
+// Check connects to the server and logs in if there is a user. The connection is upgraded with STARTTLS when the server
+// offers it so the credentials are not sent in the clear. It gives up after smtpCheckTimeout
+func (s mailMgrSMTP) Check() error {
+	conn, err := net.DialTimeout("tcp", s.Server, smtpCheckTimeout)
+	if err != nil {
+		return util.NewErrorFrom(err)
+	}
+	if err := conn.SetDeadline(time.Now().Add(smtpCheckTimeout)); err != nil {
+		conn.Close()
+		return util.NewErrorFrom(err)
+	}
+	host := strings.Split(s.Server, ":")[0]
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return util.NewErrorFrom(err)
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return util.NewErrorFrom(err)
+		}
+	}
+	if len(s.User) > 0 {
+		if err = c.Auth(smtp.PlainAuth("", s.User, s.Password, host)); err != nil {
+			return util.NewErrorFrom(err)
+		}
+	}
+	return util.NewErrorFrom(c.Quit())
+}
+
 func (s mailMgrSMTP) sendHeaders(to, subject string, sink io.WriteCloser) error {
 	buf := util.BufPool.Get()
 	defer util.BufPool.Put(buf)
@@ -0,0 +1,37 @@
+package managers
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSMTPCheckTimesOut(t *testing.T) {
+	// A server that accepts the connection and never greets
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	defer func(d time.Duration) { smtpCheckTimeout = d }(smtpCheckTimeout)
+	smtpCheckTimeout = 100 * time.Millisecond
+	done := make(chan error, 1)
+	go func() { done <- mailMgrSMTP{Server: l.Addr().String(), From: "a@a.com"}.Check() }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatalf("Expected the check to fail against a server that does not answer")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Check did not time out")
+	}
+}
@@ -4,10 +4,14 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"time"
 
 	"github.com/keydotcat/keycatd/util"
 )
 
+// Time to wait for the mail provider when checking the credentials
+const mailCheckTimeout = 10 * time.Second
+
 func NewMailMgrSparkpost(key, from string, eu bool) MailMgr {
 	return mailMgrSparkPost{key, from, eu}
 }
@@ -78,3 +82,29 @@ func (s mailMgrSparkPost) SendMail(to, subject, data string) error {
 	}
 	return nil
 }
+
+// Check fetches the account details to verify the key
+func (s mailMgrSparkPost) Check() error {
+	endpoint := "https://api.sparkpost.com/api/v1/account"
+	if s.EU {
+		endpoint = "https://api.eu.sparkpost.com/api/v1/account"
+	}
+	req, _ := http.NewRequest("GET", endpoint, nil)
+	req.Header.Add("Authorization", s.Key)
+	return checkMailProvider(req)
+}
+
+// checkMailProvider fails if the provider does not answer the request with a 200
+func checkMailProvider(req *http.Request) error {
+	client := &http.Client{Timeout: mailCheckTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return util.NewErrorFrom(err)
+	}
+	defer resp.Body.Close()
+	resp_body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return util.NewErrorf("%s: %s", resp.Status, resp_body)
+	}
+	return nil
+}
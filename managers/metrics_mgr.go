@@ -0,0 +1,40 @@
+package managers
+
+import "sync"
+
+// Counters kept by the metrics manager. Names follow the prometheus conventions
+const (
+	METRIC_LOGINS_SUCCEEDED = "keycat_logins_succeeded_total"
+	METRIC_LOGINS_FAILED    = "keycat_logins_failed_total"
+	METRIC_INVITES_SENT     = "keycat_invites_sent_total"
+	METRIC_MAILS_FAILED     = "keycat_mails_failed_total"
+	// Mails dropped after the last attempt
+	METRIC_MAILS_DEAD_LETTERED = "keycat_mails_dead_lettered_total"
+)
+
+// MetricsMgr counts events since the process started
+type MetricsMgr interface {
+	Inc(name string)
+	Count(name string) int64
+}
+
+type metricsMgr struct {
+	lock     *sync.Mutex
+	counters map[string]int64
+}
+
+func NewMetricsMgr() MetricsMgr {
+	return &metricsMgr{&sync.Mutex{}, make(map[string]int64)}
+}
+
+func (m *metricsMgr) Inc(name string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.counters[name]++
+}
+
+func (m *metricsMgr) Count(name string) int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.counters[name]
+}
@@ -10,6 +10,12 @@ import (
 	"github.com/keydotcat/keycatd/util"
 )
 
+// Session lifetime limits. Stores that can expire entries drop sessions once they go over them. 0 disables them
+var (
+	SESSION_MAX_AGE      time.Duration
+	SESSION_IDLE_TIMEOUT time.Duration
+)
+
 type Session struct {
 	Id           string    `json:"id" scaneo:"pk"`
 	User         string    `json:"user"`
@@ -18,6 +24,27 @@ type Session struct {
 	LastAccess   time.Time `json:"last_access"`
 	StoreToken   string    `json:"-"`
 	LastIp       string    `json:"last_ip"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// IsCooling tells if the session was created less than period ago
+func (s *Session) IsCooling(period time.Duration) bool {
+	return period > 0 && time.Since(s.CreatedAt) < period
+}
+
+// storeTTL returns how long the store has to keep the session from now. 0 keeps it forever
+func (s *Session) storeTTL(now time.Time) time.Duration {
+	var ttl time.Duration
+	if SESSION_MAX_AGE > 0 {
+		ttl = SESSION_MAX_AGE - now.Sub(s.CreatedAt)
+		if ttl <= 0 {
+			return time.Millisecond
+		}
+	}
+	if SESSION_IDLE_TIMEOUT > 0 && (ttl == 0 || SESSION_IDLE_TIMEOUT < ttl) {
+		ttl = SESSION_IDLE_TIMEOUT
+	}
+	return ttl
 }
 
 func encodeSession(buf *bytes.Buffer, s *Session) error {
@@ -46,3 +73,27 @@ type SessionMgr interface {
 	GetAllSessions(userId string) ([]*Session, error)
 	DeleteAllSessions(userId string) error
 }
+
+// SessionMgrPinger is implemented by session stores that live in an external server
+type SessionMgrPinger interface {
+	Ping() error
+}
+
+// SessionMgrCloser is implemented by session stores that hold connections or background goroutines. No other
+// method can be called after Close
+type SessionMgrCloser interface {
+	Close() error
+}
+
+// SessionMgrSentinel is implemented by session stores kept in redis. CurrentMaster is the address of the server that
+// takes the writes and SentinelAddrs the sentinels known to be watching it, if any. Both can be called while a
+// failover is going on
+type SessionMgrSentinel interface {
+	CurrentMaster() string
+	SentinelAddrs() []string
+}
+
+// SessionMgrCounter is implemented by session stores that can count the sessions they keep
+type SessionMgrCounter interface {
+	CountSessions() (int, error)
+}
@@ -37,9 +37,10 @@ func (r sessionMgrDB) doTx(ftor func(*sql.Tx) error) error {
 }
 
 func (r sessionMgrDB) NewSession(userId, ip, agent string, csrf bool) (*Session, error) {
-	o := Session{util.GenerateRandomToken(15), userId, agent, csrf, time.Now().UTC(), util.GenerateRandomToken(15), ip}
+	now := time.Now().UTC()
+	o := Session{util.GenerateRandomToken(15), userId, agent, csrf, now, util.GenerateRandomToken(15), ip, now}
 	err := r.doTx(func(tx *sql.Tx) error {
-		_, err := r.dbp.Exec("INSERT INTO \"session\" "+insertSessionFields+" VALUES "+insertSessionBinds, o.Id, o.User, o.Agent, o.RequiresCSRF, o.LastAccess, o.StoreToken, o.LastIp)
+		_, err := r.dbp.Exec("INSERT INTO \"session\" "+insertSessionFields+" VALUES "+insertSessionBinds, o.Id, o.User, o.Agent, o.RequiresCSRF, o.LastAccess, o.StoreToken, o.LastIp, o.CreatedAt)
 		return err
 	})
 	if err == nil {
@@ -98,6 +99,15 @@ func (r sessionMgrDB) GetAllSessions(userId string) ([]*Session, error) {
 	return scanSessions(rows)
 }
 
+// CountSessions returns how many sessions are stored. Sessions over the age limits are counted until they are used
+func (r sessionMgrDB) CountSessions() (int, error) {
+	n := 0
+	if err := r.dbp.QueryRow("SELECT COUNT(*) FROM \"session\"").Scan(&n); err != nil {
+		return 0, util.NewErrorFrom(err)
+	}
+	return n, nil
+}
+
 func (r sessionMgrDB) purgeAllData() {
 	_, err := r.dbp.Exec("DELETE FROM \"session\"")
 	if err != nil {
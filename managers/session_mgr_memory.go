@@ -0,0 +1,186 @@
+package managers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/keydotcat/keycatd/models"
+	"github.com/keydotcat/keycatd/util"
+)
+
+type memorySession struct {
+	s         Session
+	expiresAt time.Time
+}
+
+// sessionMgrMemory keeps the sessions in the process memory. Sessions are lost on restart and are not shared
+// between instances so it only fits single node deployments
+type sessionMgrMemory struct {
+	lock     *sync.Mutex
+	sessions map[string]*memorySession
+	users    map[string]map[string]bool
+	stopChan chan bool
+	*attemptCounterMemory
+	*idempotencyStoreMemory
+}
+
+func NewSessionMgrMemory(sweepInterval time.Duration) SessionMgr {
+	m := &sessionMgrMemory{
+		&sync.Mutex{},
+		make(map[string]*memorySession),
+		make(map[string]map[string]bool),
+		make(chan bool),
+		newAttemptCounterMemory(),
+		newIdempotencyStoreMemory(),
+	}
+	go m.sweepLoop(sweepInterval)
+	return m
+}
+
+func (m *sessionMgrMemory) sweepLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stopChan:
+			return
+		case now := <-ticker.C:
+			m.sweep(now)
+			m.expireAttempts(now)
+			m.expireIdempotencyKeys(now)
+		}
+	}
+}
+
+// sweep drops the expired sessions and returns how many were removed
+func (m *sessionMgrMemory) sweep(now time.Time) int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	removed := 0
+	for _, ms := range m.sessions {
+		if ms.expired(now) {
+			m.delete(&ms.s)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (m *sessionMgrMemory) stop() {
+	close(m.stopChan)
+}
+
+// Close stops the sweep of expired sessions
+func (m *sessionMgrMemory) Close() error {
+	m.stop()
+	return nil
+}
+
+func (ms *memorySession) expired(now time.Time) bool {
+	return !ms.expiresAt.IsZero() && now.After(ms.expiresAt)
+}
+
+func (m *sessionMgrMemory) store(s *Session) {
+	ms := &memorySession{s: *s}
+	now := time.Now()
+	if ttl := s.storeTTL(now); ttl > 0 {
+		ms.expiresAt = now.Add(ttl)
+	}
+	m.sessions[s.Id] = ms
+	if _, ok := m.users[s.User]; !ok {
+		m.users[s.User] = make(map[string]bool)
+	}
+	m.users[s.User][s.Id] = true
+}
+
+func (m *sessionMgrMemory) delete(s *Session) {
+	delete(m.sessions, s.Id)
+	delete(m.users[s.User], s.Id)
+	if len(m.users[s.User]) == 0 {
+		delete(m.users, s.User)
+	}
+}
+
+func (m *sessionMgrMemory) get(id string) (*memorySession, error) {
+	ms, ok := m.sessions[id]
+	if !ok || ms.expired(time.Now()) {
+		return nil, util.NewErrorFrom(models.ErrDoesntExist)
+	}
+	return ms, nil
+}
+
+// CountSessions returns how many sessions are kept. Expired ones are counted until the next sweep
+func (m *sessionMgrMemory) CountSessions() (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.sessions), nil
+}
+
+func (m *sessionMgrMemory) NewSession(userId, ip, agent string, csrf bool) (*Session, error) {
+	now := time.Now().UTC()
+	s := &Session{util.GenerateRandomToken(15), userId, agent, csrf, now, util.GenerateRandomToken(15), ip, now}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.store(s)
+	return s, nil
+}
+
+func (m *sessionMgrMemory) GetSession(id string) (*Session, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ms, err := m.get(id)
+	if err != nil {
+		return nil, err
+	}
+	s := ms.s
+	return &s, nil
+}
+
+func (m *sessionMgrMemory) UpdateSession(id, ip, agent string) (*Session, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ms, err := m.get(id)
+	if err != nil {
+		return nil, err
+	}
+	s := ms.s
+	s.Agent = agent
+	s.LastAccess = time.Now().UTC()
+	s.LastIp = ip
+	m.store(&s)
+	return &s, nil
+}
+
+func (m *sessionMgrMemory) DeleteSession(id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ms, err := m.get(id)
+	if err != nil {
+		return err
+	}
+	m.delete(&ms.s)
+	return nil
+}
+
+func (m *sessionMgrMemory) GetAllSessions(userId string) ([]*Session, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ses := make([]*Session, 0, len(m.users[userId]))
+	for sid := range m.users[userId] {
+		if ms, err := m.get(sid); err == nil {
+			s := ms.s
+			ses = append(ses, &s)
+		}
+	}
+	return ses, nil
+}
+
+func (m *sessionMgrMemory) DeleteAllSessions(userId string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for sid := range m.users[userId] {
+		delete(m.sessions, sid)
+	}
+	delete(m.users, userId)
+	return nil
+}
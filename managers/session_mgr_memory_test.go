@@ -0,0 +1,72 @@
+package managers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemorySessionManager(t *testing.T) {
+	ms := NewSessionMgrMemory(time.Hour)
+	defer ms.(*sessionMgrMemory).stop()
+	testSessionManager(ms, t, "memory")
+}
+
+func TestMemorySessionExpiry(t *testing.T) {
+	defer func() { SESSION_IDLE_TIMEOUT = 0 }()
+	SESSION_IDLE_TIMEOUT = time.Hour
+	ms := NewSessionMgrMemory(time.Hour).(*sessionMgrMemory)
+	defer ms.stop()
+	old, err := ms.NewSession("u1", "1.1.1.1", "agent", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SESSION_IDLE_TIMEOUT = 3 * time.Hour
+	fresh, err := ms.NewSession("u1", "1.1.1.1", "agent", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := ms.sweep(time.Now()); n != 0 {
+		t.Fatalf("Nothing should have expired yet and %d sessions were swept", n)
+	}
+	if n := ms.sweep(time.Now().Add(2 * time.Hour)); n != 1 {
+		t.Fatalf("Expected 1 expired session and %d were swept", n)
+	}
+	if _, err := ms.GetSession(old.Id); err == nil {
+		t.Fatal("Expired session is still there")
+	}
+	sessions, err := ms.GetAllSessions("u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].Id != fresh.Id {
+		t.Fatalf("Expected only the fresh session to be indexed and got %d", len(sessions))
+	}
+	if err := ms.DeleteAllSessions("u1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ms.GetSession(fresh.Id); err == nil {
+		t.Fatal("Revoked session is still there")
+	}
+}
+
+func TestIdempotencyStoreMemoryLimit(t *testing.T) {
+	is := newIdempotencyStoreMemory()
+	is.maxBytes = 100
+	if stored, err := is.ClaimIdempotencyKey("k1", &IdempotencyRecord{RequestHash: "h"}, time.Hour); stored != nil || err != nil {
+		t.Fatalf("Expected to claim the key: %v %v", stored, err)
+	}
+	if err := is.SaveIdempotencyKey("k1", &IdempotencyRecord{RequestHash: "h", Status: 200, Body: make([]byte, 90)}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	is.ClaimIdempotencyKey("k2", &IdempotencyRecord{RequestHash: "h"}, time.Hour)
+	if err := is.SaveIdempotencyKey("k2", &IdempotencyRecord{RequestHash: "h", Status: 200, Body: make([]byte, 90)}, time.Hour); err != ErrIdempotencyStoreFull {
+		t.Fatalf("Expected the store to be full and got %v", err)
+	}
+	is.expireIdempotencyKeys(time.Now().Add(2 * time.Hour))
+	if is.size != 0 || len(is.entries) != 0 {
+		t.Fatalf("Expected expired records to be dropped: %d bytes in %d records", is.size, len(is.entries))
+	}
+	if err := is.SaveIdempotencyKey("k2", &IdempotencyRecord{RequestHash: "h", Status: 200, Body: make([]byte, 90)}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,7 +1,9 @@
 package managers
 
 import (
+	"encoding/json"
 	"fmt"
+	"sort"
 	"strconv"
 	"time"
 
@@ -11,9 +13,11 @@ import (
 )
 
 type sessionMgrRedis struct {
-	prefix string
-	dbId   string
-	pool   *radix.Pool
+	prefix   string
+	dbId     string
+	pool     radix.Client
+	connUrl  string
+	sentinel *radix.Sentinel
 }
 
 func NewSessionMgrRedis(connUrl string, dbId int) (SessionMgr, error) {
@@ -21,7 +25,106 @@ func NewSessionMgrRedis(connUrl string, dbId int) (SessionMgr, error) {
 	if err != nil {
 		return nil, err
 	}
-	return sessionMgrRedis{"kc-", strconv.Itoa(dbId), pool}, nil
+	return sessionMgrRedis{"kc-", strconv.Itoa(dbId), pool, connUrl, nil}, nil
+}
+
+const (
+	// Max sentinels probed at the same time
+	sentinelProbeConcurrency = 8
+	sentinelProbeTimeout     = 2 * time.Second
+)
+
+// NewSessionMgrRedisSentinel asks the sentinels for the current master and follows it when it fails over.
+// Sessions are only lost on a failover if they were not replicated before the switch
+func NewSessionMgrRedisSentinel(masterName string, sentinelAddrs []string, dbId int) (SessionMgr, error) {
+	sentinel, err := radix.NewSentinel(masterName, fastestSentinelFirst(sentinelAddrs, sentinelProbeTimeout))
+	if err != nil {
+		return nil, err
+	}
+	return sessionMgrRedis{"kc-", strconv.Itoa(dbId), sentinel, "", sentinel}, nil
+}
+
+// fastestSentinelFirst pings the sentinels concurrently and moves the first one that answers to the front. The
+// sentinel client tries the addresses in order so slow or dead ones would delay the start. The rest are kept so the
+// client can fall back to them if the fastest one goes away. The addresses are returned as given if none answers
+func fastestSentinelFirst(addrs []string, timeout time.Duration) []string {
+	if len(addrs) < 2 {
+		return addrs
+	}
+	answered := make(chan string, len(addrs))
+	failed := make(chan struct{}, len(addrs))
+	slots := make(chan struct{}, sentinelProbeConcurrency)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for _, addr := range addrs {
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return
+			}
+			go func(addr string) {
+				defer func() { <-slots }()
+				if pingSentinel(addr, timeout) == nil {
+					answered <- addr
+				} else {
+					failed <- struct{}{}
+				}
+			}(addr)
+		}
+	}()
+	for range addrs {
+		select {
+		case addr := <-answered:
+			sorted := []string{addr}
+			for _, other := range addrs {
+				if other != addr {
+					sorted = append(sorted, other)
+				}
+			}
+			return sorted
+		case <-failed:
+		}
+	}
+	return addrs
+}
+
+func pingSentinel(addr string, timeout time.Duration) error {
+	conn, err := radix.Dial("tcp", addr, radix.DialTimeout(timeout))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Do(radix.Cmd(nil, "PING"))
+}
+
+// CurrentMaster returns the address of the redis server that takes the writes. With sentinels it changes after a
+// failover once the sentinel client has followed the switch
+func (r sessionMgrRedis) CurrentMaster() string {
+	if r.sentinel != nil {
+		addr, _ := r.sentinel.Addrs()
+		return addr
+	}
+	return r.connUrl
+}
+
+// SentinelAddrs returns the sentinels known by the sentinel client, sorted. It's empty without sentinels
+func (r sessionMgrRedis) SentinelAddrs() []string {
+	if r.sentinel == nil {
+		return nil
+	}
+	addrs := r.sentinel.SentinelAddrs()
+	sort.Strings(addrs)
+	return addrs
+}
+
+func (r sessionMgrRedis) Ping() error {
+	return util.NewErrorFrom(r.pool.Do(radix.Cmd(nil, "PING")))
+}
+
+// Close closes the connections to redis. With sentinels the pool is the sentinel client so there is only one to close
+func (r sessionMgrRedis) Close() error {
+	return r.pool.Close()
 }
 
 func (r sessionMgrRedis) skey(i string) string {
@@ -32,8 +135,17 @@ func (r sessionMgrRedis) ukey(i string) string {
 	return fmt.Sprintf("%su:%s", r.prefix, i)
 }
 
+// setCmd stores the encoded session with an expiration so redis drops it once it goes over its lifetime
+func (r sessionMgrRedis) setCmd(s *Session, encoded string) radix.CmdAction {
+	if ttl := s.storeTTL(time.Now()); ttl > 0 {
+		return radix.FlatCmd(nil, "SET", r.skey(s.Id), encoded, "PX", int64(ttl/time.Millisecond))
+	}
+	return radix.Cmd(nil, "SET", r.skey(s.Id), encoded)
+}
+
 func (r sessionMgrRedis) NewSession(userId, ip, agent string, csrf bool) (*Session, error) {
-	s := &Session{util.GenerateRandomToken(15), userId, agent, csrf, time.Now().UTC(), util.GenerateRandomToken(15), ip}
+	now := time.Now().UTC()
+	s := &Session{util.GenerateRandomToken(15), userId, agent, csrf, now, util.GenerateRandomToken(15), ip, now}
 	b := util.BufPool.Get()
 	defer util.BufPool.Put(b)
 	if err := encodeSession(b, s); err != nil {
@@ -41,7 +153,7 @@ func (r sessionMgrRedis) NewSession(userId, ip, agent string, csrf bool) (*Sessi
 	}
 	p := radix.Pipeline(
 		radix.Cmd(nil, "SELECT", r.dbId),
-		radix.Cmd(nil, "SET", r.skey(s.Id), b.String()),
+		r.setCmd(s, b.String()),
 		radix.Cmd(nil, "SADD", r.ukey(s.User), s.Id),
 	)
 	if err := r.pool.Do(p); err != nil {
@@ -94,7 +206,7 @@ func (r sessionMgrRedis) storeSession(s *Session) error {
 	}
 	p := radix.Pipeline(
 		radix.Cmd(nil, "SELECT", r.dbId),
-		radix.Cmd(nil, "SET", r.skey(s.Id), b.String()),
+		r.setCmd(s, b.String()),
 		radix.Cmd(nil, "SADD", r.ukey(s.User), s.Id),
 	)
 	if err := r.pool.Do(p); err != nil {
@@ -169,10 +281,10 @@ func (r sessionMgrRedis) GetAllSessions(userId string) ([]*Session, error) {
 	if err := r.pool.Do(p); err != nil {
 		return nil, err
 	}
-	ses := make([]*Session, len(sids))
+	ses := make([]*Session, 0, len(sids))
 	b := util.BufPool.Get()
 	defer util.BufPool.Put(b)
-	for i, sid := range sids {
+	for _, sid := range sids {
 		b.Reset()
 		p = radix.Pipeline(
 			radix.Cmd(nil, "SELECT", r.dbId),
@@ -181,10 +293,116 @@ func (r sessionMgrRedis) GetAllSessions(userId string) ([]*Session, error) {
 		if err := r.pool.Do(p); err != nil {
 			return nil, err
 		}
-		ses[i] = &Session{}
-		if err := decodeSession(b, ses[i]); err != nil {
+		if b.Len() == 0 {
+			// The session is gone but the user index still points to it
+			p = radix.Pipeline(
+				radix.Cmd(nil, "SELECT", r.dbId),
+				radix.Cmd(nil, "SREM", r.ukey(userId), sid),
+			)
+			if err := r.pool.Do(p); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		s := &Session{}
+		if err := decodeSession(b, s); err != nil {
 			return nil, err
 		}
+		ses = append(ses, s)
 	}
 	return ses, nil
 }
+
+func (r sessionMgrRedis) akey(i string) string {
+	return fmt.Sprintf("%sa:%s", r.prefix, i)
+}
+
+// AddAttempt creates the counter with the window as expiration if it does not exist before incrementing it
+func (r sessionMgrRedis) AddAttempt(key string, window time.Duration) (int, error) {
+	var count int
+	p := radix.Pipeline(
+		radix.Cmd(nil, "SELECT", r.dbId),
+		radix.FlatCmd(nil, "SET", r.akey(key), 0, "PX", int64(window/time.Millisecond), "NX"),
+		radix.Cmd(&count, "INCR", r.akey(key)),
+	)
+	if err := r.pool.Do(p); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (r sessionMgrRedis) Attempts(key string) (int, error) {
+	var count int
+	p := radix.Pipeline(
+		radix.Cmd(nil, "SELECT", r.dbId),
+		radix.Cmd(&count, "GET", r.akey(key)),
+	)
+	if err := r.pool.Do(p); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (r sessionMgrRedis) ResetAttempts(key string) error {
+	return r.pool.Do(radix.Pipeline(
+		radix.Cmd(nil, "SELECT", r.dbId),
+		radix.Cmd(nil, "DEL", r.akey(key)),
+	))
+}
+
+func (r sessionMgrRedis) ikey(i string) string {
+	return fmt.Sprintf("%si:%s", r.prefix, i)
+}
+
+// ClaimIdempotencyKey sets the record only if the key does not exist. If another request has the key its record is
+// returned, unless it expired in between and the key is tried again
+func (r sessionMgrRedis) ClaimIdempotencyKey(key string, rec *IdempotencyRecord, ttl time.Duration) (*IdempotencyRecord, error) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil, util.NewErrorFrom(err)
+	}
+	for i := 0; i < 3; i++ {
+		var reply string
+		set := radix.MaybeNil{Rcv: &reply}
+		var stored []byte
+		get := radix.MaybeNil{Rcv: &stored}
+		p := radix.Pipeline(
+			radix.Cmd(nil, "SELECT", r.dbId),
+			radix.FlatCmd(&set, "SET", r.ikey(key), data, "PX", int64(ttl/time.Millisecond), "NX"),
+			radix.Cmd(&get, "GET", r.ikey(key)),
+		)
+		if err := r.pool.Do(p); err != nil {
+			return nil, err
+		}
+		if !set.Nil {
+			return nil, nil
+		}
+		if get.Nil {
+			continue
+		}
+		other := &IdempotencyRecord{}
+		if err := json.Unmarshal(stored, other); err != nil {
+			return nil, util.NewErrorFrom(err)
+		}
+		return other, nil
+	}
+	return nil, util.NewErrorf("Could not claim idempotency key %s", key)
+}
+
+func (r sessionMgrRedis) SaveIdempotencyKey(key string, rec *IdempotencyRecord, ttl time.Duration) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return util.NewErrorFrom(err)
+	}
+	return r.pool.Do(radix.Pipeline(
+		radix.Cmd(nil, "SELECT", r.dbId),
+		radix.FlatCmd(nil, "SET", r.ikey(key), data, "PX", int64(ttl/time.Millisecond)),
+	))
+}
+
+func (r sessionMgrRedis) ReleaseIdempotencyKey(key string) error {
+	return r.pool.Do(radix.Pipeline(
+		radix.Cmd(nil, "SELECT", r.dbId),
+		radix.Cmd(nil, "DEL", r.ikey(key)),
+	))
+}
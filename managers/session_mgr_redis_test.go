@@ -1,6 +1,18 @@
 package managers
 
-import "testing"
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	radix "github.com/mediocregopher/radix/v3"
+)
 
 func init() {
 	rs, err := NewSessionMgrRedis("localhost:6379", 10)
@@ -19,3 +31,284 @@ func TestRedisSessionManager(t *testing.T) {
 	}
 	testSessionManager(rs, t, "redis")
 }
+
+func TestRedisSessionExpiredButIndexed(t *testing.T) {
+	rs, err := NewSessionMgrRedis("localhost:6379", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rs.(sessionMgrRedis)
+	uid := getDummyUser().Id
+	s1, err := r.NewSession(uid, "1.1.1.1", "agent1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := r.NewSession(uid, "1.1.1.1", "agent2", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := radix.Pipeline(
+		radix.Cmd(nil, "SELECT", r.dbId),
+		radix.Cmd(nil, "DEL", r.skey(s1.Id)),
+	)
+	if err = r.pool.Do(p); err != nil {
+		t.Fatal(err)
+	}
+	sess, err := r.GetAllSessions(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sess) != 1 || sess[0].Id != s2.Id {
+		t.Fatalf("Expected only session %s and got %d sessions", s2.Id, len(sess))
+	}
+	var indexed int
+	p = radix.Pipeline(
+		radix.Cmd(nil, "SELECT", r.dbId),
+		radix.Cmd(&indexed, "SCARD", r.ukey(uid)),
+	)
+	if err = r.pool.Do(p); err != nil {
+		t.Fatal(err)
+	}
+	if indexed != 1 {
+		t.Fatalf("Expected the stale session to be removed from the index and got %d entries", indexed)
+	}
+	if err = r.DeleteAllSessions(uid); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionStoreTTL(t *testing.T) {
+	defer func() { SESSION_MAX_AGE, SESSION_IDLE_TIMEOUT = 0, 0 }()
+	now := time.Now()
+	s := &Session{CreatedAt: now.Add(-time.Hour)}
+	if ttl := s.storeTTL(now); ttl != 0 {
+		t.Fatalf("Expected no ttl without limits and got %s", ttl)
+	}
+	SESSION_MAX_AGE = 3 * time.Hour
+	SESSION_IDLE_TIMEOUT = time.Hour
+	if ttl := s.storeTTL(now); ttl != time.Hour {
+		t.Fatalf("Expected the idle timeout as ttl and got %s", ttl)
+	}
+	s.CreatedAt = now.Add(-150 * time.Minute)
+	if ttl := s.storeTTL(now); ttl != 30*time.Minute {
+		t.Fatalf("Expected the remaining max age as ttl and got %s", ttl)
+	}
+	rs, err := NewSessionMgrRedis("localhost:6379", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rs.(sessionMgrRedis)
+	ns, err := r.NewSession(getDummyUser().Id, "1.1.1.1", "agent", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pttl int64
+	p := radix.Pipeline(
+		radix.Cmd(nil, "SELECT", r.dbId),
+		radix.Cmd(&pttl, "PTTL", r.skey(ns.Id)),
+	)
+	if err = r.pool.Do(p); err != nil {
+		t.Fatal(err)
+	}
+	if pttl <= 0 || pttl > int64(time.Hour/time.Millisecond) {
+		t.Fatalf("Unexpected session expiration in redis: %dms", pttl)
+	}
+}
+
+// fakeSentinel answers the sentinel commands the radix client needs pointing to the current master. switchMaster
+// changes the master and announces it to the subscribed clients like sentinels do after a failover
+type fakeSentinel struct {
+	net.Listener
+	masterName  string
+	lock        *sync.Mutex
+	masterAddr  string
+	subscribers []net.Conn
+}
+
+func respArray(args ...string) string {
+	out := fmt.Sprintf("*%d\r\n", len(args))
+	for _, a := range args {
+		out += fmt.Sprintf("$%d\r\n%s\r\n", len(a), a)
+	}
+	return out
+}
+
+func newFakeSentinel(t *testing.T, masterName, masterAddr string) *fakeSentinel {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &fakeSentinel{ln, masterName, &sync.Mutex{}, masterAddr, nil}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fs.serve(conn)
+		}
+	}()
+	return fs
+}
+
+func (fs *fakeSentinel) write(conn net.Conn, data string) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	conn.Write([]byte(data))
+}
+
+func (fs *fakeSentinel) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	subscribed := false
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, n)
+		for i := range args {
+			if line, err = rd.ReadString('\n'); err != nil {
+				return
+			}
+			l, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			buf := make([]byte, l+2)
+			if _, err := io.ReadFull(rd, buf); err != nil {
+				return
+			}
+			args[i] = string(buf[:l])
+		}
+		cmd := strings.ToUpper(strings.Join(args, " "))
+		switch {
+		case strings.HasPrefix(cmd, "SENTINEL MASTER"):
+			fs.lock.Lock()
+			host, port, _ := net.SplitHostPort(fs.masterAddr)
+			fs.lock.Unlock()
+			fs.write(conn, respArray("name", fs.masterName, "ip", host, "port", port))
+		case strings.HasPrefix(cmd, "SENTINEL"):
+			fs.write(conn, "*0\r\n")
+		case strings.HasPrefix(cmd, "SUBSCRIBE"):
+			subscribed = true
+			fs.lock.Lock()
+			fs.subscribers = append(fs.subscribers, conn)
+			fs.lock.Unlock()
+			fs.write(conn, fmt.Sprintf("*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(args[1]), args[1]))
+		case cmd == "PING" && subscribed:
+			fs.write(conn, respArray("pong", ""))
+		case cmd == "PING":
+			fs.write(conn, "+PONG\r\n")
+		default:
+			fs.write(conn, "-ERR unknown command\r\n")
+		}
+	}
+}
+
+func (fs *fakeSentinel) switchMaster(addr string) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	oldHost, oldPort, _ := net.SplitHostPort(fs.masterAddr)
+	newHost, newPort, _ := net.SplitHostPort(addr)
+	fs.masterAddr = addr
+	msg := respArray("message", "+switch-master", strings.Join([]string{fs.masterName, oldHost, oldPort, newHost, newPort}, " "))
+	for _, conn := range fs.subscribers {
+		conn.Write([]byte(msg))
+	}
+}
+
+func TestRedisSentinelSessionManager(t *testing.T) {
+	fs := newFakeSentinel(t, "kcmaster", "127.0.0.1:6379")
+	defer fs.Close()
+	rs, err := NewSessionMgrRedisSentinel("kcmaster", []string{fs.Addr().String()}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rs.(sessionMgrRedis)
+	defer r.sentinel.Close()
+	if addr := r.CurrentMaster(); addr != "127.0.0.1:6379" {
+		t.Fatalf("Unexpected master %s", addr)
+	}
+	s, err := rs.NewSession(getDummyUser().Id, "1.1.1.1", "agent", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs, err := rs.GetSession(s.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gs.User != s.User || gs.Agent != s.Agent {
+		t.Fatalf("Session mismatch after round trip: %+v vs %+v", gs, s)
+	}
+	if err := rs.DeleteSession(s.Id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedisSentinelCurrentMaster(t *testing.T) {
+	fs := newFakeSentinel(t, "kcmaster", "127.0.0.1:6379")
+	defer fs.Close()
+	rs, err := NewSessionMgrRedisSentinel("kcmaster", []string{fs.Addr().String()}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rs.(sessionMgrRedis)
+	defer r.sentinel.Close()
+	if addrs := r.SentinelAddrs(); len(addrs) != 1 || addrs[0] != fs.Addr().String() {
+		t.Fatalf("Unexpected sentinels %v", addrs)
+	}
+	// Same server under another address so the client can connect to the new master
+	fs.switchMaster("localhost:6379")
+	deadline := time.Now().Add(5 * time.Second)
+	for r.CurrentMaster() != "localhost:6379" {
+		if time.Now().After(deadline) {
+			t.Fatalf("The master is still %s after the switch", r.CurrentMaster())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := rs.NewSession(getDummyUser().Id, "1.1.1.1", "agent", false); err != nil {
+		t.Fatalf("Could not use the new master: %s", err)
+	}
+}
+
+func TestFastestSentinelFirst(t *testing.T) {
+	addrs := []string{}
+	for i := 0; i < 5; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		// Accepts the connections but never answers
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+			}
+		}()
+		addrs = append(addrs, ln.Addr().String())
+	}
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs = append(addrs, dead.Addr().String())
+	dead.Close()
+	fs := newFakeSentinel(t, "kcmaster", "127.0.0.1:6379")
+	defer fs.Close()
+	addrs = append(addrs, fs.Addr().String())
+	start := time.Now()
+	found := fastestSentinelFirst(addrs, 2*time.Second)
+	if len(found) != len(addrs) || found[0] != fs.Addr().String() {
+		t.Fatalf("Expected all the sentinels with the fast one first and got %v", found)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("Finding the fast sentinel took %s", took)
+	}
+	addrs = addrs[:len(addrs)-1]
+	if found := fastestSentinelFirst(addrs, 100*time.Millisecond); len(found) != len(addrs) {
+		t.Fatalf("Expected all the addresses back when none answers and got %v", found)
+	}
+}
@@ -0,0 +1,277 @@
+package managers
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+var ErrSessionStoreUnavailable = errors.New("Session store is not available yet")
+
+// sessionMgrRetry keeps trying to connect to a session store in the background. Until it succeeds every operation
+// fails with ErrSessionStoreUnavailable
+type sessionMgrRetry struct {
+	lock    *sync.RWMutex
+	sm      SessionMgr
+	closeCh chan struct{}
+	closed  bool
+}
+
+// retryBackoff doubles the wait after each failure up to max. Each wait is randomly cut by up to half so instances
+// that lost the store at the same time don't all retry together against it while it recovers
+type retryBackoff struct {
+	base    time.Duration
+	max     time.Duration
+	current time.Duration
+	rnd     *rand.Rand
+}
+
+func newRetryBackoff(base, max time.Duration) *retryBackoff {
+	return &retryBackoff{base: base, max: max, rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// next returns how long to wait before the next attempt
+func (b *retryBackoff) next() time.Duration {
+	switch {
+	case b.current == 0:
+		b.current = b.base
+	case b.current < b.max:
+		b.current *= 2
+	}
+	if b.current > b.max {
+		b.current = b.max
+	}
+	half := int64(b.current / 2)
+	return time.Duration(half + b.rnd.Int63n(half+1))
+}
+
+// NewSessionMgrRetry connects in the background waiting from minInterval up to maxInterval between attempts
+func NewSessionMgrRetry(connect func() (SessionMgr, error), minInterval, maxInterval time.Duration) SessionMgr {
+	r := &sessionMgrRetry{lock: &sync.RWMutex{}, closeCh: make(chan struct{})}
+	go r.connectLoop(connect, newRetryBackoff(minInterval, maxInterval))
+	return r
+}
+
+func (r *sessionMgrRetry) connectLoop(connect func() (SessionMgr, error), backoff *retryBackoff) {
+	for {
+		sm, err := connect()
+		if err == nil {
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			if r.closed {
+				// Closed while connecting
+				if c, ok := sm.(SessionMgrCloser); ok {
+					c.Close()
+				}
+				return
+			}
+			r.sm = sm
+			log.Printf("Connected to the session store")
+			return
+		}
+		wait := backoff.next()
+		log.Printf("Session store is not available: %s. Retrying in %s", err, wait.Round(time.Millisecond))
+		select {
+		case <-r.closeCh:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (r *sessionMgrRetry) get() (SessionMgr, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if r.sm == nil {
+		return nil, util.NewErrorFrom(ErrSessionStoreUnavailable)
+	}
+	return r.sm, nil
+}
+
+// Ping fails while the session store is not connected and checks the store itself afterwards
+func (r *sessionMgrRetry) Ping() error {
+	sm, err := r.get()
+	if err != nil {
+		return err
+	}
+	if p, ok := sm.(SessionMgrPinger); ok {
+		return p.Ping()
+	}
+	return nil
+}
+
+// Close stops trying to connect and closes the session store if it was already connected
+func (r *sessionMgrRetry) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	close(r.closeCh)
+	if c, ok := r.sm.(SessionMgrCloser); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// CurrentMaster is empty while the session store is not connected
+func (r *sessionMgrRetry) CurrentMaster() string {
+	sm, err := r.get()
+	if err != nil {
+		return ""
+	}
+	if s, ok := sm.(SessionMgrSentinel); ok {
+		return s.CurrentMaster()
+	}
+	return ""
+}
+
+// SentinelAddrs is empty while the session store is not connected
+func (r *sessionMgrRetry) SentinelAddrs() []string {
+	sm, err := r.get()
+	if err != nil {
+		return nil
+	}
+	if s, ok := sm.(SessionMgrSentinel); ok {
+		return s.SentinelAddrs()
+	}
+	return nil
+}
+
+// CountSessions fails while the session store is not connected or if it cannot count its sessions
+func (r *sessionMgrRetry) CountSessions() (int, error) {
+	sm, err := r.get()
+	if err != nil {
+		return 0, err
+	}
+	c, ok := sm.(SessionMgrCounter)
+	if !ok {
+		return 0, util.NewErrorf("Session store %T cannot count sessions", sm)
+	}
+	return c.CountSessions()
+}
+
+func (r *sessionMgrRetry) NewSession(userId, ip, agent string, csrf bool) (*Session, error) {
+	sm, err := r.get()
+	if err != nil {
+		return nil, err
+	}
+	return sm.NewSession(userId, ip, agent, csrf)
+}
+
+func (r *sessionMgrRetry) UpdateSession(id, ip, agent string) (*Session, error) {
+	sm, err := r.get()
+	if err != nil {
+		return nil, err
+	}
+	return sm.UpdateSession(id, ip, agent)
+}
+
+func (r *sessionMgrRetry) GetSession(id string) (*Session, error) {
+	sm, err := r.get()
+	if err != nil {
+		return nil, err
+	}
+	return sm.GetSession(id)
+}
+
+func (r *sessionMgrRetry) DeleteSession(id string) error {
+	sm, err := r.get()
+	if err != nil {
+		return err
+	}
+	return sm.DeleteSession(id)
+}
+
+func (r *sessionMgrRetry) GetAllSessions(userId string) ([]*Session, error) {
+	sm, err := r.get()
+	if err != nil {
+		return nil, err
+	}
+	return sm.GetAllSessions(userId)
+}
+
+func (r *sessionMgrRetry) DeleteAllSessions(userId string) error {
+	sm, err := r.get()
+	if err != nil {
+		return err
+	}
+	return sm.DeleteAllSessions(userId)
+}
+
+func (r *sessionMgrRetry) attemptCounter() (AttemptCounter, error) {
+	sm, err := r.get()
+	if err != nil {
+		return nil, err
+	}
+	ac, ok := sm.(AttemptCounter)
+	if !ok {
+		return nil, util.NewErrorf("Session store %T cannot count attempts", sm)
+	}
+	return ac, nil
+}
+
+func (r *sessionMgrRetry) AddAttempt(key string, window time.Duration) (int, error) {
+	ac, err := r.attemptCounter()
+	if err != nil {
+		return 0, err
+	}
+	return ac.AddAttempt(key, window)
+}
+
+func (r *sessionMgrRetry) Attempts(key string) (int, error) {
+	ac, err := r.attemptCounter()
+	if err != nil {
+		return 0, err
+	}
+	return ac.Attempts(key)
+}
+
+func (r *sessionMgrRetry) ResetAttempts(key string) error {
+	ac, err := r.attemptCounter()
+	if err != nil {
+		return err
+	}
+	return ac.ResetAttempts(key)
+}
+
+func (r *sessionMgrRetry) idempotencyStore() (IdempotencyStore, error) {
+	sm, err := r.get()
+	if err != nil {
+		return nil, err
+	}
+	is, ok := sm.(IdempotencyStore)
+	if !ok {
+		return nil, util.NewErrorf("Session store %T cannot keep idempotency keys", sm)
+	}
+	return is, nil
+}
+
+func (r *sessionMgrRetry) ClaimIdempotencyKey(key string, rec *IdempotencyRecord, ttl time.Duration) (*IdempotencyRecord, error) {
+	is, err := r.idempotencyStore()
+	if err != nil {
+		return nil, err
+	}
+	return is.ClaimIdempotencyKey(key, rec, ttl)
+}
+
+func (r *sessionMgrRetry) SaveIdempotencyKey(key string, rec *IdempotencyRecord, ttl time.Duration) error {
+	is, err := r.idempotencyStore()
+	if err != nil {
+		return err
+	}
+	return is.SaveIdempotencyKey(key, rec, ttl)
+}
+
+func (r *sessionMgrRetry) ReleaseIdempotencyKey(key string) error {
+	is, err := r.idempotencyStore()
+	if err != nil {
+		return err
+	}
+	return is.ReleaseIdempotencyKey(key)
+}
@@ -0,0 +1,42 @@
+package managers
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+func TestRetrySessionManager(t *testing.T) {
+	attempts := make(chan bool, 10)
+	sm := NewSessionMgrRetry(func() (SessionMgr, error) {
+		attempts <- true
+		if len(attempts) < 3 {
+			return nil, errors.New("not yet")
+		}
+		return NewSessionMgrDB(mdb), nil
+	}, time.Millisecond, 4*time.Millisecond)
+	rs := sm.(*sessionMgrRetry)
+	if _, err := sm.GetSession("nope"); rs.Ping() != nil && !util.CheckErr(err, ErrSessionStoreUnavailable) {
+		t.Fatalf("Expected error %s and got %s", ErrSessionStoreUnavailable, err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for rs.Ping() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Session store never became ready")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	testSessionManager(sm, t, "retry")
+}
+
+func TestRetryBackoff(t *testing.T) {
+	b := newRetryBackoff(100*time.Millisecond, time.Second)
+	for i, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		if wait := b.next(); wait < max/2 || wait > max {
+			t.Fatalf("Wait %d was %s and should be between %s and %s", i, wait, max/2, max)
+		}
+	}
+}
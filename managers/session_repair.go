@@ -0,0 +1,100 @@
+package managers
+
+import (
+	"strconv"
+
+	"github.com/keydotcat/keycatd/util"
+	radix "github.com/mediocregopher/radix/v3"
+)
+
+type SessionRepairReport struct {
+	Scanned           int `json:"scanned"`
+	Malformed         int `json:"malformed"`
+	Orphaned          int `json:"orphaned"`
+	StaleIndexEntries int `json:"stale_index_entries"`
+}
+
+// RepairSessionStore removes sessions that cannot be decoded or belong to users that no longer exist, and drops
+// per-user index entries pointing to missing sessions. The db store needs no repair since the db enforces it
+func RepairSessionStore(sm SessionMgr, userExists func(uid string) (bool, error)) (SessionRepairReport, error) {
+	switch s := sm.(type) {
+	case sessionMgrRedis:
+		return s.repair(userExists)
+	case *sessionMgrRetry:
+		inner, err := s.get()
+		if err != nil {
+			return SessionRepairReport{}, err
+		}
+		return RepairSessionStore(inner, userExists)
+	}
+	return SessionRepairReport{}, nil
+}
+
+func (r sessionMgrRedis) repair(userExists func(uid string) (bool, error)) (report SessionRepairReport, err error) {
+	db, err := strconv.Atoi(r.dbId)
+	if err != nil {
+		return report, util.NewErrorFrom(err)
+	}
+	// The scanner needs its own connection to iterate over the right db
+	conn, err := radix.Dial("tcp", r.CurrentMaster(), radix.DialSelectDB(db))
+	if err != nil {
+		return report, util.NewErrorFrom(err)
+	}
+	defer conn.Close()
+	sc := radix.NewScanner(conn, radix.ScanOpts{Command: "SCAN", Pattern: r.skey("*")})
+	var key string
+	b := util.BufPool.Get()
+	defer util.BufPool.Put(b)
+	for sc.Next(&key) {
+		report.Scanned++
+		b.Reset()
+		if err := conn.Do(radix.Cmd(b, "GET", key)); err != nil {
+			return report, util.NewErrorFrom(err)
+		}
+		if b.Len() == 0 {
+			continue
+		}
+		s := &Session{}
+		if err := decodeSession(b, s); err != nil {
+			report.Malformed++
+			if err := conn.Do(radix.Cmd(nil, "DEL", key)); err != nil {
+				return report, util.NewErrorFrom(err)
+			}
+			continue
+		}
+		exists, err := userExists(s.User)
+		if err != nil {
+			return report, err
+		}
+		if !exists {
+			report.Orphaned++
+			if err := conn.Do(radix.Cmd(nil, "DEL", key)); err != nil {
+				return report, util.NewErrorFrom(err)
+			}
+		}
+	}
+	if err := sc.Close(); err != nil {
+		return report, util.NewErrorFrom(err)
+	}
+	sc = radix.NewScanner(conn, radix.ScanOpts{Command: "SCAN", Pattern: r.ukey("*")})
+	for sc.Next(&key) {
+		sids := []string{}
+		if err := conn.Do(radix.Cmd(&sids, "SMEMBERS", key)); err != nil {
+			return report, util.NewErrorFrom(err)
+		}
+		for _, sid := range sids {
+			var found int
+			if err := conn.Do(radix.Cmd(&found, "EXISTS", r.skey(sid))); err != nil {
+				return report, util.NewErrorFrom(err)
+			}
+			if found > 0 {
+				continue
+			}
+			report.StaleIndexEntries++
+			if err := conn.Do(radix.Cmd(nil, "SREM", key, sid)); err != nil {
+				return report, util.NewErrorFrom(err)
+			}
+		}
+	}
+	return report, util.NewErrorFrom(sc.Close())
+}
@@ -0,0 +1,239 @@
+package managers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+const (
+	WEBHOOK_EVENT_USER_INVITED      = "user.invited"
+	WEBHOOK_EVENT_USER_ADDED        = "user.added"
+	WEBHOOK_EVENT_USER_REMOVED      = "user.removed"
+	WEBHOOK_EVENT_VAULT_CREATED     = "vault.created"
+	WEBHOOK_EVENT_VAULT_DELETED     = "vault.deleted"
+	WEBHOOK_EVENT_OWNER_TRANSFERRED = "team.owner_transferred"
+	// Vault events. They have the vault set
+	WEBHOOK_EVENT_SECRET_CREATED = "secret.created"
+	WEBHOOK_EVENT_SECRET_UPDATED = "secret.updated"
+	WEBHOOK_EVENT_SECRET_DELETED = "secret.deleted"
+	// Server events. They have no team
+	WEBHOOK_EVENT_MAIL_QUEUE_BACKLOG   = "mail.queue_backlog"
+	WEBHOOK_EVENT_MAIL_QUEUE_RECOVERED = "mail.queue_recovered"
+)
+
+// Header with the hex encoded HMAC-SHA256 of the body prefixed with sha256=
+const WEBHOOK_SIGNATURE_HEADER = "X-Keycat-Signature"
+
+const (
+	webhookMaxAttempts = 5
+	webhookBackoff     = time.Second
+	webhookTimeout     = 10 * time.Second
+)
+
+// WebhookEvent is the payload posted to the webhooks
+type WebhookEvent struct {
+	Event     string    `json:"event"`
+	Team      string    `json:"team"`
+	Vault     string    `json:"vault,omitempty"`
+	Actor     string    `json:"actor"`
+	Target    string    `json:"target"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Webhook is an endpoint that receives the events signed with its secret. Vaults and Events scope the hook to the
+// events of those vaults (as team/vault) and of those types. Empty scopes receive everything
+type Webhook struct {
+	Url    string
+	Secret string
+	Vaults []string
+	Events []string
+}
+
+// Accepts returns if the event is in the scope of the hook. Events without a vault never match a vault scope
+func (h Webhook) Accepts(ev WebhookEvent) bool {
+	if len(h.Events) > 0 && !inList(h.Events, ev.Event) {
+		return false
+	}
+	if len(h.Vaults) > 0 && (len(ev.Vault) == 0 || !inList(h.Vaults, ev.Team+"/"+ev.Vault)) {
+		return false
+	}
+	return true
+}
+
+// IsWebhookEvent returns if the event can be used to scope a webhook
+func IsWebhookEvent(event string) bool {
+	switch event {
+	case WEBHOOK_EVENT_USER_INVITED, WEBHOOK_EVENT_USER_ADDED, WEBHOOK_EVENT_USER_REMOVED,
+		WEBHOOK_EVENT_VAULT_CREATED, WEBHOOK_EVENT_VAULT_DELETED, WEBHOOK_EVENT_OWNER_TRANSFERRED,
+		WEBHOOK_EVENT_SECRET_CREATED, WEBHOOK_EVENT_SECRET_UPDATED, WEBHOOK_EVENT_SECRET_DELETED,
+		WEBHOOK_EVENT_MAIL_QUEUE_BACKLOG, WEBHOOK_EVENT_MAIL_QUEUE_RECOVERED:
+		return true
+	}
+	return false
+}
+
+func inList(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookMgr delivers events in the background. Send never blocks and Drain waits up to timeout for the pending
+// deliveries once no more events will be sent
+type WebhookMgr interface {
+	Send(ev WebhookEvent)
+	Drain(timeout time.Duration) error
+}
+
+// SignWebhook returns the signature sent in WEBHOOK_SIGNATURE_HEADER for the body
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+type webhookDelivery struct {
+	hook  Webhook
+	event WebhookEvent
+	body  []byte
+}
+
+// webhookMgr works like the mail queue. Deliveries are retried with exponential backoff and dropped when the queue is
+// full so a slow endpoint never slows down the requests that trigger the events. Each hook has its own queue and
+// worker so a dead endpoint only delays its own deliveries
+type webhookMgr struct {
+	hooks       []Webhook
+	client      *http.Client
+	queues      []chan webhookDelivery
+	lock        *sync.RWMutex
+	closed      bool
+	done        chan struct{}
+	maxAttempts int
+	backoff     time.Duration
+}
+
+func NewWebhookMgr(hooks []Webhook, size int) WebhookMgr {
+	wm := &webhookMgr{
+		hooks:       hooks,
+		client:      &http.Client{Timeout: webhookTimeout},
+		queues:      make([]chan webhookDelivery, len(hooks)),
+		lock:        &sync.RWMutex{},
+		done:        make(chan struct{}),
+		maxAttempts: webhookMaxAttempts,
+		backoff:     webhookBackoff,
+	}
+	wg := &sync.WaitGroup{}
+	for i := range hooks {
+		wm.queues[i] = make(chan webhookDelivery, size)
+		wg.Add(1)
+		go func(queue chan webhookDelivery) {
+			defer wg.Done()
+			wm.run(queue)
+		}(wm.queues[i])
+	}
+	go func() {
+		wg.Wait()
+		close(wm.done)
+	}()
+	return wm
+}
+
+func (wm *webhookMgr) Send(ev WebhookEvent) {
+	if len(wm.hooks) == 0 {
+		return
+	}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("Could not encode webhook event %s: %s", ev.Event, err)
+		return
+	}
+	wm.lock.RLock()
+	defer wm.lock.RUnlock()
+	if wm.closed {
+		return
+	}
+	for i, h := range wm.hooks {
+		select {
+		case wm.queues[i] <- webhookDelivery{hook: h, event: ev, body: body}:
+		default:
+			log.Printf("Webhook queue is full. Dropping %s event for %s", ev.Event, h.Url)
+		}
+	}
+}
+
+func (wm *webhookMgr) run(queue chan webhookDelivery) {
+	for d := range queue {
+		if !d.hook.Accepts(d.event) {
+			continue
+		}
+		wm.deliver(d)
+	}
+}
+
+// deliver tries to post the event up to maxAttempts times and returns how many attempts were done
+func (wm *webhookMgr) deliver(d webhookDelivery) int {
+	wait := wm.backoff
+	var err error
+	for attempt := 1; attempt <= wm.maxAttempts; attempt++ {
+		if err = wm.post(d); err == nil {
+			return attempt
+		}
+		if attempt < wm.maxAttempts {
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+	log.Printf("Dropping webhook for %s after %d attempts: %s", d.hook.Url, wm.maxAttempts, err)
+	return wm.maxAttempts
+}
+
+func (wm *webhookMgr) post(d webhookDelivery) error {
+	req, err := http.NewRequest("POST", d.hook.Url, bytes.NewReader(d.body))
+	if err != nil {
+		return util.NewErrorFrom(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WEBHOOK_SIGNATURE_HEADER, SignWebhook(d.hook.Secret, d.body))
+	resp, err := wm.client.Do(req)
+	if err != nil {
+		return util.NewErrorFrom(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return util.NewErrorf("Webhook answered with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (wm *webhookMgr) Drain(timeout time.Duration) error {
+	wm.lock.Lock()
+	if !wm.closed {
+		wm.closed = true
+		for _, queue := range wm.queues {
+			close(queue)
+		}
+	}
+	wm.lock.Unlock()
+	select {
+	case <-wm.done:
+		return nil
+	case <-time.After(timeout):
+		pending := 0
+		for _, queue := range wm.queues {
+			pending += len(queue)
+		}
+		return util.NewErrorf("Webhook queues did not drain in %s. %d deliveries were not done", timeout, pending)
+	}
+}
@@ -0,0 +1,99 @@
+package managers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSignWebhook(t *testing.T) {
+	// echo -n '{"event":"user.invited"}' | openssl dgst -sha256 -hmac secret
+	sig := SignWebhook("secret", []byte(`{"event":"user.invited"}`))
+	if sig != "sha256=4976304ec3becb4bc6211030ee6b8af574745381e2ea9465d29fef2b5654a42c" {
+		t.Fatalf("Unexpected signature %s", sig)
+	}
+	if SignWebhook("other", []byte(`{"event":"user.invited"}`)) == sig {
+		t.Fatalf("Signature does not depend on the secret")
+	}
+}
+
+func TestWebhookRetriesOnServerError(t *testing.T) {
+	lock := &sync.Mutex{}
+	attempts := 0
+	var received WebhookEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(WEBHOOK_SIGNATURE_HEADER) != SignWebhook("secret", body) {
+			t.Errorf("Invalid signature %s", r.Header.Get(WEBHOOK_SIGNATURE_HEADER))
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.Unmarshal(body, &received)
+	}))
+	defer srv.Close()
+	wm := NewWebhookMgr([]Webhook{{Url: srv.URL, Secret: "secret"}}, 10).(*webhookMgr)
+	wm.backoff = time.Millisecond
+	wm.Send(WebhookEvent{Event: WEBHOOK_EVENT_VAULT_CREATED, Team: "team", Actor: "actor", Target: "vault"})
+	if err := wm.Drain(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if attempts != 2 {
+		t.Fatalf("Expected 2 attempts and got %d", attempts)
+	}
+	if received.Event != WEBHOOK_EVENT_VAULT_CREATED || received.Target != "vault" {
+		t.Fatalf("Unexpected event received: %+v", received)
+	}
+}
+
+func TestWebhookScopes(t *testing.T) {
+	secret := WebhookEvent{Event: WEBHOOK_EVENT_SECRET_UPDATED, Team: "team", Vault: "prod"}
+	invite := WebhookEvent{Event: WEBHOOK_EVENT_USER_INVITED, Team: "team"}
+	if !(Webhook{}).Accepts(secret) || !(Webhook{}).Accepts(invite) {
+		t.Fatalf("Unscoped webhooks should get every event")
+	}
+	prod := Webhook{Vaults: []string{"team/prod"}, Events: []string{WEBHOOK_EVENT_SECRET_UPDATED}}
+	if !prod.Accepts(secret) {
+		t.Fatalf("Expected the scoped webhook to get the secret event")
+	}
+	if prod.Accepts(invite) {
+		t.Fatalf("Events without a vault should not match a vault scope")
+	}
+	if prod.Accepts(WebhookEvent{Event: WEBHOOK_EVENT_SECRET_UPDATED, Team: "other", Vault: "prod"}) {
+		t.Fatalf("Vault scopes should match the team too")
+	}
+	if prod.Accepts(WebhookEvent{Event: WEBHOOK_EVENT_SECRET_DELETED, Team: "team", Vault: "prod"}) {
+		t.Fatalf("Unexpected event type accepted")
+	}
+}
+
+func TestWebhookSlowEndpointDoesNotStallOthers(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	received := make(chan struct{}, 1)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+	}))
+	defer fast.Close()
+	wm := NewWebhookMgr([]Webhook{{Url: slow.URL, Secret: "secret"}, {Url: fast.URL, Secret: "secret"}}, 10)
+	wm.Send(WebhookEvent{Event: WEBHOOK_EVENT_VAULT_CREATED, Team: "team", Actor: "actor", Target: "vault"})
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The fast webhook did not get the event while the slow one was stuck")
+	}
+}
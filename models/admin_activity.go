@@ -0,0 +1,98 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+// AdminDemotion describes an admin that was demoted for inactivity and the admins that remain in the team
+type AdminDemotion struct {
+	Team   *Team
+	User   *User
+	Admins []*User
+}
+
+func (t *Team) touchAdminActivity(tx *sql.Tx, uid string) error {
+	_, err := tx.Exec(`UPDATE "team_user" SET "last_admin_action" = $1 WHERE "team" = $2 AND "user" = $3`, time.Now().UTC(), t.Id, uid)
+	if isErrOrPanic(err) {
+		return util.NewErrorFrom(err)
+	}
+	return nil
+}
+
+// DemoteInactiveAdmins demotes every admin that has not done any admin action since the given time. Team owners
+// are never demoted and a team always keeps at least one admin
+func DemoteInactiveAdmins(ctx context.Context, before time.Time) ([]*AdminDemotion, error) {
+	db := GetDB(ctx)
+	rows, err := db.Query(`SELECT `+selectTeamUserFullFields+` FROM "team_user", "team" WHERE "team_user"."team" = "team"."id" AND "team_user"."admin" = true AND "team_user"."user" != "team"."owner" AND "team_user"."last_admin_action" < $1`, before)
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	inactive, err := scanTeamUsers(rows)
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	demotions := []*AdminDemotion{}
+	for _, tu := range inactive {
+		var ad *AdminDemotion
+		err = doTx(ctx, func(tx *sql.Tx) error {
+			ad, err = demoteInactiveAdmin(tx, tu, before)
+			return err
+		})
+		if err != nil {
+			return demotions, err
+		}
+		if ad != nil {
+			demotions = append(demotions, ad)
+		}
+	}
+	return demotions, nil
+}
+
+func demoteInactiveAdmin(tx *sql.Tx, tu *teamUser, before time.Time) (*AdminDemotion, error) {
+	t := &Team{Id: tu.Team}
+	err := t.dbFind(tx)
+	if isNotExistsErr(err) {
+		return nil, nil
+	}
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	var stillInactive bool
+	err = tx.QueryRow(`SELECT "admin" AND "last_admin_action" < $1 FROM "team_user" WHERE "team" = $2 AND "user" = $3 FOR UPDATE`, before, tu.Team, tu.User).Scan(&stillInactive)
+	if isNotExistsErr(err) {
+		return nil, nil
+	}
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	if !stillInactive || t.Owner == tu.User {
+		return nil, nil
+	}
+	admins, err := t.getAdminUsers(tx)
+	if err != nil {
+		return nil, err
+	}
+	if len(admins) < 2 {
+		return nil, nil
+	}
+	ad := &AdminDemotion{Team: t, Admins: make([]*User, 0, len(admins)-1)}
+	for _, u := range admins {
+		if u.Id == tu.User {
+			ad.User = u
+		} else {
+			ad.Admins = append(ad.Admins, u)
+		}
+	}
+	tu.Admin = false
+	if err := tu.update(tx); err != nil {
+		return nil, err
+	}
+	if err := t.audit(tx, "", tu.User, TEAM_AUDIT_DEMOTE); err != nil {
+		return nil, err
+	}
+	return ad, nil
+}
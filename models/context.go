@@ -3,6 +3,7 @@ package models
 import (
 	"context"
 	"database/sql"
+	"sync/atomic"
 
 	"github.com/keydotcat/keycatd/util"
 )
@@ -10,7 +11,9 @@ import (
 type contextType int
 
 const (
-	contextDBKey = contextType(0)
+	contextDBKey           = contextType(0)
+	contextReadReplicasKey = contextType(1)
+	contextForcePrimaryKey = contextType(2)
 )
 
 func GetDB(ctx context.Context) *sql.DB {
@@ -21,8 +24,59 @@ func GetDB(ctx context.Context) *sql.DB {
 	return d
 }
 
+// ReadReplicas hands out the connection pools of the read replicas in turn
+type ReadReplicas struct {
+	dbs  []*sql.DB
+	next uint32
+}
+
+func NewReadReplicas(dbs []*sql.DB) *ReadReplicas {
+	return &ReadReplicas{dbs: dbs}
+}
+
+func (rr *ReadReplicas) pick() *sql.DB {
+	n := atomic.AddUint32(&rr.next, 1)
+	return rr.dbs[int(n-1)%len(rr.dbs)]
+}
+
+func AddReadReplicasToContext(ctx context.Context, rr *ReadReplicas) context.Context {
+	return context.WithValue(ctx, contextReadReplicasKey, rr)
+}
+
+// ForcePrimaryReads makes the reads done with the returned context go to the primary db. Replicas can lag behind
+// the primary so use it when the read has to see something that was just written
+func ForcePrimaryReads(ctx context.Context) context.Context {
+	return context.WithValue(ctx, contextForcePrimaryKey, true)
+}
+
+// getReadDB returns a replica for read only queries, or the primary db if there are no replicas or primary reads
+// are forced
+func getReadDB(ctx context.Context) *sql.DB {
+	if force, _ := ctx.Value(contextForcePrimaryKey).(bool); force {
+		return GetDB(ctx)
+	}
+	rr, ok := ctx.Value(contextReadReplicasKey).(*ReadReplicas)
+	if !ok || len(rr.dbs) == 0 {
+		return GetDB(ctx)
+	}
+	return rr.pick()
+}
+
 func doTx(ctx context.Context, ftor func(*sql.Tx) error) error {
-	tx, err := GetDB(ctx).BeginTx(ctx, nil)
+	return doTxOn(ctx, GetDB(ctx), ftor)
+}
+
+// doReadTx runs ftor in a transaction on a read replica. ftor cannot write anything
+func doReadTx(ctx context.Context, ftor func(*sql.Tx) error) error {
+	return doTxOn(ctx, getReadDB(ctx), ftor)
+}
+
+func doTxOn(ctx context.Context, d *sql.DB, ftor func(*sql.Tx) error) error {
+	tx, err := d.BeginTx(ctx, nil)
+	// A replica that is down should not fail the reads the primary can answer
+	if primary := GetDB(ctx); err != nil && d != primary {
+		tx, err = primary.BeginTx(ctx, nil)
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -36,6 +90,9 @@ func doTx(ctx context.Context, ftor func(*sql.Tx) error) error {
 		return err
 	}
 	if err = tx.Commit(); err != nil {
+		if isRetryableTxErr(err) {
+			return util.NewErrorFrom(err)
+		}
 		return util.NewErrorf("Could not commit transaction: %s", err)
 	}
 	return nil
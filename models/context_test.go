@@ -0,0 +1,55 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+)
+
+func TestReadReplicaRouting(t *testing.T) {
+	primary, replica := &conflictDriver{}, &conflictDriver{}
+	sql.Register("primary", primary)
+	sql.Register("replica", replica)
+	pdb, err := sql.Open("primary", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdb, err := sql.Open("replica", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	noop := func(tx *sql.Tx) error { return nil }
+	ctx := AddDBToContext(context.Background(), pdb)
+	if err := doReadTx(ctx, noop); err != nil {
+		t.Fatal(err)
+	}
+	if primary.commits != 1 {
+		t.Fatalf("Expected reads to go to the primary without replicas")
+	}
+	ctx = AddReadReplicasToContext(ctx, NewReadReplicas([]*sql.DB{rdb}))
+	if err := doReadTx(ctx, noop); err != nil {
+		t.Fatal(err)
+	}
+	if primary.commits != 1 || replica.commits != 1 {
+		t.Fatalf("Expected the read to go to the replica: %d primary and %d replica reads", primary.commits, replica.commits)
+	}
+	if err := doTx(ctx, noop); err != nil {
+		t.Fatal(err)
+	}
+	if primary.commits != 2 || replica.commits != 1 {
+		t.Fatalf("Expected the write to go to the primary: %d primary and %d replica transactions", primary.commits, replica.commits)
+	}
+	if err := doReadTx(ForcePrimaryReads(ctx), noop); err != nil {
+		t.Fatal(err)
+	}
+	if primary.commits != 3 || replica.commits != 1 {
+		t.Fatalf("Expected the forced read to go to the primary: %d primary and %d replica reads", primary.commits, replica.commits)
+	}
+	rdb.Close()
+	if err := doReadTx(ctx, noop); err != nil {
+		t.Fatal(err)
+	}
+	if primary.commits != 4 || replica.commits != 1 {
+		t.Fatalf("Expected the read to fall back to the primary: %d primary and %d replica reads", primary.commits, replica.commits)
+	}
+}
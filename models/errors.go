@@ -3,15 +3,58 @@ package models
 import "errors"
 
 var (
-	ErrInvalidEmail      = errors.New("Invalid email")
-	ErrNotInTeam         = errors.New("User does not belong to team")
-	ErrUnauthorized      = errors.New("You cannot do that")
-	ErrAlreadyInTeam     = errors.New("Already belongs to team")
-	ErrAlreadyInvited    = errors.New("Alredy invited")
-	ErrAlreadyExists     = errors.New("Already exists")
-	ErrInvalidKeys       = errors.New("Invalid keys for vault")
-	ErrDoesntExist       = errors.New("Does not exist")
-	ErrInvalidSignature  = errors.New("Invalid signature")
-	ErrInvalidPublicKey  = errors.New("Invalid public key length")
-	ErrInvalidAttributes = errors.New("Invalid attributes")
+	ErrInvalidEmail             = errors.New("Invalid email")
+	ErrNotInTeam                = errors.New("User does not belong to team")
+	ErrUnauthorized             = errors.New("You cannot do that")
+	ErrAlreadyInTeam            = errors.New("Already belongs to team")
+	ErrAlreadyInvited           = errors.New("Alredy invited")
+	ErrInviteExpired            = errors.New("The invitation has expired. Ask for a new one")
+	ErrAlreadyExists            = errors.New("Already exists")
+	ErrInvalidKeys              = errors.New("Invalid keys for vault")
+	ErrMalformedKeys            = errors.New("Vault keys are empty, have the wrong size or are repeated")
+	ErrDoesntExist              = errors.New("Does not exist")
+	ErrInvalidSignature         = errors.New("Invalid signature")
+	ErrInvalidPublicKey         = errors.New("Invalid public key length")
+	ErrInvalidAttributes        = errors.New("Invalid attributes")
+	ErrSecretTooLarge           = errors.New("Secret is too large")
+	ErrVaultQuotaExceeded       = errors.New("Vault storage quota exceeded")
+	ErrRekeyPending             = errors.New("Vault must be re-keyed after a member removal")
+	ErrMissingAllMembersKeys    = errors.New("Missing keys for vaults shared with all members")
+	ErrAccountSuspended         = errors.New("Account is not available")
+	ErrInviteEmailMismatch      = errors.New("Invitation was sent to an email that is not verified for this account")
+	ErrDanglingReference        = errors.New("Referenced secret does not exist in the vault")
+	ErrReferenceCycle           = errors.New("Secret references cannot form a cycle")
+	ErrSecretReferenced         = errors.New("Secret is referenced by other secrets")
+	ErrInvalidResetToken        = errors.New("Invalid password reset token")
+	ErrExpiredResetToken        = errors.New("Password reset token has expired")
+	ErrResetKeyChanged          = errors.New("A password reset has to keep the key pair of the account")
+	ErrTOTPRequired             = errors.New("Two factor authentication code required")
+	ErrInvalidTOTPCode          = errors.New("Invalid two factor authentication code")
+	ErrTOTPNotEnabled           = errors.New("Two factor authentication is not enabled")
+	ErrNotTeamAdmin             = errors.New("User is not an admin of the team")
+	ErrCannotRemoveOwner        = errors.New("The team owner cannot be removed")
+	ErrVaultNotFound            = errors.New("Vault does not exist in the team")
+	ErrCannotDeleteDefaultVault = errors.New("The default vault of a team cannot be deleted")
+	ErrCannotRenameDefaultVault = errors.New("The default vault of a team cannot be renamed")
+	ErrVaultPurged              = errors.New("The vault was deleted too long ago and cannot be restored")
+	ErrInviteRateLimited        = errors.New("Too many invitations for this team. Try again later")
+	ErrLocalAuthDisabled        = errors.New("Credentials for this account are managed by its identity provider. Please reset your password there")
+	ErrOwnerCannotLeave         = errors.New("The team owner has to transfer the ownership before leaving")
+	ErrInvalidRole              = errors.New("Invalid team role")
+	ErrPromotionRequiresKeys    = errors.New("Promoting a user to admin requires the vault keys")
+	ErrEmailNotConfirmed        = errors.New("Email address has not been confirmed yet")
+	ErrConfirmationRateLimited  = errors.New("A confirmation email was sent recently. Try again later")
+	ErrBatchTooLarge            = errors.New("Too many entries in a single request")
+	ErrOwnsTeams                = errors.New("The account owns teams with other members. Transfer or delete them first")
+	ErrWebAuthnNotEnabled       = errors.New("No security keys are registered")
+	ErrInvalidWebAuthn          = errors.New("Invalid security key response")
+	ErrAuthenticatorCloned      = errors.New("The security key has been cloned. Remove it and register a new one")
+	ErrTooManyCredentials       = errors.New("Too many security keys registered")
+	ErrSecondFactorRequired     = errors.New("A security key response or a two factor authentication code is required")
+	ErrAwaitingApproval         = errors.New("The account is waiting to be approved by an administrator")
+	ErrShareLinkExpired         = errors.New("The share link has expired")
+	ErrShareLinkExhausted       = errors.New("The share link has already been used")
+	ErrCannotRemovePrimaryEmail = errors.New("The primary email cannot be removed. Set another one as primary first")
+	ErrRemovalNotStarted        = errors.New("The removal of the user has to be started before finalizing it")
+	ErrJustificationRequired    = errors.New("A justification is required to read this secret")
 )
@@ -47,6 +47,10 @@ func isNotExistsErr(err error) bool {
 
 func isErrOrPanic(err error) bool {
 	if err != nil {
+		// Returned so the transaction can be retried
+		if isRetryableTxErr(err) {
+			return true
+		}
 		if err != sql.ErrTxDone || err != sql.ErrConnDone {
 			panic("Could not execute sql statement: " + err.Error())
 		}
@@ -66,3 +70,13 @@ func treatUpdateErr(res sql.Result, err error) error {
 	}
 	return nil
 }
+
+// PAGE_LENGTH_ALL is used as the limit by the unpaged listings
+const PAGE_LENGTH_ALL = 1 << 30
+
+func checkPage(offset, limit int) error {
+	if offset < 0 || limit < 1 {
+		return util.NewErrorFrom(ErrInvalidAttributes)
+	}
+	return nil
+}
@@ -35,8 +35,9 @@ func getCtx() context.Context {
 }
 
 type vaultMock struct {
-	v    *Vault
-	priv []byte
+	v     *Vault
+	priv  []byte
+	owner *User
 }
 
 func createVaultMock(user *User, team *Team) vaultMock {
@@ -47,7 +48,7 @@ func createVaultMock(user *User, team *Team) vaultMock {
 	if err != nil {
 		panic(err)
 	}
-	return vaultMock{v, unsealVaultKey(v, vkp.Keys[user.Id])}
+	return vaultMock{v, unsealVaultKey(v, vkp.Keys[user.Id]), user}
 }
 
 func getFirstVault(o *User, t *Team) vaultMock {
@@ -55,7 +56,7 @@ func getFirstVault(o *User, t *Team) vaultMock {
 	if err != nil {
 		panic(err)
 	}
-	return vaultMock{&vs[0].Vault, unsealVaultKey(&vs[0].Vault, vs[0].Key)}
+	return vaultMock{&vs[0].Vault, unsealVaultKey(&vs[0].Vault, vs[0].Key), o}
 }
 
 func createTeamMock(user *User) *Team {
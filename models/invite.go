@@ -8,10 +8,83 @@ import (
 	"github.com/keydotcat/keycatd/util"
 )
 
+// Invitations can be accepted for this long. 0 keeps them valid forever
+var INVITE_TTL = 7 * 24 * time.Hour
+
 type Invite struct {
 	Team      string    `scaneo:"pk" json:"-"`
 	Email     string    `scaneo:"pk" json:"email"`
 	CreatedAt time.Time `json:"created_at"`
+	Token     string    `json:"-"`
+	// Admin that sent the invitation. Empty for invitations sent before it was recorded
+	InvitedBy string `json:"invited_by"`
+}
+
+// PendingInvite is an invitation that can still be accepted. ExpiresAt is nil if invitations never expire
+type PendingInvite struct {
+	*Invite
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+func FindInviteByToken(ctx context.Context, token string) (i *Invite, err error) {
+	return i, doTx(ctx, func(tx *sql.Tx) error {
+		i, err = findInviteByToken(tx, token)
+		return err
+	})
+}
+
+func findInviteByToken(tx *sql.Tx, token string) (*Invite, error) {
+	if len(token) == 0 {
+		return nil, util.NewErrorFrom(ErrDoesntExist)
+	}
+	i := &Invite{}
+	err := i.dbScanRow(tx.QueryRow(`SELECT `+selectInviteFields+` FROM "invite" WHERE "token" = $1`, token))
+	if isNotExistsErr(err) {
+		return nil, util.NewErrorFrom(ErrDoesntExist)
+	}
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	if i.expired() {
+		return nil, util.NewErrorFrom(ErrInviteExpired)
+	}
+	return i, nil
+}
+
+// inviteCutoff is the creation time before which invitations have expired
+func inviteCutoff() time.Time {
+	if INVITE_TTL <= 0 {
+		return time.Time{}
+	}
+	return time.Now().UTC().Add(-INVITE_TTL)
+}
+
+func (i *Invite) expired() bool {
+	return i.CreatedAt.Before(inviteCutoff())
+}
+
+func (i *Invite) expiresAt() *time.Time {
+	if INVITE_TTL <= 0 {
+		return nil
+	}
+	exp := i.CreatedAt.Add(INVITE_TTL)
+	return &exp
+}
+
+// DeleteExpiredInvites removes the invitations that can no longer be accepted and returns how many were deleted
+func DeleteExpiredInvites(ctx context.Context) (deleted int64, err error) {
+	if INVITE_TTL <= 0 {
+		return 0, nil
+	}
+	err = doTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.Exec(`DELETE FROM "invite" WHERE "created_at" < $1`, inviteCutoff())
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		deleted, err = res.RowsAffected()
+		return util.NewErrorFrom(err)
+	})
+	return deleted, err
 }
 
 func FindInvitesForEmail(ctx context.Context, email string) (invs []*Invite, err error) {
@@ -22,7 +95,7 @@ func FindInvitesForEmail(ctx context.Context, email string) (invs []*Invite, err
 }
 
 func findInvitesForEmail(tx *sql.Tx, email string) ([]*Invite, error) {
-	rows, err := tx.Query(`SELECT `+selectInviteFields+` FROM "invite" WHERE "email" = $1`, email)
+	rows, err := tx.Query(`SELECT `+selectInviteFields+` FROM "invite" WHERE "email" = $1 AND "created_at" >= $2`, email, inviteCutoff())
 	if isErrOrPanic(err) {
 		return nil, util.NewErrorFrom(err)
 	}
@@ -48,6 +121,7 @@ func (u *Invite) insert(tx *sql.Tx) error {
 		return err
 	}
 	u.CreatedAt = time.Now().UTC()
+	u.Token = util.GenerateRandomToken(32)
 	_, err := u.dbInsert(tx)
 	if IsDuplicateErr(err) {
 		return util.NewErrorFrom(ErrAlreadyInvited)
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+// Max number of users that can be invited or added to a team in the last hour. 0 disables the limit
+var MAX_INVITES_PER_TEAM_PER_HOUR = 0
+
+// How long the invitations are kept to enforce MAX_INVITES_PER_TEAM_PER_HOUR
+const inviteLogWindow = time.Hour
+
+// recordInvite fails if the team has reached the invitation limit and logs a new invitation otherwise. The team row is
+// locked while counting so concurrent invitations cannot go past the limit
+func (t *Team) recordInvite(tx *sql.Tx) error {
+	if MAX_INVITES_PER_TEAM_PER_HOUR < 1 {
+		return nil
+	}
+	var tid string
+	err := tx.QueryRow(`SELECT "id" FROM "team" WHERE "id" = $1 FOR UPDATE`, t.Id).Scan(&tid)
+	if isNotExistsErr(err) {
+		return util.NewErrorFrom(ErrDoesntExist)
+	}
+	if isErrOrPanic(err) {
+		return util.NewErrorFrom(err)
+	}
+	now := time.Now().UTC()
+	var count int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM "team_invite_log" WHERE "team" = $1 AND "created_at" > $2`, t.Id, now.Add(-inviteLogWindow)).Scan(&count)
+	if isErrOrPanic(err) {
+		return util.NewErrorFrom(err)
+	}
+	if count >= MAX_INVITES_PER_TEAM_PER_HOUR {
+		return util.NewErrorFrom(ErrInviteRateLimited)
+	}
+	_, err = tx.Exec(`INSERT INTO "team_invite_log" ("team", "created_at") VALUES ($1, $2)`, t.Id, now)
+	if isErrOrPanic(err) {
+		return util.NewErrorFrom(err)
+	}
+	return nil
+}
+
+// DeleteOldInviteLogs removes the invitations that no longer count for the rate limit and returns how many were deleted
+func DeleteOldInviteLogs(ctx context.Context) (deleted int64, err error) {
+	err = doTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.Exec(`DELETE FROM "team_invite_log" WHERE "created_at" < $1`, time.Now().UTC().Add(-inviteLogWindow))
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		deleted, err = res.RowsAffected()
+		return util.NewErrorFrom(err)
+	})
+	return deleted, err
+}
@@ -0,0 +1,100 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"time"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+// How long a password reset token can be used after being generated
+var RESET_TOKEN_TTL = time.Hour
+
+// Only the hash of single use tokens (password resets, recovery codes) is stored so a db leak does not allow using them
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// consumeResetToken deletes the reset token of the user and fails if it did not exist. Deleting and checking in the
+// same statement makes sure only one of several concurrent resets with the same token succeeds
+func (u *User) consumeResetToken(tx *sql.Tx, token string) error {
+	if len(token) == 0 {
+		return util.NewErrorFrom(ErrInvalidResetToken)
+	}
+	var createdAt time.Time
+	err := tx.QueryRow(`DELETE FROM "token" WHERE "id" = $1 AND "user" = $2 AND "type" = $3 RETURNING "created_at"`, hashToken(token), u.Id, TOKEN_PASSWORD_RESET).Scan(&createdAt)
+	if isNotExistsErr(err) {
+		return util.NewErrorFrom(ErrInvalidResetToken)
+	}
+	if isErrOrPanic(err) {
+		return util.NewErrorFrom(err)
+	}
+	if time.Since(createdAt) > RESET_TOKEN_TTL {
+		return util.NewErrorFrom(ErrExpiredResetToken)
+	}
+	return nil
+}
+
+// GenerateResetToken replaces any previous reset token of the user with a new one. The token is only returned here
+func (u *User) GenerateResetToken(ctx context.Context) (token string, err error) {
+	if err := u.checkLocalAuth(); err != nil {
+		return "", err
+	}
+	token = util.GenerateRandomToken(32)
+	return token, doTx(ctx, func(tx *sql.Tx) error {
+		if err := u.deleteResetTokens(tx); err != nil {
+			return err
+		}
+		t := &Token{Id: hashToken(token), Type: TOKEN_PASSWORD_RESET, User: u.Id}
+		return t.insert(tx)
+	})
+}
+
+// ResetPasswordWithToken sets a new password and key pack for the user. The token cannot be used again. The key pack
+// has to seal the same key pair again since the vault keys of the user are wrapped for its public key
+func (u *User) ResetPasswordWithToken(ctx context.Context, token, password string, keyPack []byte) error {
+	if err := u.checkLocalAuth(); err != nil {
+		return err
+	}
+	pub, priv, err := expandUserKeyPack(keyPack)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(pub, u.PublicKey) {
+		return util.NewErrorFrom(ErrResetKeyChanged)
+	}
+	return doTx(ctx, func(tx *sql.Tx) error {
+		if err := u.consumeResetToken(tx, token); err != nil {
+			return err
+		}
+		if err := u.deleteResetTokens(tx); err != nil {
+			return err
+		}
+		if err := u.setPassword(password); err != nil {
+			return err
+		}
+		u.PublicKey = pub
+		u.Key = priv
+		return u.update(tx)
+	})
+}
+
+// ClearResetTokens invalidates any pending password reset for the user
+func (u *User) ClearResetTokens(ctx context.Context) error {
+	return doTx(ctx, func(tx *sql.Tx) error {
+		return u.deleteResetTokens(tx)
+	})
+}
+
+func (u *User) deleteResetTokens(tx *sql.Tx) error {
+	_, err := tx.Exec(`DELETE FROM "token" WHERE "user" = $1 AND "type" = $2`, u.Id, TOKEN_PASSWORD_RESET)
+	if isErrOrPanic(err) {
+		return util.NewErrorFrom(err)
+	}
+	return nil
+}
@@ -16,15 +16,25 @@ type Secret struct {
 	Data         []byte    `json:"data"`
 	VaultVersion uint32    `json:"vault_version"`
 	CreatedAt    time.Time `json:"created_at"`
+	// Remind the vault members to rotate the secret this many days after it was last changed. 0 disables it
+	RotationDays int       `json:"rotation_days"`
+	RotatedAt    time.Time `json:"rotated_at"`
+	// Last reminder sent. Equal to RotatedAt until the first reminder for the current data is sent
+	RotationRemindedAt time.Time `json:"-"`
 }
 
 func (v *Secret) insert(tx *sql.Tx) error {
 	v.Id = util.GenerateRandomToken(10)
 	v.Version = 1
 	v.CreatedAt = time.Now().UTC()
+	v.RotatedAt = v.CreatedAt
+	v.RotationRemindedAt = v.CreatedAt
 	if err := v.validate(false); err != nil {
 		return err
 	}
+	if err := checkSecretSize(v.Data); err != nil {
+		return err
+	}
 	_, err := v.dbInsert(tx)
 	switch {
 	case IsDuplicateErr(err):
@@ -32,31 +42,108 @@ func (v *Secret) insert(tx *sql.Tx) error {
 	case isErrOrPanic(err):
 		return util.NewErrorFrom(err)
 	}
-	return nil
+	return chargeVault(tx, v.Team, v.Vault, len(v.Data))
 }
 
 func (v *Secret) update(tx *sql.Tx) error {
+	return v.updateCharging(tx, chargeVault)
+}
+
+// rewrap stores the secret re-encrypted with a new vault key. Its size is accounted for without checking the quota
+func (v *Secret) rewrap(tx *sql.Tx) error {
+	return v.updateCharging(tx, addVaultUsage)
+}
+
+func (v *Secret) updateCharging(tx *sql.Tx, charge func(tx *sql.Tx, team, vault string, delta int) error) error {
 	v.CreatedAt = time.Now().UTC()
 	if err := v.validate(true); err != nil {
 		return err
 	}
-	_, err := v.dbInsert(tx)
+	if err := checkSecretSize(v.Data); err != nil {
+		return err
+	}
+	prevSize, err := lastSecretSize(tx, v.Team, v.Vault, v.Id)
+	if err != nil {
+		return err
+	}
+	if err := charge(tx, v.Team, v.Vault, len(v.Data)-prevSize); err != nil {
+		return err
+	}
+	_, err = v.dbInsert(tx)
 	switch {
 	case IsDuplicateErr(err):
 		return util.NewErrorFrom(ErrAlreadyExists)
 	case isErrOrPanic(err):
 		return util.NewErrorFrom(err)
 	}
-	return nil
+	return v.pruneHistory(tx)
 }
 
 func MoveSecretToVault(ctx context.Context, s *Secret, source, target *Vault) error {
 	return doTx(ctx, func(tx *sql.Tx) error {
-		if err := source.deleteSecret(tx, s.Id); err != nil {
+		sid := s.Id
+		required, err := source.requiresJustification(tx, sid)
+		if err != nil {
+			return err
+		}
+		if err := source.deleteSecret(tx, sid); err != nil {
 			return err
 		}
 		s.Id = ""
-		return target.addSecret(tx, s)
+		if err := target.addSecret(tx, s); err != nil {
+			return err
+		}
+		if required {
+			return target.requireJustification(tx, s.Id)
+		}
+		return nil
+	})
+}
+
+// MoveSecret moves a secret between two vaults of the team. Each vault has its own key so the caller has to send
+// the secret data encrypted with the key of the destination vault. The actor needs write access to the team and
+// has to be a member of both vaults. The secret gets a new id in the destination vault
+func (t *Team) MoveSecret(ctx context.Context, actor *User, sid, fromVid, toVid string, reEncrypted []byte) (s *Secret, err error) {
+	if fromVid == toVid {
+		return nil, util.NewErrorFrom(ErrInvalidAttributes)
+	}
+	return s, doTx(ctx, func(tx *sql.Tx) error {
+		if err := t.checkWriteAccess(tx, actor); err != nil {
+			if util.CheckErr(err, ErrNotInTeam) {
+				return util.NewErrorFrom(ErrUnauthorized)
+			}
+			return err
+		}
+		source, err := t.getVaultWithMember(tx, fromVid, actor)
+		if err != nil {
+			return err
+		}
+		target, err := t.getVaultWithMember(tx, toVid, actor)
+		if err != nil {
+			return err
+		}
+		prev, err := source.getSecret(tx, sid)
+		if err != nil {
+			return err
+		}
+		if _, err := verifyAndUnpack(target.PublicKey, reEncrypted); err != nil {
+			return err
+		}
+		required, err := source.requiresJustification(tx, sid)
+		if err != nil {
+			return err
+		}
+		if err := source.deleteSecret(tx, sid); err != nil {
+			return err
+		}
+		s = &Secret{Data: reEncrypted, RotationDays: prev.RotationDays}
+		if err := target.addSecret(tx, s); err != nil {
+			return err
+		}
+		if required {
+			return target.requireJustification(tx, s.Id)
+		}
+		return nil
 	})
 }
 
@@ -80,5 +167,8 @@ func (v Secret) validate(fistInsert bool) error {
 	if v.Version == 0 {
 		errs.SetFieldError("version", "invalid")
 	}
+	if v.RotationDays < 0 {
+		errs.SetFieldError("rotation_days", "invalid")
+	}
 	return errs.SetErrorOrCamo(ErrInvalidAttributes)
 }
@@ -0,0 +1,93 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+// Max entries returned by GetSecretAccessLog
+const SECRET_ACCESS_MAX_PAGE_LENGTH = 500
+
+// Rows written by each insert when recording accesses
+const secretAccessInsertBatch = 200
+
+// Accesses older than this are deleted by DeleteOldSecretAccesses
+var SECRET_ACCESS_RETENTION = 90 * 24 * time.Hour
+
+// SecretAccess is a read of a secret by a user. They are only recorded for teams whose policy audits reads. Reads
+// through a share link are recorded with the user set to the ShareLink Reader
+type SecretAccess struct {
+	Team       string    `json:"-"`
+	Vault      string    `json:"vault"`
+	Secret     string    `json:"secret"`
+	User       string    `json:"user"`
+	AccessedAt time.Time `json:"accessed_at"`
+}
+
+// RecordSecretAccesses stores a batch of secret reads
+func RecordSecretAccesses(ctx context.Context, accesses []SecretAccess) error {
+	return doTx(ctx, func(tx *sql.Tx) error {
+		for start := 0; start < len(accesses); start += secretAccessInsertBatch {
+			end := start + secretAccessInsertBatch
+			if end > len(accesses) {
+				end = len(accesses)
+			}
+			values := make([]string, 0, end-start)
+			args := make([]interface{}, 0, 5*(end-start))
+			for _, a := range accesses[start:end] {
+				n := len(args)
+				values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5))
+				args = append(args, a.Team, a.Vault, a.Secret, a.User, a.AccessedAt)
+			}
+			_, err := tx.Exec(`INSERT INTO "secret_access" ("team", "vault", "secret", "user", "accessed_at") VALUES `+strings.Join(values, ", "), args...)
+			if isErrOrPanic(err) {
+				return util.NewErrorFrom(err)
+			}
+		}
+		return nil
+	})
+}
+
+// GetSecretAccessLog returns the last reads of a secret, newest first. Only admins can see it
+func (t *Team) GetSecretAccessLog(ctx context.Context, actor *User, sid string) (log []*SecretAccess, err error) {
+	return log, doTx(ctx, func(tx *sql.Tx) error {
+		if err := t.checkAdmin(tx, actor); err != nil {
+			return err
+		}
+		rows, err := tx.Query(`SELECT "team", "vault", "secret", "user", "accessed_at" FROM "secret_access" WHERE "team" = $1 AND "secret" = $2 ORDER BY "accessed_at" DESC LIMIT $3`, t.Id, sid, SECRET_ACCESS_MAX_PAGE_LENGTH)
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		defer rows.Close()
+		log = []*SecretAccess{}
+		for rows.Next() {
+			a := &SecretAccess{}
+			if err := rows.Scan(&a.Team, &a.Vault, &a.Secret, &a.User, &a.AccessedAt); isErrOrPanic(err) {
+				return util.NewErrorFrom(err)
+			}
+			log = append(log, a)
+		}
+		if err := rows.Err(); isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		return nil
+	})
+}
+
+// DeleteOldSecretAccesses removes the accesses older than SECRET_ACCESS_RETENTION and returns how many were deleted
+func DeleteOldSecretAccesses(ctx context.Context) (deleted int64, err error) {
+	err = doTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.Exec(`DELETE FROM "secret_access" WHERE "accessed_at" < $1`, time.Now().UTC().Add(-SECRET_ACCESS_RETENTION))
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		deleted, err = res.RowsAffected()
+		return util.NewErrorFrom(err)
+	})
+	return deleted, err
+}
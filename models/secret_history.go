@@ -0,0 +1,111 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+// Max versions kept for each secret. Older ones are pruned when a new version is stored. 0 keeps everything
+var SECRET_HISTORY_LIMIT = 20
+
+// GetSecretHistory returns every stored version of the secret, newest first
+func (v Vault) GetSecretHistory(ctx context.Context, sid string) (secrets []*Secret, err error) {
+	return secrets, doTx(ctx, func(tx *sql.Tx) error {
+		secrets, err = v.getSecretHistory(tx, sid)
+		return err
+	})
+}
+
+func (v Vault) getSecretHistory(tx *sql.Tx, sid string) ([]*Secret, error) {
+	rows, err := tx.Query(`SELECT `+selectSecretFullFields+` FROM "secret" WHERE "secret"."team" = $1 AND "secret"."vault" = $2 AND "secret"."id" = $3 ORDER BY "secret"."version" DESC`, v.Team, v.Id, sid)
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	secrets, err := scanSecrets(rows)
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	if len(secrets) == 0 {
+		return nil, util.NewErrorFrom(ErrDoesntExist)
+	}
+	return secrets, nil
+}
+
+// RestoreSecretVersion stores the data of an old version as the new current version of the secret. Versions
+// stored before the vault was re-keyed cannot be restored since they are not signed with the current vault key
+func (v *Vault) RestoreSecretVersion(ctx context.Context, sid string, version uint32) (s *Secret, err error) {
+	return s, doTx(ctx, func(tx *sql.Tx) error {
+		history, err := v.getSecretHistory(tx, sid)
+		if err != nil {
+			return err
+		}
+		var old *Secret
+		for _, hs := range history {
+			if hs.Version == version {
+				old = hs
+				break
+			}
+		}
+		if old == nil {
+			return util.NewErrorFrom(ErrDoesntExist)
+		}
+		if _, err := verifyAndUnpack(v.PublicKey, old.Data); err != nil {
+			return err
+		}
+		if err := v.checkRekeyPending(tx); err != nil {
+			return err
+		}
+		if err := v.update(tx); err != nil {
+			return err
+		}
+		s = &Secret{Team: v.Team, Vault: v.Id, Id: sid, Version: history[0].Version + 1, Data: old.Data, VaultVersion: v.Version}
+		s.rotatedFrom(history[0])
+		return s.update(tx)
+	})
+}
+
+// pruneHistory drops the versions of the secret beyond SECRET_HISTORY_LIMIT. The current version is always kept
+func (s *Secret) pruneHistory(tx *sql.Tx) error {
+	if SECRET_HISTORY_LIMIT < 1 {
+		return nil
+	}
+	_, err := tx.Exec(`DELETE FROM "secret" WHERE "team" = $1 AND "vault" = $2 AND "id" = $3 AND "version" <= $4 AND "version" < $5`,
+		s.Team, s.Vault, s.Id, int64(s.Version)-int64(SECRET_HISTORY_LIMIT), s.Version)
+	if isErrOrPanic(err) {
+		return util.NewErrorFrom(err)
+	}
+	return nil
+}
+
+// PruneSecretHistory drops the versions beyond SECRET_HISTORY_LIMIT of every secret. It deletes at most batchSize
+// versions per transaction so it does not lock the secret table for long. Returns the number of versions deleted
+func PruneSecretHistory(ctx context.Context, batchSize int) (int64, error) {
+	if SECRET_HISTORY_LIMIT < 1 {
+		return 0, nil
+	}
+	var total int64
+	for {
+		var deleted int64
+		err := doTx(ctx, func(tx *sql.Tx) error {
+			res, err := tx.Exec(`DELETE FROM "secret" WHERE ("team", "vault", "id", "version") IN (
+				SELECT "s"."team", "s"."vault", "s"."id", "s"."version" FROM "secret" AS "s" JOIN (
+					SELECT "team", "vault", "id", MAX("version") AS "current" FROM "secret" GROUP BY "team", "vault", "id"
+				) AS "c" ON "s"."team" = "c"."team" AND "s"."vault" = "c"."vault" AND "s"."id" = "c"."id"
+				WHERE "s"."version" <= "c"."current" - $1 LIMIT $2)`, SECRET_HISTORY_LIMIT, batchSize)
+			if isErrOrPanic(err) {
+				return util.NewErrorFrom(err)
+			}
+			deleted, err = res.RowsAffected()
+			return util.NewErrorFrom(err)
+		})
+		if err != nil {
+			return total, err
+		}
+		total += deleted
+		if deleted < int64(batchSize) {
+			return total, nil
+		}
+	}
+}
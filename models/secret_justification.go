@@ -0,0 +1,165 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/keydotcat/keycatd/util"
+	"github.com/lib/pq"
+)
+
+// Max length of the reason given to read a secret that requires a justification
+const SECRET_JUSTIFICATION_MAX_LENGTH = 1024
+
+// SetSecretJustification flags the secret so reading it requires a justification that is written to the team audit
+// log. Only team admins can change the flag. The flag belongs to the secret and not to a version so it survives
+// updates, restores and key rotations
+func (v *Vault) SetSecretJustification(ctx context.Context, actor *User, sid string, required bool) error {
+	return doTx(ctx, func(tx *sql.Tx) error {
+		t := &Team{Id: v.Team}
+		if err := t.checkAdminAction(tx, actor); err != nil {
+			return err
+		}
+		if _, err := v.getSecret(tx, sid); err != nil {
+			return err
+		}
+		var res sql.Result
+		var err error
+		action := TEAM_AUDIT_SECRET_JUSTIFICATION_SET
+		if required {
+			res, err = tx.Exec(`INSERT INTO "secret_justification" ("team", "vault", "secret", "created_at") VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING`, v.Team, v.Id, sid, time.Now().UTC())
+		} else {
+			action = TEAM_AUDIT_SECRET_JUSTIFICATION_UNSET
+			res, err = tx.Exec(`DELETE FROM "secret_justification" WHERE "team" = $1 AND "vault" = $2 AND "secret" = $3`, v.Team, v.Id, sid)
+		}
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		n, err := res.RowsAffected()
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		if n == 0 {
+			// Already in the requested state
+			return nil
+		}
+		return t.audit(tx, actor.Id, sid, action)
+	})
+}
+
+func (v *Vault) requiresJustification(tx *sql.Tx, sid string) (bool, error) {
+	var n int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM "secret_justification" WHERE "team" = $1 AND "vault" = $2 AND "secret" = $3`, v.Team, v.Id, sid).Scan(&n)
+	if isErrOrPanic(err) {
+		return false, util.NewErrorFrom(err)
+	}
+	return n > 0, nil
+}
+
+// requireJustification flags a secret that has been moved to this vault and got a new id
+func (v *Vault) requireJustification(tx *sql.Tx, sid string) error {
+	_, err := tx.Exec(`INSERT INTO "secret_justification" ("team", "vault", "secret", "created_at") VALUES ($1, $2, $3, $4)`, v.Team, v.Id, sid, time.Now().UTC())
+	if isErrOrPanic(err) {
+		return util.NewErrorFrom(err)
+	}
+	return nil
+}
+
+func (v *Vault) deleteJustification(tx *sql.Tx, sid string) error {
+	_, err := tx.Exec(`DELETE FROM "secret_justification" WHERE "team" = $1 AND "vault" = $2 AND "secret" = $3`, v.Team, v.Id, sid)
+	if isErrOrPanic(err) {
+		return util.NewErrorFrom(err)
+	}
+	return nil
+}
+
+// GetSecretIdsRequiringJustification returns the ids of the secrets of the vault that require a justification
+func (v Vault) GetSecretIdsRequiringJustification(ctx context.Context) (ids map[string]bool, err error) {
+	return ids, doTx(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT "secret" FROM "secret_justification" WHERE "team" = $1 AND "vault" = $2`, v.Team, v.Id)
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		defer rows.Close()
+		ids = map[string]bool{}
+		for rows.Next() {
+			var sid string
+			if err := rows.Scan(&sid); isErrOrPanic(err) {
+				return util.NewErrorFrom(err)
+			}
+			ids[sid] = true
+		}
+		if err := rows.Err(); isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		return nil
+	})
+}
+
+// SecretsRequiringJustification returns the secrets of the list that cannot be read without a justification. The
+// secrets need their team, vault and id set. It reads from the primary so a secret that was just flagged is not
+// handed out by a lagging replica
+func SecretsRequiringJustification(ctx context.Context, secrets []*Secret) (flagged []*Secret, err error) {
+	if len(secrets) == 0 {
+		return nil, nil
+	}
+	teams := map[string]bool{}
+	tids := []string{}
+	for _, s := range secrets {
+		if !teams[s.Team] {
+			teams[s.Team] = true
+			tids = append(tids, s.Team)
+		}
+	}
+	return flagged, doTx(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT "team", "vault", "secret" FROM "secret_justification" WHERE "team" = ANY($1)`, pq.Array(tids))
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		defer rows.Close()
+		required := map[[3]string]bool{}
+		for rows.Next() {
+			var k [3]string
+			if err := rows.Scan(&k[0], &k[1], &k[2]); isErrOrPanic(err) {
+				return util.NewErrorFrom(err)
+			}
+			required[k] = true
+		}
+		if err := rows.Err(); isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		for _, s := range secrets {
+			if required[[3]string{s.Team, s.Vault, s.Id}] {
+				flagged = append(flagged, s)
+			}
+		}
+		return nil
+	})
+}
+
+// ValidateJustification checks the reason given to read secrets can be stored in the audit log
+func ValidateJustification(justification string) error {
+	if len(justification) > SECRET_JUSTIFICATION_MAX_LENGTH {
+		errs := util.NewErrorFields().(*util.Error)
+		errs.SetFieldError("justification", "too long")
+		return errs.SetErrorOrCamo(ErrInvalidAttributes)
+	}
+	return nil
+}
+
+// RecordJustifiedReads writes the reason the actor gave to read the secrets to the audit log of their teams
+func RecordJustifiedReads(ctx context.Context, actor *User, secrets []*Secret, justification string) error {
+	if err := ValidateJustification(justification); err != nil {
+		return err
+	}
+	return doTx(ctx, func(tx *sql.Tx) error {
+		for _, s := range secrets {
+			t := &Team{Id: s.Team}
+			if err := t.audit(tx, actor.Id, s.Id+": "+justification, TEAM_AUDIT_SECRET_JUSTIFIED_READ); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,123 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+// secretReference links a secret to another secret in the same vault. Only ids are stored, never secret data
+type secretReference struct {
+	Team   string `scaneo:"pk" json:"-"`
+	Vault  string `scaneo:"pk" json:"vault"`
+	Secret string `scaneo:"pk" json:"secret"`
+	Target string `scaneo:"pk" json:"target"`
+}
+
+func (v Vault) findSecretReferences(tx *sql.Tx, column, sid string) ([]string, error) {
+	rows, err := tx.Query(`SELECT `+selectSecretReferenceFields+` FROM "secret_reference" WHERE "team" = $1 AND "vault" = $2 AND "`+column+`" = $3`, v.Team, v.Id, sid)
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	refs, err := scanSecretReferences(rows)
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	ids := make([]string, len(refs))
+	for i, r := range refs {
+		if column == "target" {
+			ids[i] = r.Secret
+		} else {
+			ids[i] = r.Target
+		}
+	}
+	return ids, nil
+}
+
+// GetSecretReferences returns the ids of the secrets that sid points to
+func (v Vault) GetSecretReferences(ctx context.Context, sid string) (ids []string, err error) {
+	return ids, doTx(ctx, func(tx *sql.Tx) error {
+		ids, err = v.findSecretReferences(tx, "secret", sid)
+		return err
+	})
+}
+
+// GetReferencingSecrets returns the ids of the secrets that point to sid
+func (v Vault) GetReferencingSecrets(ctx context.Context, sid string) (ids []string, err error) {
+	return ids, doTx(ctx, func(tx *sql.Tx) error {
+		ids, err = v.findSecretReferences(tx, "target", sid)
+		return err
+	})
+}
+
+// SetSecretReferences replaces the secrets that sid points to. All targets must exist in the vault and the
+// references cannot form a cycle
+func (v Vault) SetSecretReferences(ctx context.Context, sid string, targets []string) error {
+	return doTx(ctx, func(tx *sql.Tx) error {
+		if _, err := v.getSecret(tx, sid); err != nil {
+			return err
+		}
+		for _, target := range targets {
+			if _, err := v.getSecret(tx, target); err != nil {
+				if util.CheckErr(err, ErrDoesntExist) {
+					return util.NewErrorFrom(ErrDanglingReference)
+				}
+				return err
+			}
+			if err := v.checkReferenceCycle(tx, sid, target); err != nil {
+				return err
+			}
+		}
+		if err := v.deleteSecretReferences(tx, sid, false); err != nil {
+			return err
+		}
+		for _, target := range targets {
+			sr := &secretReference{v.Team, v.Id, sid, target}
+			_, err := sr.dbInsert(tx)
+			if IsDuplicateErr(err) {
+				continue
+			}
+			if isErrOrPanic(err) {
+				return util.NewErrorFrom(err)
+			}
+		}
+		return nil
+	})
+}
+
+// checkReferenceCycle walks the references starting at target and fails if it gets back to sid
+func (v Vault) checkReferenceCycle(tx *sql.Tx, sid, target string) error {
+	seen := map[string]bool{}
+	pending := []string{target}
+	for len(pending) > 0 {
+		current := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if current == sid {
+			return util.NewErrorFrom(ErrReferenceCycle)
+		}
+		if seen[current] {
+			continue
+		}
+		seen[current] = true
+		next, err := v.findSecretReferences(tx, "secret", current)
+		if err != nil {
+			return err
+		}
+		pending = append(pending, next...)
+	}
+	return nil
+}
+
+// deleteSecretReferences removes the references from sid and, if incoming is set, the ones pointing to it
+func (v Vault) deleteSecretReferences(tx *sql.Tx, sid string, incoming bool) error {
+	query := `DELETE FROM "secret_reference" WHERE "team" = $1 AND "vault" = $2 AND "secret" = $3`
+	if incoming {
+		query = `DELETE FROM "secret_reference" WHERE "team" = $1 AND "vault" = $2 AND ("secret" = $3 OR "target" = $3)`
+	}
+	_, err := tx.Exec(query, v.Team, v.Id, sid)
+	if isErrOrPanic(err) {
+		return util.NewErrorFrom(err)
+	}
+	return nil
+}
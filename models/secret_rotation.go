@@ -0,0 +1,108 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+// SecretRotationReminder is a secret due for rotation and the members of its vault that have to be reminded
+type SecretRotationReminder struct {
+	Team   *Team
+	Secret *Secret
+	Users  []*User
+}
+
+// rotatedFrom keeps the rotation interval of the previous version and restarts the rotation clock
+func (s *Secret) rotatedFrom(prev *Secret) {
+	s.RotationDays = prev.RotationDays
+	s.RotatedAt = time.Now().UTC()
+	s.RotationRemindedAt = s.RotatedAt
+}
+
+// SetSecretRotation changes the rotation interval of the current version of the secret. It does not restart
+// the rotation clock
+func (v *Vault) SetSecretRotation(ctx context.Context, sid string, days int) (s *Secret, err error) {
+	if days < 0 {
+		return nil, util.NewErrorFrom(ErrInvalidAttributes)
+	}
+	return s, doTx(ctx, func(tx *sql.Tx) error {
+		s, err = v.getSecret(tx, sid)
+		if err != nil {
+			return err
+		}
+		res, err := tx.Exec(`UPDATE "secret" SET "rotation_days" = $1 WHERE "team" = $2 AND "vault" = $3 AND "id" = $4 AND "version" = $5`, days, s.Team, s.Vault, s.Id, s.Version)
+		if err := treatUpdateErr(res, err); err != nil {
+			return err
+		}
+		s.RotationDays = days
+		return nil
+	})
+}
+
+// FindSecretRotationReminders returns the secrets that are due for rotation and have not been reminded yet and
+// marks them as reminded. If repeat is set secrets that are still not rotated are reminded again every interval
+func FindSecretRotationReminders(ctx context.Context, now time.Time, repeat bool) ([]*SecretRotationReminder, error) {
+	db := GetDB(ctx)
+	rows, err := db.Query(`SELECT `+selectSecretFullFields+` FROM (
+		SELECT DISTINCT ON ("team", "vault", "id") * FROM "secret" ORDER BY "team", "vault", "id", "version" DESC
+	) AS "secret"
+	WHERE "secret"."rotation_days" > 0 AND "secret"."rotated_at" + "secret"."rotation_days" * INTERVAL '1 day' < $1
+	AND ("secret"."rotation_reminded_at" <= "secret"."rotated_at" OR ($2 AND "secret"."rotation_reminded_at" + "secret"."rotation_days" * INTERVAL '1 day' < $1))
+	AND NOT EXISTS (SELECT 1 FROM "vault" WHERE "vault"."team" = "secret"."team" AND "vault"."id" = "secret"."vault" AND "vault"."deleted_at" IS NOT NULL)`, now, repeat)
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	due, err := scanSecrets(rows)
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	reminders := []*SecretRotationReminder{}
+	for _, s := range due {
+		var sr *SecretRotationReminder
+		err = doTx(ctx, func(tx *sql.Tx) error {
+			sr, err = markSecretRotationReminded(tx, s, now)
+			return err
+		})
+		if err != nil {
+			return reminders, err
+		}
+		if sr != nil {
+			reminders = append(reminders, sr)
+		}
+	}
+	return reminders, nil
+}
+
+// markSecretRotationReminded only succeeds if nobody changed or reminded the secret since it was found, so
+// concurrent runs don't send the same reminder twice
+func markSecretRotationReminded(tx *sql.Tx, s *Secret, now time.Time) (*SecretRotationReminder, error) {
+	res, err := tx.Exec(`UPDATE "secret" SET "rotation_reminded_at" = $1 WHERE "team" = $2 AND "vault" = $3 AND "id" = $4 AND "version" = $5 AND "rotation_reminded_at" = $6`,
+		now, s.Team, s.Vault, s.Id, s.Version, s.RotationRemindedAt)
+	if err := treatUpdateErr(res, err); err != nil {
+		if util.CheckErr(err, ErrDoesntExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	s.RotationRemindedAt = now
+	t := &Team{Id: s.Team}
+	err = t.dbFind(tx)
+	if isNotExistsErr(err) {
+		return nil, nil
+	}
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	rows, err := tx.Query(`SELECT `+selectUserFullFields+` FROM "user", "vault_user" WHERE "vault_user"."team" = $1 AND "vault_user"."vault" = $2 AND "user"."id" = "vault_user"."user"`, s.Team, s.Vault)
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	users, err := scanUsers(rows)
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	return &SecretRotationReminder{t, s, users}, nil
+}
@@ -0,0 +1,84 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+const SECRET_SEARCH_MAX_RESULTS = 200
+
+// SecretSearchResult groups the matching secrets of one vault
+type SecretSearchResult struct {
+	Team     string    `json:"team"`
+	TeamName string    `json:"team_name"`
+	Vault    string    `json:"vault"`
+	Secrets  []*Secret `json:"secrets"`
+}
+
+// escapeLike escapes the LIKE wildcards so the query is matched literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// SearchSecrets looks for the last version of the secrets the user can read whose vault or team name contains
+// the query, case insensitively. Secret contents and their names are encrypted client side so the server can only
+// search the metadata it can read in the clear. Clients have to search inside the secrets themselves after
+// decrypting them. Only vaults the user is a member of are searched
+func (u *User) SearchSecrets(ctx context.Context, query string, limit int) (res []*SecretSearchResult, err error) {
+	query = strings.TrimSpace(query)
+	if len(query) == 0 {
+		return nil, util.NewErrorFrom(ErrInvalidAttributes)
+	}
+	if limit < 1 || limit > SECRET_SEARCH_MAX_RESULTS {
+		limit = SECRET_SEARCH_MAX_RESULTS
+	}
+	return res, doReadTx(ctx, func(tx *sql.Tx) error {
+		res, err = u.searchSecrets(tx, "%"+escapeLike(query)+"%", limit)
+		return err
+	})
+}
+
+func (u *User) searchSecrets(tx *sql.Tx, pattern string, limit int) ([]*SecretSearchResult, error) {
+	rows, err := tx.Query(`SELECT `+selectSecretFullFields+` FROM (
+		SELECT DISTINCT ON ("secret"."team", "secret"."vault", "secret"."id") "secret".*
+		FROM "secret", "vault_user", "team", "vault"
+		WHERE "vault_user"."user" = $1 AND
+			"secret"."team" = "vault_user"."team" AND
+			"secret"."vault" = "vault_user"."vault" AND
+			"vault"."team" = "secret"."team" AND "vault"."id" = "secret"."vault" AND "vault"."deleted_at" IS NULL AND
+			"team"."id" = "secret"."team" AND
+			("secret"."vault" ILIKE $2 OR "team"."name" ILIKE $2)
+		ORDER BY "secret"."team", "secret"."vault", "secret"."id", "secret"."version" DESC
+	) AS "secret" ORDER BY "secret"."team", "secret"."vault", "secret"."created_at" DESC LIMIT $3`, u.Id, pattern, limit)
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	secrets, err := scanSecrets(rows)
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	rows, err = tx.Query(`SELECT `+selectTeamFullFields+` FROM "team", "team_user" WHERE "team_user"."team" = "team"."id" AND "team_user"."user" = $1`, u.Id)
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	teams, err := scanTeams(rows)
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	teamNames := map[string]string{}
+	for _, t := range teams {
+		teamNames[t.Id] = t.Name
+	}
+	res := []*SecretSearchResult{}
+	for _, s := range secrets {
+		if last := len(res) - 1; last >= 0 && res[last].Team == s.Team && res[last].Vault == s.Vault {
+			res[last].Secrets = append(res[last].Secrets, s)
+			continue
+		}
+		res = append(res, &SecretSearchResult{s.Team, teamNames[s.Team], s.Vault, []*Secret{s}})
+	}
+	return res, nil
+}
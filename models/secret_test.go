@@ -1,7 +1,11 @@
 package models
 
 import (
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/keydotcat/keycatd/util"
 )
 
 func TestGetAllSecretsForOwnerAndUser(t *testing.T) {
@@ -10,7 +14,7 @@ func TestGetAllSecretsForOwnerAndUser(t *testing.T) {
 	vm := getFirstVault(owner, team)
 	vm2 := createVaultMock(owner, team)
 	invitee := getDummyUser()
-	_, err := team.AddOrInviteUserByEmail(ctx, owner, invitee.Email)
+	_, err := team.AddOrInviteUserByEmail(ctx, owner, invitee.Email, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -20,12 +24,12 @@ func TestGetAllSecretsForOwnerAndUser(t *testing.T) {
 		t.Fatal(err)
 	}
 	s2 := &Secret{Data: signAndPack(vm2.priv, a32b)}
-	err = vm2.v.AddSecret(ctx, s2)
+	err = vm2.v.AddSecret(ctx, vm2.owner, s2)
 	if err != nil {
 		t.Fatal(err)
 	}
 	s := &Secret{Data: signAndPack(vm.priv, a32b)}
-	err = vm.v.AddSecret(ctx, s)
+	err = vm.v.AddSecret(ctx, vm.owner, s)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -50,12 +54,12 @@ func TestUpdateSecret(t *testing.T) {
 	owner, team := getDummyOwnerWithTeam()
 	vm := getFirstVault(owner, team)
 	s := &Secret{Data: signAndPack(vm.priv, a32b)}
-	if err := vm.v.AddSecret(ctx, s); err != nil {
+	if err := vm.v.AddSecret(ctx, vm.owner, s); err != nil {
 		t.Fatal(err)
 	}
 	s.Version = 0
 	s.VaultVersion = 0
-	if err := vm.v.UpdateSecret(ctx, s); err != nil {
+	if err := vm.v.UpdateSecret(ctx, vm.owner, s); err != nil {
 		t.Fatal(err)
 	}
 	if s.Version != 2 {
@@ -64,7 +68,7 @@ func TestUpdateSecret(t *testing.T) {
 	if s.VaultVersion != vm.v.Version {
 		t.Errorf("Mismatch in the vault version %d vs %d", s.VaultVersion, vm.v.Version)
 	}
-	if err := vm.v.UpdateSecret(ctx, s); err != nil {
+	if err := vm.v.UpdateSecret(ctx, vm.owner, s); err != nil {
 		t.Fatal(err)
 	}
 	if s.Version != 3 {
@@ -72,6 +76,64 @@ func TestUpdateSecret(t *testing.T) {
 	}
 }
 
+func TestSecretHistory(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	vm := getFirstVault(owner, team)
+	SECRET_HISTORY_LIMIT = 3
+	defer func() { SECRET_HISTORY_LIMIT = 20 }()
+	datas := [][]byte{}
+	s := &Secret{}
+	for i := 0; i < 5; i++ {
+		s.Data = signAndPack(vm.priv, []byte(util.GenerateRandomToken(32)))
+		datas = append(datas, s.Data)
+		var err error
+		if i == 0 {
+			err = vm.v.AddSecret(ctx, vm.owner, s)
+		} else {
+			err = vm.v.UpdateSecret(ctx, vm.owner, s)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	history, err := vm.v.GetSecretHistory(ctx, s.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 {
+		t.Fatalf("Expected 3 versions and got %d", len(history))
+	}
+	for i, hs := range history {
+		if hs.Version != uint32(5-i) || string(hs.Data) != string(datas[4-i]) {
+			t.Fatalf("Unexpected version %d in position %d", hs.Version, i)
+		}
+	}
+	if _, err = vm.v.RestoreSecretVersion(ctx, s.Id, 1); !util.CheckErr(err, ErrDoesntExist) {
+		t.Fatalf("Expected pruned version to be gone and got %s", err)
+	}
+	rs, err := vm.v.RestoreSecretVersion(ctx, s.Id, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.Version != 6 {
+		t.Fatalf("Expected restored version to be 6 and got %d", rs.Version)
+	}
+	cs, err := vm.v.GetSecret(ctx, s.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.Version != 6 || string(cs.Data) != string(datas[2]) {
+		t.Fatalf("Current version was not restored")
+	}
+	if history, err = vm.v.GetSecretHistory(ctx, s.Id); err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 || history[2].Version != 4 {
+		t.Fatalf("History was not pruned after restoring")
+	}
+}
+
 func TestCheckRetrieveLastVersionOfSecret(t *testing.T) {
 	ctx := getCtx()
 	owner, team := getDummyOwnerWithTeam()
@@ -89,11 +151,11 @@ func TestCheckRetrieveLastVersionOfSecret(t *testing.T) {
 			vault = vm2.v
 			s = &Secret{Data: signAndPack(vm2.priv, a32b)}
 		}
-		if err := vault.AddSecret(ctx, s); err != nil {
+		if err := vault.AddSecret(ctx, owner, s); err != nil {
 			t.Fatal(err)
 		}
 		for j := 0; j < i; j++ {
-			if err := vault.UpdateSecret(ctx, s); err != nil {
+			if err := vault.UpdateSecret(ctx, owner, s); err != nil {
 				t.Fatal(err)
 			}
 		}
@@ -129,10 +191,10 @@ func TestMoveSecretToVault(t *testing.T) {
 	for i, vm := range vms[:2] {
 		s := &Secret{Data: signAndPack(vm.priv, a32b)}
 		secrets[i] = s
-		if err := vm.v.AddSecret(ctx, s); err != nil {
+		if err := vm.v.AddSecret(ctx, vm.owner, s); err != nil {
 			t.Fatal(err)
 		}
-		if err := vm.v.UpdateSecret(ctx, s); err != nil {
+		if err := vm.v.UpdateSecret(ctx, vm.owner, s); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -170,6 +232,42 @@ func TestMoveSecretToVault(t *testing.T) {
 	}
 }
 
+func TestTeamMoveSecret(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	vm := getFirstVault(owner, team)
+	vm2 := createVaultMock(owner, team)
+	member := getDummyUser()
+	if _, err := team.AddOrInviteUserByEmail(ctx, owner, member.Email, nil); err != nil {
+		t.Fatal(err)
+	}
+	s := &Secret{Data: signAndPack(vm.priv, a32b)}
+	if err := vm.v.AddSecret(ctx, vm.owner, s); err != nil {
+		t.Fatal(err)
+	}
+	data := signAndPack(vm2.priv, a32b)
+	if _, err := team.MoveSecret(ctx, member, s.Id, vm.v.Id, vm2.v.Id, data); !util.CheckErr(err, ErrUnauthorized) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrUnauthorized, err)
+	}
+	if _, err := team.MoveSecret(ctx, owner, s.Id, vm.v.Id, "nope", data); !util.CheckErr(err, ErrVaultNotFound) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrVaultNotFound, err)
+	}
+	moved, err := team.MoveSecret(ctx, owner, s.Id, vm.v.Id, vm2.v.Id, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.v.GetSecret(ctx, s.Id); !util.CheckErr(err, ErrDoesntExist) {
+		t.Fatalf("Secret is still in the source vault: %v", err)
+	}
+	ns, err := vm2.v.GetSecret(ctx, moved.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ns.Data) != string(data) {
+		t.Fatal("Moved secret does not have the re-encrypted data")
+	}
+}
+
 func TestMoveSecretToTeamVault(t *testing.T) {
 	ctx := getCtx()
 	owner, team := getDummyOwnerWithTeam()
@@ -185,10 +283,10 @@ func TestMoveSecretToTeamVault(t *testing.T) {
 		for iv, vm := range vms[it][:2] {
 			s := &Secret{Data: signAndPack(vm.priv, a32b)}
 			secrets[it][iv] = s
-			if err := vm.v.AddSecret(ctx, s); err != nil {
+			if err := vm.v.AddSecret(ctx, vm.owner, s); err != nil {
 				t.Fatal(err)
 			}
-			if err := vm.v.UpdateSecret(ctx, s); err != nil {
+			if err := vm.v.UpdateSecret(ctx, vm.owner, s); err != nil {
 				t.Fatal(err)
 			}
 		}
@@ -228,3 +326,298 @@ func TestMoveSecretToTeamVault(t *testing.T) {
 		}
 	}
 }
+
+func TestSecretReferences(t *testing.T) {
+	ctx := getCtx()
+	o, team := getDummyOwnerWithTeam()
+	vm := getFirstVault(o, team)
+	ss := make([]*Secret, 3)
+	for i := range ss {
+		ss[i] = &Secret{Data: signAndPack(vm.priv, a32b)}
+		if err := vm.v.AddSecret(ctx, vm.owner, ss[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := vm.v.SetSecretReferences(ctx, ss[0].Id, []string{"nonexistent"}); !util.CheckErr(err, ErrDanglingReference) {
+		t.Fatalf("Expected error %s and got %s", ErrDanglingReference, err)
+	}
+	if err := vm.v.SetSecretReferences(ctx, ss[0].Id, []string{ss[1].Id}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.v.SetSecretReferences(ctx, ss[1].Id, []string{ss[2].Id}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.v.SetSecretReferences(ctx, ss[2].Id, []string{ss[0].Id}); !util.CheckErr(err, ErrReferenceCycle) {
+		t.Fatalf("Expected error %s and got %s", ErrReferenceCycle, err)
+	}
+	if err := vm.v.SetSecretReferences(ctx, ss[2].Id, []string{ss[2].Id}); !util.CheckErr(err, ErrReferenceCycle) {
+		t.Fatalf("Expected self references to be refused and got %s", err)
+	}
+	by, err := vm.v.GetReferencingSecrets(ctx, ss[1].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(by) != 1 || by[0] != ss[0].Id {
+		t.Fatalf("Expected %s to be referenced by %s and got %v", ss[1].Id, ss[0].Id, by)
+	}
+	if err := vm.v.DeleteSecret(ctx, vm.owner, ss[1].Id); err != nil {
+		t.Fatal(err)
+	}
+	refs, err := vm.v.GetSecretReferences(ctx, ss[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 0 {
+		t.Errorf("Expected the references to a deleted secret to be removed and got %v", refs)
+	}
+}
+
+func TestPruneSecretHistory(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	vm := getFirstVault(owner, team)
+	defer func(limit int) { SECRET_HISTORY_LIMIT = limit }(SECRET_HISTORY_LIMIT)
+	SECRET_HISTORY_LIMIT = 0
+	s := &Secret{Data: signAndPack(vm.priv, a32b)}
+	if err := vm.v.AddSecret(ctx, vm.owner, s); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		s.Data = signAndPack(vm.priv, []byte(util.GenerateRandomToken(32)))
+		if err := vm.v.UpdateSecret(ctx, vm.owner, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := PruneSecretHistory(ctx, 1); err != nil || n != 0 {
+		t.Fatalf("Nothing should be pruned without a limit: %d %v", n, err)
+	}
+	SECRET_HISTORY_LIMIT = 2
+	if _, err := PruneSecretHistory(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	history, err := vm.v.GetSecretHistory(ctx, s.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("Expected 2 versions and got %d", len(history))
+	}
+	if history[0].Version != s.Version {
+		t.Fatalf("Current version was pruned: %d vs %d", s.Version, history[0].Version)
+	}
+}
+
+func TestSecretRotationReminders(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	vm := getFirstVault(owner, team)
+	s := &Secret{Data: signAndPack(vm.priv, a32b), RotationDays: 1}
+	if err := vm.v.AddSecret(ctx, vm.owner, s); err != nil {
+		t.Fatal(err)
+	}
+	reminded := func(now time.Time, repeat bool) bool {
+		reminders, err := FindSecretRotationReminders(ctx, now, repeat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, sr := range reminders {
+			if sr.Secret.Id == s.Id {
+				if len(sr.Users) != 1 || sr.Users[0].Id != owner.Id || sr.Team.Id != team.Id {
+					t.Fatalf("Unexpected reminder recipients: %+v", sr)
+				}
+				return true
+			}
+		}
+		return false
+	}
+	now := time.Now().UTC()
+	if reminded(now, false) {
+		t.Fatal("Secret is not due yet")
+	}
+	if !reminded(now.Add(36*time.Hour), false) {
+		t.Fatal("Expected a reminder once the secret is due")
+	}
+	if reminded(now.Add(72*time.Hour), false) {
+		t.Fatal("Reminders should not repeat unless configured")
+	}
+	if !reminded(now.Add(72*time.Hour), true) {
+		t.Fatal("Expected a repeated reminder")
+	}
+	s.Data = signAndPack(vm.priv, []byte(util.GenerateRandomToken(32)))
+	if err := vm.v.UpdateSecret(ctx, vm.owner, s); err != nil {
+		t.Fatal(err)
+	}
+	if s.RotationDays != 1 {
+		t.Fatalf("Rotation interval was not kept on update: %d", s.RotationDays)
+	}
+	if reminded(now.Add(12*time.Hour), true) {
+		t.Fatal("Updating the secret should restart the rotation clock")
+	}
+	if _, err := vm.v.SetSecretRotation(ctx, s.Id, 0); err != nil {
+		t.Fatal(err)
+	}
+	if reminded(now.Add(72*time.Hour), true) {
+		t.Fatal("Secrets without a rotation interval should not be reminded")
+	}
+}
+
+func TestSearchSecrets(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	vm := getFirstVault(owner, team)
+	vm2 := createVaultMock(owner, team)
+	member := getDummyUser()
+	if _, err := team.AddOrInviteUserByEmail(ctx, owner, member.Email, nil); err != nil {
+		t.Fatal(err)
+	}
+	s := &Secret{Data: signAndPack(vm.priv, a32b)}
+	if err := vm.v.AddSecret(ctx, vm.owner, s); err != nil {
+		t.Fatal(err)
+	}
+	s2 := &Secret{Data: signAndPack(vm2.priv, a32b)}
+	if err := vm2.v.AddSecret(ctx, vm2.owner, s2); err != nil {
+		t.Fatal(err)
+	}
+	found := func(u *User, query string) map[string]bool {
+		res, err := u.SearchSecrets(ctx, query, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := map[string]bool{}
+		for _, r := range res {
+			if r.Team != team.Id || r.TeamName != team.Name {
+				t.Fatalf("Unexpected team in result %+v", r)
+			}
+			for _, rs := range r.Secrets {
+				if rs.Vault != r.Vault {
+					t.Fatalf("Secret %s from vault %s grouped in vault %s", rs.Id, rs.Vault, r.Vault)
+				}
+				ids[rs.Id] = true
+			}
+		}
+		return ids
+	}
+	if ids := found(owner, strings.ToUpper(vm2.v.Id)); !ids[s2.Id] || ids[s.Id] {
+		t.Fatalf("Vault name search for the owner returned %v", ids)
+	}
+	if ids := found(member, vm2.v.Id); len(ids) > 0 {
+		t.Fatalf("Member got secrets from a vault it doesn't belong to: %v", ids)
+	}
+	if ids := found(owner, team.Name); !ids[s.Id] || !ids[s2.Id] {
+		t.Fatalf("Team name search for the owner returned %v", ids)
+	}
+	if ids := found(member, team.Name); !ids[s.Id] || ids[s2.Id] {
+		t.Fatalf("Team name search for the member returned %v", ids)
+	}
+	if ids := found(member, "%"); len(ids) > 0 {
+		t.Fatalf("Wildcards should be matched literally and got %v", ids)
+	}
+	if _, err := member.SearchSecrets(ctx, " ", 0); !util.CheckErr(err, ErrInvalidAttributes) {
+		t.Fatalf("Expected an invalid attributes error for an empty query and got %v", err)
+	}
+}
+
+func TestSecretAccessLog(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	member := getDummyUser()
+	if _, err := team.AddOrInviteUserByEmail(ctx, owner, member.Email, nil); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	accesses := []SecretAccess{
+		{Team: team.Id, Vault: DEFAULT_VAULT_NAME, Secret: "s1", User: member.Id, AccessedAt: now.Add(-time.Minute)},
+		{Team: team.Id, Vault: DEFAULT_VAULT_NAME, Secret: "s1", User: owner.Id, AccessedAt: now},
+		{Team: team.Id, Vault: DEFAULT_VAULT_NAME, Secret: "s2", User: owner.Id, AccessedAt: now},
+	}
+	if err := RecordSecretAccesses(ctx, accesses); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := team.GetSecretAccessLog(ctx, member, "s1"); !util.CheckErr(err, ErrUnauthorized) {
+		t.Fatalf("Expected %s and got %v", ErrUnauthorized, err)
+	}
+	log, err := team.GetSecretAccessLog(ctx, owner, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(log) != 2 || log[0].User != owner.Id || log[1].User != member.Id {
+		t.Fatalf("Unexpected access log %+v", log)
+	}
+}
+
+func TestSecretJustification(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	member := getDummyUser()
+	if _, err := team.AddOrInviteUserByEmail(ctx, owner, member.Email, nil); err != nil {
+		t.Fatal(err)
+	}
+	vm := getFirstVault(owner, team)
+	vm2 := createVaultMock(owner, team)
+	flagged := &Secret{Data: signAndPack(vm.priv, a32b)}
+	plain := &Secret{Data: signAndPack(vm.priv, a32b)}
+	for _, s := range []*Secret{flagged, plain} {
+		if err := vm.v.AddSecret(ctx, owner, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := vm.v.SetSecretJustification(ctx, member, flagged.Id, true); !util.CheckErr(err, ErrUnauthorized) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrUnauthorized, err)
+	}
+	start := time.Now().UTC()
+	if err := vm.v.SetSecretJustification(ctx, owner, flagged.Id, true); err != nil {
+		t.Fatal(err)
+	}
+	// Flagging twice does not log twice
+	if err := vm.v.SetSecretJustification(ctx, owner, flagged.Id, true); err != nil {
+		t.Fatal(err)
+	}
+	// The flag is kept across versions
+	if err := vm.v.UpdateSecret(ctx, owner, flagged); err != nil {
+		t.Fatal(err)
+	}
+	found, err := SecretsRequiringJustification(ctx, []*Secret{flagged, plain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0] != flagged {
+		t.Fatalf("Expected only %s to require a justification and got %v", flagged.Id, found)
+	}
+	if err := RecordJustifiedReads(ctx, member, found, strings.Repeat("a", SECRET_JUSTIFICATION_MAX_LENGTH+1)); !util.CheckErr(err, ErrInvalidAttributes) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrInvalidAttributes, err)
+	}
+	if err := RecordJustifiedReads(ctx, member, found, "incident 42"); err != nil {
+		t.Fatal(err)
+	}
+	logs, err := team.GetAuditLog(ctx, owner, start, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 || logs[0].Action != TEAM_AUDIT_SECRET_JUSTIFICATION_SET || logs[1].Action != TEAM_AUDIT_SECRET_JUSTIFIED_READ {
+		t.Fatalf("Unexpected audit log entries: %v", logs)
+	}
+	if logs[1].Actor != member.Id || logs[1].Target != flagged.Id+": incident 42" {
+		t.Fatalf("Unexpected justified read entry: %s -> %s", logs[1].Actor, logs[1].Target)
+	}
+	// Moving the secret keeps the flag under the new id
+	moved, err := team.MoveSecret(ctx, owner, flagged.Id, vm.v.Id, vm2.v.Id, signAndPack(vm2.priv, a32b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := vm2.v.GetSecretIdsRequiringJustification(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ids[moved.Id] || len(ids) != 1 {
+		t.Fatalf("Expected the moved secret %s to require a justification and got %v", moved.Id, ids)
+	}
+	if ids, err = vm.v.GetSecretIdsRequiringJustification(ctx); err != nil || len(ids) != 0 {
+		t.Fatalf("Expected no flagged secrets left in the source vault and got %v (%v)", ids, err)
+	}
+	if err := vm2.v.SetSecretJustification(ctx, owner, moved.Id, false); err != nil {
+		t.Fatal(err)
+	}
+	if found, err = SecretsRequiringJustification(ctx, []*Secret{moved}); err != nil || len(found) != 0 {
+		t.Fatalf("Expected the flag to be removed and got %v (%v)", found, err)
+	}
+}
@@ -0,0 +1,175 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+var (
+	// Lifetime of share links created without one
+	SHARE_LINK_DEFAULT_TTL = 24 * time.Hour
+	// Longest lifetime a share link can have
+	SHARE_LINK_MAX_TTL = 30 * 24 * time.Hour
+	// Max times a share link can be opened
+	SHARE_LINK_MAX_USES = 100
+)
+
+// ShareLink gives someone outside the team access to a copy of a secret. Data is the secret encrypted by the client
+// with a key that is delivered separately and never reaches the server. Only the hash of the token is stored
+type ShareLink struct {
+	Id            string    `scaneo:"pk" json:"-"`
+	Team          string    `json:"-"`
+	Vault         string    `json:"vault"`
+	Secret        string    `json:"secret"`
+	Creator       string    `json:"-"`
+	Data          []byte    `json:"data"`
+	RemainingUses int       `json:"remaining_uses"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// ShareLinkOptions sets what a share link gives access to. MaxUses defaults to 1 and TTL to SHARE_LINK_DEFAULT_TTL
+type ShareLinkOptions struct {
+	Data    []byte
+	MaxUses int
+	TTL     time.Duration
+}
+
+func (o *ShareLinkOptions) validate() error {
+	if o.MaxUses == 0 {
+		o.MaxUses = 1
+	}
+	if o.TTL == 0 {
+		o.TTL = SHARE_LINK_DEFAULT_TTL
+	}
+	errs := util.NewErrorFields().(*util.Error)
+	if len(o.Data) == 0 {
+		errs.SetFieldError("data", "missing")
+	}
+	if o.MaxUses < 1 || o.MaxUses > SHARE_LINK_MAX_USES {
+		errs.SetFieldError("max_uses", "invalid")
+	}
+	if o.TTL < 0 || o.TTL > SHARE_LINK_MAX_TTL {
+		errs.SetFieldError("ttl", "invalid")
+	}
+	if err := errs.SetErrorOrCamo(ErrInvalidAttributes); err != nil {
+		return err
+	}
+	return checkSecretSize(o.Data)
+}
+
+// CreateShareLink stores a link to the given copy of the secret and returns the token to open it. The token is only
+// returned here
+func (v *Vault) CreateShareLink(ctx context.Context, actor *User, sid string, opts ShareLinkOptions) (token string, sl *ShareLink, err error) {
+	if err := opts.validate(); err != nil {
+		return "", nil, err
+	}
+	token = util.GenerateRandomToken(32)
+	now := time.Now().UTC()
+	sl = &ShareLink{
+		Id:            hashToken(token),
+		Team:          v.Team,
+		Vault:         v.Id,
+		Secret:        sid,
+		Creator:       actor.Id,
+		Data:          opts.Data,
+		RemainingUses: opts.MaxUses,
+		ExpiresAt:     now.Add(opts.TTL),
+		CreatedAt:     now,
+	}
+	err = doTx(ctx, func(tx *sql.Tx) error {
+		if _, err := v.getSecret(tx, sid); err != nil {
+			return err
+		}
+		if _, err := sl.dbInsert(tx); isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		return (&Team{Id: v.Team}).audit(tx, actor.Id, sid, TEAM_AUDIT_SECRET_SHARE)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return token, sl, nil
+}
+
+// Prefix of the user recorded in the secret access log for reads through a share link. It is followed by the id of
+// the creator of the link
+const SHARE_LINK_READER_PREFIX = "share:"
+
+// Reader is the user recorded in the secret access log when the link is opened
+func (sl *ShareLink) Reader() string {
+	return SHARE_LINK_READER_PREFIX + sl.Creator
+}
+
+// ResolveShareLink uses the link once and returns it. Uses are taken with a single conditional update so concurrent
+// requests can never open the link more times than allowed. Links to secrets in deleted vaults cannot be opened.
+// Fails with ErrShareLinkExpired or ErrShareLinkExhausted if it cannot be used anymore
+func ResolveShareLink(ctx context.Context, token string) (sl *ShareLink, err error) {
+	if len(token) == 0 {
+		return nil, util.NewErrorFrom(ErrDoesntExist)
+	}
+	sl = &ShareLink{Id: hashToken(token)}
+	err = doTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.Exec(`UPDATE "share_link" SET "remaining_uses" = "remaining_uses" - 1
+			WHERE "id" = $1 AND "remaining_uses" > 0 AND "expires_at" > $2 AND EXISTS (
+				SELECT 1 FROM "vault" WHERE "vault"."team" = "share_link"."team" AND "vault"."id" = "share_link"."vault" AND "vault"."deleted_at" IS NULL
+			)`, sl.Id, time.Now().UTC())
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		used, err := res.RowsAffected()
+		if err != nil {
+			return util.NewErrorFrom(err)
+		}
+		err = sl.dbFind(tx)
+		if isNotExistsErr(err) {
+			return util.NewErrorFrom(ErrDoesntExist)
+		}
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		if used > 0 {
+			return nil
+		}
+		if _, err := (&Team{Id: sl.Team}).findVault(tx, sl.Vault); util.CheckErr(err, ErrVaultNotFound) {
+			return util.NewErrorFrom(ErrDoesntExist)
+		} else if err != nil {
+			return err
+		}
+		switch {
+		case !sl.ExpiresAt.After(time.Now().UTC()):
+			return util.NewErrorFrom(ErrShareLinkExpired)
+		default:
+			return util.NewErrorFrom(ErrShareLinkExhausted)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sl, nil
+}
+
+// DeleteExpiredShareLinks removes the links past their expiry and returns how many were deleted. Exhausted links are
+// kept until then so they keep answering ErrShareLinkExhausted
+func DeleteExpiredShareLinks(ctx context.Context) (deleted int64, err error) {
+	err = doTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.Exec(`DELETE FROM "share_link" WHERE "expires_at" <= $1`, time.Now().UTC())
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		deleted, err = res.RowsAffected()
+		return util.NewErrorFrom(err)
+	})
+	return deleted, err
+}
+
+func (v *Vault) deleteShareLinks(tx *sql.Tx, sid string) error {
+	_, err := tx.Exec(`DELETE FROM "share_link" WHERE "team" = $1 AND "vault" = $2 AND "secret" = $3`, v.Team, v.Id, sid)
+	if isErrOrPanic(err) {
+		return util.NewErrorFrom(err)
+	}
+	return nil
+}
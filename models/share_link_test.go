@@ -0,0 +1,111 @@
+package models
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+func createShareLinkMock(t *testing.T, maxUses int) (string, *ShareLink) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	vm := getFirstVault(owner, team)
+	s := &Secret{Data: signAndPack(vm.priv, a32b)}
+	if err := vm.v.AddSecret(ctx, vm.owner, s); err != nil {
+		t.Fatal(err)
+	}
+	token, sl, err := vm.v.CreateShareLink(ctx, owner, s.Id, ShareLinkOptions{Data: a32b, MaxUses: maxUses})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token, sl
+}
+
+func TestShareLinkConcurrentResolves(t *testing.T) {
+	ctx := getCtx()
+	token, _ := createShareLinkMock(t, 3)
+	lock := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	opened, exhausted := 0, 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sl, err := ResolveShareLink(ctx, token)
+			lock.Lock()
+			defer lock.Unlock()
+			switch {
+			case err == nil && string(sl.Data) == string(a32b):
+				opened++
+			case util.CheckErr(err, ErrShareLinkExhausted):
+				exhausted++
+			default:
+				t.Errorf("Unexpected error resolving the link: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if opened != 3 || exhausted != 7 {
+		t.Fatalf("Expected the link to be opened 3 times and got %d opens and %d exhausted", opened, exhausted)
+	}
+	if _, err := ResolveShareLink(ctx, "nope"); !util.CheckErr(err, ErrDoesntExist) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrDoesntExist, err)
+	}
+}
+
+func TestShareLinkExpiry(t *testing.T) {
+	ctx := getCtx()
+	token, sl := createShareLinkMock(t, 2)
+	old := time.Now().UTC().Add(-time.Minute)
+	if _, err := mdb.Exec(`UPDATE "share_link" SET "expires_at" = $1 WHERE "id" = $2`, old, sl.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResolveShareLink(ctx, token); !util.CheckErr(err, ErrShareLinkExpired) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrShareLinkExpired, err)
+	}
+	if _, err := DeleteExpiredShareLinks(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResolveShareLink(ctx, token); !util.CheckErr(err, ErrDoesntExist) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrDoesntExist, err)
+	}
+}
+
+func TestShareLinkFollowsVault(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	vm := createVaultMock(owner, team)
+	s := &Secret{Data: signAndPack(vm.priv, a32b)}
+	if err := vm.v.AddSecret(ctx, vm.owner, s); err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := vm.v.CreateShareLink(ctx, owner, s.Id, ShareLinkOptions{Data: a32b, MaxUses: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := team.RenameVault(ctx, owner, vm.v.Id, "renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ResolveShareLink(ctx, token); err != nil {
+		t.Fatalf("Expected the link to survive the rename: %s", err)
+	}
+	if err = team.DeleteVault(ctx, owner, v.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ResolveShareLink(ctx, token); !util.CheckErr(err, ErrDoesntExist) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrDoesntExist, err)
+	}
+	if _, err = team.RestoreVault(ctx, owner, v.Id); err != nil {
+		t.Fatal(err)
+	}
+	sl, err := ResolveShareLink(ctx, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sl.RemainingUses != 1 {
+		t.Fatalf("Expected the deleted vault not to use up the link and got %d uses left", sl.RemainingUses)
+	}
+}
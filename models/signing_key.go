@@ -0,0 +1,64 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/keydotcat/keycatd/util"
+	"golang.org/x/crypto/ed25519"
+)
+
+// SigningKey is used to sign the tokens issued by the server. It is shared by all the instances through the db
+type SigningKey struct {
+	Id         string    `scaneo:"pk" json:"id"`
+	PrivateKey []byte    `json:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func (sk *SigningKey) PublicKey() ed25519.PublicKey {
+	return ed25519.PrivateKey(sk.PrivateKey).Public().(ed25519.PublicKey)
+}
+
+func CreateSigningKey(ctx context.Context) (sk *SigningKey, err error) {
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		panic(err)
+	}
+	sk = &SigningKey{Id: util.GenerateRandomToken(16), PrivateKey: priv, CreatedAt: time.Now().UTC()}
+	return sk, doTx(ctx, func(tx *sql.Tx) error {
+		_, err := sk.dbInsert(tx)
+		if IsDuplicateErr(err) {
+			return util.NewErrorFrom(ErrAlreadyExists)
+		}
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		return nil
+	})
+}
+
+// GetSigningKeysSince returns the keys created after the given time, newest first
+func GetSigningKeysSince(ctx context.Context, since time.Time) (sks []*SigningKey, err error) {
+	return sks, doTx(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT `+selectSigningKeyFields+` FROM "signing_key" WHERE "created_at" > $1 ORDER BY "created_at" DESC`, since)
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		sks, err = scanSigningKeys(rows)
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		return nil
+	})
+}
+
+func DeleteSigningKeysBefore(ctx context.Context, before time.Time) error {
+	return doTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`DELETE FROM "signing_key" WHERE "created_at" < $1`, before)
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		return nil
+	})
+}
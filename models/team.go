@@ -4,14 +4,26 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/keydotcat/keycatd/util"
+	"github.com/lib/pq"
 )
 
 const DEFAULT_VAULT_NAME = "Personal"
 
+// Max length of team and vault names
+const MAX_NAME_LENGTH = 100
+
+const (
+	EMAIL_STATUS_EXISTING_USER   = "existing_user"
+	EMAIL_STATUS_ALREADY_IN_TEAM = "already_in_team"
+	EMAIL_STATUS_ALREADY_INVITED = "already_invited"
+	EMAIL_STATUS_NEW             = "new"
+)
+
 type Team struct {
 	Id        string    `scaneo:"pk" json:"id"`
 	Name      string    `json:"name"`
@@ -36,14 +48,14 @@ func createTeam(tx *sql.Tx, owner *User, primary bool, name string, vaultKeys Va
 	if err := t.insert(tx); err != nil {
 		return nil, err
 	}
-	tu := &teamUser{t.Id, owner.Id, true, false}
+	tu := &teamUser{t.Id, owner.Id, true, false, false}
 	if err := tu.insert(tx); err != nil {
 		return nil, err
 	}
 	if err := vaultKeys.checkKeyIdsMatch([]string{owner.Id}); err != nil {
 		return nil, err
 	}
-	if _, err := createVault(tx, DEFAULT_VAULT_NAME, t.Id, vaultKeys); err != nil {
+	if _, err := createVault(tx, DEFAULT_VAULT_NAME, t.Id, false, vaultKeys); err != nil {
 		return nil, err
 	}
 	return t, nil
@@ -58,6 +70,14 @@ func (t *Team) insert(tx *sql.Tx) error {
 	return util.NewErrorFrom(err)
 }
 
+func (t *Team) update(tx *sql.Tx) error {
+	if err := t.validate(); err != nil {
+		return err
+	}
+	t.UpdatedAt = time.Now().UTC()
+	return treatUpdateErr(t.dbUpdate(tx))
+}
+
 func (t *Team) validate() error {
 	errs := util.NewErrorFields().(*util.Error)
 	if !reValidUsername.MatchString(t.Owner) {
@@ -100,29 +120,239 @@ func (t *Team) getUsersAfiliation(tx *sql.Tx) ([]*teamUser, error) {
 }
 
 func (t *Team) CreateVault(ctx context.Context, u *User, name string, signedVaultKeys VaultKeyPair) (v *Vault, err error) {
+	return t.createVaultWithKeys(ctx, u, name, false, signedVaultKeys)
+}
+
+// CreateAllMembersVault creates a vault that every member of the team can access. Keys for all members are required.
+func (t *Team) CreateAllMembersVault(ctx context.Context, u *User, name string, signedVaultKeys VaultKeyPair) (v *Vault, err error) {
+	return t.createVaultWithKeys(ctx, u, name, true, signedVaultKeys)
+}
+
+func (t *Team) createVaultWithKeys(ctx context.Context, u *User, name string, allMembers bool, signedVaultKeys VaultKeyPair) (v *Vault, err error) {
 	vaultKeys, err := signedVaultKeys.verifyAndUnpack(u.PublicKey)
 	if err != nil {
 		return nil, err
 	}
-	return v, doTx(ctx, func(tx *sql.Tx) error {
-		admins, err := t.getAdminUsers(tx)
-		if err != nil {
+	return v, doRetryTx(ctx, func(tx *sql.Tx) error {
+		if err := t.checkAdminAction(tx, u); err != nil {
 			return err
 		}
-		isAdmin := false
-		uids := make([]string, len(admins))
-		for i, admin := range admins {
-			uids[i] = admin.Id
-			isAdmin = isAdmin || (admin.Id == u.Id)
+		var users []*User
+		if allMembers {
+			users, err = t.getUsers(tx)
+		} else {
+			users, err = t.getAdminUsers(tx)
 		}
-		if !isAdmin {
-			return util.NewErrorFrom(ErrUnauthorized)
+		if err != nil {
+			return err
+		}
+		uids := make([]string, len(users))
+		for i, user := range users {
+			uids[i] = user.Id
 		}
 		if err = vaultKeys.checkKeyIdsMatch(uids); err != nil {
 			return err
 		}
-		v, err = createVault(tx, name, t.Id, vaultKeys)
+		v, err = createVault(tx, name, t.Id, allMembers, vaultKeys)
+		if err != nil {
+			return err
+		}
+		return t.audit(tx, u.Id, v.Id, TEAM_AUDIT_VAULT_CREATE)
+	})
+}
+
+// DeleteVault removes a vault with all its secrets and keys. The default vault of the team cannot be deleted
+func (t *Team) DeleteVault(ctx context.Context, actor *User, vid string) error {
+	if vid == DEFAULT_VAULT_NAME {
+		return util.NewErrorFrom(ErrCannotDeleteDefaultVault)
+	}
+	return doRetryTx(ctx, func(tx *sql.Tx) error {
+		if err := t.checkAdminAction(tx, actor); err != nil {
+			return err
+		}
+		v, err := t.findVault(tx, vid)
+		if err != nil {
+			return err
+		}
+		if VAULT_PURGE_AFTER > 0 {
+			v.DeletedAt = pq.NullTime{Time: time.Now().UTC(), Valid: true}
+			if err := treatUpdateErr(v.dbUpdate(tx)); err != nil {
+				return err
+			}
+		} else if err := v.purge(tx); err != nil {
+			return err
+		}
+		return t.audit(tx, actor.Id, v.Id, TEAM_AUDIT_VAULT_DELETE)
+	})
+}
+
+// RestoreVault undoes the deletion of a vault that has not been purged yet. It returns ErrVaultPurged once the
+// restore window is over
+func (t *Team) RestoreVault(ctx context.Context, actor *User, vid string) (v *Vault, err error) {
+	return v, doRetryTx(ctx, func(tx *sql.Tx) error {
+		if err := t.checkAdminAction(tx, actor); err != nil {
+			return err
+		}
+		v = &Vault{Id: vid, Team: t.Id}
+		err := v.dbFind(tx)
+		if isNotExistsErr(err) {
+			return t.vaultGoneErr(tx, vid)
+		}
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		if !v.DeletedAt.Valid {
+			return nil
+		}
+		if time.Since(v.DeletedAt.Time) > VAULT_PURGE_AFTER {
+			return util.NewErrorFrom(ErrVaultPurged)
+		}
+		v.DeletedAt = pq.NullTime{}
+		if err := treatUpdateErr(v.dbUpdate(tx)); err != nil {
+			return err
+		}
+		return t.audit(tx, actor.Id, v.Id, TEAM_AUDIT_VAULT_RESTORE)
+	})
+}
+
+// vaultGoneErr tells apart vaults that never existed from the ones that were purged by looking at the audit log
+func (t *Team) vaultGoneErr(tx *sql.Tx, vid string) error {
+	var purged int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM "team_audit_log" WHERE "team" = $1 AND "target" = $2 AND "action" = $3`, t.Id, vid, TEAM_AUDIT_VAULT_PURGE).Scan(&purged)
+	if isErrOrPanic(err) {
+		return util.NewErrorFrom(err)
+	}
+	if purged > 0 {
+		return util.NewErrorFrom(ErrVaultPurged)
+	}
+	return util.NewErrorFrom(ErrVaultNotFound)
+}
+
+// findVault returns ErrVaultNotFound if the vault is not in the team or has been deleted
+func (t *Team) findVault(tx *sql.Tx, vid string) (*Vault, error) {
+	v := &Vault{Id: vid, Team: t.Id}
+	err := v.dbFind(tx)
+	if isNotExistsErr(err) || (err == nil && v.DeletedAt.Valid) {
+		return nil, util.NewErrorFrom(ErrVaultNotFound)
+	}
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	return v, nil
+}
+
+// PurgeDeletedVaults removes the vaults that were deleted more than VAULT_PURGE_AFTER ago along with their
+// secrets. Returns the number of vaults purged
+func PurgeDeletedVaults(ctx context.Context) (int, error) {
+	db := GetDB(ctx)
+	rows, err := db.Query(`SELECT `+selectVaultFields+` FROM "vault" WHERE "deleted_at" < $1`, time.Now().UTC().Add(-VAULT_PURGE_AFTER))
+	if isErrOrPanic(err) {
+		return 0, util.NewErrorFrom(err)
+	}
+	vs, err := scanVaults(rows)
+	if isErrOrPanic(err) {
+		return 0, util.NewErrorFrom(err)
+	}
+	for i, v := range vs {
+		err := doTx(ctx, func(tx *sql.Tx) error {
+			if err := v.purge(tx); err != nil {
+				return err
+			}
+			t := &Team{Id: v.Team}
+			return t.audit(tx, "", v.Id, TEAM_AUDIT_VAULT_PURGE)
+		})
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(vs), nil
+}
+
+// cleanName trims the name and checks it is not empty, not too long and usable in a url path
+func cleanName(field, name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if len(name) == 0 || len(name) > MAX_NAME_LENGTH || strings.ContainsAny(name, "/\\") {
+		errs := util.NewErrorFields().(*util.Error)
+		errs.SetFieldError(field, "invalid")
+		return "", errs.SetErrorOrCamo(ErrInvalidAttributes)
+	}
+	return name, nil
+}
+
+// Rename changes the name of the team. Only admins can do it and the owner cannot have two teams with the same name
+func (t *Team) Rename(ctx context.Context, actor *User, name string) error {
+	name, err := cleanName("team_name", name)
+	if err != nil {
 		return err
+	}
+	return doTx(ctx, func(tx *sql.Tx) error {
+		if err := t.checkAdminAction(tx, actor); err != nil {
+			return err
+		}
+		if err := t.dbFind(tx); isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		var dups int
+		err := tx.QueryRow(`SELECT COUNT(*) FROM "team" WHERE "owner" = $1 AND "id" <> $2 AND lower("name") = lower($3)`, t.Owner, t.Id, name).Scan(&dups)
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		if dups > 0 {
+			errs := util.NewErrorFields().(*util.Error)
+			errs.SetFieldError("team_name", "duplicate")
+			return errs.SetErrorOrCamo(ErrAlreadyExists)
+		}
+		t.Name = name
+		if err := t.update(tx); err != nil {
+			return err
+		}
+		return t.audit(tx, actor.Id, t.Id, TEAM_AUDIT_RENAME)
+	})
+}
+
+// Tables that point to a vault by its id
+var vaultChildTables = []string{"vault_user", "secret", "vault_rekey", "secret_reference", "share_link", "secret_justification"}
+
+// RenameVault changes the name of a vault. The name is the id of the vault so every row that points to it is moved
+// to the new one. The default vault cannot be renamed
+func (t *Team) RenameVault(ctx context.Context, actor *User, vid, name string) (v *Vault, err error) {
+	name, err = cleanName("vault_id", name)
+	if err != nil {
+		return nil, err
+	}
+	if vid == DEFAULT_VAULT_NAME {
+		return nil, util.NewErrorFrom(ErrCannotRenameDefaultVault)
+	}
+	return v, doTx(ctx, func(tx *sql.Tx) error {
+		if err := t.checkAdminAction(tx, actor); err != nil {
+			return err
+		}
+		v, err = t.findVault(tx, vid)
+		if err != nil {
+			return err
+		}
+		if name == vid {
+			return nil
+		}
+		v.Id = name
+		v.UpdatedAt = time.Now().UTC()
+		_, err = v.dbInsert(tx)
+		if IsDuplicateErr(err) {
+			return util.NewErrorFrom(ErrAlreadyExists)
+		}
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		for _, table := range vaultChildTables {
+			_, err := tx.Exec(`UPDATE "`+table+`" SET "vault" = $1 WHERE "team" = $2 AND "vault" = $3`, name, t.Id, vid)
+			if isErrOrPanic(err) {
+				return util.NewErrorFrom(err)
+			}
+		}
+		if _, err := tx.Exec(`DELETE FROM "vault" WHERE "team" = $1 AND "id" = $2`, t.Id, vid); isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		return t.audit(tx, actor.Id, vid+" -> "+name, TEAM_AUDIT_VAULT_RENAME)
 	})
 }
 
@@ -162,7 +392,7 @@ func (t *Team) filterTeamUsers(tx *sql.Tx, uids ...string) ([]*teamUser, error)
 }
 
 func (t *Team) PromoteUser(ctx context.Context, promoter *User, promotee *User, signedVaultKeys VaultKeyPair) error {
-	return doTx(ctx, func(tx *sql.Tx) error {
+	return doRetryTx(ctx, func(tx *sql.Tx) error {
 		teamUsers, err := t.filterTeamUsers(tx, promoter.Id, promotee.Id)
 		if err != nil {
 			return err
@@ -170,6 +400,9 @@ func (t *Team) PromoteUser(ctx context.Context, promoter *User, promotee *User,
 		if !teamUsers[0].Admin {
 			return util.NewErrorFrom(ErrUnauthorized)
 		}
+		if err := t.touchAdminActivity(tx, teamUsers[0].User); err != nil {
+			return err
+		}
 		if teamUsers[1].Admin {
 			return nil
 		}
@@ -196,25 +429,127 @@ func (t *Team) PromoteUser(ctx context.Context, promoter *User, promotee *User,
 		}
 		ta := teamUsers[1]
 		ta.Admin = true
-		return ta.update(tx)
+		ta.ReadOnly = false
+		if err := ta.update(tx); err != nil {
+			return err
+		}
+		if err := t.audit(tx, promoter.Id, promotee.Id, TEAM_AUDIT_PROMOTE); err != nil {
+			return err
+		}
+		return t.touchAdminActivity(tx, promotee.Id)
 	})
 }
 
-func (t *Team) AddOrInviteUserByEmail(ctx context.Context, admin *User, newcomerEmail string) (i *Invite, err error) {
-	return i, doTx(ctx, func(tx *sql.Tx) error {
-		nu, err := findUserByEmail(tx, newcomerEmail)
+// AddOrInviteUserByEmail adds the user to the team if it already exists or invites it otherwise. If the user exists
+// vaultKeys must contain the keys for every vault shared with all members of the team
+func (t *Team) AddOrInviteUserByEmail(ctx context.Context, admin *User, newcomerEmail string, vaultKeys map[string][]byte) (i *Invite, err error) {
+	return i, doRetryTx(ctx, func(tx *sql.Tx) error {
+		if err := t.checkAdminAction(tx, admin); err != nil {
+			return err
+		}
+		if err := t.recordInvite(tx); err != nil {
+			return err
+		}
+		nu, err := findUserByAnyEmail(tx, newcomerEmail)
 		switch {
 		case util.CheckErr(err, ErrDoesntExist):
 			i, err = t.generateInvite(tx, admin, newcomerEmail)
-			return err
+			if err != nil {
+				return err
+			}
+			return t.audit(tx, admin.Id, newcomerEmail, TEAM_AUDIT_INVITE)
 		case err != nil:
 			return err
 		default:
-			return t.addUser(tx, admin, nu)
+			if err := t.addUser(tx, admin, nu); err != nil {
+				return err
+			}
+			if err := t.addAllMembersKeys(tx, nu, vaultKeys); err != nil {
+				return err
+			}
+			return t.audit(tx, admin.Id, nu.Id, TEAM_AUDIT_USER_ADD)
+		}
+	})
+}
+
+// GrantAllMembersAccess gives a user that joined through an invitation access to the vaults shared with all members
+func (t *Team) GrantAllMembersAccess(ctx context.Context, admin *User, u *User, vaultKeys map[string][]byte) error {
+	return doRetryTx(ctx, func(tx *sql.Tx) error {
+		if err := t.checkAdminAction(tx, admin); err != nil {
+			return err
+		}
+		tu, err := t.getUserAffiliation(tx, u.Id)
+		if err != nil {
+			return err
+		}
+		if tu == nil {
+			return util.NewErrorFrom(ErrNotInTeam)
 		}
+		if err := t.addAllMembersKeys(tx, u, vaultKeys); err != nil {
+			return err
+		}
+		tu.AccessRequired = false
+		return tu.update(tx)
 	})
 }
 
+func (t *Team) addAllMembersKeys(tx *sql.Tx, u *User, vaultKeys map[string][]byte) error {
+	vs, err := t.getAllMembersVaultsMissingForUser(tx, u)
+	if err != nil {
+		return err
+	}
+	for _, v := range vs {
+		key, ok := vaultKeys[v.Id]
+		if !ok {
+			return util.NewErrorFrom(ErrMissingAllMembersKeys)
+		}
+		if _, err := verifyAndUnpack(v.PublicKey, key); err != nil {
+			return err
+		}
+		if err := v.addUser(tx, u.Id, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AcceptInvitation joins an existing account to the team if the invitation was sent to any of its verified emails
+func (t *Team) AcceptInvitation(ctx context.Context, u *User, token string) error {
+	return doRetryTx(ctx, func(tx *sql.Tx) error {
+		i, err := findInviteByToken(tx, token)
+		if err != nil {
+			return err
+		}
+		if i.Team != t.Id {
+			return util.NewErrorFrom(ErrDoesntExist)
+		}
+		if verified, err := u.hasVerifiedEmail(tx, i.Email); err != nil {
+			return err
+		} else if !verified {
+			return util.NewErrorFrom(ErrInviteEmailMismatch)
+		}
+		if err := t.joinFromInvite(tx, u); err != nil {
+			return err
+		}
+		return treatUpdateErr(i.dbDelete(tx))
+	})
+}
+
+func (t *Team) joinFromInvite(tx *sql.Tx, u *User) error {
+	if err := t.addUserNoAdminCheck(tx, u); err != nil {
+		return err
+	}
+	vs, err := t.getAllMembersVaultsMissingForUser(tx, u)
+	if err != nil {
+		return err
+	}
+	if len(vs) == 0 {
+		return nil
+	}
+	tu := &teamUser{t.Id, u.Id, false, true, false}
+	return tu.update(tx)
+}
+
 func (t *Team) getUserAffiliation(tx *sql.Tx, username string) (*teamUser, error) {
 	tu := &teamUser{Team: t.Id, User: username}
 	err := tu.dbFind(tx)
@@ -232,15 +567,105 @@ func (t *Team) generateInvite(tx *sql.Tx, admin *User, email string) (*Invite, e
 	if !reValidEmail.MatchString(email) {
 		return nil, util.NewErrorFrom(ErrInvalidEmail)
 	}
-	if err := t.checkAdmin(tx, admin); err != nil {
+	if err := t.checkAdminAction(tx, admin); err != nil {
 		return nil, err
 	}
-	i := &Invite{Team: t.Id, Email: email}
+	// Expired invitations don't block inviting the email again
+	if _, err := tx.Exec(`DELETE FROM "invite" WHERE "team" = $1 AND "email" = $2 AND "created_at" < $3`, t.Id, email, inviteCutoff()); isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	i := &Invite{Team: t.Id, Email: email, InvitedBy: admin.Id}
 	return i, i.insert(tx)
 }
 
+// GetPendingInvites returns the invitations that have not been accepted, revoked or expired, oldest first. Only
+// admins can see them
+func (t *Team) GetPendingInvites(ctx context.Context, actor *User) (pending []*PendingInvite, err error) {
+	return pending, doTx(ctx, func(tx *sql.Tx) error {
+		if err := t.checkAdmin(tx, actor); err != nil {
+			return err
+		}
+		invites, err := t.getInvites(tx)
+		if err != nil {
+			return err
+		}
+		sort.Slice(invites, func(i, j int) bool { return invites[i].CreatedAt.Before(invites[j].CreatedAt) })
+		pending = make([]*PendingInvite, len(invites))
+		for i, inv := range invites {
+			pending[i] = &PendingInvite{inv, inv.expiresAt()}
+		}
+		return nil
+	})
+}
+
+// RevokeInvite cancels a pending invitation so it cannot be accepted anymore. Only admins can do it
+func (t *Team) RevokeInvite(ctx context.Context, actor *User, email string) error {
+	return doTx(ctx, func(tx *sql.Tx) error {
+		if err := t.checkAdminAction(tx, actor); err != nil {
+			return err
+		}
+		i := &Invite{Team: t.Id, Email: email}
+		if err := treatUpdateErr(i.dbDelete(tx)); err != nil {
+			return err
+		}
+		return t.audit(tx, actor.Id, email, TEAM_AUDIT_INVITE_REVOKE)
+	})
+}
+
+// ClassifyEmails tells what would happen to each email if it were invited to the team without changing anything
+func (t *Team) ClassifyEmails(ctx context.Context, admin *User, emails []string) (status map[string]string, err error) {
+	for _, email := range emails {
+		if !reValidEmail.MatchString(email) {
+			return nil, util.NewErrorFrom(ErrInvalidEmail)
+		}
+	}
+	status = make(map[string]string, len(emails))
+	return status, doTx(ctx, func(tx *sql.Tx) error {
+		if err := t.checkAdmin(tx, admin); err != nil {
+			return err
+		}
+		for _, email := range emails {
+			st, err := t.classifyEmail(tx, email)
+			if err != nil {
+				return err
+			}
+			status[email] = st
+		}
+		return nil
+	})
+}
+
+func (t *Team) classifyEmail(tx *sql.Tx, email string) (string, error) {
+	u, err := findUserByAnyEmail(tx, email)
+	switch {
+	case err == nil:
+		tu, err := t.getUserAffiliation(tx, u.Id)
+		if err != nil {
+			return "", err
+		}
+		if tu != nil {
+			return EMAIL_STATUS_ALREADY_IN_TEAM, nil
+		}
+		return EMAIL_STATUS_EXISTING_USER, nil
+	case !util.CheckErr(err, ErrDoesntExist):
+		return "", err
+	}
+	i := &Invite{Team: t.Id, Email: email}
+	err = i.dbFind(tx)
+	if isNotExistsErr(err) {
+		return EMAIL_STATUS_NEW, nil
+	}
+	if isErrOrPanic(err) {
+		return "", util.NewErrorFrom(err)
+	}
+	if i.expired() {
+		return EMAIL_STATUS_NEW, nil
+	}
+	return EMAIL_STATUS_ALREADY_INVITED, nil
+}
+
 func (t *Team) getInvites(tx *sql.Tx) ([]*Invite, error) {
-	rows, err := tx.Query(`SELECT `+selectInviteFields+` FROM "invite" WHERE "invite"."team" = $1`, t.Id)
+	rows, err := tx.Query(`SELECT `+selectInviteFields+` FROM "invite" WHERE "invite"."team" = $1 AND "invite"."created_at" >= $2`, t.Id, inviteCutoff())
 	if isErrOrPanic(err) {
 		return nil, util.NewErrorFrom(err)
 	}
@@ -272,14 +697,23 @@ func (t *Team) checkAdmin(tx *sql.Tx, u *User) error {
 	}
 	if tu == nil {
 		return util.NewErrorFrom(ErrNotInTeam)
-	} else if !tu.Admin {
+	} else if tu.role() != TEAM_ROLE_ADMIN {
 		return util.NewErrorFrom(ErrUnauthorized)
 	}
 	return nil
 }
 
+// checkAdminAction checks the user is an admin like checkAdmin and records the admin activity. Only calls that change
+// the team use it so reading does not keep an admin from being demoted for inactivity
+func (t *Team) checkAdminAction(tx *sql.Tx, u *User) error {
+	if err := t.checkAdmin(tx, u); err != nil {
+		return err
+	}
+	return t.touchAdminActivity(tx, u.Id)
+}
+
 func (t *Team) addUser(tx *sql.Tx, admin *User, newUser *User) error {
-	if err := t.checkAdmin(tx, admin); err != nil {
+	if err := t.checkAdminAction(tx, admin); err != nil {
 		return err
 	}
 	return t.addUserNoAdminCheck(tx, newUser)
@@ -293,7 +727,7 @@ func (t *Team) addUserNoAdminCheck(tx *sql.Tx, newUser *User) error {
 	if tu != nil {
 		return util.NewErrorFrom(ErrAlreadyInTeam)
 	}
-	tu = &teamUser{t.Id, newUser.Id, false, false}
+	tu = &teamUser{t.Id, newUser.Id, false, false, false}
 	return tu.insert(tx)
 }
 
@@ -301,7 +735,7 @@ func (t *Team) DemoteUser(ctx context.Context, demoter *User, demotee *User) err
 	if t.Owner == demotee.Id {
 		return util.NewErrorFrom(ErrUnauthorized)
 	}
-	return doTx(ctx, func(tx *sql.Tx) error {
+	return doRetryTx(ctx, func(tx *sql.Tx) error {
 		teamUsers, err := t.filterTeamUsers(tx, demoter.Id, demotee.Id)
 		if err != nil {
 			return err
@@ -309,17 +743,56 @@ func (t *Team) DemoteUser(ctx context.Context, demoter *User, demotee *User) err
 		if !teamUsers[0].Admin {
 			return util.NewErrorFrom(ErrUnauthorized)
 		}
+		if err := t.touchAdminActivity(tx, teamUsers[0].User); err != nil {
+			return err
+		}
 		if !teamUsers[1].Admin {
 			return nil
 		}
 		ta := teamUsers[1]
 		ta.Admin = false
-		return ta.update(tx)
+		if err := ta.update(tx); err != nil {
+			return err
+		}
+		return t.audit(tx, demoter.Id, demotee.Id, TEAM_AUDIT_DEMOTE)
+	})
+}
+
+// TransferOwnership hands the team over to another admin. The previous owner remains in the team as an admin.
+func (t *Team) TransferOwnership(ctx context.Context, currentOwner *User, newOwner *User) error {
+	return doRetryTx(ctx, func(tx *sql.Tx) error {
+		ct := &Team{Id: t.Id}
+		err := ct.dbFind(tx)
+		if isNotExistsErr(err) {
+			return util.NewErrorFrom(ErrDoesntExist)
+		}
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		if ct.Owner != currentOwner.Id {
+			return util.NewErrorFrom(ErrUnauthorized)
+		}
+		tu, err := t.getUserAffiliation(tx, newOwner.Id)
+		if err != nil {
+			return err
+		}
+		if tu == nil || !tu.Admin {
+			return util.NewErrorFrom(ErrNotTeamAdmin)
+		}
+		ct.Owner = newOwner.Id
+		if err := ct.update(tx); err != nil {
+			return err
+		}
+		if err := ct.audit(tx, currentOwner.Id, newOwner.Id, TEAM_AUDIT_OWNER_TRANSFER); err != nil {
+			return err
+		}
+		*t = *ct
+		return nil
 	})
 }
 
 func (t *Team) GetSecretsForUser(ctx context.Context, u *User) (s []*Secret, err error) {
-	return s, doTx(ctx, func(tx *sql.Tx) error {
+	return s, doReadTx(ctx, func(tx *sql.Tx) error {
 		s, err = t.getSecretsForUser(tx, u)
 		return err
 	})
@@ -327,14 +800,14 @@ func (t *Team) GetSecretsForUser(ctx context.Context, u *User) (s []*Secret, err
 
 func (t *Team) getSecretsForUser(tx *sql.Tx, u *User) (s []*Secret, err error) {
 	query := `
-	SELECT DISTINCT ON ("secret"."team", "secret"."vault", "secret"."id")
-		"secret"."team", "secret"."vault", "secret"."id", "secret"."version", "secret"."data", "secret"."vault_version", "secret"."created_at"  
-	FROM "secret", "vault_user" 
+	SELECT DISTINCT ON ("secret"."team", "secret"."vault", "secret"."id") ` + selectSecretFullFields + `
+	FROM "secret", "vault_user", "vault"
 	WHERE 
 		"secret"."team" = $1 AND 
 		"secret"."team" = "vault_user"."team" AND 
 		"secret"."vault" = "vault_user"."vault" AND 
-		"vault_user"."user" = $2
+		"vault_user"."user" = $2 AND
+		"vault"."team" = "secret"."team" AND "vault"."id" = "secret"."vault" AND "vault"."deleted_at" IS NULL
 	ORDER BY "secret"."team", "secret"."vault", "secret"."id", "secret"."version" DESC`
 	rows, err := tx.Query(query, t.Id, u.Id)
 	if isErrOrPanic(err) {
@@ -349,7 +822,7 @@ func (t *Team) getSecretsForUser(tx *sql.Tx, u *User) (s []*Secret, err error) {
 
 func (t *Team) GetVaultForUser(ctx context.Context, vid string, u *User) (*Vault, error) {
 	db := GetDB(ctx)
-	r := db.QueryRow(`SELECT `+selectVaultFullFields+` FROM "vault", "vault_user" WHERE "vault"."team" = $1 AND "vault"."id" = $2 AND "vault_user"."team" = "vault"."team" AND "vault_user"."user" = $3 AND "vault_user"."vault" = "vault"."id"`, t.Id, vid, u.Id)
+	r := db.QueryRow(`SELECT `+selectVaultFullFields+` FROM "vault", "vault_user" WHERE "vault"."team" = $1 AND "vault"."id" = $2 AND "vault"."deleted_at" IS NULL AND "vault_user"."team" = "vault"."team" AND "vault_user"."user" = $3 AND "vault_user"."vault" = "vault"."id"`, t.Id, vid, u.Id)
 	v := &Vault{}
 	err := v.dbScanRow(r)
 	if isNotExistsErr(err) {
@@ -361,15 +834,66 @@ func (t *Team) GetVaultForUser(ctx context.Context, vid string, u *User) (*Vault
 	return v, nil
 }
 
+// getVaultWithMember returns ErrVaultNotFound if the vault is not in the team and ErrUnauthorized if the user
+// is not a member of it
+func (t *Team) getVaultWithMember(tx *sql.Tx, vid string, u *User) (*Vault, error) {
+	v, err := t.findVault(tx, vid)
+	if err != nil {
+		return nil, err
+	}
+	var members int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM "vault_user" WHERE "team" = $1 AND "vault" = $2 AND "user" = $3`, t.Id, vid, u.Id).Scan(&members)
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	if members == 0 {
+		return nil, util.NewErrorFrom(ErrUnauthorized)
+	}
+	return v, nil
+}
+
 func (t *Team) GetVaultsForUser(ctx context.Context, u *User) (vs []*Vault, err error) {
-	return vs, doTx(ctx, func(tx *sql.Tx) error {
-		vs, err = t.getVaultsForUser(tx, u)
+	vs, _, err = t.GetVaultsForUserPaged(ctx, u, 0, PAGE_LENGTH_ALL)
+	return vs, err
+}
+
+// GetVaultsForUserPaged returns a page of the vaults of the team the user is a member of and how many there are
+// in total. Vaults are sorted by creation time so pages don't overlap
+func (t *Team) GetVaultsForUserPaged(ctx context.Context, u *User, offset, limit int) (vs []*Vault, total int, err error) {
+	if err := checkPage(offset, limit); err != nil {
+		return nil, 0, err
+	}
+	return vs, total, doReadTx(ctx, func(tx *sql.Tx) error {
+		vs, total, err = t.getVaultsForUserPaged(tx, u, offset, limit)
 		return err
 	})
 }
 
 func (t *Team) getVaultsForUser(tx *sql.Tx, u *User) ([]*Vault, error) {
-	rows, err := tx.Query(`SELECT `+selectVaultFullFields+` FROM "vault", "vault_user" WHERE  "vault"."team" = $1 AND "vault"."team" = "vault_user"."team" AND "vault"."id" = "vault_user"."vault" AND "vault_user"."user" = $2`, t.Id, u.Id)
+	vaults, _, err := t.getVaultsForUserPaged(tx, u, 0, PAGE_LENGTH_ALL)
+	return vaults, err
+}
+
+func (t *Team) getVaultsForUserPaged(tx *sql.Tx, u *User, offset, limit int) ([]*Vault, int, error) {
+	total := 0
+	r := tx.QueryRow(`SELECT COUNT(*) FROM "vault", "vault_user" WHERE "vault"."team" = $1 AND "vault"."deleted_at" IS NULL AND "vault"."team" = "vault_user"."team" AND "vault"."id" = "vault_user"."vault" AND "vault_user"."user" = $2`, t.Id, u.Id)
+	if err := r.Scan(&total); isErrOrPanic(err) {
+		return nil, 0, util.NewErrorFrom(err)
+	}
+	rows, err := tx.Query(`SELECT `+selectVaultFullFields+` FROM "vault", "vault_user" WHERE  "vault"."team" = $1 AND "vault"."deleted_at" IS NULL AND "vault"."team" = "vault_user"."team" AND "vault"."id" = "vault_user"."vault" AND "vault_user"."user" = $2 ORDER BY "vault"."created_at", "vault"."id" OFFSET $3 LIMIT $4`, t.Id, u.Id, offset, limit)
+	if isErrOrPanic(err) {
+		return nil, 0, util.NewErrorFrom(err)
+	}
+	vaults, err := scanVaults(rows)
+	if isErrOrPanic(err) {
+		return nil, 0, util.NewErrorFrom(err)
+	}
+	return vaults, total, nil
+}
+
+// getAllVaultsForUser returns the vaults the user has keys for including the deleted ones that can still be restored
+func (t *Team) getAllVaultsForUser(tx *sql.Tx, u *User) ([]*Vault, error) {
+	rows, err := tx.Query(`SELECT `+selectVaultFullFields+` FROM "vault", "vault_user" WHERE "vault"."team" = $1 AND "vault"."team" = "vault_user"."team" AND "vault"."id" = "vault_user"."vault" AND "vault_user"."user" = $2`, t.Id, u.Id)
 	if isErrOrPanic(err) {
 		return nil, util.NewErrorFrom(err)
 	}
@@ -381,7 +905,196 @@ func (t *Team) getVaultsForUser(tx *sql.Tx, u *User) ([]*Vault, error) {
 }
 
 func (t *Team) getVaultsMissingForUser(tx *sql.Tx, u *User) ([]*Vault, error) {
-	cmd := `SELECT ` + selectVaultFullFields + ` FROM "vault" WHERE "vault"."team" = $1 AND "vault"."id" NOT IN ( SELECT "vault"."id" FROM "vault", "vault_user" WHERE "vault"."team" = $1 AND "vault"."team" = "vault_user"."team" AND "vault"."id" = "vault_user"."vault" AND "vault_user"."user" = $2)`
+	cmd := `SELECT ` + selectVaultFullFields + ` FROM "vault" WHERE "vault"."team" = $1 AND "vault"."deleted_at" IS NULL AND "vault"."id" NOT IN ( SELECT "vault"."id" FROM "vault", "vault_user" WHERE "vault"."team" = $1 AND "vault"."team" = "vault_user"."team" AND "vault"."id" = "vault_user"."vault" AND "vault_user"."user" = $2)`
+	rows, err := tx.Query(cmd, t.Id, u.Id)
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	vaults, err := scanVaults(rows)
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	return vaults, nil
+}
+
+// BeginRemoveUser revokes the access of the target user to all vaults in the team, deleted ones included. The vaults
+// that the user could read are returned and must be re-keyed with FinalizeRemoveUser before the removal is complete.
+// Deleted vaults stay flagged for re-keying until they are restored and re-keyed
+func (t *Team) BeginRemoveUser(ctx context.Context, remover *User, removee *User) (vs []*Vault, err error) {
+	if t.Owner == removee.Id {
+		return nil, util.NewErrorFrom(ErrUnauthorized)
+	}
+	return vs, doRetryTx(ctx, func(tx *sql.Tx) error {
+		teamUsers, err := t.filterTeamUsers(tx, remover.Id, removee.Id)
+		if err != nil {
+			return err
+		}
+		if !teamUsers[0].Admin {
+			return util.NewErrorFrom(ErrUnauthorized)
+		}
+		if err := t.touchAdminActivity(tx, teamUsers[0].User); err != nil {
+			return err
+		}
+		all, err := t.getAllVaultsForUser(tx, removee)
+		if err != nil {
+			return err
+		}
+		vs = []*Vault{}
+		for _, v := range all {
+			if err := v.removeUser(tx, removee.Id); err != nil {
+				return err
+			}
+			vr := &vaultRekey{Team: t.Id, Vault: v.Id, User: removee.Id}
+			if err := vr.insert(tx); err != nil {
+				return err
+			}
+			if !v.DeletedAt.Valid {
+				vs = append(vs, v)
+			}
+		}
+		ta := teamUsers[1]
+		ta.Admin = false
+		if err := ta.update(tx); err != nil {
+			return err
+		}
+		return t.audit(tx, remover.Id, removee.Id, TEAM_AUDIT_USER_REMOVE_BEGIN)
+	})
+}
+
+// RemoveUser removes the target user from the team and deletes every vault key the user had. The vaults the user
+// could read are still flagged for re-keying so admins can rotate them with FinalizeRemoveUser.
+func (t *Team) RemoveUser(ctx context.Context, actor *User, target *User) error {
+	if t.Owner == target.Id {
+		return util.NewErrorFrom(ErrCannotRemoveOwner)
+	}
+	return doRetryTx(ctx, func(tx *sql.Tx) error {
+		teamUsers, err := t.filterTeamUsers(tx, actor.Id, target.Id)
+		if err != nil {
+			return err
+		}
+		if !teamUsers[0].Admin {
+			return util.NewErrorFrom(ErrUnauthorized)
+		}
+		if err := t.touchAdminActivity(tx, teamUsers[0].User); err != nil {
+			return err
+		}
+		if err := t.removeUser(tx, teamUsers[1]); err != nil {
+			return err
+		}
+		return t.audit(tx, actor.Id, target.Id, TEAM_AUDIT_USER_REMOVE)
+	})
+}
+
+// Leave removes the user from the team. The owner has to transfer the ownership before leaving. The vaults
+// the user could read are flagged for re-keying the same way as when an admin removes a member.
+func (t *Team) Leave(ctx context.Context, u *User) error {
+	if t.Owner == u.Id {
+		return util.NewErrorFrom(ErrOwnerCannotLeave)
+	}
+	return doRetryTx(ctx, func(tx *sql.Tx) error {
+		tu, err := t.getUserAffiliation(tx, u.Id)
+		if err != nil {
+			return err
+		}
+		if tu == nil {
+			return util.NewErrorFrom(ErrNotInTeam)
+		}
+		if err := t.removeUser(tx, tu); err != nil {
+			return err
+		}
+		return t.audit(tx, u.Id, u.Id, TEAM_AUDIT_LEAVE)
+	})
+}
+
+// removeUser deletes the membership and vault keys of the user and flags the vaults it could read for re-keying,
+// deleted ones included so they cannot be restored with a key the user still knows
+func (t *Team) removeUser(tx *sql.Tx, tu *teamUser) error {
+	vs, err := t.getAllVaultsForUser(tx, &User{Id: tu.User})
+	if err != nil {
+		return err
+	}
+	for _, v := range vs {
+		vr := &vaultRekey{Team: t.Id, Vault: v.Id, User: tu.User}
+		if err := vr.insert(tx); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`DELETE FROM "vault_user" WHERE "team" = $1 AND "user" = $2`, t.Id, tu.User)
+	if isErrOrPanic(err) {
+		return util.NewErrorFrom(err)
+	}
+	return treatUpdateErr(tu.dbDelete(tx))
+}
+
+// FinalizeRemoveUser receives the new keys for every vault returned by BeginRemoveUser and removes the user from the team.
+// It fails with ErrRemovalNotStarted if the user can still read any vault of the team
+func (t *Team) FinalizeRemoveUser(ctx context.Context, remover *User, removee *User, rewraps map[string]VaultRewrap) error {
+	if t.Owner == removee.Id {
+		return util.NewErrorFrom(ErrCannotRemoveOwner)
+	}
+	return doRetryTx(ctx, func(tx *sql.Tx) error {
+		if err := t.checkAdminAction(tx, remover); err != nil {
+			return err
+		}
+		var keys int
+		err := tx.QueryRow(`SELECT COUNT(*) FROM "vault_user" WHERE "team" = $1 AND "user" = $2`, t.Id, removee.Id).Scan(&keys)
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		if keys > 0 {
+			return util.NewErrorFrom(ErrRemovalNotStarted)
+		}
+		pending, err := findVaultRekeysForUser(tx, t.Id, removee.Id)
+		if err != nil {
+			return err
+		}
+		// Deleted vaults cannot be read so they keep the flag until they are restored and re-keyed
+		live := []*Vault{}
+		for _, vr := range pending {
+			v := &Vault{Id: vr.Vault, Team: t.Id}
+			err = v.dbFind(tx)
+			if isNotExistsErr(err) {
+				return util.NewErrorFrom(ErrDoesntExist)
+			}
+			if isErrOrPanic(err) {
+				return util.NewErrorFrom(err)
+			}
+			if !v.DeletedAt.Valid {
+				live = append(live, v)
+			}
+		}
+		if len(live) != len(rewraps) {
+			return util.NewErrorFrom(ErrInvalidKeys)
+		}
+		for _, v := range live {
+			rw, ok := rewraps[v.Id]
+			if !ok {
+				return util.NewErrorFrom(ErrInvalidKeys)
+			}
+			vaultKeys, err := rw.Keys.verifyAndUnpack(remover.PublicKey)
+			if err != nil {
+				return err
+			}
+			if err := v.rekey(tx, remover.Id, vaultKeys, rw.Secrets); err != nil {
+				return err
+			}
+		}
+		tu, err := t.getUserAffiliation(tx, removee.Id)
+		if err != nil {
+			return err
+		}
+		if tu == nil {
+			return nil
+		}
+		if err := treatUpdateErr(tu.dbDelete(tx)); err != nil {
+			return err
+		}
+		return t.audit(tx, remover.Id, removee.Id, TEAM_AUDIT_USER_REMOVE)
+	})
+}
+
+func (t *Team) getAllMembersVaultsMissingForUser(tx *sql.Tx, u *User) ([]*Vault, error) {
+	cmd := `SELECT ` + selectVaultFullFields + ` FROM "vault" WHERE "vault"."team" = $1 AND "vault"."all_members" = true AND "vault"."deleted_at" IS NULL AND "vault"."id" NOT IN ( SELECT "vault_user"."vault" FROM "vault_user" WHERE "vault_user"."team" = $1 AND "vault_user"."user" = $2)`
 	rows, err := tx.Query(cmd, t.Id, u.Id)
 	if isErrOrPanic(err) {
 		return nil, util.NewErrorFrom(err)
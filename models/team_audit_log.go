@@ -0,0 +1,93 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+const (
+	TEAM_AUDIT_INVITE           = "invite"
+	TEAM_AUDIT_INVITE_REVOKE    = "invite_revoke"
+	TEAM_AUDIT_USER_ADD         = "user_add"
+	TEAM_AUDIT_USER_REMOVE      = "user_remove"
+	TEAM_AUDIT_LEAVE            = "leave"
+	TEAM_AUDIT_PROMOTE          = "promote"
+	TEAM_AUDIT_DEMOTE           = "demote"
+	TEAM_AUDIT_ROLE_CHANGE      = "role_change"
+	TEAM_AUDIT_VAULT_CREATE     = "vault_create"
+	TEAM_AUDIT_VAULT_DELETE     = "vault_delete"
+	TEAM_AUDIT_VAULT_KEY_ROTATE = "vault_key_rotate"
+	TEAM_AUDIT_POLICY_CHANGE    = "policy_change"
+	TEAM_AUDIT_OWNER_TRANSFER   = "owner_transfer"
+	TEAM_AUDIT_ACCOUNT_DELETE   = "account_delete"
+	TEAM_AUDIT_RENAME           = "rename"
+	TEAM_AUDIT_VAULT_RENAME     = "vault_rename"
+	TEAM_AUDIT_VAULT_RESTORE    = "vault_restore"
+	TEAM_AUDIT_VAULT_PURGE      = "vault_purge"
+	TEAM_AUDIT_VAULT_QUOTA      = "vault_quota"
+	TEAM_AUDIT_SECRET_SHARE     = "secret_share"
+	TEAM_AUDIT_USER_SUSPEND     = "user_suspend"
+	TEAM_AUDIT_USER_UNSUSPEND   = "user_unsuspend"
+	// Set and unset require a justification to read the secret
+	TEAM_AUDIT_SECRET_JUSTIFICATION_SET   = "secret_justification_set"
+	TEAM_AUDIT_SECRET_JUSTIFICATION_UNSET = "secret_justification_unset"
+	TEAM_AUDIT_SECRET_JUSTIFIED_READ      = "secret_justified_read"
+	// The member lost its vault keys and the vaults have to be re-keyed to finalize the removal
+	TEAM_AUDIT_USER_REMOVE_BEGIN = "user_remove_begin"
+)
+
+// Max number of entries returned by a single GetAuditLog call
+const TEAM_AUDIT_MAX_PAGE_LENGTH = 500
+
+// TeamAuditLog records a security relevant change in a team. Actor is empty for actions done by the server itself
+type TeamAuditLog struct {
+	Id        string    `scaneo:"pk" json:"id"`
+	Team      string    `json:"team"`
+	Actor     string    `json:"actor"`
+	Target    string    `json:"target"`
+	Action    string    `json:"action"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// audit stores a new entry in the team audit log. It must be called within the transaction that does the change
+func (t *Team) audit(tx *sql.Tx, actor, target, action string) error {
+	l := &TeamAuditLog{
+		Id:        util.GenerateRandomToken(16),
+		Team:      t.Id,
+		Actor:     actor,
+		Target:    target,
+		Action:    action,
+		CreatedAt: time.Now().UTC(),
+	}
+	_, err := l.dbInsert(tx)
+	if isErrOrPanic(err) {
+		return util.NewErrorFrom(err)
+	}
+	return nil
+}
+
+// GetAuditLog returns up to limit entries after the since and after cursor, oldest first. Entries are sorted by their
+// creation time and id so passing those of the last entry of a page as since and after returns the next page without
+// skipping entries created at the same time. Only admins can read the log
+func (t *Team) GetAuditLog(ctx context.Context, actor *User, since time.Time, after string, limit int) (logs []*TeamAuditLog, err error) {
+	if limit < 1 || limit > TEAM_AUDIT_MAX_PAGE_LENGTH {
+		limit = TEAM_AUDIT_MAX_PAGE_LENGTH
+	}
+	return logs, doTx(ctx, func(tx *sql.Tx) error {
+		if err := t.checkAdmin(tx, actor); err != nil {
+			return err
+		}
+		rows, err := tx.Query(`SELECT `+selectTeamAuditLogFields+` FROM "team_audit_log" WHERE "team" = $1 AND ("created_at" > $2 OR ("created_at" = $2 AND "id" > $3)) ORDER BY "created_at" ASC, "id" ASC LIMIT $4`, t.Id, since, after, limit)
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		logs, err = scanTeamAuditLogs(rows)
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,89 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+// Max emails accepted by a single BulkAddOrInvite call
+const BULK_INVITE_MAX = 100
+
+const (
+	EMAIL_STATUS_ADDED   = "added"
+	EMAIL_STATUS_INVITED = "invited"
+	EMAIL_STATUS_ERROR   = "error"
+)
+
+// BulkInviteResult is the outcome of adding or inviting a single email. Invite is set when an invitation was created
+type BulkInviteResult struct {
+	Email  string  `json:"email"`
+	Status string  `json:"status"`
+	Error  string  `json:"error,omitempty"`
+	Invite *Invite `json:"-"`
+}
+
+// BulkAddOrInvite adds the existing users and invites the rest of the emails. Emails are deduplicated ignoring case
+// and each one is processed on its own so a failure doesn't stop the rest. Existing users are added without keys,
+// so if the team has vaults shared with all members they have to be granted access like users that join through an
+// invitation
+func (t *Team) BulkAddOrInvite(ctx context.Context, admin *User, emails []string) ([]*BulkInviteResult, error) {
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, email := range emails {
+		email = strings.TrimSpace(email)
+		if key := strings.ToLower(email); len(email) > 0 && !seen[key] {
+			seen[key] = true
+			unique = append(unique, email)
+		}
+	}
+	if len(unique) > BULK_INVITE_MAX {
+		return nil, util.NewErrorFrom(ErrBatchTooLarge)
+	}
+	if err := doTx(ctx, func(tx *sql.Tx) error { return t.checkAdmin(tx, admin) }); err != nil {
+		return nil, err
+	}
+	results := make([]*BulkInviteResult, len(unique))
+	for i, email := range unique {
+		res := &BulkInviteResult{Email: email}
+		err := doTx(ctx, func(tx *sql.Tx) (err error) {
+			res.Status, res.Invite, err = t.addOrInvite(tx, admin, email)
+			return err
+		})
+		switch {
+		case util.CheckErr(err, ErrAlreadyInTeam):
+			res.Status = EMAIL_STATUS_ALREADY_IN_TEAM
+		case util.CheckErr(err, ErrAlreadyInvited):
+			res.Status = EMAIL_STATUS_ALREADY_INVITED
+		case err != nil:
+			res.Status = EMAIL_STATUS_ERROR
+			res.Error = err.Error()
+			res.Invite = nil
+		}
+		results[i] = res
+	}
+	return results, nil
+}
+
+func (t *Team) addOrInvite(tx *sql.Tx, admin *User, email string) (string, *Invite, error) {
+	if err := t.recordInvite(tx); err != nil {
+		return "", nil, err
+	}
+	nu, err := findUserByAnyEmail(tx, email)
+	switch {
+	case util.CheckErr(err, ErrDoesntExist):
+		i, err := t.generateInvite(tx, admin, email)
+		if err != nil {
+			return "", nil, err
+		}
+		return EMAIL_STATUS_INVITED, i, t.audit(tx, admin.Id, email, TEAM_AUDIT_INVITE)
+	case err != nil:
+		return "", nil, err
+	}
+	if err := t.joinFromInvite(tx, nu); err != nil {
+		return "", nil, err
+	}
+	return EMAIL_STATUS_ADDED, nil, t.audit(tx, admin.Id, nu.Id, TEAM_AUDIT_USER_ADD)
+}
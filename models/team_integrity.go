@@ -0,0 +1,96 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+const (
+	KEY_ISSUE_MISSING_KEY    = "missing_key"
+	KEY_ISSUE_NON_MEMBER_KEY = "non_member_key"
+)
+
+type KeyIntegrityIssue struct {
+	Vault   string `json:"vault"`
+	User    string `json:"user"`
+	Problem string `json:"problem"`
+}
+
+func FindAllTeams(ctx context.Context) (ts []*Team, err error) {
+	return ts, doTx(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT ` + selectTeamFields + ` FROM "team"`)
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		ts, err = scanTeams(rows)
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		return nil
+	})
+}
+
+func FindTeam(ctx context.Context, tid string) (t *Team, err error) {
+	t = &Team{Id: tid}
+	return t, doTx(ctx, func(tx *sql.Tx) error {
+		err := t.dbFind(tx)
+		if isNotExistsErr(err) {
+			return util.NewErrorFrom(ErrDoesntExist)
+		}
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		return nil
+	})
+}
+
+// VerifyKeyIntegrity reports vaults where an admin (or any member for vaults shared with all members) has no key
+// and keys that belong to users that are not in the team. It does not change anything.
+func (t *Team) VerifyKeyIntegrity(ctx context.Context) (issues []KeyIntegrityIssue, err error) {
+	return issues, doTx(ctx, func(tx *sql.Tx) error {
+		issues, err = t.verifyKeyIntegrity(tx)
+		return err
+	})
+}
+
+func (t *Team) verifyKeyIntegrity(tx *sql.Tx) ([]KeyIntegrityIssue, error) {
+	members, err := t.getUsersAfiliation(tx)
+	if err != nil {
+		return nil, err
+	}
+	memberById := make(map[string]*teamUser, len(members))
+	for _, tu := range members {
+		memberById[tu.User] = tu
+	}
+	rows, err := tx.Query(`SELECT `+selectVaultFields+` FROM "vault" WHERE "team" = $1`, t.Id)
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	vaults, err := scanVaults(rows)
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	issues := []KeyIntegrityIssue{}
+	for _, v := range vaults {
+		uids, err := v.getUserIds(tx)
+		if err != nil {
+			return nil, err
+		}
+		hasKey := make(map[string]bool, len(uids))
+		for _, uid := range uids {
+			hasKey[uid] = true
+			if _, ok := memberById[uid]; !ok {
+				issues = append(issues, KeyIntegrityIssue{v.Id, uid, KEY_ISSUE_NON_MEMBER_KEY})
+			}
+		}
+		for _, tu := range members {
+			required := tu.Admin || (v.AllMembers && !tu.AccessRequired)
+			if required && !hasKey[tu.User] {
+				issues = append(issues, KeyIntegrityIssue{v.Id, tu.User, KEY_ISSUE_MISSING_KEY})
+			}
+		}
+	}
+	return issues, nil
+}
@@ -0,0 +1,138 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+const (
+	TEAM_ROLE_OWNER  = "owner"
+	TEAM_ROLE_ADMIN  = "admin"
+	TEAM_ROLE_MEMBER = "member"
+	TEAM_ROLE_READER = "reader"
+)
+
+type TeamMembership struct {
+	Team
+	Role string `json:"role"`
+}
+
+func scanTeamMemberships(rs *sql.Rows, uid string) ([]TeamMembership, error) {
+	structs := make([]TeamMembership, 0, 16)
+	var err error
+	for rs.Next() {
+		var s TeamMembership
+		var admin, readOnly bool
+		if err = rs.Scan(
+			&s.Id,
+			&s.Name,
+			&s.Owner,
+			&s.Primary,
+			&s.Size,
+			&s.CreatedAt,
+			&s.UpdatedAt,
+			&admin,
+			&readOnly,
+		); err != nil {
+			return nil, err
+		}
+		switch {
+		case s.Owner == uid:
+			s.Role = TEAM_ROLE_OWNER
+		case admin:
+			s.Role = TEAM_ROLE_ADMIN
+		case readOnly:
+			s.Role = TEAM_ROLE_READER
+		default:
+			s.Role = TEAM_ROLE_MEMBER
+		}
+		structs = append(structs, s)
+	}
+	if err = rs.Err(); err != nil {
+		return nil, err
+	}
+	return structs, nil
+}
+
+// GetTeamsWithRole returns every team the user belongs to along with the role the user has in it
+func (u *User) GetTeamsWithRole(ctx context.Context) ([]TeamMembership, error) {
+	db := GetDB(ctx)
+	rows, err := db.Query(`SELECT `+selectTeamFullFields+`, "team_user"."admin", "team_user"."read_only" FROM "team" JOIN "team_user" ON "team_user"."team" = "team"."id" WHERE "team_user"."user" = $1`, u.Id)
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	teams, err := scanTeamMemberships(rows, u.Id)
+	isErrOrPanic(err)
+	return teams, util.NewErrorFrom(err)
+}
+
+func (tu *teamUser) role() string {
+	switch {
+	case tu.Admin:
+		return TEAM_ROLE_ADMIN
+	case tu.ReadOnly:
+		return TEAM_ROLE_READER
+	default:
+		return TEAM_ROLE_MEMBER
+	}
+}
+
+// SetUserRole changes the role of a team member. Readers can see the vaults they have access to but cannot
+// modify any secret in them. Promoting to admin requires the vault keys so it has to go through PromoteUser.
+func (t *Team) SetUserRole(ctx context.Context, actor *User, target *User, role string) error {
+	switch role {
+	case TEAM_ROLE_ADMIN, TEAM_ROLE_MEMBER, TEAM_ROLE_READER:
+	default:
+		return util.NewErrorFrom(ErrInvalidRole)
+	}
+	if t.Owner == target.Id {
+		return util.NewErrorFrom(ErrUnauthorized)
+	}
+	return doRetryTx(ctx, func(tx *sql.Tx) error {
+		teamUsers, err := t.filterTeamUsers(tx, actor.Id, target.Id)
+		if err != nil {
+			return err
+		}
+		if !teamUsers[0].Admin {
+			return util.NewErrorFrom(ErrUnauthorized)
+		}
+		if err := t.touchAdminActivity(tx, actor.Id); err != nil {
+			return err
+		}
+		tu := teamUsers[1]
+		if tu.role() == role {
+			return nil
+		}
+		if role == TEAM_ROLE_ADMIN {
+			return util.NewErrorFrom(ErrPromotionRequiresKeys)
+		}
+		tu.Admin = false
+		tu.ReadOnly = role == TEAM_ROLE_READER
+		if err := tu.update(tx); err != nil {
+			return err
+		}
+		return t.audit(tx, actor.Id, target.Id, TEAM_AUDIT_ROLE_CHANGE)
+	})
+}
+
+// CheckWriteAccess returns ErrUnauthorized if the user cannot modify secrets in the team vaults
+func (t *Team) CheckWriteAccess(ctx context.Context, u *User) error {
+	return doTx(ctx, func(tx *sql.Tx) error {
+		return t.checkWriteAccess(tx, u)
+	})
+}
+
+func (t *Team) checkWriteAccess(tx *sql.Tx, u *User) error {
+	tu, err := t.getUserAffiliation(tx, u.Id)
+	if err != nil {
+		return err
+	}
+	if tu == nil {
+		return util.NewErrorFrom(ErrNotInTeam)
+	} else if tu.role() == TEAM_ROLE_READER {
+		return util.NewErrorFrom(ErrUnauthorized)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+// TeamPolicy holds the session and security settings a team enforces on its members. They can only make the
+// instance settings stricter. Zero values inherit the instance setting. AuditReads records every read of the secrets
+// of the team
+type TeamPolicy struct {
+	Team                  string    `scaneo:"pk" json:"-"`
+	RequireTOTP           bool      `json:"require_totp"`
+	SessionCoolingMinutes int       `json:"session_cooling_minutes"`
+	SessionIdleMinutes    int       `json:"session_idle_minutes"`
+	AuditReads            bool      `json:"audit_reads"`
+	UpdatedAt             time.Time `json:"updated_at"`
+}
+
+func (p *TeamPolicy) validate() error {
+	errs := util.NewErrorFields().(*util.Error)
+	if p.SessionCoolingMinutes < 0 {
+		errs.SetFieldError("session_cooling_minutes", "invalid")
+	}
+	if p.SessionIdleMinutes < 0 {
+		errs.SetFieldError("session_idle_minutes", "invalid")
+	}
+	return errs.SetErrorOrCamo(ErrInvalidAttributes)
+}
+
+// GetPolicy returns the policy of the team. Teams without a policy get an empty one that inherits everything
+func (t *Team) GetPolicy(ctx context.Context) (p *TeamPolicy, err error) {
+	return p, doTx(ctx, func(tx *sql.Tx) error {
+		p, err = t.getPolicy(tx)
+		return err
+	})
+}
+
+func (t *Team) getPolicy(tx *sql.Tx) (*TeamPolicy, error) {
+	p := &TeamPolicy{Team: t.Id}
+	err := p.dbFind(tx)
+	switch {
+	case err == sql.ErrNoRows:
+		return &TeamPolicy{Team: t.Id}, nil
+	case isErrOrPanic(err):
+		return nil, util.NewErrorFrom(err)
+	}
+	return p, nil
+}
+
+// SetPolicy replaces the policy of the team. Only admins can change it and an admin can only require two factor
+// authentication after enabling it, so nobody locks themselves out of the team
+func (t *Team) SetPolicy(ctx context.Context, actor *User, p *TeamPolicy) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	return doTx(ctx, func(tx *sql.Tx) error {
+		if err := t.checkAdminAction(tx, actor); err != nil {
+			return err
+		}
+		if p.RequireTOTP {
+			if _, err := actor.findTOTP(tx); err != nil {
+				return err
+			}
+		}
+		p.Team = t.Id
+		p.UpdatedAt = time.Now().UTC()
+		res, err := p.dbUpdate(tx)
+		err = treatUpdateErr(res, err)
+		if util.CheckErr(err, ErrDoesntExist) {
+			_, err = p.dbInsert(tx)
+			if isErrOrPanic(err) {
+				return util.NewErrorFrom(err)
+			}
+		} else if err != nil {
+			return err
+		}
+		return t.audit(tx, actor.Id, t.Id, TEAM_AUDIT_POLICY_CHANGE)
+	})
+}
+
+// GetTeamPolicies returns the policies of every team the user belongs to that has one
+func (u *User) GetTeamPolicies(ctx context.Context) ([]*TeamPolicy, error) {
+	db := GetDB(ctx)
+	rows, err := db.Query(`SELECT `+selectTeamPolicyFullFields+` FROM "team_policy", "team_user" WHERE "team_policy"."team" = "team_user"."team" AND "team_user"."user" = $1`, u.Id)
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	policies, err := scanTeamPolicys(rows)
+	isErrOrPanic(err)
+	return policies, util.NewErrorFrom(err)
+}
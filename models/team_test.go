@@ -2,7 +2,9 @@ package models
 
 import (
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/keydotcat/keycatd/util"
 )
@@ -40,10 +42,124 @@ func TestCreateTeam(t *testing.T) {
 	}
 }
 
+func TestGetTeamsWithRole(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	member := getDummyUser()
+	if _, err := team.AddOrInviteUserByEmail(ctx, owner, member.Email, nil); err != nil {
+		t.Fatal(err)
+	}
+	roles := map[string]string{}
+	tms, err := member.GetTeamsWithRole(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tm := range tms {
+		roles[tm.Id] = tm.Role
+	}
+	if len(tms) != 2 || roles[team.Id] != TEAM_ROLE_MEMBER {
+		t.Fatalf("Expected to be a member of team %s and got %v", team.Id, roles)
+	}
+	vaultsFull, err := team.GetVaultsFullForUser(ctx, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = team.PromoteUser(ctx, owner, member, expandVaultKeysOnce(vaultsFull)); err != nil {
+		t.Fatal(err)
+	}
+	tms, err = member.GetTeamsWithRole(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tm := range tms {
+		roles[tm.Id] = tm.Role
+	}
+	if roles[team.Id] != TEAM_ROLE_ADMIN {
+		t.Fatalf("Expected to be an admin of team %s and got %s", team.Id, roles[team.Id])
+	}
+	for tid, role := range roles {
+		if tid != team.Id && role != TEAM_ROLE_OWNER {
+			t.Fatalf("Expected to own the primary team %s and got %s", tid, role)
+		}
+	}
+}
+
+func TestSetUserRole(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	reader := getDummyUser()
+	if _, err := team.AddOrInviteUserByEmail(ctx, owner, reader.Email, nil); err != nil {
+		t.Fatal(err)
+	}
+	vm := createVaultMock(owner, team)
+	if err := vm.v.AddUsers(ctx, map[string][]byte{reader.Id: sealVaultKey(vm.v, vm.priv)}); err != nil {
+		t.Fatal(err)
+	}
+	s := &Secret{Data: signAndPack(vm.priv, a32b)}
+	if err := vm.v.AddSecret(ctx, vm.owner, s); err != nil {
+		t.Fatal(err)
+	}
+	if err := team.SetUserRole(ctx, reader, owner, TEAM_ROLE_READER); !util.CheckErr(err, ErrUnauthorized) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrUnauthorized, err)
+	}
+	if err := team.SetUserRole(ctx, owner, reader, "superuser"); !util.CheckErr(err, ErrInvalidRole) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrInvalidRole, err)
+	}
+	if err := team.SetUserRole(ctx, owner, reader, TEAM_ROLE_ADMIN); !util.CheckErr(err, ErrPromotionRequiresKeys) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrPromotionRequiresKeys, err)
+	}
+	if err := team.SetUserRole(ctx, owner, reader, TEAM_ROLE_READER); err != nil {
+		t.Fatal(err)
+	}
+	if err := team.CheckWriteAccess(ctx, reader); !util.CheckErr(err, ErrUnauthorized) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrUnauthorized, err)
+	}
+	if err := team.CheckWriteAccess(ctx, owner); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.v.AddSecret(ctx, reader, &Secret{Data: signAndPack(vm.priv, a32b)}); !util.CheckErr(err, ErrUnauthorized) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrUnauthorized, err)
+	}
+	if err := vm.v.UpdateSecret(ctx, reader, &Secret{Id: s.Id, Data: signAndPack(vm.priv, a32b)}); !util.CheckErr(err, ErrUnauthorized) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrUnauthorized, err)
+	}
+	if err := vm.v.DeleteSecret(ctx, reader, s.Id); !util.CheckErr(err, ErrUnauthorized) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrUnauthorized, err)
+	}
+	secrets, err := team.GetSecretsForUser(ctx, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets) != 1 {
+		t.Fatalf("Expected reader to see 1 secret and got %d", len(secrets))
+	}
+	if isAdmin, err := team.CheckAdmin(ctx, reader); err != nil || isAdmin {
+		t.Fatalf("Reader should not be an admin: %v %s", isAdmin, err)
+	}
+	tms, err := reader.GetTeamsWithRole(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tm := range tms {
+		if tm.Id == team.Id && tm.Role != TEAM_ROLE_READER {
+			t.Fatalf("Expected to be a reader of team %s and got %s", team.Id, tm.Role)
+		}
+	}
+	if err := team.SetUserRole(ctx, owner, reader, TEAM_ROLE_MEMBER); err != nil {
+		t.Fatal(err)
+	}
+	if err := team.CheckWriteAccess(ctx, reader); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.v.UpdateSecret(ctx, reader, &Secret{Id: s.Id, Data: signAndPack(vm.priv, a32b)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestInviteUserToTeam(t *testing.T) {
 	ctx := getCtx()
 	owner, team := getDummyOwnerWithTeam()
-	i, err := team.AddOrInviteUserByEmail(ctx, owner, "a@a.com")
+	i, err := team.AddOrInviteUserByEmail(ctx, owner, "a@a.com", nil)
 	if err != nil {
 		fmt.Println(util.GetStack(err))
 		t.Fatal(err)
@@ -51,34 +167,277 @@ func TestInviteUserToTeam(t *testing.T) {
 	if i == nil {
 		t.Fatalf("Added user when it had to be invited")
 	}
-	i, err = team.AddOrInviteUserByEmail(ctx, owner, "a@a.com")
+	i, err = team.AddOrInviteUserByEmail(ctx, owner, "a@a.com", nil)
 	if !util.CheckErr(err, ErrAlreadyInvited) {
 		t.Fatalf("Expected error %s and got %s", ErrAlreadyInvited, err)
 	}
 }
 
+func TestInviteRateLimit(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	MAX_INVITES_PER_TEAM_PER_HOUR = 2
+	defer func() { MAX_INVITES_PER_TEAM_PER_HOUR = 0 }()
+	for i := 0; i < 2; i++ {
+		if _, err := team.AddOrInviteUserByEmail(ctx, owner, fmt.Sprintf("rate%d@a.com", i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := team.AddOrInviteUserByEmail(ctx, owner, "rate2@a.com", nil); !util.CheckErr(err, ErrInviteRateLimited) {
+		t.Fatalf("Expected error %s and got %s", ErrInviteRateLimited, err)
+	}
+	otherOwner, other := getDummyOwnerWithTeam()
+	if _, err := other.AddOrInviteUserByEmail(ctx, otherOwner, "rate2@a.com", nil); err != nil {
+		t.Fatalf("Limit should be per team: %s", err)
+	}
+	if _, err := mdb.Exec(`UPDATE "team_invite_log" SET "created_at" = $1 WHERE "team" = $2`, time.Now().UTC().Add(-2*time.Hour), team.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DeleteOldInviteLogs(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var left int
+	if err := mdb.QueryRow(`SELECT COUNT(*) FROM "team_invite_log" WHERE "team" = $1`, team.Id).Scan(&left); err != nil {
+		t.Fatal(err)
+	}
+	if left != 0 {
+		t.Fatalf("Expected the old invitation logs to be deleted and %d are left", left)
+	}
+	if _, err := team.AddOrInviteUserByEmail(ctx, owner, "rate2@a.com", nil); err != nil {
+		t.Fatalf("Old invitations should not count for the limit: %s", err)
+	}
+}
+
 func TestAddExistingUserToTeam(t *testing.T) {
 	ctx := getCtx()
 	owner, team := getDummyOwnerWithTeam()
 	invitee := getDummyUser()
-	i, err := team.AddOrInviteUserByEmail(ctx, owner, invitee.Email)
+	i, err := team.AddOrInviteUserByEmail(ctx, owner, invitee.Email, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 	if i != nil {
 		t.Fatalf("Added user when it had to be invited")
 	}
-	i, err = team.AddOrInviteUserByEmail(ctx, owner, invitee.Email)
+	i, err = team.AddOrInviteUserByEmail(ctx, owner, invitee.Email, nil)
 	if !util.CheckErr(err, ErrAlreadyInTeam) {
 		t.Fatalf("Expected error %s and got %s", ErrAlreadyInTeam, err)
 	}
 }
 
+func TestAddExistingUserBySecondaryEmail(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	invitee := getConfirmedDummyUser()
+	email := "e_" + util.GenerateRandomToken(10) + "@nowhere.net"
+	tok, err := invitee.AddEmail(ctx, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := invitee.VerifyEmail(ctx, tok.Id); err != nil {
+		t.Fatal(err)
+	}
+	i, err := team.AddOrInviteUserByEmail(ctx, owner, email, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != nil {
+		t.Fatalf("Invited %s instead of adding the account that has it", email)
+	}
+	if _, err = invitee.GetTeam(ctx, team.Id); err != nil {
+		t.Fatalf("Expected the invitee to be in the team: %s", err)
+	}
+}
+
+func TestBulkAddOrInvite(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	existing := getDummyUser()
+	member := getDummyUser()
+	if _, err := team.AddOrInviteUserByEmail(ctx, owner, member.Email, nil); err != nil {
+		t.Fatal(err)
+	}
+	invited := "bulk-" + util.GenerateRandomToken(5) + "@a.com"
+	if _, err := team.AddOrInviteUserByEmail(ctx, owner, invited, nil); err != nil {
+		t.Fatal(err)
+	}
+	newcomer := "bulk-" + util.GenerateRandomToken(5) + "@a.com"
+	emails := []string{existing.Email, newcomer, strings.ToUpper(newcomer), member.Email, invited, "not an email"}
+	results, err := team.BulkAddOrInvite(ctx, owner, emails)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{EMAIL_STATUS_ADDED, EMAIL_STATUS_INVITED, EMAIL_STATUS_ALREADY_IN_TEAM, EMAIL_STATUS_ALREADY_INVITED, EMAIL_STATUS_ERROR}
+	if len(results) != len(expected) {
+		t.Fatalf("Expected %d results after removing the duplicate and got %d", len(expected), len(results))
+	}
+	for i, res := range results {
+		if res.Status != expected[i] {
+			t.Errorf("Expected %s for %s and got %s (%s)", expected[i], res.Email, res.Status, res.Error)
+		}
+	}
+	if results[1].Invite == nil || results[0].Invite != nil {
+		t.Fatalf("Only new emails should get an invitation")
+	}
+	st, err := team.ClassifyEmails(ctx, owner, []string{existing.Email})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st[existing.Email] != EMAIL_STATUS_ALREADY_IN_TEAM {
+		t.Fatalf("Existing user was not added to the team: %s", st[existing.Email])
+	}
+	tooMany := make([]string, BULK_INVITE_MAX+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("bulk%d@a.com", i)
+	}
+	if _, err := team.BulkAddOrInvite(ctx, owner, tooMany); !util.CheckErr(err, ErrBatchTooLarge) {
+		t.Fatalf("Expected error %s and got %v", ErrBatchTooLarge, err)
+	}
+	if _, err := team.BulkAddOrInvite(ctx, member, []string{newcomer}); !util.CheckErr(err, ErrUnauthorized) {
+		t.Fatalf("Expected error %s and got %v", ErrUnauthorized, err)
+	}
+}
+
+func TestAcceptInvitationWithExistingAccount(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	invitee := getDummyUser()
+	email := "i_" + util.GenerateRandomToken(10) + "@nowhere.net"
+	i, err := team.AddOrInviteUserByEmail(ctx, owner, email, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = team.AcceptInvitation(ctx, invitee, i.Token); !util.CheckErr(err, ErrInviteEmailMismatch) {
+		t.Fatalf("Expected error %s and got %s", ErrInviteEmailMismatch, err)
+	}
+	tok, err := invitee.ChangeEmail(ctx, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = team.AcceptInvitation(ctx, invitee, i.Token); !util.CheckErr(err, ErrInviteEmailMismatch) {
+		t.Fatalf("Expected unverified emails to be refused and got %s", err)
+	}
+	invitee, err = tok.ConfirmEmail(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = team.AcceptInvitation(ctx, invitee, "nope"); !util.CheckErr(err, ErrDoesntExist) {
+		t.Fatalf("Expected error %s and got %s", ErrDoesntExist, err)
+	}
+	if err = team.AcceptInvitation(ctx, invitee, i.Token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = FindInviteByToken(ctx, i.Token); !util.CheckErr(err, ErrDoesntExist) {
+		t.Fatalf("Expected the invite to be consumed and got %s", err)
+	}
+	if _, err = invitee.GetTeam(ctx, team.Id); err != nil {
+		t.Fatalf("Expected the invitee to be in the team: %s", err)
+	}
+}
+
+func TestPendingInvites(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	invitee := getDummyUser()
+	email := "i_" + util.GenerateRandomToken(10) + "@nowhere.net"
+	i, err := team.AddOrInviteUserByEmail(ctx, owner, email, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	isPending := func() bool {
+		pending, err := team.GetPendingInvites(ctx, owner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range pending {
+			if p.Email == email {
+				if p.InvitedBy != owner.Id || p.ExpiresAt == nil || !p.ExpiresAt.Equal(p.CreatedAt.Add(INVITE_TTL)) {
+					t.Fatalf("Unexpected pending invite %+v", p)
+				}
+				return true
+			}
+		}
+		return false
+	}
+	if !isPending() {
+		t.Fatalf("Expected %s to be pending", email)
+	}
+	tok, err := invitee.ChangeEmail(ctx, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invitee, err = tok.ConfirmEmail(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err = team.AcceptInvitation(ctx, invitee, i.Token); err != nil {
+		t.Fatal(err)
+	}
+	if isPending() {
+		t.Fatalf("Accepted invite for %s is still pending", email)
+	}
+	if _, err := team.GetPendingInvites(ctx, invitee); !util.CheckErr(err, ErrUnauthorized) {
+		t.Fatalf("Expected error %s and got %s", ErrUnauthorized, err)
+	}
+}
+
+func TestAcceptExpiredInvitation(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	invitee := getDummyUser()
+	email := "i_" + util.GenerateRandomToken(10) + "@nowhere.net"
+	i, err := team.AddOrInviteUserByEmail(ctx, owner, email, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().UTC().Add(-INVITE_TTL - time.Hour)
+	if _, err := mdb.Exec(`UPDATE "invite" SET "created_at" = $1 WHERE "team" = $2 AND "email" = $3`, old, team.Id, email); err != nil {
+		t.Fatal(err)
+	}
+	if err = team.AcceptInvitation(ctx, invitee, i.Token); !util.CheckErr(err, ErrInviteExpired) {
+		t.Fatalf("Expected error %s and got %s", ErrInviteExpired, err)
+	}
+	ni, err := team.AddOrInviteUserByEmail(ctx, owner, email, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to invite again after expiry: %s", err)
+	}
+	if ni.Token == i.Token {
+		t.Errorf("Expected a new invitation token")
+	}
+}
+
+func TestRevokeInvite(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	email := "i_" + util.GenerateRandomToken(10) + "@nowhere.net"
+	i, err := team.AddOrInviteUserByEmail(ctx, owner, email, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := team.AddOrInviteUserByEmail(ctx, owner, email, nil); !util.CheckErr(err, ErrAlreadyInvited) {
+		t.Fatalf("Expected error %s and got %s", ErrAlreadyInvited, err)
+	}
+	if err := team.RevokeInvite(ctx, getDummyUser(), email); !util.CheckErr(err, ErrNotInTeam) {
+		t.Fatalf("Expected error %s and got %s", ErrNotInTeam, err)
+	}
+	if err := team.RevokeInvite(ctx, owner, email); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FindInviteByToken(ctx, i.Token); !util.CheckErr(err, ErrDoesntExist) {
+		t.Fatalf("Expected the invite to be gone and got %s", err)
+	}
+	if err := team.RevokeInvite(ctx, owner, email); !util.CheckErr(err, ErrDoesntExist) {
+		t.Fatalf("Expected error %s and got %s", ErrDoesntExist, err)
+	}
+	if _, err := team.AddOrInviteUserByEmail(ctx, owner, email, nil); err != nil {
+		t.Fatalf("Expected to be able to invite again after revoking: %s", err)
+	}
+}
+
 func TestCreateVault(t *testing.T) {
 	ctx := getCtx()
 	owner, team := getDummyOwnerWithTeam()
 	invitee := getDummyUser()
-	_, err := team.AddOrInviteUserByEmail(ctx, owner, invitee.Email)
+	_, err := team.AddOrInviteUserByEmail(ctx, owner, invitee.Email, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -121,11 +480,162 @@ func TestCreateVault(t *testing.T) {
 	}
 }
 
+func TestDeleteVault(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	vm := createVaultMock(owner, team)
+	for i := 0; i < 2; i++ {
+		if err := vm.v.AddSecret(ctx, vm.owner, &Secret{Data: signAndPack(vm.priv, a32b)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := team.DeleteVault(ctx, owner, DEFAULT_VAULT_NAME); !util.CheckErr(err, ErrCannotDeleteDefaultVault) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrCannotDeleteDefaultVault, err)
+	}
+	if err := team.DeleteVault(ctx, owner, "nonexistent"); !util.CheckErr(err, ErrVaultNotFound) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrVaultNotFound, err)
+	}
+	if err := team.DeleteVault(ctx, owner, vm.v.Id); err != nil {
+		t.Fatal(err)
+	}
+	vaults, err := team.GetVaultsForUser(ctx, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range vaults {
+		if v.Id == vm.v.Id {
+			t.Fatalf("Deleted vault %s is still listed", v.Id)
+		}
+	}
+	if len(vaults) != 1 {
+		t.Fatalf("Expected only the default vault and got %d vaults", len(vaults))
+	}
+}
+
+func TestRestoreVault(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	vm := createVaultMock(owner, team)
+	if err := vm.v.AddSecret(ctx, vm.owner, &Secret{Data: signAndPack(vm.priv, a32b)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := team.DeleteVault(ctx, owner, vm.v.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := team.GetVaultForUser(ctx, vm.v.Id, owner); !util.CheckErr(err, ErrDoesntExist) {
+		t.Fatalf("Deleted vault is still visible: %v", err)
+	}
+	if err := team.DeleteVault(ctx, owner, vm.v.Id); !util.CheckErr(err, ErrVaultNotFound) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrVaultNotFound, err)
+	}
+	v, err := team.RestoreVault(ctx, owner, vm.v.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.DeletedAt.Valid {
+		t.Errorf("Restored vault is still marked as deleted")
+	}
+	vaults, err := team.GetVaultsForUser(ctx, owner)
+	if err != nil || len(vaults) != 2 {
+		t.Fatalf("Expected the restored vault to be listed and got %d vaults (%v)", len(vaults), err)
+	}
+	secrets, err := v.GetSecrets(ctx)
+	if err != nil || len(secrets) != 1 {
+		t.Fatalf("Expected the secret of the restored vault and got %d (%v)", len(secrets), err)
+	}
+}
+
+func TestRestoreVaultAfterPurge(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	vm := createVaultMock(owner, team)
+	if err := team.DeleteVault(ctx, owner, vm.v.Id); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().UTC().Add(-VAULT_PURGE_AFTER - time.Hour)
+	if _, err := mdb.Exec(`UPDATE "vault" SET "deleted_at" = $1 WHERE "team" = $2 AND "id" = $3`, old, team.Id, vm.v.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := team.RestoreVault(ctx, owner, vm.v.Id); !util.CheckErr(err, ErrVaultPurged) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrVaultPurged, err)
+	}
+	n, err := PurgeDeletedVaults(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < 1 {
+		t.Fatalf("Expected the vault to be purged")
+	}
+	if _, err := team.RestoreVault(ctx, owner, vm.v.Id); !util.CheckErr(err, ErrVaultPurged) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrVaultPurged, err)
+	}
+	if _, err := team.RestoreVault(ctx, owner, "nonexistent"); !util.CheckErr(err, ErrVaultNotFound) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrVaultNotFound, err)
+	}
+}
+
+func TestRenameTeamAndVault(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	member := getDummyUser()
+	if _, err := team.AddOrInviteUserByEmail(ctx, owner, member.Email, nil); err != nil {
+		t.Fatal(err)
+	}
+	vm := createVaultMock(owner, team)
+	if err := vm.v.AddSecret(ctx, vm.owner, &Secret{Data: signAndPack(vm.priv, a32b)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := team.Rename(ctx, member, "stolen"); !util.CheckErr(err, ErrUnauthorized) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrUnauthorized, err)
+	}
+	if _, err := team.RenameVault(ctx, member, vm.v.Id, "stolen"); !util.CheckErr(err, ErrUnauthorized) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrUnauthorized, err)
+	}
+	for _, name := range []string{"", "   ", strings.Repeat("a", MAX_NAME_LENGTH+1)} {
+		if err := team.Rename(ctx, owner, name); !util.CheckErr(err, ErrInvalidAttributes) || !util.CheckFieldErr(err, "team_name", "invalid") {
+			t.Fatalf("Expected name '%s' to be rejected and got %v", name, err)
+		}
+		if _, err := team.RenameVault(ctx, owner, vm.v.Id, name); !util.CheckErr(err, ErrInvalidAttributes) {
+			t.Fatalf("Expected vault name '%s' to be rejected and got %v", name, err)
+		}
+	}
+	other := createTeamMock(owner)
+	if err := team.Rename(ctx, owner, strings.ToUpper(other.Name)); !util.CheckErr(err, ErrAlreadyExists) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrAlreadyExists, err)
+	}
+	if err := team.Rename(ctx, owner, "  renamed  "); err != nil {
+		t.Fatal(err)
+	}
+	if team.Name != "renamed" {
+		t.Errorf("Expected the trimmed name and got '%s'", team.Name)
+	}
+	if _, err := team.RenameVault(ctx, owner, DEFAULT_VAULT_NAME, "other"); !util.CheckErr(err, ErrCannotRenameDefaultVault) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrCannotRenameDefaultVault, err)
+	}
+	if _, err := team.RenameVault(ctx, owner, vm.v.Id, DEFAULT_VAULT_NAME); !util.CheckErr(err, ErrAlreadyExists) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrAlreadyExists, err)
+	}
+	v, err := team.RenameVault(ctx, owner, vm.v.Id, "shared stuff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := team.GetVaultForUser(ctx, vm.v.Id, owner); !util.CheckErr(err, ErrDoesntExist) {
+		t.Fatalf("Old vault still exists: %v", err)
+	}
+	secrets, err := v.GetSecrets(ctx)
+	if err != nil || len(secrets) != 1 {
+		t.Fatalf("Expected the secret to be moved to the renamed vault and got %d (%v)", len(secrets), err)
+	}
+	if _, err := team.GetVaultForUser(ctx, "shared stuff", owner); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestPromoteUser(t *testing.T) {
 	ctx := getCtx()
 	owner, team := getDummyOwnerWithTeam()
 	invitee := getDummyUser()
-	_, err := team.AddOrInviteUserByEmail(ctx, owner, invitee.Email)
+	_, err := team.AddOrInviteUserByEmail(ctx, owner, invitee.Email, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -178,3 +688,700 @@ func TestPromoteUser(t *testing.T) {
 	}
 
 }
+
+func TestTransferOwnership(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	invitee := getDummyUser()
+	if _, err := team.AddOrInviteUserByEmail(ctx, owner, invitee.Email, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := team.TransferOwnership(ctx, owner, invitee); !util.CheckErr(err, ErrNotTeamAdmin) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrNotTeamAdmin, err)
+	}
+	vaultsFull, err := team.GetVaultsFullForUser(ctx, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = team.PromoteUser(ctx, owner, invitee, expandVaultKeysOnce(vaultsFull)); err != nil {
+		t.Fatal(err)
+	}
+	if err = team.TransferOwnership(ctx, invitee, owner); !util.CheckErr(err, ErrUnauthorized) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrUnauthorized, err)
+	}
+	if err = team.TransferOwnership(ctx, owner, invitee); err != nil {
+		t.Fatal(err)
+	}
+	if team.Owner != invitee.Id {
+		t.Fatalf("Expected owner to be %s and got %s", invitee.Id, team.Owner)
+	}
+	isAdmin, err := team.CheckAdmin(ctx, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isAdmin {
+		t.Fatalf("Previous owner was supposed to remain an admin")
+	}
+	if err = team.DemoteUser(ctx, owner, invitee); !util.CheckErr(err, ErrUnauthorized) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrUnauthorized, err)
+	}
+}
+
+func TestRemoveUser(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	invitee := getDummyUser()
+	if _, err := team.AddOrInviteUserByEmail(ctx, owner, invitee.Email, nil); err != nil {
+		t.Fatal(err)
+	}
+	vm := createVaultMock(owner, team)
+	if err := vm.v.AddUsers(ctx, map[string][]byte{invitee.Id: sealVaultKey(vm.v, vm.priv)}); err != nil {
+		t.Fatal(err)
+	}
+	before, err := team.GetVaultsFullForUser(ctx, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = team.RemoveUser(ctx, invitee, owner); !util.CheckErr(err, ErrCannotRemoveOwner) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrCannotRemoveOwner, err)
+	}
+	if err = team.RemoveUser(ctx, invitee, invitee); !util.CheckErr(err, ErrUnauthorized) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrUnauthorized, err)
+	}
+	if err = team.RemoveUser(ctx, owner, invitee); err != nil {
+		t.Fatal(err)
+	}
+	iVaults, err := team.GetVaultsForUser(ctx, invitee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(iVaults) != 0 {
+		t.Fatalf("Removed user still has access to %d vaults", len(iVaults))
+	}
+	if _, err = team.CheckAdmin(ctx, invitee); !util.CheckErr(err, ErrNotInTeam) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrNotInTeam, err)
+	}
+	after, err := team.GetVaultsFullForUser(ctx, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Fatalf("Owner lost access to vaults: %d vs %d", len(before), len(after))
+	}
+	keys := map[string]string{}
+	for _, v := range before {
+		keys[v.Id] = string(v.Key)
+	}
+	for _, v := range after {
+		if keys[v.Id] != string(v.Key) {
+			t.Fatalf("Owner key for vault %s changed after removal", v.Id)
+		}
+	}
+}
+
+func TestDemoteInactiveAdmins(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	invitee := getDummyUser()
+	if _, err := team.AddOrInviteUserByEmail(ctx, owner, invitee.Email, nil); err != nil {
+		t.Fatal(err)
+	}
+	vaultsFull, err := team.GetVaultsFullForUser(ctx, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = team.PromoteUser(ctx, owner, invitee, expandVaultKeysOnce(vaultsFull)); err != nil {
+		t.Fatal(err)
+	}
+	demotions, err := DemoteInactiveAdmins(ctx, time.Now().UTC().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ad := range demotions {
+		if ad.Team.Id == team.Id {
+			t.Fatalf("Recently promoted admin %s was demoted", ad.User.Id)
+		}
+	}
+	demotions, err = DemoteInactiveAdmins(ctx, time.Now().UTC().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, ad := range demotions {
+		if ad.Team.Id != team.Id {
+			continue
+		}
+		if ad.User.Id != invitee.Id || len(ad.Admins) != 1 || ad.Admins[0].Id != owner.Id {
+			t.Fatalf("Unexpected demotion of %s in team %s", ad.User.Id, team.Id)
+		}
+		found = true
+	}
+	if !found {
+		t.Fatalf("Inactive admin was not demoted")
+	}
+	if isAdmin, err := team.CheckAdmin(ctx, invitee); err != nil || isAdmin {
+		t.Fatalf("Inactive admin is still an admin: %s", err)
+	}
+	if isAdmin, err := team.CheckAdmin(ctx, owner); err != nil || !isAdmin {
+		t.Fatalf("Owner was demoted: %s", err)
+	}
+}
+
+func TestAdminReadsAreNotActivity(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	old := time.Now().UTC().Add(-2 * time.Hour)
+	if _, err := mdb.Exec(`UPDATE "team_user" SET "last_admin_action" = $1 WHERE "team" = $2 AND "user" = $3`, old, team.Id, owner.Id); err != nil {
+		t.Fatal(err)
+	}
+	lastAction := func() time.Time {
+		var last time.Time
+		if err := mdb.QueryRow(`SELECT "last_admin_action" FROM "team_user" WHERE "team" = $1 AND "user" = $2`, team.Id, owner.Id).Scan(&last); err != nil {
+			t.Fatal(err)
+		}
+		return last
+	}
+	if _, err := team.GetPendingInvites(ctx, owner); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := team.GetAuditLog(ctx, owner, time.Time{}, "", 10); err != nil {
+		t.Fatal(err)
+	}
+	if last := lastAction(); last.After(old.Add(time.Minute)) {
+		t.Fatalf("Reads were recorded as admin activity at %s", last)
+	}
+	if _, err := team.AddOrInviteUserByEmail(ctx, owner, "activity@a.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	if last := lastAction(); !last.After(old.Add(time.Minute)) {
+		t.Fatalf("Invitation was not recorded as admin activity")
+	}
+}
+
+func TestTwoPhaseRemoveUser(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	invitee := getDummyUser()
+	_, err := team.AddOrInviteUserByEmail(ctx, owner, invitee.Email, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := createVaultMock(owner, team)
+	if err = vm.v.AddUsers(ctx, map[string][]byte{invitee.Id: sealVaultKey(vm.v, vm.priv)}); err != nil {
+		t.Fatal(err)
+	}
+	s := &Secret{Data: signAndPack(vm.priv, a32b)}
+	if err = vm.v.AddSecret(ctx, vm.owner, s); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = team.BeginRemoveUser(ctx, invitee, owner); !util.CheckErr(err, ErrUnauthorized) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrUnauthorized, err)
+	}
+	if err = team.FinalizeRemoveUser(ctx, owner, owner, nil); !util.CheckErr(err, ErrCannotRemoveOwner) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrCannotRemoveOwner, err)
+	}
+	if err = team.FinalizeRemoveUser(ctx, owner, invitee, nil); !util.CheckErr(err, ErrRemovalNotStarted) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrRemovalNotStarted, err)
+	}
+	vs, err := team.BeginRemoveUser(ctx, owner, invitee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 1 || vs[0].Id != vm.v.Id {
+		t.Fatalf("Expected to have to rekey vault %s", vm.v.Id)
+	}
+	logs, err := team.GetAuditLog(ctx, owner, time.Time{}, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := logs[len(logs)-1]; l.Action != TEAM_AUDIT_USER_REMOVE_BEGIN || l.Actor != owner.Id || l.Target != invitee.Id {
+		t.Fatalf("Expected the removal to be audited and got %s %s -> %s", l.Action, l.Actor, l.Target)
+	}
+	iVaults, err := team.GetVaultsForUser(ctx, invitee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(iVaults) != 0 {
+		t.Fatalf("Removed user still has access to %d vaults", len(iVaults))
+	}
+	ENFORCE_REKEY_ON_REMOVAL = true
+	defer func() { ENFORCE_REKEY_ON_REMOVAL = false }()
+	if err = vm.v.AddSecret(ctx, vm.owner, &Secret{Data: signAndPack(vm.priv, a32b)}); !util.CheckErr(err, ErrRekeyPending) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrRekeyPending, err)
+	}
+	ownerPrivKeys := getUserPrivateKeys(owner.PublicKey, owner.Key)
+	vkp := getDummyVaultKeyPair(ownerPrivKeys, owner.Id)
+	newPriv := unsealVaultKey(&Vault{PublicKey: vkp.PublicKey[64:]}, vkp.Keys[owner.Id])
+	if err = team.FinalizeRemoveUser(ctx, owner, invitee, nil); !util.CheckErr(err, ErrInvalidKeys) {
+		t.Fatalf("Expected the pending vaults to be required: %s", err)
+	}
+	rewraps := map[string]VaultRewrap{vm.v.Id: VaultRewrap{Keys: vkp}}
+	if err = team.FinalizeRemoveUser(ctx, owner, invitee, rewraps); !util.CheckErr(err, ErrInvalidKeys) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrInvalidKeys, err)
+	}
+	rs := &Secret{Id: s.Id, Data: signAndPack(newPriv, a32b)}
+	rewraps[vm.v.Id] = VaultRewrap{Keys: vkp, Secrets: []*Secret{rs}}
+	if err = team.FinalizeRemoveUser(ctx, owner, invitee, rewraps); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = team.CheckAdmin(ctx, invitee); !util.CheckErr(err, ErrNotInTeam) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrNotInTeam, err)
+	}
+	v, err := team.GetVaultForUser(ctx, vm.v.Id, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logs, err = team.GetAuditLog(ctx, owner, time.Time{}, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	rekeyed := fmt.Sprintf("%s: key version %d", v.Id, v.KeyVersion)
+	if l := logs[len(logs)-2]; l.Action != TEAM_AUDIT_VAULT_KEY_ROTATE || l.Actor != owner.Id || l.Target != rekeyed {
+		t.Fatalf("Expected the re-key to be audited and got %s %s -> %s", l.Action, l.Actor, l.Target)
+	}
+	if l := logs[len(logs)-1]; l.Action != TEAM_AUDIT_USER_REMOVE || l.Target != invitee.Id {
+		t.Fatalf("Expected the removal to be audited and got %s %s -> %s", l.Action, l.Actor, l.Target)
+	}
+	if err = v.AddSecret(ctx, owner, &Secret{Data: signAndPack(newPriv, a32b)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoveUserWithDeletedVault(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	invitee := getDummyUser()
+	if _, err := team.AddOrInviteUserByEmail(ctx, owner, invitee.Email, nil); err != nil {
+		t.Fatal(err)
+	}
+	vm := createVaultMock(owner, team)
+	if err := vm.v.AddUsers(ctx, map[string][]byte{invitee.Id: sealVaultKey(vm.v, vm.priv)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := team.DeleteVault(ctx, owner, vm.v.Id); err != nil {
+		t.Fatal(err)
+	}
+	vs, err := team.BeginRemoveUser(ctx, owner, invitee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 0 {
+		t.Fatalf("Expected no live vaults to rekey and got %d", len(vs))
+	}
+	if err = team.FinalizeRemoveUser(ctx, owner, invitee, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = team.RestoreVault(ctx, owner, vm.v.Id); err != nil {
+		t.Fatal(err)
+	}
+	vms, err := team.GetVaultMembers(ctx, owner, vm.v.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range vms {
+		if m.Id == invitee.Id {
+			t.Fatalf("Removed user still has a key for the restored vault")
+		}
+	}
+}
+
+func TestAllMembersVault(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	ownerPrivKeys := getUserPrivateKeys(owner.PublicKey, owner.Key)
+	vkp := getDummyVaultKeyPair(ownerPrivKeys, owner.Id)
+	v, err := team.CreateAllMembersVault(ctx, owner, util.GenerateRandomToken(5), vkp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.AllMembers {
+		t.Fatalf("Expected vault to be shared with all members")
+	}
+	vpriv := unsealVaultKey(v, vkp.Keys[owner.Id])
+	member := getDummyUser()
+	_, err = team.AddOrInviteUserByEmail(ctx, owner, member.Email, nil)
+	if !util.CheckErr(err, ErrMissingAllMembersKeys) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrMissingAllMembersKeys, err)
+	}
+	_, err = team.AddOrInviteUserByEmail(ctx, owner, member.Email, map[string][]byte{v.Id: sealVaultKey(v, vpriv)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = team.GetVaultForUser(ctx, v.Id, member); err != nil {
+		t.Fatal(err)
+	}
+	uid := "u_" + util.GenerateRandomToken(10)
+	if _, err = team.AddOrInviteUserByEmail(ctx, owner, uid+"@nowhere.net", nil); err != nil {
+		t.Fatal(err)
+	}
+	_, priv, fullpack := generateNewKeys()
+	invitee, _, err := NewUser(ctx, uid, "uid fullname", uid+"@nowhere.net", uid, fullpack, getDummyVaultKeyPair(priv, uid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tuf, err := team.GetUsersAfiliationFull(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tu := range tuf {
+		if tu.User == invitee.Id && !tu.AccessRequired {
+			t.Fatalf("Expected invitee to require access to all members vaults")
+		}
+	}
+	if err = team.GrantAllMembersAccess(ctx, owner, invitee, nil); !util.CheckErr(err, ErrMissingAllMembersKeys) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrMissingAllMembersKeys, err)
+	}
+	if err = team.GrantAllMembersAccess(ctx, owner, invitee, map[string][]byte{v.Id: sealVaultKey(v, vpriv)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = team.GetVaultForUser(ctx, v.Id, invitee); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClassifyEmails(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	member := getDummyUser()
+	if _, err := team.AddOrInviteUserByEmail(ctx, owner, member.Email, nil); err != nil {
+		t.Fatal(err)
+	}
+	existing := getDummyUser()
+	invited := util.GenerateRandomToken(10) + "@nowhere.net"
+	if _, err := team.AddOrInviteUserByEmail(ctx, owner, invited, nil); err != nil {
+		t.Fatal(err)
+	}
+	unknown := util.GenerateRandomToken(10) + "@nowhere.net"
+	_, err := team.ClassifyEmails(ctx, member, []string{unknown})
+	if !util.CheckErr(err, ErrUnauthorized) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrUnauthorized, err)
+	}
+	status, err := team.ClassifyEmails(ctx, owner, []string{member.Email, existing.Email, invited, unknown})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		member.Email:   EMAIL_STATUS_ALREADY_IN_TEAM,
+		existing.Email: EMAIL_STATUS_EXISTING_USER,
+		invited:        EMAIL_STATUS_ALREADY_INVITED,
+		unknown:        EMAIL_STATUS_NEW,
+	}
+	for email, st := range expected {
+		if status[email] != st {
+			t.Errorf("Expected %s for %s and got %s", st, email, status[email])
+		}
+	}
+	invites, err := FindInvitesForEmail(ctx, unknown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invites) != 0 {
+		t.Errorf("Classifying emails should not send invites")
+	}
+}
+
+func TestVerifyKeyIntegrity(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	member := getDummyUser()
+	if _, err := team.AddOrInviteUserByEmail(ctx, owner, member.Email, nil); err != nil {
+		t.Fatal(err)
+	}
+	issues, err := team.VerifyKeyIntegrity(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 0 {
+		t.Fatalf("Expected no issues and got %+v", issues)
+	}
+	vm := getFirstVault(owner, team)
+	if _, err := mdb.Exec(`UPDATE "team_user" SET "admin" = true WHERE "team" = $1 AND "user" = $2`, team.Id, member.Id); err != nil {
+		t.Fatal(err)
+	}
+	issues, err = team.VerifyKeyIntegrity(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 1 || issues[0].Vault != vm.v.Id || issues[0].User != member.Id || issues[0].Problem != KEY_ISSUE_MISSING_KEY {
+		t.Fatalf("Expected the new admin to miss the key and got %+v", issues)
+	}
+}
+
+func TestTeamAuditLog(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	member := getDummyUser()
+	if _, err := team.AddOrInviteUserByEmail(ctx, owner, member.Email, nil); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().UTC()
+	vaultsFull, err := team.GetVaultsFullForUser(ctx, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = team.PromoteUser(ctx, owner, member, expandVaultKeysOnce(vaultsFull)); err != nil {
+		t.Fatal(err)
+	}
+	if err = team.DemoteUser(ctx, owner, member); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = team.GetAuditLog(ctx, member, start, "", 0); !util.CheckErr(err, ErrUnauthorized) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrUnauthorized, err)
+	}
+	logs, err := team.GetAuditLog(ctx, owner, start, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 {
+		t.Fatalf("Expected 2 audit log entries and got %d", len(logs))
+	}
+	for i, action := range []string{TEAM_AUDIT_PROMOTE, TEAM_AUDIT_DEMOTE} {
+		l := logs[i]
+		if l.Action != action || l.Actor != owner.Id || l.Target != member.Id {
+			t.Errorf("Unexpected audit log entry %d: %s %s -> %s", i, l.Action, l.Actor, l.Target)
+		}
+	}
+	// Entries created at the same time are not skipped between pages
+	if _, err := mdb.Exec(`UPDATE "team_audit_log" SET "created_at" = $1 WHERE "id" = $2`, logs[0].CreatedAt, logs[1].Id); err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	since, after := start, ""
+	for page := 0; page < 3; page++ {
+		entries, err := team.GetAuditLog(ctx, owner, since, after, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) == 0 {
+			break
+		}
+		seen[entries[0].Id] = true
+		since, after = entries[0].CreatedAt, entries[0].Id
+	}
+	if !seen[logs[0].Id] || !seen[logs[1].Id] {
+		t.Fatalf("Paging skipped entries created at the same time")
+	}
+}
+
+func TestLeaveTeam(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	if err := team.Leave(ctx, owner); !util.CheckErr(err, ErrOwnerCannotLeave) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrOwnerCannotLeave, err)
+	}
+	admin := getDummyUser()
+	if _, err := team.AddOrInviteUserByEmail(ctx, owner, admin.Email, nil); err != nil {
+		t.Fatal(err)
+	}
+	vaultsFull, err := team.GetVaultsFullForUser(ctx, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = team.PromoteUser(ctx, owner, admin, expandVaultKeysOnce(vaultsFull)); err != nil {
+		t.Fatal(err)
+	}
+	// The owner is demoted so the leaving user is the only admin left
+	if _, err := mdb.Exec(`UPDATE "team_user" SET "admin" = false WHERE "team" = $1 AND "user" = $2`, team.Id, owner.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err = team.Leave(ctx, admin); err != nil {
+		t.Fatal(err)
+	}
+	teams, err := admin.GetTeams(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tm := range teams {
+		if tm.Id == team.Id {
+			t.Fatalf("User still belongs to team %s after leaving", team.Id)
+		}
+	}
+	vs, err := team.GetVaultsForUser(ctx, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 0 {
+		t.Fatalf("User that left still has keys for %d vaults", len(vs))
+	}
+	if err = team.Leave(ctx, admin); !util.CheckErr(err, ErrNotInTeam) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrNotInTeam, err)
+	}
+}
+
+func TestRotateVaultKey(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	member := getDummyUser()
+	if _, err := team.AddOrInviteUserByEmail(ctx, owner, member.Email, nil); err != nil {
+		t.Fatal(err)
+	}
+	vm := createVaultMock(owner, team)
+	if err := vm.v.AddUsers(ctx, map[string][]byte{member.Id: sealVaultKey(vm.v, vm.priv)}); err != nil {
+		t.Fatal(err)
+	}
+	s := &Secret{Data: signAndPack(vm.priv, a32b)}
+	if err := vm.v.AddSecret(ctx, vm.owner, s); err != nil {
+		t.Fatal(err)
+	}
+	keyVersion := vm.v.KeyVersion
+	ownerPrivKeys := getUserPrivateKeys(owner.PublicKey, owner.Key)
+	vkp := getDummyVaultKeyPair(ownerPrivKeys, owner.Id)
+	newPriv := unsealVaultKey(&Vault{PublicKey: vkp.PublicKey[64:]}, vkp.Keys[owner.Id])
+	secrets := []*Secret{{Id: s.Id, Data: signAndPack(newPriv, a32b)}}
+	if _, err := team.RotateVaultKey(ctx, owner, vm.v.Id, vkp, secrets); !util.CheckErr(err, ErrInvalidKeys) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrInvalidKeys, err)
+	}
+	vkp = getDummyVaultKeyPair(ownerPrivKeys, owner.Id, member.Id)
+	newPriv = unsealVaultKey(&Vault{PublicKey: vkp.PublicKey[64:]}, vkp.Keys[owner.Id])
+	secrets = []*Secret{{Id: s.Id, Data: signAndPack(newPriv, a32b)}}
+	if _, err := team.RotateVaultKey(ctx, member, vm.v.Id, vkp, secrets); !util.CheckErr(err, ErrUnauthorized) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrUnauthorized, err)
+	}
+	v, err := team.RotateVaultKey(ctx, owner, vm.v.Id, vkp, secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.KeyVersion != keyVersion+1 {
+		t.Fatalf("Expected key version %d and got %d", keyVersion+1, v.KeyVersion)
+	}
+	if err = v.AddSecret(ctx, owner, &Secret{Data: signAndPack(vm.priv, a32b)}); err == nil {
+		t.Fatalf("Secrets signed with the old key should be rejected")
+	}
+	if err = v.AddSecret(ctx, owner, &Secret{Data: signAndPack(newPriv, a32b)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTeamPolicy(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	member := getDummyUser()
+	if _, err := team.AddOrInviteUserByEmail(ctx, owner, member.Email, nil); err != nil {
+		t.Fatal(err)
+	}
+	p, err := team.GetPolicy(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.RequireTOTP || p.SessionCoolingMinutes != 0 || p.SessionIdleMinutes != 0 {
+		t.Fatalf("Expected an empty policy and got %+v", p)
+	}
+	if err = team.SetPolicy(ctx, member, &TeamPolicy{SessionIdleMinutes: 30}); !util.CheckErr(err, ErrUnauthorized) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrUnauthorized, err)
+	}
+	if err = team.SetPolicy(ctx, owner, &TeamPolicy{SessionIdleMinutes: -1}); !util.CheckErr(err, ErrInvalidAttributes) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrInvalidAttributes, err)
+	}
+	if err = team.SetPolicy(ctx, owner, &TeamPolicy{RequireTOTP: true}); !util.CheckErr(err, ErrTOTPNotEnabled) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrTOTPNotEnabled, err)
+	}
+	if _, err = owner.EnableTOTP(ctx, "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"); err != nil {
+		t.Fatal(err)
+	}
+	for _, idle := range []int{30, 15} {
+		if err = team.SetPolicy(ctx, owner, &TeamPolicy{RequireTOTP: true, SessionIdleMinutes: idle}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	policies, err := member.GetTeamPolicies(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 1 || policies[0].Team != team.Id || !policies[0].RequireTOTP || policies[0].SessionIdleMinutes != 15 {
+		t.Fatalf("Unexpected team policies %+v", policies)
+	}
+}
+
+func TestGetTeamsAndVaultsPaged(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	createTeamMock(owner)
+	createTeamMock(owner)
+	createVaultMock(owner, team)
+	createVaultMock(owner, team)
+	seen := map[string]bool{}
+	for offset := 0; offset < 3; offset += 2 {
+		ts, total, err := owner.GetTeamsPaged(ctx, offset, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 3 {
+			t.Fatalf("Expected 3 teams in total and got %d", total)
+		}
+		for _, tm := range ts {
+			if seen[tm.Id] {
+				t.Fatalf("Team %s returned in more than one page", tm.Id)
+			}
+			seen[tm.Id] = true
+		}
+	}
+	if len(seen) != 3 {
+		t.Fatalf("Expected to page through 3 teams and got %d", len(seen))
+	}
+	ts, total, err := owner.GetTeamsPaged(ctx, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ts) != 0 || total != 3 {
+		t.Fatalf("Expected an empty page with a total of 3 and got %d teams and a total of %d", len(ts), total)
+	}
+	vs, total, err := team.GetVaultsForUserPaged(ctx, owner, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := team.GetVaultsForUser(ctx, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 3 || len(all) != 3 || len(vs) != 1 || vs[0].Id != all[1].Id {
+		t.Fatalf("Unexpected vault page %v with a total of %d out of %d vaults", vs, total, len(all))
+	}
+	vs, total, err = team.GetVaultsForUserPaged(ctx, owner, 5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 0 || total != 3 {
+		t.Fatalf("Expected an empty page with a total of 3 and got %d vaults and a total of %d", len(vs), total)
+	}
+	if _, _, err := owner.GetTeamsPaged(ctx, -1, 10); !util.CheckErr(err, ErrInvalidAttributes) {
+		t.Fatalf("Expected an invalid attributes error and got %v", err)
+	}
+}
+
+func TestGetVaultMembers(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	invitee := getDummyUser()
+	if _, err := team.AddOrInviteUserByEmail(ctx, owner, invitee.Email, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := team.GetVaultMembers(ctx, invitee, DEFAULT_VAULT_NAME); !util.CheckErr(err, ErrUnauthorized) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrUnauthorized, err)
+	}
+	if _, err := team.GetVaultMembers(ctx, owner, "nope"); !util.CheckErr(err, ErrVaultNotFound) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrVaultNotFound, err)
+	}
+	roles := func() map[string]string {
+		vms, err := team.GetVaultMembers(ctx, owner, DEFAULT_VAULT_NAME)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := map[string]string{}
+		for _, vm := range vms {
+			r[vm.Id] = vm.Role
+		}
+		return r
+	}
+	if r := roles(); len(r) != 1 || r[owner.Id] != TEAM_ROLE_OWNER {
+		t.Fatalf("Expected only the owner in the vault and got %v", r)
+	}
+	vaultsFull, err := team.GetVaultsFullForUser(ctx, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := team.PromoteUser(ctx, owner, invitee, expandVaultKeysOnce(vaultsFull)); err != nil {
+		t.Fatal(err)
+	}
+	if r := roles(); len(r) != 2 || r[invitee.Id] != TEAM_ROLE_ADMIN {
+		t.Fatalf("Expected the promoted user as an admin of the vault and got %v", r)
+	}
+}
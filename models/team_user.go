@@ -11,6 +11,7 @@ type teamUser struct {
 	User           string `scaneo:"pk" json:"user"`
 	Admin          bool   `json:"admin"`
 	AccessRequired bool   `json:"-"`
+	ReadOnly       bool   `json:"read_only"`
 }
 
 func (tu *teamUser) insert(tx *sql.Tx) error {
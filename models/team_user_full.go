@@ -11,7 +11,8 @@ type TeamUserFull struct {
 	Team           string `scaneo:"pk" json:"-"`
 	User           string `scaneo:"pk" json:"id"`
 	Admin          bool   `json:"admin"`
-	AccessRequired bool   `json:"-"`
+	AccessRequired bool   `json:"access_required"`
+	ReadOnly       bool   `json:"read_only"`
 	FullName       string `json:"fullname"`
 	PublicKey      []byte `json:"public_key"`
 }
@@ -26,6 +27,7 @@ func scanTeamUserFull(rs *sql.Rows) ([]*TeamUserFull, error) {
 			&s.User,
 			&s.Admin,
 			&s.AccessRequired,
+			&s.ReadOnly,
 			&s.FullName,
 			&s.PublicKey,
 		); err != nil {
@@ -8,7 +8,19 @@ import (
 	"github.com/keydotcat/keycatd/util"
 )
 
-const TOKEN_VERIFICATION = 0
+const (
+	TOKEN_VERIFICATION   = 0
+	TOKEN_PASSWORD_RESET = 1
+	TOKEN_TOTP_RECOVERY  = 2
+	// Pending webauthn challenges. Only the last one of each type is kept
+	TOKEN_WEBAUTHN_REGISTRATION = 3
+	TOKEN_WEBAUTHN_LOGIN        = 4
+	// Verification of an additional email. The address is kept in Extra
+	TOKEN_EMAIL_VERIFICATION = 5
+)
+
+// Verification links can be used for this long after they were last sent. 0 keeps them valid forever
+var CONFIRMATION_TOKEN_TTL = 7 * 24 * time.Hour
 
 type Token struct {
 	Id        string    `scaneo:"pk" json:"id"`
@@ -58,14 +70,18 @@ func (u *Token) validate() error {
 	if len(u.Id) < 6 {
 		errs.SetFieldError("id", "too short")
 	}
-	if u.Type != TOKEN_VERIFICATION {
+	switch u.Type {
+	case TOKEN_VERIFICATION, TOKEN_PASSWORD_RESET, TOKEN_TOTP_RECOVERY, TOKEN_WEBAUTHN_REGISTRATION, TOKEN_WEBAUTHN_LOGIN, TOKEN_EMAIL_VERIFICATION:
+	default:
 		errs.SetFieldError("type", "invalid")
 	}
 	return errs.SetErrorOrCamo(ErrInvalidAttributes)
 }
 
 func (u *Token) insert(tx *sql.Tx) error {
-	u.Id = util.GenerateRandomToken(32)
+	if len(u.Id) == 0 {
+		u.Id = util.GenerateRandomToken(32)
+	}
 	if err := u.validate(); err != nil {
 		return err
 	}
@@ -88,8 +104,47 @@ func (u *Token) update(tx *sql.Tx) error {
 	return treatUpdateErr(res, err)
 }
 
+// tokenCutoff is the time before which tokens that last ttl have expired. If ttl is not positive they never expire
+func tokenCutoff(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().UTC().Add(-ttl)
+}
+
+// expired tells if the token can no longer be used. Verification tokens count from the last time they were sent
+func (t *Token) expired() bool {
+	switch t.Type {
+	case TOKEN_VERIFICATION, TOKEN_EMAIL_VERIFICATION:
+		return t.UpdatedAt.Before(tokenCutoff(CONFIRMATION_TOKEN_TTL))
+	case TOKEN_PASSWORD_RESET:
+		return t.CreatedAt.Before(tokenCutoff(RESET_TOKEN_TTL))
+	case TOKEN_WEBAUTHN_REGISTRATION, TOKEN_WEBAUTHN_LOGIN:
+		return t.CreatedAt.Before(tokenCutoff(WEBAUTHN_CHALLENGE_TTL))
+	}
+	return false
+}
+
+// DeleteExpiredTokens removes the verification, password reset and security key challenge tokens that can no longer
+// be used. Two factor recovery codes don't expire. Returns the number of tokens deleted
+func DeleteExpiredTokens(ctx context.Context) (deleted int64, err error) {
+	err = doTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.Exec(`DELETE FROM "token" WHERE ("type" IN ($1, $2) AND "updated_at" < $3) OR ("type" = $4 AND "created_at" < $5)
+			OR ("type" IN ($6, $7) AND "created_at" < $8)`,
+			TOKEN_VERIFICATION, TOKEN_EMAIL_VERIFICATION, tokenCutoff(CONFIRMATION_TOKEN_TTL),
+			TOKEN_PASSWORD_RESET, tokenCutoff(RESET_TOKEN_TTL),
+			TOKEN_WEBAUTHN_REGISTRATION, TOKEN_WEBAUTHN_LOGIN, tokenCutoff(WEBAUTHN_CHALLENGE_TTL))
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		deleted, err = res.RowsAffected()
+		return util.NewErrorFrom(err)
+	})
+	return deleted, err
+}
+
 func (t *Token) ConfirmEmail(ctx context.Context) (u *User, err error) {
-	if t.Type != TOKEN_VERIFICATION {
+	if t.Type != TOKEN_VERIFICATION || t.expired() {
 		return nil, util.NewErrorFrom(ErrDoesntExist)
 	}
 	return u, doTx(ctx, func(tx *sql.Tx) error {
@@ -97,15 +152,29 @@ func (t *Token) ConfirmEmail(ctx context.Context) (u *User, err error) {
 		if err != nil {
 			return err
 		}
-		if err = treatUpdateErr(t.dbDelete(tx)); err != nil {
-			return err
+		return t.confirmEmail(tx, u)
+	})
+}
+
+func (t *Token) confirmEmail(tx *sql.Tx, u *User) error {
+	if err := treatUpdateErr(t.dbDelete(tx)); err != nil {
+		return err
+	}
+	// Signups confirm the email they registered with. Changes replace the old primary, which may have been one of the
+	// additional emails
+	if u.UnconfirmedEmail != u.Email {
+		if _, err := tx.Exec(`DELETE FROM "user_email" WHERE "user" = $1 AND ("primary" OR "email" = $2)`, u.Id, u.UnconfirmedEmail); isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
 		}
-		u.Email = u.UnconfirmedEmail
-		u.UnconfirmedEmail = ""
-		if !u.ConfirmedAt.Valid {
-			u.ConfirmedAt.Valid = true
-			u.ConfirmedAt.Time = time.Now().UTC()
+		if err := insertEmail(tx, "user_email", &UserEmail{Email: u.UnconfirmedEmail, User: u.Id, Primary: true}); err != nil {
+			return err
 		}
-		return u.update(tx)
-	})
+	}
+	u.Email = u.UnconfirmedEmail
+	u.UnconfirmedEmail = ""
+	if !u.ConfirmedAt.Valid {
+		u.ConfirmedAt.Valid = true
+		u.ConfirmedAt.Time = time.Now().UTC()
+	}
+	return u.update(tx)
 }
@@ -1,7 +1,10 @@
 package models
 
 import (
+	"database/sql"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/keydotcat/keycatd/util"
 )
@@ -25,7 +28,7 @@ func TestConfirmEmail(t *testing.T) {
 	if u2.UnconfirmedEmail != "" {
 		t.Errorf("Unconfirmed email didn't reset")
 	}
-	if u2.Email != uid+"@nowhere.net" {
+	if u2.Email != strings.ToLower(uid+"@nowhere.net") {
 		t.Errorf("Email mismatch")
 	}
 	if !u2.ConfirmedAt.Valid {
@@ -44,3 +47,173 @@ func TestConfirmEmail(t *testing.T) {
 	}
 
 }
+
+func TestPasswordReset(t *testing.T) {
+	ctx := getCtx()
+	u := getDummyUser()
+	_, _, newPack := generateNewKeys()
+	pack := append(append([]byte{}, u.PublicKey...), u.Key...)
+	if err := u.ResetPasswordWithToken(ctx, "bad token", "newpass", pack); !util.CheckErr(err, ErrInvalidResetToken) {
+		t.Fatalf("Expected error %s and got %s", ErrInvalidResetToken, err)
+	}
+	old, err := u.GenerateResetToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := u.GenerateResetToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.ResetPasswordWithToken(ctx, old, "newpass", pack); !util.CheckErr(err, ErrInvalidResetToken) {
+		t.Fatalf("Expected previous tokens to be invalidated and got %s", err)
+	}
+	if err := u.ResetPasswordWithToken(ctx, token, "newpass", newPack); !util.CheckErr(err, ErrResetKeyChanged) {
+		t.Fatalf("Expected error %s and got %s", ErrResetKeyChanged, err)
+	}
+	RESET_TOKEN_TTL = -time.Second
+	err = u.ResetPasswordWithToken(ctx, token, "newpass", pack)
+	RESET_TOKEN_TTL = time.Hour
+	if !util.CheckErr(err, ErrExpiredResetToken) {
+		t.Fatalf("Expected error %s and got %s", ErrExpiredResetToken, err)
+	}
+	if err := u.ResetPasswordWithToken(ctx, token, "newpass", pack); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.CheckPassword("newpass"); err != nil {
+		t.Errorf("Password was not changed")
+	}
+	if err := u.ResetPasswordWithToken(ctx, token, "otherpass", pack); !util.CheckErr(err, ErrInvalidResetToken) {
+		t.Fatalf("Expected tokens to be single use and got %s", err)
+	}
+	token, err = u.GenerateResetToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.ClearResetTokens(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.ResetPasswordWithToken(ctx, token, "otherpass", pack); !util.CheckErr(err, ErrInvalidResetToken) {
+		t.Fatalf("Expected cleared tokens to be invalid and got %s", err)
+	}
+}
+
+func TestPasswordResetDisabledForSSOUsers(t *testing.T) {
+	ctx := getCtx()
+	u := getDummyUser()
+	if u.AuthSource != AUTH_SOURCE_LOCAL {
+		t.Fatalf("Expected new users to use local auth and got %s", u.AuthSource)
+	}
+	u.AuthSource = AUTH_SOURCE_SSO
+	if err := doTx(ctx, func(tx *sql.Tx) error { return u.update(tx) }); err != nil {
+		t.Fatal(err)
+	}
+	_, _, pack := generateNewKeys()
+	if _, err := u.GenerateResetToken(ctx); !util.CheckErr(err, ErrLocalAuthDisabled) {
+		t.Fatalf("Expected error %s and got %s", ErrLocalAuthDisabled, err)
+	}
+	if err := u.ResetPasswordWithToken(ctx, "token", "newpass", pack); !util.CheckErr(err, ErrLocalAuthDisabled) {
+		t.Fatalf("Expected error %s and got %s", ErrLocalAuthDisabled, err)
+	}
+	if err := u.ChangePassword(ctx, "newpass", pack); !util.CheckErr(err, ErrLocalAuthDisabled) {
+		t.Fatalf("Expected error %s and got %s", ErrLocalAuthDisabled, err)
+	}
+}
+
+func TestResendConfirmation(t *testing.T) {
+	ctx := getCtx()
+	u := getDummyUser()
+	if _, err := u.ResendConfirmation(ctx); !util.CheckErr(err, ErrConfirmationRateLimited) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrConfirmationRateLimited, err)
+	}
+	defer func(d time.Duration) { CONFIRMATION_RESEND_INTERVAL = d }(CONFIRMATION_RESEND_INTERVAL)
+	CONFIRMATION_RESEND_INTERVAL = 0
+	tok, err := u.ResendConfirmation(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	CONFIRMATION_RESEND_INTERVAL = time.Hour
+	if _, err := u.ResendConfirmation(ctx); !util.CheckErr(err, ErrConfirmationRateLimited) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrConfirmationRateLimited, err)
+	}
+	if err = u.ConfirmEmail(ctx, "nope"); !util.CheckErr(err, ErrDoesntExist) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrDoesntExist, err)
+	}
+	if err = u.ConfirmEmail(ctx, tok.Id); err != nil {
+		t.Fatal(err)
+	}
+	if !u.ConfirmedAt.Valid {
+		t.Fatalf("User is not confirmed")
+	}
+	if _, err := u.ResendConfirmation(ctx); !util.CheckErr(err, ErrDoesntExist) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrDoesntExist, err)
+	}
+}
+
+func TestDeleteExpiredTokens(t *testing.T) {
+	ctx := getCtx()
+	stale := getDummyUser()
+	fresh := getDummyUser()
+	staleReset, err := stale.GenerateResetToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	freshReset, err := fresh.GenerateResetToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().UTC().Add(-CONFIRMATION_TOKEN_TTL - time.Hour)
+	if _, err := mdb.Exec(`UPDATE "token" SET "created_at" = $1, "updated_at" = $1 WHERE "user" = $2`, old, stale.Id); err != nil {
+		t.Fatal(err)
+	}
+	n, err := DeleteExpiredTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < 2 {
+		t.Errorf("Expected at least 2 tokens deleted and got %d", n)
+	}
+	if _, err := stale.GetVerificationToken(ctx); !util.CheckErr(err, ErrDoesntExist) {
+		t.Errorf("Expected the stale verification token to be deleted and got %v", err)
+	}
+	if len(FindTokensForUser(ctx, stale.Id)) != 0 {
+		t.Errorf("Expected the stale reset token %s to be deleted", staleReset)
+	}
+	if len(FindTokensForUser(ctx, fresh.Id)) != 2 {
+		t.Errorf("Expected the fresh verification and reset %s tokens to be kept", freshReset)
+	}
+	tok, err := stale.ResendConfirmation(ctx)
+	if err != nil {
+		t.Fatalf("Expected a new verification token after the cleanup: %s", err)
+	}
+	if err := stale.ConfirmEmail(ctx, tok.Id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteExpiredInvites(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	staleEmail := "i_" + util.GenerateRandomToken(10) + "@nowhere.net"
+	freshEmail := "i_" + util.GenerateRandomToken(10) + "@nowhere.net"
+	if _, err := team.AddOrInviteUserByEmail(ctx, owner, staleEmail, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := team.AddOrInviteUserByEmail(ctx, owner, freshEmail, nil); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().UTC().Add(-INVITE_TTL - time.Hour)
+	if _, err := mdb.Exec(`UPDATE "invite" SET "created_at" = $1 WHERE "team" = $2 AND "email" = $3`, old, team.Id, staleEmail); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DeleteExpiredInvites(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := mdb.QueryRow(`SELECT COUNT(*) FROM "invite" WHERE "team" = $1 AND "email" = $2`, team.Id, staleEmail).Scan(&count); err != nil || count != 0 {
+		t.Errorf("Expected the expired invitation to be deleted: %d %v", count, err)
+	}
+	invs, err := FindInvitesForEmail(ctx, freshEmail)
+	if err != nil || len(invs) != 1 {
+		t.Errorf("Expected the fresh invitation to be kept: %v %v", invs, err)
+	}
+}
@@ -0,0 +1,49 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/keydotcat/keycatd/util"
+	"github.com/lib/pq"
+)
+
+// Run transactions again when they fail with a serialization error. CockroachDB runs every transaction as
+// serializable and aborts the ones that conflict, expecting clients to retry them. Postgres doesn't need it
+var RETRY_SERIALIZATION_FAILURES = false
+
+const (
+	txMaxRetries      = 5
+	txRetryFirstDelay = 10 * time.Millisecond
+)
+
+// SQLSTATE of serialization failures
+const pqSerializationFailure = "40001"
+
+func isRetryableTxErr(err error) bool {
+	if ue, ok := err.(*util.Error); ok {
+		err = ue.Inner()
+	}
+	pe, ok := err.(*pq.Error)
+	return ok && pe.Code == pqSerializationFailure
+}
+
+// doRetryTx runs ftor in a transaction like doTx. If RETRY_SERIALIZATION_FAILURES is set and the transaction fails
+// with a serialization error, ftor is run again in a new transaction after a wait that doubles each time, up to
+// txMaxRetries times. ftor has to load everything it needs inside the transaction so running it again is safe
+func doRetryTx(ctx context.Context, ftor func(*sql.Tx) error) error {
+	delay := txRetryFirstDelay
+	for retries := 0; ; retries++ {
+		err := doTx(ctx, ftor)
+		if !RETRY_SERIALIZATION_FAILURES || retries == txMaxRetries || !isRetryableTxErr(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
@@ -0,0 +1,71 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"github.com/keydotcat/keycatd/util"
+	"github.com/lib/pq"
+)
+
+// conflictDriver fails the commit of the first conflicts transactions with a serialization failure
+type conflictDriver struct {
+	conflicts int
+	commits   int
+}
+
+func (d *conflictDriver) Open(name string) (driver.Conn, error) { return conflictConn{d}, nil }
+
+type conflictConn struct{ d *conflictDriver }
+
+func (c conflictConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("no statements")
+}
+func (c conflictConn) Close() error              { return nil }
+func (c conflictConn) Begin() (driver.Tx, error) { return conflictTx{c.d}, nil }
+
+type conflictTx struct{ d *conflictDriver }
+
+func (tx conflictTx) Commit() error {
+	tx.d.commits++
+	if tx.d.commits <= tx.d.conflicts {
+		return &pq.Error{Code: pqSerializationFailure, Message: "restart transaction"}
+	}
+	return nil
+}
+func (tx conflictTx) Rollback() error { return nil }
+
+func TestRetrySerializationFailure(t *testing.T) {
+	d := &conflictDriver{conflicts: 1}
+	sql.Register("conflict", d)
+	fdb, err := sql.Open("conflict", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := AddDBToContext(context.Background(), fdb)
+	runs := 0
+	ftor := func(tx *sql.Tx) error {
+		runs++
+		return nil
+	}
+	defer func(r bool) { RETRY_SERIALIZATION_FAILURES = r }(RETRY_SERIALIZATION_FAILURES)
+	RETRY_SERIALIZATION_FAILURES = false
+	if err := doRetryTx(ctx, ftor); !isRetryableTxErr(err) || runs != 1 {
+		t.Fatalf("Expected postgres transactions not to be retried: %d runs, %s", runs, err)
+	}
+	RETRY_SERIALIZATION_FAILURES = true
+	d.commits, runs = 0, 0
+	if err := doRetryTx(ctx, ftor); err != nil {
+		t.Fatal(err)
+	}
+	if runs != 2 {
+		t.Fatalf("Expected the transaction to run twice and it ran %d times", runs)
+	}
+	d.conflicts, d.commits, runs = txMaxRetries+1, 0, 0
+	if err := doRetryTx(ctx, ftor); !isRetryableTxErr(err) || runs != txMaxRetries+1 {
+		t.Fatalf("Expected to give up after %d retries: %d runs, %s", txMaxRetries, runs, util.GetStack(err))
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"fmt"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/keydotcat/keycatd/util"
@@ -14,31 +15,51 @@ import (
 
 var (
 	HASH_PASSWD_COST = 14
-	reValidUsername  = regexp.MustCompile(`^[\w-]{3,}$`)
-	reValidEmail     = regexp.MustCompile(`^([\w-]+\.?)+@([\w-]+\.*)+\.\w+$`)
+	// Minimum time between two confirmation mails for the same user
+	CONFIRMATION_RESEND_INTERVAL = time.Minute
+	reValidUsername              = regexp.MustCompile(`^[\w-]{3,}$`)
+	reValidEmail                 = regexp.MustCompile(`^([\w-]+\.?)+@([\w-]+\.*)+\.\w+$`)
+)
+
+const (
+	AUTH_SOURCE_LOCAL = "local"
+	AUTH_SOURCE_SSO   = "sso"
 )
 
 type User struct {
-	Id               string      `scaneo:"pk" json:"id"`
-	Email            string      `json:"email"`
-	UnconfirmedEmail string      `json:"-"`
-	HashPass         []byte      `json:"-"`
-	FullName         string      `json:"fullname"`
-	ConfirmedAt      pq.NullTime `json:"confirmed_at,omitempty"`
-	LockedAt         pq.NullTime `json:"locked_at,omitempty"`
-	SignInCount      int         `json:"sign_in_count"`
-	FailedAttempts   int         `json:"failed_attempts"`
-	PublicKey        []byte      `json:"public_key"`
-	Key              []byte      `json:"-"`
-	CreatedAt        time.Time   `json:"created_at"`
-	UpdatedAt        time.Time   `json:"updated_at"`
+	Id               string         `scaneo:"pk" json:"id"`
+	Email            string         `json:"email"`
+	UnconfirmedEmail string         `json:"-"`
+	HashPass         []byte         `json:"-"`
+	FullName         string         `json:"fullname"`
+	ConfirmedAt      pq.NullTime    `json:"confirmed_at,omitempty"`
+	LockedAt         pq.NullTime    `json:"locked_at,omitempty"`
+	SignInCount      int            `json:"sign_in_count"`
+	FailedAttempts   int            `json:"failed_attempts"`
+	PublicKey        []byte         `json:"public_key"`
+	Key              []byte         `json:"-"`
+	CreatedAt        time.Time      `json:"created_at"`
+	UpdatedAt        time.Time      `json:"updated_at"`
+	Kdf              util.KDFParams `json:"kdf"`
+	SuspendedAt      pq.NullTime    `json:"suspended_at,omitempty"`
+	SuspendedReason  string         `json:"-"`
+	AuthSource       string         `json:"auth_source"`
+	AwaitingApproval bool           `json:"awaiting_approval"`
 }
 
 func NewUser(ctx context.Context, id, fullname, email, password string, keyPack []byte, signedVaultKeys VaultKeyPair) (*User, *Token, error) {
+	return NewUserWithKDF(ctx, id, fullname, email, password, keyPack, util.NewKDFParams(), signedVaultKeys)
+}
+
+func NewUserWithKDF(ctx context.Context, id, fullname, email, password string, keyPack []byte, kdf util.KDFParams, signedVaultKeys VaultKeyPair) (*User, *Token, error) {
+	if err := kdf.Validate(); err != nil {
+		return nil, nil, err
+	}
 	pub, priv, err := expandUserKeyPack(keyPack)
 	if err != nil {
 		return nil, nil, err
 	}
+	email = normalizeEmail(email)
 	u := &User{
 		Id:               id,
 		Email:            email,
@@ -46,6 +67,9 @@ func NewUser(ctx context.Context, id, fullname, email, password string, keyPack
 		FullName:         fullname,
 		PublicKey:        pub,
 		Key:              priv,
+		Kdf:              kdf,
+		AuthSource:       AUTH_SOURCE_LOCAL,
+		AwaitingApproval: REQUIRE_APPROVAL,
 	}
 	vaultKeys, err := signedVaultKeys.verifyAndUnpack(u.PublicKey)
 	if err != nil {
@@ -75,7 +99,7 @@ func NewUser(ctx context.Context, id, fullname, email, password string, keyPack
 			if err != nil {
 				return err
 			}
-			if err := team.addUserNoAdminCheck(tx, u); err != nil {
+			if err := team.joinFromInvite(tx, u); err != nil {
 				return err
 			}
 			if _, err := i.dbDelete(tx); err != nil {
@@ -87,6 +111,37 @@ func NewUser(ctx context.Context, id, fullname, email, password string, keyPack
 }
 
 func (u *User) ChangePassword(ctx context.Context, password string, keyPack []byte) error {
+	if err := u.checkLocalAuth(); err != nil {
+		return err
+	}
+	pub, priv, err := expandUserKeyPack(keyPack)
+	if err != nil {
+		return err
+	}
+	if err := u.setPassword(password); err != nil {
+		return err
+	}
+	u.PublicKey = pub
+	u.Key = priv
+	return doTx(ctx, func(tx *sql.Tx) error {
+		return u.update(tx)
+	})
+}
+
+// NeedsKDFUpgrade returns whether the kdf params of the user are weaker than the ones given to new accounts
+func (u *User) NeedsKDFUpgrade() bool {
+	return u.AuthSource != AUTH_SOURCE_SSO && (u.Kdf.IsEmpty() || u.Kdf.WeakerThan(util.NewKDFParams()))
+}
+
+// UpgradeKDF replaces the kdf params of the user. The client derives the password and the key that seals the private
+// key again with the new params, so they are replaced as in ChangePassword
+func (u *User) UpgradeKDF(ctx context.Context, password string, keyPack []byte, kdf util.KDFParams) error {
+	if err := u.checkLocalAuth(); err != nil {
+		return err
+	}
+	if err := kdf.Validate(); err != nil {
+		return err
+	}
 	pub, priv, err := expandUserKeyPack(keyPack)
 	if err != nil {
 		return err
@@ -96,7 +151,54 @@ func (u *User) ChangePassword(ctx context.Context, password string, keyPack []by
 	}
 	u.PublicKey = pub
 	u.Key = priv
+	u.Kdf = kdf
+	return doTx(ctx, func(tx *sql.Tx) error {
+		return u.update(tx)
+	})
+}
+
+// VaultKeyId identifies a vault across teams in the key maps of RotateKeyPair
+func VaultKeyId(team, vault string) string {
+	return team + "/" + vault
+}
+
+// RotateKeyPair replaces the key pair of the user. keyPack has the new public and sealed private keys like in
+// ChangePassword and rewrapped has the key of every vault the user can read sealed for the new public key, indexed
+// by VaultKeyId. Vaults waiting to be purged are included so they can still be restored. If the map has missing or
+// extra vaults nothing is changed and ErrInvalidKeys is returned
+func (u *User) RotateKeyPair(ctx context.Context, keyPack []byte, rewrapped map[string][]byte) error {
+	pub, priv, err := expandUserKeyPack(keyPack)
+	if err != nil {
+		return err
+	}
 	return doTx(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT `+selectVaultFullFields+` FROM "vault", "vault_user" WHERE "vault_user"."user" = $1 AND "vault"."team" = "vault_user"."team" AND "vault"."id" = "vault_user"."vault"`, u.Id)
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		vs, err := scanVaults(rows)
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		if len(rewrapped) != len(vs) {
+			return util.NewErrorFrom(ErrInvalidKeys)
+		}
+		now := time.Now().UTC()
+		for _, v := range vs {
+			key, ok := rewrapped[VaultKeyId(v.Team, v.Id)]
+			if !ok || len(key) != privateKeyPackSize {
+				return util.NewErrorFrom(ErrInvalidKeys)
+			}
+			if _, err := verifyAndUnpack(v.PublicKey, key); err != nil {
+				return err
+			}
+			res, err := tx.Exec(`UPDATE "vault_user" SET "key" = $1, "updated_at" = $2 WHERE "team" = $3 AND "vault" = $4 AND "user" = $5`, key, now, v.Team, v.Id, u.Id)
+			if err := treatUpdateErr(res, err); err != nil {
+				return err
+			}
+		}
+		u.PublicKey = pub
+		u.Key = priv
 		return u.update(tx)
 	})
 }
@@ -120,7 +222,7 @@ func FindUserByEmail(ctx context.Context, email string) (u *User, err error) {
 }
 
 func findUserByEmail(tx *sql.Tx, email string) (*User, error) {
-	return findUserByField(tx, "email", email)
+	return findUserByField(tx, "email", normalizeEmail(email))
 }
 
 func findUserByField(tx *sql.Tx, fieldName, value string) (*User, error) {
@@ -135,11 +237,14 @@ func findUserByField(tx *sql.Tx, fieldName, value string) (*User, error) {
 }
 
 func (u *User) CreateTeam(ctx context.Context, name string, signedVaultKeys VaultKeyPair) (t *Team, err error) {
+	if u.AwaitingApproval {
+		return nil, util.NewErrorFrom(ErrAwaitingApproval)
+	}
 	vaultKeys, err := signedVaultKeys.verifyAndUnpack(u.PublicKey)
 	if err != nil {
 		return nil, err
 	}
-	return t, doTx(ctx, func(tx *sql.Tx) error {
+	return t, doRetryTx(ctx, func(tx *sql.Tx) error {
 		t, err = createTeam(tx, u, false, name, vaultKeys)
 		return err
 	})
@@ -161,8 +266,11 @@ func (u *User) insert(tx *sql.Tx) error {
 		errs.SetFieldError("user_"+dup, "duplicate")
 		return errs.SetErrorOrCamo(ErrAlreadyExists)
 	}
-	isErrOrPanic(err)
-	return util.NewErrorFrom(err)
+	if isErrOrPanic(err) {
+		return util.NewErrorFrom(err)
+	}
+	// Primary emails can also clash with an additional email of another account
+	return insertEmail(tx, "user_email", &UserEmail{Email: u.Email, User: u.Id, Primary: true})
 }
 
 func (u *User) update(tx *sql.Tx) error {
@@ -197,6 +305,9 @@ func (u *User) validate() error {
 	if len(u.Key) != privateKeyPackSize {
 		errs.SetFieldError("user_private_key", "invalid")
 	}
+	if u.AuthSource != AUTH_SOURCE_LOCAL && u.AuthSource != AUTH_SOURCE_SSO {
+		errs.SetFieldError("user_auth_source", "invalid")
+	}
 	return errs.SetErrorOrCamo(ErrInvalidAttributes)
 }
 
@@ -209,6 +320,14 @@ func (u *User) setPassword(pass string) error {
 	return nil
 }
 
+// checkLocalAuth fails for users whose credentials are managed by an external identity provider
+func (u *User) checkLocalAuth() error {
+	if u.AuthSource == AUTH_SOURCE_SSO {
+		return util.NewErrorFrom(ErrLocalAuthDisabled)
+	}
+	return nil
+}
+
 func (u *User) CheckPassword(pass string) error {
 	err := bcrypt.CompareHashAndPassword(u.HashPass, []byte(pass))
 	if err != nil {
@@ -218,29 +337,85 @@ func (u *User) CheckPassword(pass string) error {
 }
 
 func (u *User) GetTeams(ctx context.Context) ([]*Team, error) {
-	db := GetDB(ctx)
-	rows, err := db.Query(`SELECT `+selectTeamFullFields+` FROM "team", "team_user" WHERE  "team_user"."team" = "team".id AND "team_user"."user" = $1`, u.Id)
+	teams, _, err := u.GetTeamsPaged(ctx, 0, PAGE_LENGTH_ALL)
+	return teams, err
+}
+
+// GetTeamsPaged returns a page of the teams of the user and how many teams the user is in. Teams are sorted by
+// creation time so pages don't overlap
+func (u *User) GetTeamsPaged(ctx context.Context, offset, limit int) ([]*Team, int, error) {
+	if err := checkPage(offset, limit); err != nil {
+		return nil, 0, err
+	}
+	db := getReadDB(ctx)
+	total := 0
+	r := db.QueryRow(`SELECT COUNT(*) FROM "team_user" WHERE "team_user"."user" = $1`, u.Id)
+	if err := r.Scan(&total); isErrOrPanic(err) {
+		return nil, 0, util.NewErrorFrom(err)
+	}
+	rows, err := db.Query(`SELECT `+selectTeamFullFields+` FROM "team", "team_user" WHERE  "team_user"."team" = "team".id AND "team_user"."user" = $1 ORDER BY "team"."created_at", "team"."id" OFFSET $2 LIMIT $3`, u.Id, offset, limit)
 	if isErrOrPanic(err) {
-		return nil, util.NewErrorFrom(err)
+		return nil, 0, util.NewErrorFrom(err)
 	}
 	teams, err := scanTeams(rows)
 	isErrOrPanic(err)
-	return teams, util.NewErrorFrom(err)
+	return teams, total, util.NewErrorFrom(err)
 }
 
 func (u *User) GetVerificationToken(ctx context.Context) (t *Token, err error) {
-	t = &Token{}
-	err = doTx(ctx, func(tx *sql.Tx) error {
-		r := tx.QueryRow(`SELECT `+selectTokenFields+` FROM "token" WHERE "user" = $1 AND "type" = $2`, u.Id, TOKEN_VERIFICATION)
-		return t.dbScanRow(r)
+	return t, doTx(ctx, func(tx *sql.Tx) error {
+		t, err = u.getVerificationToken(tx)
+		return err
 	})
-	fmt.Println("ERROR", err)
+}
+
+func (u *User) getVerificationToken(tx *sql.Tx) (*Token, error) {
+	t := &Token{}
+	r := tx.QueryRow(`SELECT `+selectTokenFields+` FROM "token" WHERE "user" = $1 AND "type" = $2`, u.Id, TOKEN_VERIFICATION)
+	err := t.dbScanRow(r)
 	if isNotExistsErr(err) {
 		return nil, util.NewErrorFrom(ErrDoesntExist)
 	}
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
 	return t, nil
 }
 
+// ConfirmEmail consumes the verification token of the user and marks the pending address as confirmed
+func (u *User) ConfirmEmail(ctx context.Context, token string) error {
+	return doTx(ctx, func(tx *sql.Tx) error {
+		t, err := u.getVerificationToken(tx)
+		if err != nil {
+			return err
+		}
+		if t.Id != token || t.expired() {
+			return util.NewErrorFrom(ErrDoesntExist)
+		}
+		return t.confirmEmail(tx, u)
+	})
+}
+
+// ResendConfirmation returns the pending verification token so it can be mailed again. Sending it again extends its
+// validity and a new one is created if the old one was already cleaned up.
+// Resends are limited to one every CONFIRMATION_RESEND_INTERVAL per user.
+func (u *User) ResendConfirmation(ctx context.Context) (t *Token, err error) {
+	return t, doTx(ctx, func(tx *sql.Tx) error {
+		t, err = u.getVerificationToken(tx)
+		if util.CheckErr(err, ErrDoesntExist) && len(u.UnconfirmedEmail) > 0 {
+			t = &Token{Type: TOKEN_VERIFICATION, User: u.Id}
+			return t.insert(tx)
+		}
+		if err != nil {
+			return err
+		}
+		if time.Since(t.UpdatedAt) < CONFIRMATION_RESEND_INTERVAL {
+			return util.NewErrorFrom(ErrConfirmationRateLimited)
+		}
+		return t.update(tx)
+	})
+}
+
 func (u *User) GetTeam(ctx context.Context, tid string) (t *Team, err error) {
 	return t, doTx(ctx, func(tx *sql.Tx) error {
 		t, err = u.getTeam(tx, tid)
@@ -273,7 +448,149 @@ func (u *User) ChangeEmail(ctx context.Context, email string) (t *Token, err err
 				return err
 			}
 		}
-		u.UnconfirmedEmail = email
+		u.UnconfirmedEmail = normalizeEmail(email)
 		return u.update(tx)
 	})
 }
+
+// FindUnverifiedUsersToRemind returns the users created before the given time that have not verified their email
+// and have not been told yet that their account is going to be deleted
+func FindUnverifiedUsersToRemind(ctx context.Context, createdBefore time.Time) (us []*User, err error) {
+	return us, doTx(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT `+selectUserFields+` FROM "user" WHERE "confirmed_at" IS NULL AND "created_at" < $1 AND "purge_reminded_at" IS NULL`, createdBefore)
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		us, err = scanUsers(rows)
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		return nil
+	})
+}
+
+// SetPurgeReminded records that the user was warned about the deletion of the unverified account. The grace period
+// before the purge starts now
+func (u *User) SetPurgeReminded(ctx context.Context) error {
+	return doTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.Exec(`UPDATE "user" SET "purge_reminded_at" = $1 WHERE "id" = $2 AND "confirmed_at" IS NULL`, time.Now().UTC(), u.Id)
+		return treatUpdateErr(res, err)
+	})
+}
+
+// PurgeUnverifiedRemindedBefore deletes with all their data the users that still have not verified their email and
+// were reminded before the given time
+func PurgeUnverifiedRemindedBefore(ctx context.Context, remindedBefore time.Time) (n int64, err error) {
+	return n, doTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.Exec(`DELETE FROM "user" WHERE "confirmed_at" IS NULL AND "purge_reminded_at" < $1`, remindedBefore)
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		n, err = res.RowsAffected()
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		return nil
+	})
+}
+
+// verifiedEmails returns all the addresses the user has proven to own
+func (u *User) verifiedEmails(tx *sql.Tx) ([]string, error) {
+	if !u.ConfirmedAt.Valid {
+		return nil, nil
+	}
+	ues, err := u.getEmails(tx)
+	if err != nil {
+		return nil, err
+	}
+	emails := []string{u.Email}
+	for _, ue := range ues {
+		emails = append(emails, ue.Email)
+	}
+	return emails, nil
+}
+
+func (u *User) hasVerifiedEmail(tx *sql.Tx, email string) (bool, error) {
+	emails, err := u.verifiedEmails(tx)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range emails {
+		if strings.EqualFold(e, email) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (u *User) IsSuspended() bool {
+	return u.SuspendedAt.Valid
+}
+
+// Delete removes the user and all its data. The user is removed from every team it belongs to and the vaults it
+// could read are flagged for re-keying. The primary team of the user is deleted with it as long as nobody else
+// is in it. Deletion is blocked with ErrOwnsTeams while the user owns any other team, and the ids of those teams
+// are returned in the "teams" field of the error. Deleting a user that is already gone is not an error
+func (u *User) Delete(ctx context.Context) error {
+	return doTx(ctx, func(tx *sql.Tx) error {
+		if _, err := findUser(tx, u.Id); util.CheckErr(err, ErrDoesntExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := u.checkOwnsNoTeams(tx); err != nil {
+			return err
+		}
+		rows, err := tx.Query(`SELECT `+selectTeamUserFields+` FROM "team_user" WHERE "user" = $1 AND "team" IN (SELECT "id" FROM "team" WHERE "owner" != $1)`, u.Id)
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		tus, err := scanTeamUsers(rows)
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		for _, tu := range tus {
+			t := &Team{Id: tu.Team}
+			if err := t.removeUser(tx, tu); err != nil {
+				return err
+			}
+			if err := t.audit(tx, u.Id, u.Id, TEAM_AUDIT_ACCOUNT_DELETE); err != nil {
+				return err
+			}
+		}
+		for _, q := range []string{
+			`DELETE FROM "session" WHERE "user" = $1`,
+			`DELETE FROM "invite" WHERE "email" = $2`,
+			`DELETE FROM "user" WHERE "id" = $1`,
+		} {
+			if _, err := tx.Exec(q, u.Id, u.Email); isErrOrPanic(err) {
+				return util.NewErrorFrom(err)
+			}
+		}
+		return nil
+	})
+}
+
+// checkOwnsNoTeams fails if the user owns a team other than an unshared primary team
+func (u *User) checkOwnsNoTeams(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT "team"."id" FROM "team" WHERE "team"."owner" = $1 AND (NOT "team"."primary" OR EXISTS (
+		SELECT 1 FROM "team_user" WHERE "team_user"."team" = "team"."id" AND "team_user"."user" != $1)) ORDER BY "team"."id"`, u.Id)
+	if isErrOrPanic(err) {
+		return util.NewErrorFrom(err)
+	}
+	defer rows.Close()
+	owned := []string{}
+	for rows.Next() {
+		var tid string
+		if err := rows.Scan(&tid); isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		owned = append(owned, tid)
+	}
+	if len(owned) == 0 {
+		return nil
+	}
+	errs := util.NewErrorFields().(*util.Error)
+	errs.SetFieldError("teams", strings.Join(owned, ","))
+	return errs.SetErrorOrCamo(ErrOwnsTeams)
+}
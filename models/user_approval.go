@@ -0,0 +1,56 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+var (
+	// New accounts wait for an approver before they can log in
+	REQUIRE_APPROVAL = false
+	// Ids of the users that can approve new accounts
+	APPROVERS = []string{}
+)
+
+func checkApprover(actor *User) error {
+	for _, id := range APPROVERS {
+		if id == actor.Id {
+			return nil
+		}
+	}
+	return util.NewErrorFrom(ErrUnauthorized)
+}
+
+// FindUsersAwaitingApproval returns the accounts waiting to be approved, oldest first. Only approvers can list them
+func FindUsersAwaitingApproval(ctx context.Context, actor *User) (us []*User, err error) {
+	if err := checkApprover(actor); err != nil {
+		return nil, err
+	}
+	err = doTx(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT ` + selectUserFields + ` FROM "user" WHERE "awaiting_approval" = true ORDER BY "created_at"`)
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		us, err = scanUsers(rows)
+		isErrOrPanic(err)
+		return util.NewErrorFrom(err)
+	})
+	return us, err
+}
+
+// Approve lets the user log in and create teams. The actor has to be one of the APPROVERS
+func (u *User) Approve(ctx context.Context, actor *User) error {
+	if err := checkApprover(actor); err != nil {
+		return err
+	}
+	return doTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.Exec(`UPDATE "user" SET "awaiting_approval" = false WHERE "id" = $1 AND "awaiting_approval" = true`, u.Id)
+		if err := treatUpdateErr(res, err); err != nil {
+			return err
+		}
+		u.AwaitingApproval = false
+		return nil
+	})
+}
@@ -0,0 +1,176 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+// UserEmail is an address of a user. Every account has its primary email here along with its verified additional
+// ones so the primary key keeps an address from belonging to two accounts, whether it is a primary email or an
+// additional one. Addresses are stored lower cased
+type UserEmail struct {
+	Email     string    `scaneo:"pk" json:"email"`
+	User      string    `json:"-"`
+	Primary   bool      `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// normalizeEmail lower cases the address so the same one cannot be registered twice with a different case
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// emailOwner returns the id of the user that has the address as its primary or additional email, or "" if nobody has it
+func emailOwner(tx *sql.Tx, email string) (string, error) {
+	ue := &UserEmail{Email: normalizeEmail(email)}
+	err := ue.dbFind(tx)
+	if isNotExistsErr(err) {
+		return "", nil
+	}
+	if isErrOrPanic(err) {
+		return "", util.NewErrorFrom(err)
+	}
+	return ue.User, nil
+}
+
+// insertEmail stores the address of the user. It fails with a duplicate error in field if another account has it
+func insertEmail(tx *sql.Tx, field string, ue *UserEmail) error {
+	ue.Email = normalizeEmail(ue.Email)
+	ue.CreatedAt = time.Now().UTC()
+	_, err := ue.dbInsert(tx)
+	if IsDuplicateErr(err) {
+		return duplicateEmailErr(field)
+	}
+	if isErrOrPanic(err) {
+		return util.NewErrorFrom(err)
+	}
+	return nil
+}
+
+func duplicateEmailErr(field string) error {
+	errs := util.NewErrorFields().(*util.Error)
+	errs.SetFieldError(field, "duplicate")
+	return errs.SetErrorOrCamo(ErrAlreadyExists)
+}
+
+// findUserByAnyEmail finds the user by its primary email or any of its additional ones
+func findUserByAnyEmail(tx *sql.Tx, email string) (*User, error) {
+	owner, err := emailOwner(tx, email)
+	if err != nil {
+		return nil, err
+	}
+	if len(owner) == 0 {
+		return nil, util.NewErrorFrom(ErrDoesntExist)
+	}
+	return findUser(tx, owner)
+}
+
+// AddEmail starts adding an additional email to the user. The address is only added once the returned token is used
+// with VerifyEmail. Adding an address that is already pending returns the same token so it can be sent again
+func (u *User) AddEmail(ctx context.Context, email string) (t *Token, err error) {
+	email = normalizeEmail(email)
+	if !u.ConfirmedAt.Valid {
+		return nil, util.NewErrorFrom(ErrEmailNotConfirmed)
+	}
+	if !reValidEmail.MatchString(email) {
+		errs := util.NewErrorFields().(*util.Error)
+		errs.SetFieldError("email", "invalid")
+		return nil, errs.SetErrorOrCamo(ErrInvalidAttributes)
+	}
+	return t, doTx(ctx, func(tx *sql.Tx) error {
+		if owner, err := emailOwner(tx, email); err != nil {
+			return err
+		} else if len(owner) > 0 {
+			return duplicateEmailErr("email")
+		}
+		for _, token := range findTokensForUser(tx, u.Id) {
+			if token.Type == TOKEN_EMAIL_VERIFICATION && token.Extra == email {
+				t = token
+				return t.update(tx)
+			}
+		}
+		t = &Token{Type: TOKEN_EMAIL_VERIFICATION, User: u.Id, Extra: email}
+		return t.insert(tx)
+	})
+}
+
+// VerifyEmail consumes a token from AddEmail and adds its address to the user. It fails with ErrAlreadyExists if
+// another account took the address in the meantime
+func (u *User) VerifyEmail(ctx context.Context, token string) (ue *UserEmail, err error) {
+	return ue, doTx(ctx, func(tx *sql.Tx) error {
+		t := &Token{Id: token}
+		err := t.dbFind(tx)
+		if isNotExistsErr(err) {
+			return util.NewErrorFrom(ErrDoesntExist)
+		}
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		if t.Type != TOKEN_EMAIL_VERIFICATION || t.User != u.Id || t.expired() {
+			return util.NewErrorFrom(ErrDoesntExist)
+		}
+		if err := treatUpdateErr(t.dbDelete(tx)); err != nil {
+			return err
+		}
+		ue = &UserEmail{Email: t.Extra, User: u.Id}
+		return insertEmail(tx, "email", ue)
+	})
+}
+
+// GetEmails returns the additional emails of the user. The primary one is not included
+func (u *User) GetEmails(ctx context.Context) (ues []*UserEmail, err error) {
+	return ues, doTx(ctx, func(tx *sql.Tx) error {
+		ues, err = u.getEmails(tx)
+		return err
+	})
+}
+
+func (u *User) getEmails(tx *sql.Tx) ([]*UserEmail, error) {
+	rows, err := tx.Query(`SELECT `+selectUserEmailFields+` FROM "user_email" WHERE "user" = $1 AND NOT "primary" ORDER BY "email"`, u.Id)
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	ues, err := scanUserEmails(rows)
+	isErrOrPanic(err)
+	return ues, util.NewErrorFrom(err)
+}
+
+// SetPrimaryEmail makes one of the additional emails the primary one. The old primary email is kept as an
+// additional one
+func (u *User) SetPrimaryEmail(ctx context.Context, email string) error {
+	email = normalizeEmail(email)
+	if email == u.Email {
+		return nil
+	}
+	return doTx(ctx, func(tx *sql.Tx) error {
+		ue := &UserEmail{Email: email}
+		err := ue.dbFind(tx)
+		if isNotExistsErr(err) || (err == nil && ue.User != u.Id) {
+			return util.NewErrorFrom(ErrDoesntExist)
+		}
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		if _, err := tx.Exec(`UPDATE "user_email" SET "primary" = ("email" = $1) WHERE "user" = $2`, email, u.Id); isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		u.Email = email
+		return u.update(tx)
+	})
+}
+
+// RemoveEmail removes one of the additional emails of the user. The primary email cannot be removed
+func (u *User) RemoveEmail(ctx context.Context, email string) error {
+	email = normalizeEmail(email)
+	if email == u.Email {
+		return util.NewErrorFrom(ErrCannotRemovePrimaryEmail)
+	}
+	return doTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.Exec(`DELETE FROM "user_email" WHERE "email" = $1 AND "user" = $2 AND NOT "primary"`, email, u.Id)
+		return treatUpdateErr(res, err)
+	})
+}
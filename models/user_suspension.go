@@ -0,0 +1,102 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/keydotcat/keycatd/util"
+	"github.com/lib/pq"
+)
+
+var (
+	// Ids of the users that can suspend accounts. A suspension locks the user out of every team so it is left to the
+	// operators of the server and not to team owners
+	SUSPENSION_ADMINS = []string{}
+)
+
+// Longest reason that can be given for a suspension
+const USER_SUSPEND_REASON_MAX_LENGTH = 256
+
+func checkSuspensionAdmin(actor *User) error {
+	for _, id := range SUSPENSION_ADMINS {
+		if id == actor.Id {
+			return nil
+		}
+	}
+	return util.NewErrorFrom(ErrUnauthorized)
+}
+
+// Suspend blocks the user from logging in without touching any of its data. The actor has to be one of the
+// SUSPENSION_ADMINS. It is recorded in the audit log of every team of the user along with the reason
+func (u *User) Suspend(ctx context.Context, actor *User, reason string) error {
+	if err := checkSuspensionAdmin(actor); err != nil {
+		return err
+	}
+	if actor.Id == u.Id {
+		return util.NewErrorFrom(ErrUnauthorized)
+	}
+	if len(reason) > USER_SUSPEND_REASON_MAX_LENGTH {
+		errs := util.NewErrorFields().(*util.Error)
+		errs.SetFieldError("reason", "invalid")
+		return errs.SetErrorOrCamo(ErrInvalidAttributes)
+	}
+	return doTx(ctx, func(tx *sql.Tx) error {
+		now := time.Now().UTC()
+		res, err := tx.Exec(`UPDATE "user" SET "suspended_at" = $1, "suspended_reason" = $2 WHERE "id" = $3`, now, reason, u.Id)
+		if err := treatUpdateErr(res, err); err != nil {
+			return err
+		}
+		u.SuspendedAt = pq.NullTime{Time: now, Valid: true}
+		u.SuspendedReason = reason
+		target := u.Id
+		if len(reason) > 0 {
+			target += ": " + reason
+		}
+		return u.auditAllTeams(tx, actor.Id, target, TEAM_AUDIT_USER_SUSPEND)
+	})
+}
+
+// Unsuspend lets a suspended user log in again. Like Suspend it can only be done by one of the SUSPENSION_ADMINS
+func (u *User) Unsuspend(ctx context.Context, actor *User) error {
+	if err := checkSuspensionAdmin(actor); err != nil {
+		return err
+	}
+	return doTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.Exec(`UPDATE "user" SET "suspended_at" = NULL, "suspended_reason" = '' WHERE "id" = $1`, u.Id)
+		if err := treatUpdateErr(res, err); err != nil {
+			return err
+		}
+		u.SuspendedAt = pq.NullTime{}
+		u.SuspendedReason = ""
+		return u.auditAllTeams(tx, actor.Id, u.Id, TEAM_AUDIT_USER_UNSUSPEND)
+	})
+}
+
+// auditAllTeams writes the action to the audit log of every team the user belongs to
+func (u *User) auditAllTeams(tx *sql.Tx, actor, target, action string) error {
+	rows, err := tx.Query(`SELECT "team" FROM "team_user" WHERE "user" = $1`, u.Id)
+	if isErrOrPanic(err) {
+		return util.NewErrorFrom(err)
+	}
+	tids := []string{}
+	for rows.Next() {
+		var tid string
+		if err := rows.Scan(&tid); isErrOrPanic(err) {
+			rows.Close()
+			return util.NewErrorFrom(err)
+		}
+		tids = append(tids, tid)
+	}
+	rows.Close()
+	if err := rows.Err(); isErrOrPanic(err) {
+		return util.NewErrorFrom(err)
+	}
+	for _, tid := range tids {
+		t := &Team{Id: tid}
+		if err := t.audit(tx, actor, target, action); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,8 +2,11 @@ package models
 
 import (
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/keydotcat/keycatd/thelpers"
 	"github.com/keydotcat/keycatd/util"
 )
 
@@ -21,6 +24,19 @@ func getDummyUser() *User {
 	return u
 }
 
+func getConfirmedDummyUser() *User {
+	ctx := getCtx()
+	u := getDummyUser()
+	tok, err := u.GetVerificationToken(ctx)
+	if err != nil {
+		panic(err)
+	}
+	if err := u.ConfirmEmail(ctx, tok.Id); err != nil {
+		panic(err)
+	}
+	return u
+}
+
 func TestCreateUser(t *testing.T) {
 	ctx := getCtx()
 	uid := util.GenerateRandomToken(5)
@@ -94,3 +110,504 @@ func TestCreateUser(t *testing.T) {
 		t.Errorf("Mismatch in user IDs. Got %s and expected %s", nu.Id, u.Id)
 	}
 }
+
+func TestPurgeUnverifiedUsers(t *testing.T) {
+	ctx := getCtx()
+	u := getDummyUser()
+	findToRemind := func(u *User) bool {
+		us, err := FindUnverifiedUsersToRemind(ctx, time.Now().UTC().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, fu := range us {
+			if fu.Id == u.Id {
+				return true
+			}
+		}
+		return false
+	}
+	if !findToRemind(u) {
+		t.Fatalf("Expected to find unverified user %s", u.Id)
+	}
+	// Nobody is deleted before being reminded
+	if _, err := PurgeUnverifiedRemindedBefore(ctx, time.Now().UTC().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FindUser(ctx, u.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.SetPurgeReminded(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if findToRemind(u) {
+		t.Fatalf("Expected user %s not to be reminded twice", u.Id)
+	}
+	// Still in the grace period
+	if _, err := PurgeUnverifiedRemindedBefore(ctx, time.Now().UTC().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FindUser(ctx, u.Id); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := PurgeUnverifiedRemindedBefore(ctx, time.Now().UTC().Add(time.Minute)); err != nil || n < 1 {
+		t.Fatalf("Expected to purge the reminded user: %d %v", n, err)
+	}
+	if _, err := FindUser(ctx, u.Id); !util.CheckErr(err, ErrDoesntExist) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrDoesntExist, err)
+	}
+	u = getDummyUser()
+	tok, err := u.GetVerificationToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tok.ConfirmEmail(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if findToRemind(u) {
+		t.Fatalf("Expected verified user %s not to be reminded", u.Id)
+	}
+	if err = u.SetPurgeReminded(ctx); !util.CheckErr(err, ErrDoesntExist) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrDoesntExist, err)
+	}
+}
+
+func TestSuspendUser(t *testing.T) {
+	ctx := getCtx()
+	admin := getDummyUser()
+	SUSPENSION_ADMINS = []string{admin.Id}
+	defer func() { SUSPENSION_ADMINS = []string{} }()
+	owner := getDummyUser()
+	team := createTeamMock(owner)
+	member := getDummyUser()
+	if _, err := team.AddOrInviteUserByEmail(ctx, owner, member.Email, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := member.Suspend(ctx, owner, "nope"); !util.CheckErr(err, ErrUnauthorized) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrUnauthorized, err)
+	}
+	if err := admin.Suspend(ctx, admin, "myself"); !util.CheckErr(err, ErrUnauthorized) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrUnauthorized, err)
+	}
+	if err := member.Suspend(ctx, admin, "investigation"); err != nil {
+		t.Fatal(err)
+	}
+	logs, err := team.GetAuditLog(ctx, owner, time.Time{}, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := logs[len(logs)-1]; last.Action != TEAM_AUDIT_USER_SUSPEND || last.Target != member.Id+": investigation" || last.Actor != admin.Id {
+		t.Fatalf("Expected the suspension to be audited and got %s %s", last.Action, last.Target)
+	}
+	su, err := FindUser(ctx, member.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !su.IsSuspended() || su.SuspendedReason != "investigation" {
+		t.Fatalf("User was expected to be suspended")
+	}
+	if _, err := team.CheckAdmin(ctx, member); err != nil {
+		t.Fatalf("Suspension should keep team memberships: %s", err)
+	}
+	if err := member.Unsuspend(ctx, owner); !util.CheckErr(err, ErrUnauthorized) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrUnauthorized, err)
+	}
+	if err := member.Unsuspend(ctx, admin); err != nil {
+		t.Fatal(err)
+	}
+	su, err = FindUser(ctx, member.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if su.IsSuspended() {
+		t.Fatalf("User was expected to be active again")
+	}
+}
+
+func TestOwnerOfUnrelatedTeamCannotSuspend(t *testing.T) {
+	ctx := getCtx()
+	victim, _ := getDummyOwnerWithTeam()
+	stranger, strangerTeam := getDummyOwnerWithTeam()
+	// Existing accounts are added to the team without asking them
+	if _, err := strangerTeam.AddOrInviteUserByEmail(ctx, stranger, victim.Email, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := victim.Suspend(ctx, stranger, "lockout"); !util.CheckErr(err, ErrUnauthorized) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrUnauthorized, err)
+	}
+	su, err := FindUser(ctx, victim.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if su.IsSuspended() {
+		t.Fatalf("The owner of an unrelated team suspended the user")
+	}
+}
+
+func TestApproveUser(t *testing.T) {
+	ctx := getCtx()
+	approver := getDummyUser()
+	defer func() { REQUIRE_APPROVAL, APPROVERS = false, []string{} }()
+	REQUIRE_APPROVAL = true
+	APPROVERS = []string{approver.Id}
+	u := getDummyUser()
+	if !u.AwaitingApproval {
+		t.Fatalf("New user was expected to wait for approval")
+	}
+	privKeys := getUserPrivateKeys(u.PublicKey, u.Key)
+	if _, err := u.CreateTeam(ctx, "pending", getDummyVaultKeyPair(privKeys, u.Id)); !util.CheckErr(err, ErrAwaitingApproval) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrAwaitingApproval, err)
+	}
+	if err := u.Approve(ctx, getDummyUser()); !util.CheckErr(err, ErrUnauthorized) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrUnauthorized, err)
+	}
+	pending, err := FindUsersAwaitingApproval(ctx, approver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, p := range pending {
+		found = found || p.Id == u.Id
+	}
+	if !found {
+		t.Fatalf("Expected %s in the approval queue", u.Id)
+	}
+	if err := u.Approve(ctx, approver); err != nil {
+		t.Fatal(err)
+	}
+	au, err := FindUser(ctx, u.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if au.AwaitingApproval {
+		t.Fatalf("User was expected to be approved")
+	}
+	if _, err := au.CreateTeam(ctx, "approved", getDummyVaultKeyPair(privKeys, u.Id)); err != nil {
+		t.Fatal(err)
+	}
+	if err := au.Approve(ctx, approver); !util.CheckErr(err, ErrDoesntExist) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrDoesntExist, err)
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	ctx := getCtx()
+	u := getDummyUser()
+	b32 := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	secret, err := util.DecodeTOTPSecret(b32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.VerifyTOTP(ctx, "123456"); !util.CheckErr(err, ErrTOTPNotEnabled) {
+		t.Fatalf("Expected error %s and got %s", ErrTOTPNotEnabled, err)
+	}
+	codes, err := u.EnableTOTP(ctx, b32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != TOTP_RECOVERY_CODES {
+		t.Fatalf("Expected %d recovery codes and got %d", TOTP_RECOVERY_CODES, len(codes))
+	}
+	if _, err := u.EnableTOTP(ctx, b32); !util.CheckErr(err, ErrAlreadyExists) {
+		t.Fatalf("Expected error %s and got %s", ErrAlreadyExists, err)
+	}
+	if enabled, err := u.HasTOTP(ctx); err != nil || !enabled {
+		t.Fatalf("Expected totp to be enabled (%s)", err)
+	}
+	step := util.TOTPStep(time.Now())
+	code := util.TOTPCode(secret, step)
+	if err := u.VerifyTOTP(ctx, code); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.VerifyTOTP(ctx, code); !util.CheckErr(err, ErrInvalidTOTPCode) {
+		t.Fatalf("Expected a reused code to be refused and got %s", err)
+	}
+	if err := u.VerifyTOTP(ctx, util.TOTPCode(secret, step-1)); !util.CheckErr(err, ErrInvalidTOTPCode) {
+		t.Fatalf("Expected an older code to be refused and got %s", err)
+	}
+	if err := u.VerifyTOTP(ctx, codes[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.VerifyTOTP(ctx, codes[0]); !util.CheckErr(err, ErrInvalidTOTPCode) {
+		t.Fatalf("Expected recovery codes to be single use and got %s", err)
+	}
+	if err := u.DisableTOTP(ctx, "000000"); !util.CheckErr(err, ErrInvalidTOTPCode) {
+		t.Fatalf("Expected error %s and got %s", ErrInvalidTOTPCode, err)
+	}
+	if err := u.DisableTOTP(ctx, codes[1]); err != nil {
+		t.Fatal(err)
+	}
+	if enabled, err := u.HasTOTP(ctx); err != nil || enabled {
+		t.Fatalf("Expected totp to be disabled (%s)", err)
+	}
+}
+
+func webAuthnLogin(u *User, fa *thelpers.FakeAuthenticator) error {
+	ctx := getCtx()
+	opts, err := u.BeginWebAuthnLogin(ctx)
+	if err != nil {
+		return err
+	}
+	cd, ad, sig := fa.Assert(opts.Challenge)
+	return u.VerifyWebAuthn(ctx, &WebAuthnAssertion{fa.CredentialId, cd, ad, sig})
+}
+
+func registerWebAuthn(t *testing.T, u *User, name string) *thelpers.FakeAuthenticator {
+	ctx := getCtx()
+	fa := thelpers.NewFakeAuthenticator(WEBAUTHN_RP_ID, WEBAUTHN_ORIGIN)
+	opts, err := u.BeginWebAuthnRegistration(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := u.FinishWebAuthnRegistration(ctx, name, fa.ClientData(util.WEBAUTHN_TYPE_CREATE, opts.Challenge), fa.AttestationObject()); err != nil {
+		t.Fatal(err)
+	}
+	return fa
+}
+
+func TestWebAuthnCounterRegression(t *testing.T) {
+	u := getDummyUser()
+	if _, err := u.BeginWebAuthnLogin(getCtx()); !util.CheckErr(err, ErrWebAuthnNotEnabled) {
+		t.Fatalf("Expected error %s and got %s", ErrWebAuthnNotEnabled, err)
+	}
+	fa := registerWebAuthn(t, u, "key")
+	if enabled, err := u.HasWebAuthn(getCtx()); err != nil || !enabled {
+		t.Fatalf("Expected webauthn to be enabled (%v)", err)
+	}
+	if err := webAuthnLogin(u, fa); err != nil {
+		t.Fatal(err)
+	}
+	if err := webAuthnLogin(u, fa); err != nil {
+		t.Fatal(err)
+	}
+	fa.SignCount = 1
+	if err := webAuthnLogin(u, fa); !util.CheckErr(err, ErrAuthenticatorCloned) {
+		t.Fatalf("Expected error %s and got %s", ErrAuthenticatorCloned, err)
+	}
+	// A challenge cannot be answered twice
+	opts, err := u.BeginWebAuthnLogin(getCtx())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fa.SignCount = 10
+	cd, ad, sig := fa.Assert(opts.Challenge)
+	if err := u.VerifyWebAuthn(getCtx(), &WebAuthnAssertion{fa.CredentialId, cd, ad, sig}); err != nil {
+		t.Fatal(err)
+	}
+	cd, ad, sig = fa.Assert(opts.Challenge)
+	if err := u.VerifyWebAuthn(getCtx(), &WebAuthnAssertion{fa.CredentialId, cd, ad, sig}); !util.CheckErr(err, ErrInvalidWebAuthn) {
+		t.Fatalf("Expected error %s and got %s", ErrInvalidWebAuthn, err)
+	}
+}
+
+func TestWebAuthnMultipleCredentials(t *testing.T) {
+	ctx := getCtx()
+	u := getDummyUser()
+	fa1 := registerWebAuthn(t, u, "desk key")
+	fa2 := registerWebAuthn(t, u, "travel key")
+	opts, err := u.BeginWebAuthnRegistration(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(opts.ExcludeCredentials) != 2 {
+		t.Fatalf("Expected 2 excluded credentials and got %d", len(opts.ExcludeCredentials))
+	}
+	uws, err := u.GetWebAuthnCredentials(ctx)
+	if err != nil || len(uws) != 2 {
+		t.Fatalf("Expected 2 credentials and got %d (%v)", len(uws), err)
+	}
+	// Counters are tracked per credential
+	fa2.SignCount = 20
+	if err := webAuthnLogin(u, fa2); err != nil {
+		t.Fatal(err)
+	}
+	if err := webAuthnLogin(u, fa1); err != nil {
+		t.Fatal(err)
+	}
+	other := thelpers.NewFakeAuthenticator(WEBAUTHN_RP_ID, WEBAUTHN_ORIGIN)
+	if err := webAuthnLogin(u, other); !util.CheckErr(err, ErrInvalidWebAuthn) {
+		t.Fatalf("Expected error %s and got %s", ErrInvalidWebAuthn, err)
+	}
+	if err := u.DeleteWebAuthn(ctx, fa1.CredentialId, nil, ""); !util.CheckErr(err, ErrSecondFactorRequired) {
+		t.Fatalf("Expected error %s and got %s", ErrSecondFactorRequired, err)
+	}
+	// A rejected assertion burns the challenge
+	lopts, err := u.BeginWebAuthnLogin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cd, ad, sig := other.Assert(lopts.Challenge)
+	if err := u.DeleteWebAuthn(ctx, fa1.CredentialId, &WebAuthnAssertion{other.CredentialId, cd, ad, sig}, ""); !util.CheckErr(err, ErrInvalidWebAuthn) {
+		t.Fatalf("Expected error %s and got %s", ErrInvalidWebAuthn, err)
+	}
+	cd, ad, sig = fa2.Assert(lopts.Challenge)
+	if err := u.DeleteWebAuthn(ctx, fa1.CredentialId, &WebAuthnAssertion{fa2.CredentialId, cd, ad, sig}, ""); !util.CheckErr(err, ErrInvalidWebAuthn) {
+		t.Fatalf("Expected error %s and got %s", ErrInvalidWebAuthn, err)
+	}
+	lopts, err = u.BeginWebAuthnLogin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cd, ad, sig = fa2.Assert(lopts.Challenge)
+	if err := u.DeleteWebAuthn(ctx, fa1.CredentialId, &WebAuthnAssertion{fa2.CredentialId, cd, ad, sig}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := webAuthnLogin(u, fa1); !util.CheckErr(err, ErrInvalidWebAuthn) {
+		t.Fatalf("Expected error %s and got %s", ErrInvalidWebAuthn, err)
+	}
+	if err := webAuthnLogin(u, fa2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	member := getDummyUser()
+	if _, err := team.AddOrInviteUserByEmail(ctx, owner, member.Email, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := owner.Delete(ctx); !util.CheckErr(err, ErrOwnsTeams) || !util.CheckFieldErr(err, "teams", team.Id) {
+		t.Fatalf("Expected %s listing team %s and got %v", ErrOwnsTeams, team.Id, err)
+	}
+	if err := member.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FindUser(ctx, member.Id); !util.CheckErr(err, ErrDoesntExist) {
+		t.Fatalf("Unexpected error: %s vs %s", ErrDoesntExist, err)
+	}
+	var rows int
+	if err := mdb.QueryRow(`SELECT (SELECT COUNT(*) FROM "team_user" WHERE "user" = $1) + (SELECT COUNT(*) FROM "vault_user" WHERE "user" = $1)`, member.Id).Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 0 {
+		t.Fatalf("Deleted user still has %d membership rows", rows)
+	}
+	if err := member.Delete(ctx); err != nil {
+		t.Fatalf("Deleting the user again should be a no-op and got %s", err)
+	}
+	other := createTeamMock(owner)
+	if err := owner.Delete(ctx); !util.CheckFieldErr(err, "teams", other.Id) {
+		t.Fatalf("Expected %s listing team %s and got %v", ErrOwnsTeams, other.Id, err)
+	}
+	solo, soloTeam := getDummyOwnerWithTeam()
+	if err := solo.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FindTeam(ctx, soloTeam.Id); !util.CheckErr(err, ErrDoesntExist) {
+		t.Fatalf("The primary team should be deleted with its owner and got %v", err)
+	}
+}
+
+func TestRotateKeyPair(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	createVaultMock(owner, team)
+	other := createTeamMock(owner)
+	rewrapped := map[string][]byte{}
+	for _, tm := range []*Team{team, other} {
+		vs, err := tm.GetVaultsFullForUser(ctx, owner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, vf := range vs {
+			rewrapped[VaultKeyId(tm.Id, vf.Id)] = sealVaultKey(&vf.Vault, unsealVaultKey(&vf.Vault, vf.Key))
+		}
+	}
+	if len(rewrapped) != 3 {
+		t.Fatalf("Expected 3 vaults and got %d", len(rewrapped))
+	}
+	_, _, pack := generateNewKeys()
+	oldPub := owner.PublicKey
+	missing := map[string][]byte{}
+	for k, v := range rewrapped {
+		missing[k] = v
+	}
+	for k := range missing {
+		delete(missing, k)
+		break
+	}
+	if err := owner.RotateKeyPair(ctx, pack, missing); !util.CheckErr(err, ErrInvalidKeys) {
+		t.Fatalf("Expected %s and got %v", ErrInvalidKeys, err)
+	}
+	if u, err := FindUser(ctx, owner.Id); err != nil || string(u.PublicKey) != string(oldPub) {
+		t.Fatalf("The key pair changed after a failed rotation: %v", err)
+	}
+	if err := owner.RotateKeyPair(ctx, pack, rewrapped); err != nil {
+		t.Fatal(err)
+	}
+	u, err := FindUser(ctx, owner.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(u.PublicKey) != string(pack[:publicKeyPackSize]) {
+		t.Fatalf("The public key was not rotated")
+	}
+	vs, err := team.GetVaultsFullForUser(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, vf := range vs {
+		if string(vf.Key) != string(rewrapped[VaultKeyId(team.Id, vf.Id)]) {
+			t.Fatalf("Vault %s key was not rewrapped", vf.Id)
+		}
+	}
+}
+
+func TestUserEmails(t *testing.T) {
+	ctx := getCtx()
+	u := getConfirmedDummyUser()
+	primary := u.Email
+	if _, err := getDummyUser().AddEmail(ctx, "x@nowhere.net"); !util.CheckErr(err, ErrEmailNotConfirmed) {
+		t.Fatalf("Expected error %s and got %s", ErrEmailNotConfirmed, err)
+	}
+	second := "e_" + util.GenerateRandomToken(10) + "@nowhere.net"
+	tok, err := u.AddEmail(ctx, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := u.AddEmail(ctx, primary); !util.CheckFieldErr(err, "email", "duplicate") {
+		t.Fatalf("Expected the primary email to be refused and got %s", err)
+	}
+	if _, err := u.VerifyEmail(ctx, "nope"); !util.CheckErr(err, ErrDoesntExist) {
+		t.Fatalf("Expected error %s and got %s", ErrDoesntExist, err)
+	}
+	if _, err := u.VerifyEmail(ctx, tok.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getConfirmedDummyUser().AddEmail(ctx, strings.ToUpper(second)); !util.CheckFieldErr(err, "email", "duplicate") {
+		t.Fatalf("Expected an email of another account to be refused and got %s", err)
+	}
+	_, priv, fullpack := generateNewKeys()
+	uid := "u_" + util.GenerateRandomToken(10)
+	if _, _, err := NewUser(ctx, uid, "uid fullname", second, uid, fullpack, getDummyVaultKeyPair(priv, uid)); !util.CheckFieldErr(err, "user_email", "duplicate") {
+		t.Fatalf("Expected signups with an additional email to be refused and got %s", err)
+	}
+	if err := u.RemoveEmail(ctx, primary); !util.CheckErr(err, ErrCannotRemovePrimaryEmail) {
+		t.Fatalf("Expected error %s and got %s", ErrCannotRemovePrimaryEmail, err)
+	}
+	if err := u.SetPrimaryEmail(ctx, second); err != nil {
+		t.Fatal(err)
+	}
+	if u, err = FindUser(ctx, u.Id); err != nil {
+		t.Fatal(err)
+	}
+	if u.Email != strings.ToLower(second) {
+		t.Fatalf("Expected primary email %s and got %s", second, u.Email)
+	}
+	ues, err := u.GetEmails(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ues) != 1 || ues[0].Email != primary {
+		t.Fatalf("Expected the old primary email to be kept: %+v", ues)
+	}
+	if err := u.RemoveEmail(ctx, strings.ToUpper(second)); !util.CheckErr(err, ErrCannotRemovePrimaryEmail) {
+		t.Fatalf("Expected error %s and got %s", ErrCannotRemovePrimaryEmail, err)
+	}
+	if err := u.RemoveEmail(ctx, primary); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.RemoveEmail(ctx, primary); !util.CheckErr(err, ErrDoesntExist) {
+		t.Fatalf("Expected error %s and got %s", ErrDoesntExist, err)
+	}
+}
@@ -0,0 +1,153 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"time"
+
+	"github.com/keydotcat/keycatd/util"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const TOTP_RECOVERY_CODES = 10
+
+// Key used to encrypt the totp secrets in the db. It has to be stable across restarts
+var TOTP_ENCRYPTION_KEY = [32]byte{}
+
+func init() {
+	copy(TOTP_ENCRYPTION_KEY[:], util.GenerateRandomByteArray(32))
+}
+
+type UserTOTP struct {
+	User      string    `scaneo:"pk" json:"-"`
+	Secret    []byte    `json:"-"`
+	LastStep  int64     `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func sealTOTPSecret(secret []byte) []byte {
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		panic(err)
+	}
+	return secretbox.Seal(nonce[:], secret, &nonce, &TOTP_ENCRYPTION_KEY)
+}
+
+func openTOTPSecret(sealed []byte) ([]byte, error) {
+	if len(sealed) < 24+secretbox.Overhead {
+		return nil, util.NewErrorFrom(ErrInvalidAttributes)
+	}
+	var nonce [24]byte
+	copy(nonce[:], sealed[:24])
+	secret, ok := secretbox.Open(nil, sealed[24:], &nonce, &TOTP_ENCRYPTION_KEY)
+	if !ok {
+		return nil, util.NewErrorf("Could not decrypt the totp secret")
+	}
+	return secret, nil
+}
+
+func (u *User) findTOTP(tx *sql.Tx) (*UserTOTP, error) {
+	ut := &UserTOTP{}
+	err := ut.dbScanRow(tx.QueryRow(`SELECT `+selectUserTOTPFields+` FROM "user_totp" WHERE "user" = $1 FOR UPDATE`, u.Id))
+	if isNotExistsErr(err) {
+		return nil, util.NewErrorFrom(ErrTOTPNotEnabled)
+	}
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	return ut, nil
+}
+
+// HasTOTP tells if the user has to give a totp code to log in
+func (u *User) HasTOTP(ctx context.Context) (enabled bool, err error) {
+	return enabled, doTx(ctx, func(tx *sql.Tx) error {
+		_, err := u.findTOTP(tx)
+		if util.CheckErr(err, ErrTOTPNotEnabled) {
+			return nil
+		}
+		enabled = err == nil
+		return err
+	})
+}
+
+// EnableTOTP stores the base32 secret encrypted and returns the recovery codes. They are not stored in clear so
+// this is the only time they can be shown
+func (u *User) EnableTOTP(ctx context.Context, secret string) (codes []string, err error) {
+	key, err := util.DecodeTOTPSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	return codes, doTx(ctx, func(tx *sql.Tx) error {
+		ut := &UserTOTP{User: u.Id, Secret: sealTOTPSecret(key), LastStep: 0, CreatedAt: time.Now().UTC()}
+		_, err := ut.dbInsert(tx)
+		if IsDuplicateErr(err) {
+			return util.NewErrorFrom(ErrAlreadyExists)
+		}
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		codes = make([]string, TOTP_RECOVERY_CODES)
+		for i := range codes {
+			codes[i] = util.GenerateRandomToken(12)
+			t := &Token{Id: hashToken(codes[i]), Type: TOKEN_TOTP_RECOVERY, User: u.Id}
+			if err := t.insert(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// VerifyTOTP accepts a code for the current 30 second window (with one step of skew) or a recovery code. A code
+// cannot be used twice and recovery codes are discarded once used
+func (u *User) VerifyTOTP(ctx context.Context, code string) error {
+	return doTx(ctx, func(tx *sql.Tx) error {
+		return u.verifyTOTP(tx, code)
+	})
+}
+
+func (u *User) verifyTOTP(tx *sql.Tx, code string) error {
+	ut, err := u.findTOTP(tx)
+	if err != nil {
+		return err
+	}
+	secret, err := openTOTPSecret(ut.Secret)
+	if err != nil {
+		return err
+	}
+	if step, ok := util.CheckTOTP(secret, code, time.Now()); ok {
+		if step <= ut.LastStep {
+			return util.NewErrorFrom(ErrInvalidTOTPCode)
+		}
+		ut.LastStep = step
+		return treatUpdateErr(ut.dbUpdate(tx))
+	}
+	if len(code) == 0 {
+		return util.NewErrorFrom(ErrInvalidTOTPCode)
+	}
+	res, err := tx.Exec(`DELETE FROM "token" WHERE "id" = $1 AND "user" = $2 AND "type" = $3`, hashToken(code), u.Id, TOKEN_TOTP_RECOVERY)
+	if isErrOrPanic(err) {
+		return util.NewErrorFrom(err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return util.NewErrorFrom(ErrInvalidTOTPCode)
+	}
+	return nil
+}
+
+// DisableTOTP removes the secret and the recovery codes if the code is valid
+func (u *User) DisableTOTP(ctx context.Context, code string) error {
+	return doTx(ctx, func(tx *sql.Tx) error {
+		if err := u.verifyTOTP(tx, code); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM "user_totp" WHERE "user" = $1`, u.Id); isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		if _, err := tx.Exec(`DELETE FROM "token" WHERE "user" = $1 AND "type" = $2`, u.Id, TOKEN_TOTP_RECOVERY); isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		return nil
+	})
+}
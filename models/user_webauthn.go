@@ -0,0 +1,266 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"time"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+// Relying party the credentials are bound to. The api sets them from the public url of the server
+var (
+	WEBAUTHN_RP_ID  = "localhost"
+	WEBAUTHN_ORIGIN = "http://localhost"
+)
+
+// How long a registration or login challenge can be answered
+var WEBAUTHN_CHALLENGE_TTL = 5 * time.Minute
+
+// Max security keys a user can register
+const WEBAUTHN_MAX_CREDENTIALS = 10
+
+// UserWebAuthn is a security key registered as a second factor. SignCount is the last counter seen from the
+// authenticator and is used to detect cloned keys
+type UserWebAuthn struct {
+	User         string    `scaneo:"pk" json:"-"`
+	CredentialId []byte    `scaneo:"pk" json:"credential_id"`
+	PublicKey    []byte    `json:"-"`
+	SignCount    int64     `json:"-"`
+	Name         string    `json:"name"`
+	CreatedAt    time.Time `json:"created_at"`
+	LastUsedAt   time.Time `json:"last_used_at"`
+}
+
+// WebAuthnRegistrationOptions has what the client needs to create a credential with navigator.credentials.create
+type WebAuthnRegistrationOptions struct {
+	Challenge          string   `json:"challenge"`
+	RPID               string   `json:"rp_id"`
+	UserId             string   `json:"user_id"`
+	UserName           string   `json:"user_name"`
+	ExcludeCredentials [][]byte `json:"exclude_credentials"`
+}
+
+// WebAuthnLoginOptions has what the client needs to get an assertion with navigator.credentials.get
+type WebAuthnLoginOptions struct {
+	Challenge        string   `json:"challenge"`
+	RPID             string   `json:"rp_id"`
+	AllowCredentials [][]byte `json:"allow_credentials"`
+}
+
+// WebAuthnAssertion is the response of the authenticator to a login challenge
+type WebAuthnAssertion struct {
+	CredentialId      []byte `json:"credential_id"`
+	ClientDataJSON    []byte `json:"client_data_json"`
+	AuthenticatorData []byte `json:"authenticator_data"`
+	Signature         []byte `json:"signature"`
+}
+
+func (u *User) findWebAuthns(tx *sql.Tx) ([]*UserWebAuthn, error) {
+	rows, err := tx.Query(`SELECT `+selectUserWebAuthnFields+` FROM "user_webauthn" WHERE "user" = $1 ORDER BY "created_at"`, u.Id)
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	uws, err := scanUserWebAuthns(rows)
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	return uws, nil
+}
+
+// GetWebAuthnCredentials returns the security keys of the user
+func (u *User) GetWebAuthnCredentials(ctx context.Context) (uws []*UserWebAuthn, err error) {
+	return uws, doTx(ctx, func(tx *sql.Tx) error {
+		uws, err = u.findWebAuthns(tx)
+		return err
+	})
+}
+
+// HasWebAuthn tells if the user can answer a webauthn challenge to log in
+func (u *User) HasWebAuthn(ctx context.Context) (enabled bool, err error) {
+	return enabled, doTx(ctx, func(tx *sql.Tx) error {
+		var n int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM "user_webauthn" WHERE "user" = $1`, u.Id).Scan(&n); isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		enabled = n > 0
+		return nil
+	})
+}
+
+// newWebAuthnChallenge replaces any pending challenge of the same type. Only the hash is stored like other tokens
+func (u *User) newWebAuthnChallenge(tx *sql.Tx, tokenType int) (string, error) {
+	if _, err := tx.Exec(`DELETE FROM "token" WHERE "user" = $1 AND "type" = $2`, u.Id, tokenType); isErrOrPanic(err) {
+		return "", util.NewErrorFrom(err)
+	}
+	challenge := base64.RawURLEncoding.EncodeToString(util.GenerateRandomByteArray(32))
+	t := &Token{Id: hashToken(challenge), Type: tokenType, User: u.Id}
+	return challenge, t.insert(tx)
+}
+
+// consumeWebAuthnChallenge checks the client data was signed for a pending challenge of the user and discards it.
+// The challenge is deleted in its own transaction so it cannot be answered again even if the response is rejected
+func (u *User) consumeWebAuthnChallenge(ctx context.Context, tokenType int, clientDataJSON []byte, typ string) error {
+	challenge, err := util.WebAuthnChallenge(clientDataJSON)
+	if err != nil {
+		return util.NewErrorFrom(ErrInvalidWebAuthn)
+	}
+	var createdAt time.Time
+	err = doTx(ctx, func(tx *sql.Tx) error {
+		err := tx.QueryRow(`DELETE FROM "token" WHERE "id" = $1 AND "user" = $2 AND "type" = $3 RETURNING "created_at"`, hashToken(challenge), u.Id, tokenType).Scan(&createdAt)
+		if isNotExistsErr(err) {
+			return util.NewErrorFrom(ErrInvalidWebAuthn)
+		}
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if time.Since(createdAt) > WEBAUTHN_CHALLENGE_TTL {
+		return util.NewErrorFrom(ErrInvalidWebAuthn)
+	}
+	if err := util.CheckWebAuthnClientData(clientDataJSON, typ, challenge, WEBAUTHN_ORIGIN); err != nil {
+		return util.NewErrorFrom(ErrInvalidWebAuthn)
+	}
+	return nil
+}
+
+// BeginWebAuthnRegistration creates the challenge to register a new security key
+func (u *User) BeginWebAuthnRegistration(ctx context.Context) (opts *WebAuthnRegistrationOptions, err error) {
+	return opts, doTx(ctx, func(tx *sql.Tx) error {
+		uws, err := u.findWebAuthns(tx)
+		if err != nil {
+			return err
+		}
+		if len(uws) >= WEBAUTHN_MAX_CREDENTIALS {
+			return util.NewErrorFrom(ErrTooManyCredentials)
+		}
+		opts = &WebAuthnRegistrationOptions{RPID: WEBAUTHN_RP_ID, UserId: u.Id, UserName: u.Email, ExcludeCredentials: [][]byte{}}
+		for _, uw := range uws {
+			opts.ExcludeCredentials = append(opts.ExcludeCredentials, uw.CredentialId)
+		}
+		opts.Challenge, err = u.newWebAuthnChallenge(tx, TOKEN_WEBAUTHN_REGISTRATION)
+		return err
+	})
+}
+
+// FinishWebAuthnRegistration stores the credential created by the authenticator for a pending registration challenge
+func (u *User) FinishWebAuthnRegistration(ctx context.Context, name string, clientDataJSON, attestationObject []byte) (uw *UserWebAuthn, err error) {
+	if len(name) == 0 || len(name) > 100 {
+		errs := util.NewErrorFields().(*util.Error)
+		errs.SetFieldError("name", "invalid")
+		return nil, errs.SetErrorOrCamo(ErrInvalidAttributes)
+	}
+	if err := u.consumeWebAuthnChallenge(ctx, TOKEN_WEBAUTHN_REGISTRATION, clientDataJSON, util.WEBAUTHN_TYPE_CREATE); err != nil {
+		return nil, err
+	}
+	return uw, doTx(ctx, func(tx *sql.Tx) error {
+		ad, err := util.ParseWebAuthnAttestation(attestationObject)
+		if err != nil || !ad.CheckRPID(WEBAUTHN_RP_ID) || ad.Flags&util.WEBAUTHN_FLAG_USER_PRESENT == 0 {
+			return util.NewErrorFrom(ErrInvalidWebAuthn)
+		}
+		now := time.Now().UTC()
+		uw = &UserWebAuthn{
+			User:         u.Id,
+			CredentialId: ad.CredentialId,
+			PublicKey:    ad.PublicKey,
+			SignCount:    int64(ad.SignCount),
+			Name:         name,
+			CreatedAt:    now,
+			LastUsedAt:   now,
+		}
+		_, err = uw.dbInsert(tx)
+		if IsDuplicateErr(err) {
+			return util.NewErrorFrom(ErrAlreadyExists)
+		}
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		return nil
+	})
+}
+
+// BeginWebAuthnLogin creates the challenge the user has to sign with one of the registered security keys
+func (u *User) BeginWebAuthnLogin(ctx context.Context) (opts *WebAuthnLoginOptions, err error) {
+	return opts, doTx(ctx, func(tx *sql.Tx) error {
+		uws, err := u.findWebAuthns(tx)
+		if err != nil {
+			return err
+		}
+		if len(uws) == 0 {
+			return util.NewErrorFrom(ErrWebAuthnNotEnabled)
+		}
+		opts = &WebAuthnLoginOptions{RPID: WEBAUTHN_RP_ID}
+		for _, uw := range uws {
+			opts.AllowCredentials = append(opts.AllowCredentials, uw.CredentialId)
+		}
+		opts.Challenge, err = u.newWebAuthnChallenge(tx, TOKEN_WEBAUTHN_LOGIN)
+		return err
+	})
+}
+
+// VerifyWebAuthn checks an assertion for a pending login challenge. Authenticators increase their counter on each
+// use so a counter that does not grow means the key has been cloned and the login is refused
+func (u *User) VerifyWebAuthn(ctx context.Context, a *WebAuthnAssertion) error {
+	if a == nil {
+		return util.NewErrorFrom(ErrInvalidWebAuthn)
+	}
+	if err := u.consumeWebAuthnChallenge(ctx, TOKEN_WEBAUTHN_LOGIN, a.ClientDataJSON, util.WEBAUTHN_TYPE_GET); err != nil {
+		return err
+	}
+	return doTx(ctx, func(tx *sql.Tx) error {
+		uws, err := u.findWebAuthns(tx)
+		if err != nil {
+			return err
+		}
+		var uw *UserWebAuthn
+		for _, c := range uws {
+			if bytes.Equal(c.CredentialId, a.CredentialId) {
+				uw = c
+			}
+		}
+		if uw == nil {
+			return util.NewErrorFrom(ErrInvalidWebAuthn)
+		}
+		ad, err := util.ParseWebAuthnAuthData(a.AuthenticatorData)
+		if err != nil || !ad.CheckRPID(WEBAUTHN_RP_ID) || ad.Flags&util.WEBAUTHN_FLAG_USER_PRESENT == 0 {
+			return util.NewErrorFrom(ErrInvalidWebAuthn)
+		}
+		if err := util.VerifyWebAuthnSignature(uw.PublicKey, a.AuthenticatorData, a.ClientDataJSON, a.Signature); err != nil {
+			return util.NewErrorFrom(ErrInvalidWebAuthn)
+		}
+		// Authenticators without a counter always send 0
+		if (ad.SignCount > 0 || uw.SignCount > 0) && int64(ad.SignCount) <= uw.SignCount {
+			return util.NewErrorFrom(ErrAuthenticatorCloned)
+		}
+		uw.SignCount = int64(ad.SignCount)
+		uw.LastUsedAt = time.Now().UTC()
+		return treatUpdateErr(uw.dbUpdate(tx))
+	})
+}
+
+// DeleteWebAuthn removes a security key of the user. A session alone is not enough to remove a second factor so
+// the user has to answer a login challenge with any of the registered keys or send a totp code
+func (u *User) DeleteWebAuthn(ctx context.Context, credentialId []byte, a *WebAuthnAssertion, totpCode string) error {
+	var err error
+	switch {
+	case a != nil:
+		err = u.VerifyWebAuthn(ctx, a)
+	case len(totpCode) > 0:
+		err = u.VerifyTOTP(ctx, totpCode)
+	default:
+		err = util.NewErrorFrom(ErrSecondFactorRequired)
+	}
+	if err != nil {
+		return err
+	}
+	return doTx(ctx, func(tx *sql.Tx) error {
+		uw := &UserWebAuthn{User: u.Id, CredentialId: credentialId}
+		return treatUpdateErr(uw.dbDelete(tx))
+	})
+}
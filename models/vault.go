@@ -6,19 +6,30 @@ import (
 	"time"
 
 	"github.com/keydotcat/keycatd/util"
+	"github.com/lib/pq"
 )
 
+// Deleted vaults can be restored for this long before they are purged. 0 deletes them right away
+var VAULT_PURGE_AFTER = 30 * 24 * time.Hour
+
 type Vault struct {
-	Id        string    `scaneo:"pk" json:"id"`
-	Team      string    `scaneo:"pk" json:"-"`
-	Version   uint32    `json:"version"`
-	PublicKey []byte    `json:"public_key"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	Id         string    `scaneo:"pk" json:"id"`
+	Team       string    `scaneo:"pk" json:"-"`
+	Version    uint32    `json:"version"`
+	PublicKey  []byte    `json:"public_key"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	AllMembers bool      `json:"all_members"`
+	KeyVersion uint32    `json:"key_version"`
+	// Set while the vault waits to be purged
+	DeletedAt pq.NullTime `json:"-"`
+	// Max bytes the last version of the secrets can take. 0 means no limit
+	Quota     int64 `json:"quota"`
+	UsedBytes int64 `json:"used_bytes"`
 }
 
-func createVault(tx *sql.Tx, id, team string, vkp VaultKeyPair) (*Vault, error) {
-	v := &Vault{Id: id, Team: team, Version: 1, PublicKey: vkp.PublicKey}
+func createVault(tx *sql.Tx, id, team string, allMembers bool, vkp VaultKeyPair) (*Vault, error) {
+	v := &Vault{Id: id, Team: team, Version: 1, PublicKey: vkp.PublicKey, AllMembers: allMembers}
 	if err := v.insert(tx); err != nil {
 		return nil, err
 	}
@@ -38,6 +49,7 @@ func (v *Vault) insert(tx *sql.Tx) error {
 	v.CreatedAt = now
 	v.UpdatedAt = now
 	v.Version = 1
+	v.KeyVersion = 1
 	_, err := v.dbInsert(tx)
 	switch {
 	case IsDuplicateErr(err):
@@ -48,6 +60,17 @@ func (v *Vault) insert(tx *sql.Tx) error {
 	return nil
 }
 
+// purge removes the vault and everything that points to it
+func (v *Vault) purge(tx *sql.Tx) error {
+	for _, table := range vaultChildTables {
+		_, err := tx.Exec(`DELETE FROM "`+table+`" WHERE "team" = $1 AND "vault" = $2`, v.Team, v.Id)
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+	}
+	return treatUpdateErr(v.dbDelete(tx))
+}
+
 func (v *Vault) update(tx *sql.Tx) error {
 	if err := v.validate(); err != nil {
 		return err
@@ -175,10 +198,19 @@ func (v Vault) removeUser(tx *sql.Tx, username string) error {
 	return treatUpdateErr(vu.dbDelete(tx))
 }
 
-func (v *Vault) AddSecret(ctx context.Context, s *Secret) error {
+// checkWriteAccess returns ErrUnauthorized if the actor is a reader of the vault team
+func (v *Vault) checkWriteAccess(tx *sql.Tx, actor *User) error {
+	t := &Team{Id: v.Team}
+	return t.checkWriteAccess(tx, actor)
+}
+
+func (v *Vault) AddSecret(ctx context.Context, actor *User, s *Secret) error {
 	var err error
 	for retry := 0; retry < 3; retry++ {
-		err = doTx(ctx, func(tx *sql.Tx) error {
+		err = doRetryTx(ctx, func(tx *sql.Tx) error {
+			if err := v.checkWriteAccess(tx, actor); err != nil {
+				return err
+			}
 			return v.addSecret(tx, s)
 		})
 		if err == ErrAlreadyExists {
@@ -195,6 +227,9 @@ func (v *Vault) addSecret(tx *sql.Tx, s *Secret) error {
 	if _, err := verifyAndUnpack(v.PublicKey, s.Data); err != nil {
 		return err
 	}
+	if err := v.checkRekeyPending(tx); err != nil {
+		return err
+	}
 	if err := v.update(tx); err != nil {
 		return err
 	}
@@ -202,7 +237,7 @@ func (v *Vault) addSecret(tx *sql.Tx, s *Secret) error {
 	return s.insert(tx)
 }
 
-func (v *Vault) AddSecretList(ctx context.Context, sl []*Secret) error {
+func (v *Vault) AddSecretList(ctx context.Context, actor *User, sl []*Secret) error {
 	for _, s := range sl {
 		s.Team = v.Team
 		s.Vault = v.Id
@@ -212,7 +247,13 @@ func (v *Vault) AddSecretList(ctx context.Context, sl []*Secret) error {
 	}
 	var err error
 	for retry := 0; retry < 3; retry++ {
-		err = doTx(ctx, func(tx *sql.Tx) error {
+		err = doRetryTx(ctx, func(tx *sql.Tx) error {
+			if err := v.checkWriteAccess(tx, actor); err != nil {
+				return err
+			}
+			if err := v.checkRekeyPending(tx); err != nil {
+				return err
+			}
 			for _, s := range sl {
 				if err := v.update(tx); err != nil {
 					return err
@@ -232,16 +273,22 @@ func (v *Vault) AddSecretList(ctx context.Context, sl []*Secret) error {
 	return err
 }
 
-func (v *Vault) UpdateSecret(ctx context.Context, s *Secret) error {
+func (v *Vault) UpdateSecret(ctx context.Context, actor *User, s *Secret) error {
 	_, err := verifyAndUnpack(v.PublicKey, s.Data)
 	if err != nil {
 		return err
 	}
-	return doTx(ctx, func(tx *sql.Tx) error {
+	return doRetryTx(ctx, func(tx *sql.Tx) error {
+		if err := v.checkWriteAccess(tx, actor); err != nil {
+			return err
+		}
 		os, err := v.getSecret(tx, s.Id)
 		if err != nil {
 			return err
 		}
+		if err := v.checkRekeyPending(tx); err != nil {
+			return err
+		}
 		if err := v.update(tx); err != nil {
 			return err
 		}
@@ -249,12 +296,16 @@ func (v *Vault) UpdateSecret(ctx context.Context, s *Secret) error {
 		s.Vault = os.Vault
 		s.Version = os.Version + 1
 		s.VaultVersion = v.Version
+		s.rotatedFrom(os)
 		return s.update(tx)
 	})
 }
 
-func (v *Vault) DeleteSecret(ctx context.Context, sid string) error {
-	return doTx(ctx, func(tx *sql.Tx) error {
+func (v *Vault) DeleteSecret(ctx context.Context, actor *User, sid string) error {
+	return doRetryTx(ctx, func(tx *sql.Tx) error {
+		if err := v.checkWriteAccess(tx, actor); err != nil {
+			return err
+		}
 		return v.deleteSecret(tx, sid)
 	})
 }
@@ -263,17 +314,39 @@ func (v *Vault) deleteSecret(tx *sql.Tx, sid string) error {
 	if err := v.update(tx); err != nil {
 		return err
 	}
+	size, err := lastSecretSize(tx, v.Team, v.Id, sid)
+	if err != nil {
+		return err
+	}
 	res, err := tx.Exec(`DELETE FROM "secret" WHERE "secret"."id" = $1`, sid)
-	return treatUpdateErr(res, err)
+	if err := treatUpdateErr(res, err); err != nil {
+		return err
+	}
+	if err := chargeVault(tx, v.Team, v.Id, -size); err != nil {
+		return err
+	}
+	if err := v.deleteShareLinks(tx, sid); err != nil {
+		return err
+	}
+	if err := v.deleteJustification(tx, sid); err != nil {
+		return err
+	}
+	return v.deleteSecretReferences(tx, sid, true)
+}
+
+func (v Vault) GetSecrets(ctx context.Context) (secrets []*Secret, err error) {
+	return secrets, doReadTx(ctx, func(tx *sql.Tx) error {
+		secrets, err = v.getSecrets(tx)
+		return err
+	})
 }
 
-func (v Vault) GetSecrets(ctx context.Context) ([]*Secret, error) {
-	db := GetDB(ctx)
+func (v Vault) getSecrets(tx *sql.Tx) ([]*Secret, error) {
 	query := `
 		SELECT DISTINCT ON ("secret"."team", "secret"."vault", "secret"."id") ` + selectSecretFullFields + ` 
 		FROM "secret" WHERE "secret"."team" = $1 AND "secret"."vault" = $2 
 		ORDER BY "secret"."team", "secret"."vault", "secret"."id", "secret"."version" DESC`
-	rows, err := db.Query(query, v.Team, v.Id)
+	rows, err := tx.Query(query, v.Team, v.Id)
 	if isErrOrPanic(err) {
 		return nil, util.NewErrorFrom(err)
 	}
@@ -285,7 +358,7 @@ func (v Vault) GetSecrets(ctx context.Context) ([]*Secret, error) {
 }
 
 func (v Vault) GetSecretsAllVersions(ctx context.Context) ([]*Secret, error) {
-	db := GetDB(ctx)
+	db := getReadDB(ctx)
 	query := `SELECT` + selectSecretFullFields + ` FROM "secret" WHERE "secret"."team" = $1 AND "secret"."vault" = $2`
 	rows, err := db.Query(query, v.Team, v.Id)
 	if isErrOrPanic(err) {
@@ -299,7 +372,7 @@ func (v Vault) GetSecretsAllVersions(ctx context.Context) ([]*Secret, error) {
 }
 
 func (v Vault) GetSecret(ctx context.Context, sid string) (s *Secret, err error) {
-	return s, doTx(ctx, func(tx *sql.Tx) error {
+	return s, doReadTx(ctx, func(tx *sql.Tx) error {
 		s, err = v.getSecret(tx, sid)
 		return err
 	})
@@ -317,3 +390,99 @@ func (v Vault) getSecret(tx *sql.Tx, sid string) (*Secret, error) {
 	}
 	return s, nil
 }
+
+// Max ids accepted by a single GetSecretsByIds call
+const SECRET_BATCH_MAX = 200
+
+// SecretBatch is the result of fetching many secrets at once. Ids that are not in the vault are in Missing and ids of
+// secrets the user cannot read are in Unauthorized
+type SecretBatch struct {
+	Secrets      []*Secret `json:"secrets"`
+	Missing      []string  `json:"missing"`
+	Unauthorized []string  `json:"unauthorized"`
+}
+
+// GetSecretsByIds returns the last version of the requested secrets with a single query. Ids that cannot be returned
+// are reported in the batch instead of failing the whole call. Duplicated ids are only returned once
+func (v Vault) GetSecretsByIds(ctx context.Context, u *User, sids []string) (*SecretBatch, error) {
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, sid := range sids {
+		if !seen[sid] {
+			seen[sid] = true
+			unique = append(unique, sid)
+		}
+	}
+	if len(unique) > SECRET_BATCH_MAX {
+		return nil, util.NewErrorFrom(ErrBatchTooLarge)
+	}
+	sb := &SecretBatch{Secrets: []*Secret{}, Missing: []string{}, Unauthorized: []string{}}
+	// Membership is checked on the primary so a replica that lags behind cannot hand secrets to a removed member
+	var members int
+	err := doTx(ctx, func(tx *sql.Tx) error {
+		err := tx.QueryRow(`SELECT COUNT(*) FROM "vault_user" WHERE "team" = $1 AND "vault" = $2 AND "user" = $3`, v.Team, v.Id, u.Id).Scan(&members)
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sb, doReadTx(ctx, func(tx *sql.Tx) error {
+		query := `
+		SELECT DISTINCT ON ("secret"."team", "secret"."vault", "secret"."id") ` + selectSecretFullFields + `
+		FROM "secret" WHERE "secret"."team" = $1 AND "secret"."vault" = $2 AND "secret"."id" = ANY($3)
+		ORDER BY "secret"."team", "secret"."vault", "secret"."id", "secret"."version" DESC`
+		rows, err := tx.Query(query, v.Team, v.Id, pq.Array(unique))
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		secrets, err := scanSecrets(rows)
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		found := map[string]bool{}
+		for _, s := range secrets {
+			found[s.Id] = true
+		}
+		for _, sid := range unique {
+			switch {
+			case !found[sid]:
+				sb.Missing = append(sb.Missing, sid)
+			case members == 0:
+				sb.Unauthorized = append(sb.Unauthorized, sid)
+			}
+		}
+		if members > 0 {
+			sb.Secrets = secrets
+		}
+		return nil
+	})
+}
+
+// StreamSecrets calls fn with the last version of each secret in the vault one at a time, without loading them all
+// in memory. The query is cancelled if the context is done
+func (v Vault) StreamSecrets(ctx context.Context, fn func(*Secret) error) error {
+	return doReadTx(ctx, func(tx *sql.Tx) error {
+		query := `
+		SELECT DISTINCT ON ("secret"."team", "secret"."vault", "secret"."id") ` + selectSecretFullFields + `
+		FROM "secret" WHERE "secret"."team" = $1 AND "secret"."vault" = $2
+		ORDER BY "secret"."team", "secret"."vault", "secret"."id", "secret"."version" DESC`
+		rows, err := tx.QueryContext(ctx, query, v.Team, v.Id)
+		if err != nil {
+			return util.NewErrorFrom(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			s := &Secret{}
+			if err := rows.Scan(&s.Team, &s.Vault, &s.Id, &s.Version, &s.Data, &s.VaultVersion, &s.CreatedAt, &s.RotationDays, &s.RotatedAt, &s.RotationRemindedAt); err != nil {
+				return util.NewErrorFrom(err)
+			}
+			if err := fn(s); err != nil {
+				return err
+			}
+		}
+		return util.NewErrorFrom(rows.Err())
+	})
+}
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+// VaultBundle has what a user needs to decrypt an exported vault: the vault public key and the vault key wrapped
+// for that user. The secrets are streamed separately with StreamSecrets
+type VaultBundle struct {
+	Team      string `json:"team"`
+	Vault     string `json:"id"`
+	PublicKey []byte `json:"public_key"`
+	Key       []byte `json:"key"`
+}
+
+// Export returns the bundle for the vault if the user has access to it
+func (v Vault) Export(ctx context.Context, u *User) (b VaultBundle, err error) {
+	return b, doTx(ctx, func(tx *sql.Tx) error {
+		vu := &vaultUser{Team: v.Team, Vault: v.Id, User: u.Id}
+		err := vu.dbFind(tx)
+		if isNotExistsErr(err) {
+			return util.NewErrorFrom(ErrDoesntExist)
+		}
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		b = VaultBundle{v.Team, v.Id, v.PublicKey, vu.Key}
+		return nil
+	})
+}
@@ -14,7 +14,7 @@ type VaultFull struct {
 }
 
 func (s *VaultFull) dbScanRow(r *sql.Row) error {
-	return r.Scan(&s.Id, &s.Team, &s.Version, &s.PublicKey, &s.CreatedAt, &s.UpdatedAt, &s.Key)
+	return r.Scan(&s.Id, &s.Team, &s.Version, &s.PublicKey, &s.CreatedAt, &s.UpdatedAt, &s.AllMembers, &s.KeyVersion, &s.DeletedAt, &s.Quota, &s.UsedBytes, &s.Key)
 }
 
 func scanVaultsFull(rs *sql.Rows) ([]*VaultFull, error) {
@@ -29,6 +29,11 @@ func scanVaultsFull(rs *sql.Rows) ([]*VaultFull, error) {
 			&s.PublicKey,
 			&s.CreatedAt,
 			&s.UpdatedAt,
+			&s.AllMembers,
+			&s.KeyVersion,
+			&s.DeletedAt,
+			&s.Quota,
+			&s.UsedBytes,
 			&s.Key,
 		); err != nil {
 			return nil, err
@@ -49,7 +54,7 @@ func (t *Team) GetVaultsFullForUser(ctx context.Context, u *User) (vf []*VaultFu
 }
 
 func (t *Team) getVaultsFullForUser(tx *sql.Tx, u *User) ([]*VaultFull, error) {
-	rows, err := tx.Query(`SELECT `+selectVaultFullFields+`, "vault_user"."key" FROM "vault", "vault_user" WHERE  "vault"."team" = $1 AND "vault"."team" = "vault_user"."team" AND "vault"."id" = "vault_user"."vault" AND "vault_user"."user" = $2`, t.Id, u.Id)
+	rows, err := tx.Query(`SELECT `+selectVaultFullFields+`, "vault_user"."key" FROM "vault", "vault_user" WHERE  "vault"."team" = $1 AND "vault"."deleted_at" IS NULL AND "vault"."team" = "vault_user"."team" AND "vault"."id" = "vault_user"."vault" AND "vault_user"."user" = $2`, t.Id, u.Id)
 	if isErrOrPanic(err) {
 		return nil, util.NewErrorFrom(err)
 	}
@@ -70,7 +75,7 @@ func (t *Team) getVaultsFullForUser(tx *sql.Tx, u *User) ([]*VaultFull, error) {
 func (v *Vault) GetVaultFullForUser(ctx context.Context, u *User) (vf *VaultFull, err error) {
 	vf = &VaultFull{}
 	return vf, doTx(ctx, func(tx *sql.Tx) error {
-		r := tx.QueryRow(`SELECT `+selectVaultFullFields+`, "vault_user"."key" FROM "vault", "vault_user" WHERE  "vault"."team" = $1 AND "vault"."team" = "vault_user"."team" AND "vault"."id" = "vault_user"."vault" AND "vault"."id" = $2 AND "vault_user"."user" = $3`, v.Team, v.Id, u.Id)
+		r := tx.QueryRow(`SELECT `+selectVaultFullFields+`, "vault_user"."key" FROM "vault", "vault_user" WHERE  "vault"."team" = $1 AND "vault"."deleted_at" IS NULL AND "vault"."team" = "vault_user"."team" AND "vault"."id" = "vault_user"."vault" AND "vault"."id" = $2 AND "vault_user"."user" = $3`, v.Team, v.Id, u.Id)
 		err := vf.dbScanRow(r)
 		if isErrOrPanic(err) {
 			if isNotExistsErr(err) {
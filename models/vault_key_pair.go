@@ -1,6 +1,9 @@
 package models
 
 import (
+	"bytes"
+	"encoding/json"
+
 	"github.com/keydotcat/keycatd/util"
 	"golang.org/x/crypto/ed25519"
 	"golang.org/x/crypto/nacl/secretbox"
@@ -13,6 +16,10 @@ const boxPrivateKeySize = 32
 var (
 	publicKeyPackSize  = ed25519.PublicKeySize + ed25519.SignatureSize + boxPublicKeySize
 	privateKeyPackSize = ed25519.SignatureSize + secretbox.Overhead + boxNonceSize + ed25519.PrivateKeySize + boxPrivateKeySize
+	// A vault key sealed for a member is packed like a user private key
+	vaultKeyPackSize = privateKeyPackSize
+	// Signed public key pack of a vault
+	vaultPublicKeyPackSize = ed25519.SignatureSize + publicKeyPackSize
 )
 
 type VaultKeyPair struct {
@@ -20,10 +27,67 @@ type VaultKeyPair struct {
 	Keys      map[string][]byte `json:"keys"`
 }
 
+// UnmarshalJSON rejects key maps that repeat a user id since decoding them into a map would silently keep only
+// the last key
+func (vkp *VaultKeyPair) UnmarshalJSON(data []byte) error {
+	raw := struct {
+		PublicKey []byte          `json:"public_key"`
+		Keys      json.RawMessage `json:"keys"`
+	}{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	vkp.PublicKey = raw.PublicKey
+	vkp.Keys = nil
+	if len(raw.Keys) == 0 || string(raw.Keys) == "null" {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw.Keys))
+	if tok, err := dec.Token(); err != nil {
+		return err
+	} else if tok != json.Delim('{') {
+		return util.NewErrorFrom(ErrMalformedKeys)
+	}
+	keys := map[string][]byte{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		id, _ := tok.(string)
+		var key []byte
+		if err := dec.Decode(&key); err != nil {
+			return err
+		}
+		if _, ok := keys[id]; ok {
+			return util.NewErrorFrom(ErrMalformedKeys)
+		}
+		keys[id] = key
+	}
+	vkp.Keys = keys
+	return nil
+}
+
+// checkStructure validates the sizes of the packs before checking any signature
+func (vkp VaultKeyPair) checkStructure() error {
+	if len(vkp.PublicKey) > 0 && len(vkp.PublicKey) != vaultPublicKeyPackSize {
+		return util.NewErrorFrom(ErrMalformedKeys)
+	}
+	for id, key := range vkp.Keys {
+		if len(id) == 0 || len(key) != vaultKeyPackSize {
+			return util.NewErrorFrom(ErrMalformedKeys)
+		}
+	}
+	return nil
+}
+
 func (vkp VaultKeyPair) checkKeyIdsMatch(ppl []string) error {
 	if vkp.Keys == nil {
 		return util.NewErrorFrom(ErrInvalidKeys)
 	}
+	if err := vkp.checkStructure(); err != nil {
+		return err
+	}
 	var ko []string
 	for _, p := range ppl {
 		if _, ok := vkp.Keys[p]; !ok {
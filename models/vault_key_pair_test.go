@@ -3,6 +3,8 @@ package models
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
 	"testing"
 
 	"github.com/keydotcat/keycatd/util"
@@ -146,3 +148,32 @@ func TestSigningAndVerificationOfVaultKeyPairs(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestMalformedVaultKeyPairs(t *testing.T) {
+	_, priv, _ := generateNewKeys()
+	vkp := getDummyVaultKeyPair(priv, "member1", "member2")
+	if err := vkp.checkKeyIdsMatch([]string{"member1", "member2"}); err != nil {
+		t.Fatal(err)
+	}
+	vkp.Keys["member2"] = []byte{}
+	if err := vkp.checkKeyIdsMatch([]string{"member1", "member2"}); !util.CheckErr(err, ErrMalformedKeys) {
+		t.Fatalf("Unexpected error for an empty key: %s vs %v", ErrMalformedKeys, err)
+	}
+	vkp.Keys["member2"] = vkp.Keys["member1"][:vaultKeyPackSize-1]
+	if err := vkp.checkKeyIdsMatch([]string{"member1", "member2"}); !util.CheckErr(err, ErrMalformedKeys) {
+		t.Fatalf("Unexpected error for a short key: %s vs %v", ErrMalformedKeys, err)
+	}
+	key := base64.StdEncoding.EncodeToString(vkp.Keys["member1"])
+	dup := `{"public_key":null,"keys":{"member1":"` + key + `","member1":"` + key + `"}}`
+	decoded := VaultKeyPair{}
+	if err := json.Unmarshal([]byte(dup), &decoded); !util.CheckErr(err, ErrMalformedKeys) {
+		t.Fatalf("Unexpected error for a repeated user id: %s vs %v", ErrMalformedKeys, err)
+	}
+	ok := `{"public_key":null,"keys":{"member1":"` + key + `","member2":"` + key + `"}}`
+	if err := json.Unmarshal([]byte(ok), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Keys) != 2 || !bytes.Equal(decoded.Keys["member2"], vkp.Keys["member1"]) {
+		t.Fatalf("Keys were not decoded properly: %v", decoded.Keys)
+	}
+}
@@ -0,0 +1,66 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+// VaultMember is a user that holds a key for a vault along with the role the user has in the team
+type VaultMember struct {
+	Id       string `json:"id"`
+	FullName string `json:"fullname"`
+	Role     string `json:"role"`
+}
+
+func scanVaultMembers(rs *sql.Rows, owner string) ([]*VaultMember, error) {
+	structs := make([]*VaultMember, 0, 16)
+	var err error
+	for rs.Next() {
+		var s VaultMember
+		tu := teamUser{}
+		if err = rs.Scan(
+			&s.Id,
+			&s.FullName,
+			&tu.Admin,
+			&tu.ReadOnly,
+		); err != nil {
+			return nil, err
+		}
+		if s.Id == owner {
+			s.Role = TEAM_ROLE_OWNER
+		} else {
+			s.Role = tu.role()
+		}
+		structs = append(structs, &s)
+	}
+	if err = rs.Err(); err != nil {
+		return nil, err
+	}
+	return structs, nil
+}
+
+// GetVaultMembers returns the users that can read the vault. Only team admins can list them
+func (t *Team) GetVaultMembers(ctx context.Context, actor *User, vid string) (vms []*VaultMember, err error) {
+	return vms, doTx(ctx, func(tx *sql.Tx) error {
+		if err := t.checkAdmin(tx, actor); err != nil {
+			return err
+		}
+		if _, err := t.findVault(tx, vid); err != nil {
+			return err
+		}
+		rows, err := tx.Query(`SELECT "user"."id", "user"."full_name", "team_user"."admin", "team_user"."read_only"
+			FROM "vault_user", "team_user", "user"
+			WHERE "vault_user"."team" = $1 AND "vault_user"."vault" = $2 AND
+				"team_user"."team" = "vault_user"."team" AND "team_user"."user" = "vault_user"."user" AND
+				"user"."id" = "vault_user"."user"
+			ORDER BY "user"."id"`, t.Id, vid)
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		vms, err = scanVaultMembers(rows, t.Owner)
+		isErrOrPanic(err)
+		return util.NewErrorFrom(err)
+	})
+}
@@ -0,0 +1,82 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+// Max size in bytes of the encrypted data of a secret
+var MAX_SECRET_SIZE = 64 * 1024
+
+func checkSecretSize(data []byte) error {
+	if len(data) > MAX_SECRET_SIZE {
+		return util.NewErrorFrom(ErrSecretTooLarge)
+	}
+	return nil
+}
+
+// chargeVault adds delta to the bytes used by the vault. Only the last version of each secret counts. It fails with
+// ErrVaultQuotaExceeded if the vault grows over its quota. Shrinking always works even if the vault is already over
+// the quota because it was lowered
+func chargeVault(tx *sql.Tx, team, vault string, delta int) error {
+	if delta == 0 {
+		return nil
+	}
+	res, err := tx.Exec(`UPDATE "vault" SET "used_bytes" = "used_bytes" + $1 WHERE "team" = $2 AND "id" = $3 AND ($1 < 0 OR "quota" = 0 OR "used_bytes" + $1 <= "quota")`, int64(delta), team, vault)
+	if err := treatUpdateErr(res, err); err != nil {
+		if util.CheckErr(err, ErrDoesntExist) {
+			return util.NewErrorFrom(ErrVaultQuotaExceeded)
+		}
+		return err
+	}
+	return nil
+}
+
+// addVaultUsage adds delta to the bytes used by the vault without checking the quota. Re-keying uses it so a vault at
+// its quota can still be re-encrypted when the size of the ciphertexts changes
+func addVaultUsage(tx *sql.Tx, team, vault string, delta int) error {
+	if delta == 0 {
+		return nil
+	}
+	res, err := tx.Exec(`UPDATE "vault" SET "used_bytes" = "used_bytes" + $1 WHERE "team" = $2 AND "id" = $3`, int64(delta), team, vault)
+	return treatUpdateErr(res, err)
+}
+
+// lastSecretSize returns the size of the last version of the secret or 0 if it does not exist
+func lastSecretSize(tx *sql.Tx, team, vault, sid string) (int, error) {
+	var size int
+	r := tx.QueryRow(`SELECT LENGTH("data") FROM "secret" WHERE "team" = $1 AND "vault" = $2 AND "id" = $3 ORDER BY "version" DESC LIMIT 1`, team, vault, sid)
+	err := r.Scan(&size)
+	if isNotExistsErr(err) {
+		return 0, nil
+	}
+	if isErrOrPanic(err) {
+		return 0, util.NewErrorFrom(err)
+	}
+	return size, nil
+}
+
+// SetVaultQuota limits the bytes the secrets of a vault can take. 0 removes the limit. A quota under the current
+// usage is allowed and only blocks the vault from growing. Only admins can change it
+func (t *Team) SetVaultQuota(ctx context.Context, actor *User, vid string, bytes int64) (v *Vault, err error) {
+	if bytes < 0 {
+		return nil, util.NewErrorFrom(ErrInvalidAttributes)
+	}
+	return v, doTx(ctx, func(tx *sql.Tx) error {
+		if err := t.checkAdminAction(tx, actor); err != nil {
+			return err
+		}
+		v, err = t.findVault(tx, vid)
+		if err != nil {
+			return err
+		}
+		res, err := tx.Exec(`UPDATE "vault" SET "quota" = $1 WHERE "team" = $2 AND "id" = $3`, bytes, t.Id, vid)
+		if err := treatUpdateErr(res, err); err != nil {
+			return err
+		}
+		v.Quota = bytes
+		return t.audit(tx, actor.Id, vid, TEAM_AUDIT_VAULT_QUOTA)
+	})
+}
@@ -0,0 +1,162 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/keydotcat/keycatd/util"
+)
+
+// When enabled, vaults with a pending rekey refuse new or updated secrets until the removal is finalized
+var ENFORCE_REKEY_ON_REMOVAL = false
+
+type vaultRekey struct {
+	Team      string    `scaneo:"pk" json:"-"`
+	Vault     string    `scaneo:"pk" json:"vault"`
+	User      string    `scaneo:"pk" json:"user"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// VaultRewrap holds the new keys for a vault and all its secrets re-encrypted with them
+type VaultRewrap struct {
+	Keys    VaultKeyPair `json:"keys"`
+	Secrets []*Secret    `json:"secrets"`
+}
+
+func (vr *vaultRekey) insert(tx *sql.Tx) error {
+	vr.CreatedAt = time.Now().UTC()
+	_, err := vr.dbInsert(tx)
+	if IsDuplicateErr(err) {
+		return nil
+	}
+	if isErrOrPanic(err) {
+		return util.NewErrorFrom(err)
+	}
+	return nil
+}
+
+func findVaultRekeysForUser(tx *sql.Tx, team, user string) ([]*vaultRekey, error) {
+	rows, err := tx.Query(`SELECT `+selectVaultRekeyFields+` FROM "vault_rekey" WHERE "team" = $1 AND "user" = $2`, team, user)
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	vrs, err := scanVaultRekeys(rows)
+	if isErrOrPanic(err) {
+		return nil, util.NewErrorFrom(err)
+	}
+	return vrs, nil
+}
+
+func (v Vault) isRekeyPending(tx *sql.Tx) (bool, error) {
+	var pending int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM "vault_rekey" WHERE "team" = $1 AND "vault" = $2`, v.Team, v.Id).Scan(&pending)
+	if isErrOrPanic(err) {
+		return false, util.NewErrorFrom(err)
+	}
+	return pending > 0, nil
+}
+
+func (v Vault) checkRekeyPending(tx *sql.Tx) error {
+	if !ENFORCE_REKEY_ON_REMOVAL {
+		return nil
+	}
+	pending, err := v.isRekeyPending(tx)
+	if err != nil {
+		return err
+	}
+	if pending {
+		return util.NewErrorFrom(ErrRekeyPending)
+	}
+	return nil
+}
+
+// rekey replaces the key of the vault and its secrets with the re-encrypted ones. The new key version is written to the
+// audit log of the team
+func (v *Vault) rekey(tx *sql.Tx, actor string, vaultKeys VaultKeyPair, secrets []*Secret) error {
+	uids, err := v.getUserIds(tx)
+	if err != nil {
+		return err
+	}
+	if err := vaultKeys.checkKeyIdsMatch(uids); err != nil {
+		return err
+	}
+	current, err := v.getSecrets(tx)
+	if err != nil {
+		return err
+	}
+	if len(current) != len(secrets) {
+		return util.NewErrorFrom(ErrInvalidKeys)
+	}
+	byId := make(map[string]*Secret, len(current))
+	for _, s := range current {
+		byId[s.Id] = s
+	}
+	for _, s := range secrets {
+		if _, ok := byId[s.Id]; !ok {
+			return util.NewErrorFrom(ErrInvalidKeys)
+		}
+		if _, err := verifyAndUnpack(vaultKeys.PublicKey, s.Data); err != nil {
+			return err
+		}
+	}
+	now := time.Now().UTC()
+	res, err := tx.Exec(`UPDATE "vault" SET "public_key" = $1, "key_version" = "key_version" + 1 WHERE "team" = $2 AND "id" = $3`, vaultKeys.PublicKey, v.Team, v.Id)
+	if err := treatUpdateErr(res, err); err != nil {
+		return err
+	}
+	v.PublicKey = vaultKeys.PublicKey
+	v.KeyVersion++
+	for uid, key := range vaultKeys.Keys {
+		res, err := tx.Exec(`UPDATE "vault_user" SET "key" = $1, "updated_at" = $2 WHERE "team" = $3 AND "vault" = $4 AND "user" = $5`, key, now, v.Team, v.Id, uid)
+		if err := treatUpdateErr(res, err); err != nil {
+			return err
+		}
+	}
+	if err := v.update(tx); err != nil {
+		return err
+	}
+	for _, s := range secrets {
+		s.Team = v.Team
+		s.Vault = v.Id
+		s.Version = byId[s.Id].Version + 1
+		s.VaultVersion = v.Version
+		// Re-encrypting with the new vault key does not change the secret so the rotation clock keeps running
+		s.RotationDays = byId[s.Id].RotationDays
+		s.RotatedAt = byId[s.Id].RotatedAt
+		s.RotationRemindedAt = byId[s.Id].RotationRemindedAt
+		if err := s.rewrap(tx); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`DELETE FROM "vault_rekey" WHERE "team" = $1 AND "vault" = $2`, v.Team, v.Id)
+	if isErrOrPanic(err) {
+		return util.NewErrorFrom(err)
+	}
+	t := &Team{Id: v.Team}
+	return t.audit(tx, actor, fmt.Sprintf("%s: key version %d", v.Id, v.KeyVersion), TEAM_AUDIT_VAULT_KEY_ROTATE)
+}
+
+// RotateVaultKey replaces the key of a vault so copies of the old key become useless. The new key pair must have
+// a key for every current member of the vault and secrets must hold every secret re-encrypted with the new key.
+func (t *Team) RotateVaultKey(ctx context.Context, actor *User, vid string, newVkp VaultKeyPair, secrets []*Secret) (v *Vault, err error) {
+	return v, doRetryTx(ctx, func(tx *sql.Tx) error {
+		if err := t.checkAdminAction(tx, actor); err != nil {
+			return err
+		}
+		vaultKeys, err := newVkp.verifyAndUnpack(actor.PublicKey)
+		if err != nil {
+			return err
+		}
+		v = &Vault{Id: vid, Team: t.Id}
+		err = v.dbFind(tx)
+		if isNotExistsErr(err) {
+			return util.NewErrorFrom(ErrVaultNotFound)
+		}
+		if isErrOrPanic(err) {
+			return util.NewErrorFrom(err)
+		}
+		return v.rekey(tx, actor.Id, vaultKeys, secrets)
+	})
+}
@@ -20,7 +20,7 @@ func TestAddModifyAndDeleteSecret(t *testing.T) {
 	vm := getFirstVault(o, team)
 	s := &Secret{Data: signAndPack(vm.priv, a32b)}
 	version := vm.v.Version
-	if err := vm.v.AddSecret(ctx, s); err != nil {
+	if err := vm.v.AddSecret(ctx, vm.owner, s); err != nil {
 		t.Fatal(err)
 	}
 	if vm.v.Version != version+1 {
@@ -41,7 +41,7 @@ func TestAddModifyAndDeleteSecret(t *testing.T) {
 	if s.Version != 1 {
 		t.Fatalf("Invalid secret version, expected 1 and got %d", s.Version)
 	}
-	if err := vm.v.UpdateSecret(ctx, s); err != nil {
+	if err := vm.v.UpdateSecret(ctx, vm.owner, s); err != nil {
 		t.Fatal(err)
 	}
 	if s.Version != 2 {
@@ -67,10 +67,10 @@ func TestAddModifyAndDeleteSecret(t *testing.T) {
 	if !found {
 		t.Error("Could not find stored secret")
 	}
-	if err := vm.v.DeleteSecret(ctx, s.Id); err != nil {
+	if err := vm.v.DeleteSecret(ctx, vm.owner, s.Id); err != nil {
 		t.Fatal(err)
 	}
-	if err := vm.v.UpdateSecret(ctx, s); !util.CheckErr(err, ErrDoesntExist) {
+	if err := vm.v.UpdateSecret(ctx, vm.owner, s); !util.CheckErr(err, ErrDoesntExist) {
 		t.Fatalf("Expected different error: %s vs %s", ErrDoesntExist, err)
 	}
 }
@@ -83,7 +83,7 @@ func TestAddSecretList(t *testing.T) {
 		&Secret{Data: signAndPack(vm.priv, a32b)},
 		&Secret{Data: signAndPack(vm.priv, a32b)},
 	}
-	if err := vm.v.AddSecretList(ctx, sl); err != nil {
+	if err := vm.v.AddSecretList(ctx, vm.owner, sl); err != nil {
 		t.Fatal(err)
 	}
 	for i, s := range sl {
@@ -98,3 +98,144 @@ func TestAddSecretList(t *testing.T) {
 		t.Fatalf("Mismatch in the vault (%d) and secret vault (%d) version", vm.v.Version, sl[1].VaultVersion)
 	}
 }
+
+func TestSecretTooLarge(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	vm := getFirstVault(owner, team)
+	s := &Secret{Data: signAndPack(vm.priv, make([]byte, MAX_SECRET_SIZE))}
+	if err := vm.v.AddSecret(ctx, vm.owner, s); !util.CheckErr(err, ErrSecretTooLarge) {
+		t.Fatalf("Expected %s and got %v", ErrSecretTooLarge, err)
+	}
+	s = &Secret{Data: signAndPack(vm.priv, a32b)}
+	if err := vm.v.AddSecret(ctx, vm.owner, s); err != nil {
+		t.Fatal(err)
+	}
+	s.Data = signAndPack(vm.priv, make([]byte, MAX_SECRET_SIZE))
+	if err := vm.v.UpdateSecret(ctx, vm.owner, s); !util.CheckErr(err, ErrSecretTooLarge) {
+		t.Fatalf("Expected %s and got %v", ErrSecretTooLarge, err)
+	}
+}
+
+func TestVaultQuota(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	vm := createVaultMock(owner, team)
+	size := int64(len(signAndPack(vm.priv, a32b)))
+	if _, err := team.SetVaultQuota(ctx, owner, vm.v.Id, 2*size); err != nil {
+		t.Fatal(err)
+	}
+	var sids []string
+	for i := 0; i < 2; i++ {
+		s := &Secret{Data: signAndPack(vm.priv, a32b)}
+		if err := vm.v.AddSecret(ctx, vm.owner, s); err != nil {
+			t.Fatal(err)
+		}
+		sids = append(sids, s.Id)
+	}
+	if err := vm.v.AddSecret(ctx, vm.owner, &Secret{Data: signAndPack(vm.priv, a32b)}); !util.CheckErr(err, ErrVaultQuotaExceeded) {
+		t.Fatalf("Expected %s and got %v", ErrVaultQuotaExceeded, err)
+	}
+	s := &Secret{Id: sids[0], Data: signAndPack(vm.priv, append(a32b, 1))}
+	if err := vm.v.UpdateSecret(ctx, vm.owner, s); !util.CheckErr(err, ErrVaultQuotaExceeded) {
+		t.Fatalf("Growing a secret over the quota should fail and got %v", err)
+	}
+	if err := vm.v.DeleteSecret(ctx, vm.owner, sids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.v.AddSecret(ctx, vm.owner, &Secret{Data: signAndPack(vm.priv, a32b)}); err != nil {
+		t.Fatalf("Deleting a secret should free its space: %s", err)
+	}
+	v, err := team.SetVaultQuota(ctx, owner, vm.v.Id, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.UsedBytes != 2*size {
+		t.Fatalf("Expected %d used bytes and got %d", 2*size, v.UsedBytes)
+	}
+	if err := vm.v.AddSecret(ctx, vm.owner, &Secret{Data: signAndPack(vm.priv, a32b)}); err != nil {
+		t.Fatalf("A zero quota should not limit the vault: %s", err)
+	}
+}
+
+func TestRekeyIgnoresVaultQuota(t *testing.T) {
+	ctx := getCtx()
+	owner, team := getDummyOwnerWithTeam()
+	vm := createVaultMock(owner, team)
+	s := &Secret{Data: signAndPack(vm.priv, a32b)}
+	if err := vm.v.AddSecret(ctx, vm.owner, s); err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(s.Data))
+	if _, err := team.SetVaultQuota(ctx, owner, vm.v.Id, size); err != nil {
+		t.Fatal(err)
+	}
+	ownerPrivKeys := getUserPrivateKeys(owner.PublicKey, owner.Key)
+	vkp := getDummyVaultKeyPair(ownerPrivKeys, owner.Id)
+	newPriv := unsealVaultKey(&Vault{PublicKey: vkp.PublicKey[64:]}, vkp.Keys[owner.Id])
+	rs := &Secret{Id: s.Id, Data: signAndPack(newPriv, append(a32b, 1))}
+	if _, err := team.RotateVaultKey(ctx, owner, vm.v.Id, vkp, []*Secret{rs}); err != nil {
+		t.Fatalf("Re-keying a vault at its quota should work: %s", err)
+	}
+	v, err := team.SetVaultQuota(ctx, owner, vm.v.Id, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.UsedBytes != int64(len(rs.Data)) {
+		t.Fatalf("Expected %d used bytes and got %d", len(rs.Data), v.UsedBytes)
+	}
+}
+
+func TestGetSecretsByIds(t *testing.T) {
+	ctx := getCtx()
+	o, team := getDummyOwnerWithTeam()
+	vm := getFirstVault(o, team)
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		s := &Secret{Data: signAndPack(vm.priv, a32b)}
+		if err := vm.v.AddSecret(ctx, vm.owner, s); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, s.Id)
+	}
+	other := getFirstVault(o, createTeamMock(o))
+	foreign := &Secret{Data: signAndPack(other.priv, a32b)}
+	if err := other.v.AddSecret(ctx, other.owner, foreign); err != nil {
+		t.Fatal(err)
+	}
+	sb, err := vm.v.GetSecretsByIds(ctx, o, append(ids, "nope", foreign.Id, ids[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sb.Secrets) != len(ids) {
+		t.Fatalf("Expected %d secrets and got %d", len(ids), len(sb.Secrets))
+	}
+	for _, s := range sb.Secrets {
+		if s.Vault != vm.v.Id {
+			t.Fatalf("Got a secret from vault %s", s.Vault)
+		}
+	}
+	if len(sb.Missing) != 2 || sb.Missing[0] != "nope" || sb.Missing[1] != foreign.Id {
+		t.Fatalf("Unexpected missing ids %v", sb.Missing)
+	}
+	if len(sb.Unauthorized) != 0 {
+		t.Fatalf("Unexpected unauthorized ids %v", sb.Unauthorized)
+	}
+	sb, err = vm.v.GetSecretsByIds(ctx, getDummyUser(), ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sb.Secrets) != 0 || len(sb.Unauthorized) != len(ids) {
+		t.Fatalf("Expected secrets to be hidden from non members: %+v", sb)
+	}
+	if _, err = vm.v.GetSecretsByIds(ctx, o, make([]string, SECRET_BATCH_MAX+1)); err != nil {
+		t.Fatalf("Expected duplicated ids to be counted once: %s", err)
+	}
+	tooMany := []string{}
+	for i := 0; i <= SECRET_BATCH_MAX; i++ {
+		tooMany = append(tooMany, util.GenerateRandomToken(5))
+	}
+	if _, err = vm.v.GetSecretsByIds(ctx, o, tooMany); !util.CheckErr(err, ErrBatchTooLarge) {
+		t.Fatalf("Expected error %s and got %s", ErrBatchTooLarge, err)
+	}
+}
@@ -0,0 +1,116 @@
+package thelpers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+)
+
+// FakeAuthenticator is a software ES256 security key to test webauthn registrations and logins
+type FakeAuthenticator struct {
+	RPID         string
+	Origin       string
+	CredentialId []byte
+	Key          *ecdsa.PrivateKey
+	SignCount    uint32
+}
+
+func NewFakeAuthenticator(rpId, origin string) *FakeAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	credId := make([]byte, 16)
+	if _, err := rand.Read(credId); err != nil {
+		panic(err)
+	}
+	return &FakeAuthenticator{RPID: rpId, Origin: origin, CredentialId: credId, Key: key}
+}
+
+func (fa *FakeAuthenticator) ClientData(typ, challenge string) []byte {
+	b, err := json.Marshal(map[string]string{"type": typ, "challenge": challenge, "origin": fa.Origin})
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func (fa *FakeAuthenticator) authData(flags byte, attested []byte) []byte {
+	h := sha256.Sum256([]byte(fa.RPID))
+	b := append(h[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[33:], fa.SignCount)
+	return append(b, attested...)
+}
+
+// COSEKey returns the cose encoding of the public key
+func (fa *FakeAuthenticator) COSEKey() []byte {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	xb, yb := fa.Key.X.Bytes(), fa.Key.Y.Bytes()
+	copy(x[32-len(xb):], xb)
+	copy(y[32-len(yb):], yb)
+	b := cborHead(5, 5)
+	b = append(append(b, cborInt(1)...), cborInt(2)...)
+	b = append(append(b, cborInt(3)...), cborInt(-7)...)
+	b = append(append(b, cborInt(-1)...), cborInt(1)...)
+	b = append(append(b, cborInt(-2)...), cborBytes(x)...)
+	b = append(append(b, cborInt(-3)...), cborBytes(y)...)
+	return b
+}
+
+// AttestationObject returns a "none" attestation for the credential
+func (fa *FakeAuthenticator) AttestationObject() []byte {
+	attested := make([]byte, 16, 18)
+	attested = append(attested, 0, 0)
+	binary.BigEndian.PutUint16(attested[16:], uint16(len(fa.CredentialId)))
+	attested = append(append(attested, fa.CredentialId...), fa.COSEKey()...)
+	b := cborHead(5, 3)
+	b = append(append(b, cborText("fmt")...), cborText("none")...)
+	b = append(append(b, cborText("attStmt")...), cborHead(5, 0)...)
+	b = append(append(b, cborText("authData")...), cborBytes(fa.authData(0x41, attested))...)
+	return b
+}
+
+// Assert signs the challenge after increasing the counter and returns the client data, authenticator data and
+// signature
+func (fa *FakeAuthenticator) Assert(challenge string) (clientData, authData, sig []byte) {
+	fa.SignCount++
+	clientData = fa.ClientData("webauthn.get", challenge)
+	authData = fa.authData(0x01, nil)
+	cdh := sha256.Sum256(clientData)
+	h := sha256.Sum256(append(append([]byte{}, authData...), cdh[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, fa.Key, h[:])
+	if err != nil {
+		panic(err)
+	}
+	return clientData, authData, sig
+}
+
+func cborHead(major byte, n int) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n < 256:
+		return []byte{major<<5 | 24, byte(n)}
+	default:
+		return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+	}
+}
+
+func cborInt(n int) []byte {
+	if n < 0 {
+		return cborHead(1, -1-n)
+	}
+	return cborHead(0, n)
+}
+
+func cborBytes(b []byte) []byte {
+	return append(cborHead(2, len(b)), b...)
+}
+
+func cborText(s string) []byte {
+	return append(cborHead(3, len(s)), s...)
+}
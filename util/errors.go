@@ -111,6 +111,10 @@ func NewErrorf(f string, v ...interface{}) error {
 	}
 }
 
+func (e *Error) Fields() map[string]string {
+	return e.fields
+}
+
 func (e *Error) SetFieldError(f, er string) {
 	e.fields[f] = er
 }
@@ -0,0 +1,122 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	KDF_ARGON2ID            = "argon2id"
+	KDF_DEFAULT_ITERATIONS  = 3
+	KDF_DEFAULT_MEMORY      = 64 * 1024
+	KDF_DEFAULT_PARALLELISM = 4
+	KDF_SALT_SIZE           = 16
+)
+
+// Bounds for the configured kdf params. Memory is in KiB
+const (
+	KDF_MIN_ITERATIONS  = 1
+	KDF_MAX_ITERATIONS  = 100
+	KDF_MIN_MEMORY      = 16 * 1024
+	KDF_MAX_MEMORY      = 4 * 1024 * 1024
+	KDF_MIN_PARALLELISM = 1
+	KDF_MAX_PARALLELISM = 64
+)
+
+// Params given to new accounts. Accounts with weaker params are asked to upgrade them on login
+var (
+	KDF_ITERATIONS  uint32 = KDF_DEFAULT_ITERATIONS
+	KDF_MEMORY      uint32 = KDF_DEFAULT_MEMORY
+	KDF_PARALLELISM uint8  = KDF_DEFAULT_PARALLELISM
+)
+
+// Secret used to derive fake kdf params for unknown emails. It should be stable across restarts
+var FAKE_KDF_SECRET = GenerateRandomByteArray(32)
+
+// KDFParams are the parameters the client uses to derive the account key from the password
+type KDFParams struct {
+	Algorithm   string `json:"algorithm"`
+	Iterations  uint32 `json:"iterations"`
+	Memory      uint32 `json:"memory"`
+	Parallelism uint8  `json:"parallelism"`
+	Salt        []byte `json:"salt"`
+}
+
+func NewKDFParams() KDFParams {
+	return KDFParams{
+		Algorithm:   KDF_ARGON2ID,
+		Iterations:  KDF_ITERATIONS,
+		Memory:      KDF_MEMORY,
+		Parallelism: KDF_PARALLELISM,
+		Salt:        GenerateRandomByteArray(KDF_SALT_SIZE),
+	}
+}
+
+// FakeKDFParams returns plausible params for an unknown email. The same email always gets the same params
+func FakeKDFParams(email string) KDFParams {
+	mac := hmac.New(sha256.New, FAKE_KDF_SECRET)
+	mac.Write([]byte(email))
+	kdf := NewKDFParams()
+	kdf.Salt = mac.Sum(nil)[:KDF_SALT_SIZE]
+	return kdf
+}
+
+func (k KDFParams) IsEmpty() bool {
+	return len(k.Algorithm) == 0
+}
+
+// WeakerThan returns whether the params are cheaper to brute force than o. Parallelism does not change the cost
+// for an attacker so it is not compared
+func (k KDFParams) WeakerThan(o KDFParams) bool {
+	return k.Algorithm != o.Algorithm || k.Iterations < o.Iterations || k.Memory < o.Memory
+}
+
+// Validate checks the params are well formed and at least as strong as the ones given to new accounts
+func (k KDFParams) Validate() error {
+	if k.Algorithm != KDF_ARGON2ID {
+		return NewErrorf("Invalid kdf algorithm %s", k.Algorithm)
+	}
+	if k.Iterations == 0 || k.Memory == 0 || k.Parallelism == 0 {
+		return NewErrorf("Invalid kdf parameters")
+	}
+	if k.WeakerThan(NewKDFParams()) {
+		return NewErrorf("The kdf parameters are weaker than required")
+	}
+	if len(k.Salt) < KDF_SALT_SIZE {
+		return NewErrorf("Invalid kdf salt")
+	}
+	return nil
+}
+
+func (k KDFParams) Value() (driver.Value, error) {
+	if k.IsEmpty() {
+		return "", nil
+	}
+	b, err := json.Marshal(k)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (k *KDFParams) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		return nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return fmt.Errorf("Cannot scan %T into KDFParams", src)
+	}
+	if len(data) == 0 {
+		*k = KDFParams{}
+		return nil
+	}
+	return json.Unmarshal(data, k)
+}
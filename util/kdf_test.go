@@ -0,0 +1,86 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestFakeKDFParamsAreDeterministic(t *testing.T) {
+	p1 := FakeKDFParams("unknown@nowhere.net")
+	p2 := FakeKDFParams("unknown@nowhere.net")
+	if !reflect.DeepEqual(p1, p2) {
+		t.Errorf("Fake kdf params for the same email differ")
+	}
+	p3 := FakeKDFParams("other@nowhere.net")
+	if bytes.Equal(p1.Salt, p3.Salt) {
+		t.Errorf("Fake kdf salts for different emails are the same")
+	}
+	old := FAKE_KDF_SECRET
+	FAKE_KDF_SECRET = []byte("another secret")
+	defer func() { FAKE_KDF_SECRET = old }()
+	if bytes.Equal(p1.Salt, FakeKDFParams("unknown@nowhere.net").Salt) {
+		t.Errorf("Fake kdf salt does not depend on the secret")
+	}
+}
+
+func TestFakeKDFParamsLookReal(t *testing.T) {
+	genuine := NewKDFParams()
+	fake := FakeKDFParams("unknown@nowhere.net")
+	if err := fake.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if len(genuine.Salt) != len(fake.Salt) {
+		t.Errorf("Salt length mismatch: %d vs %d", len(genuine.Salt), len(fake.Salt))
+	}
+	genuine.Salt = nil
+	fake.Salt = nil
+	if !reflect.DeepEqual(genuine, fake) {
+		t.Errorf("Fake kdf params differ from real ones: %+v vs %+v", fake, genuine)
+	}
+	rj, _ := json.Marshal(NewKDFParams())
+	fj, _ := json.Marshal(FakeKDFParams("unknown@nowhere.net"))
+	if len(rj) != len(fj) {
+		t.Errorf("Serialized fake kdf params differ in size: %s vs %s", fj, rj)
+	}
+}
+
+func TestKDFParamsDBRoundTrip(t *testing.T) {
+	k := NewKDFParams()
+	v, err := k.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2 := KDFParams{}
+	if err := k2.Scan(v); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(k, k2) {
+		t.Errorf("Mismatch after round trip: %+v vs %+v", k, k2)
+	}
+	if err := k2.Scan(""); err != nil || !k2.IsEmpty() {
+		t.Errorf("Expected empty params from empty column")
+	}
+}
+
+func TestKDFParamsWeakerThanConfigured(t *testing.T) {
+	old := KDF_MEMORY
+	defer func() { KDF_MEMORY = old }()
+	p := NewKDFParams()
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	KDF_MEMORY = p.Memory * 2
+	if !p.WeakerThan(NewKDFParams()) {
+		t.Errorf("Params with less memory than configured should be weaker")
+	}
+	if err := p.Validate(); err == nil {
+		t.Errorf("Params weaker than configured should not be valid")
+	}
+	p.Parallelism = 1
+	p.Memory = KDF_MEMORY
+	if p.WeakerThan(NewKDFParams()) {
+		t.Errorf("Parallelism should not make params weaker")
+	}
+}
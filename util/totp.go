@@ -0,0 +1,61 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	TOTP_PERIOD      = 30
+	TOTP_DIGITS      = 6
+	TOTP_SKEW        = 1
+	TOTP_SECRET_SIZE = 10
+)
+
+// DecodeTOTPSecret parses a base32 secret as shown to authenticator apps
+func DecodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	b, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil {
+		return nil, NewErrorf("Invalid totp secret: %s", err)
+	}
+	if len(b) < TOTP_SECRET_SIZE {
+		return nil, NewErrorf("Invalid totp secret: it has to be at least %d bytes long", TOTP_SECRET_SIZE)
+	}
+	return b, nil
+}
+
+func TOTPStep(t time.Time) int64 {
+	return t.Unix() / TOTP_PERIOD
+}
+
+// TOTPCode returns the RFC 6238 code for the given time step
+func TOTPCode(secret []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, value%1000000)
+}
+
+// CheckTOTP looks for the code in the steps around t and returns the step it belongs to
+func CheckTOTP(secret []byte, code string, t time.Time) (int64, bool) {
+	if len(code) != TOTP_DIGITS {
+		return 0, false
+	}
+	now := TOTPStep(t)
+	for step := now - TOTP_SKEW; step <= now+TOTP_SKEW; step++ {
+		if hmac.Equal([]byte(TOTPCode(secret, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
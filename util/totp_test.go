@@ -0,0 +1,48 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// Test vectors from RFC 6238 (SHA1), truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for ts, code := range vectors {
+		if got := TOTPCode(secret, TOTPStep(time.Unix(ts, 0))); got != code {
+			t.Errorf("Expected code %s at %d and got %s", code, ts, got)
+		}
+	}
+}
+
+func TestCheckTOTP(t *testing.T) {
+	secret, err := DecodeTOTPSecret("GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1111111111, 0)
+	step := TOTPStep(now)
+	for _, delta := range []int64{-1, 0, 1} {
+		got, ok := CheckTOTP(secret, TOTPCode(secret, step+delta), now)
+		if !ok || got != step+delta {
+			t.Errorf("Expected code with skew %d to be valid", delta)
+		}
+	}
+	if _, ok := CheckTOTP(secret, TOTPCode(secret, step+2), now); ok {
+		t.Errorf("Expected codes out of the skew window to be invalid")
+	}
+	if _, ok := CheckTOTP(secret, "12345", now); ok {
+		t.Errorf("Expected short codes to be invalid")
+	}
+	if _, err := DecodeTOTPSecret("GEZDG"); err == nil {
+		t.Errorf("Expected short secrets to be refused")
+	}
+}
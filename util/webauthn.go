@@ -0,0 +1,322 @@
+package util
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+)
+
+const (
+	WEBAUTHN_TYPE_CREATE = "webauthn.create"
+	WEBAUTHN_TYPE_GET    = "webauthn.get"
+	// Authenticator data flags
+	WEBAUTHN_FLAG_USER_PRESENT  = 0x01
+	WEBAUTHN_FLAG_USER_VERIFIED = 0x04
+	WEBAUTHN_FLAG_ATTESTED      = 0x40
+	// Max length of a credential id as defined by the spec
+	WEBAUTHN_MAX_CREDENTIAL_ID = 1023
+	// Nested cbor structures deeper than this are rejected
+	cborMaxDepth = 8
+)
+
+// COSE key parameters for the supported algorithms
+const (
+	coseKeyType    = 1
+	coseKeyAlg     = 3
+	coseKeyCrv     = -1
+	coseKeyX       = -2
+	coseKeyY       = -3
+	coseKeyRSAN    = -1
+	coseKeyRSAE    = -2
+	coseKeyTypeOKP = 1
+	coseKeyTypeEC2 = 2
+	coseKeyTypeRSA = 3
+	coseAlgES256   = -7
+	coseAlgEdDSA   = -8
+	coseAlgRS256   = -257
+	coseCrvP256    = 1
+	coseCrvEd25519 = 6
+)
+
+// Sizes of the fixed parts of the authenticator data
+const (
+	webAuthnAuthDataMin = 37
+	webAuthnAAGUIDSize  = 16
+)
+
+// WebAuthnAuthData is the authenticator data sent by the authenticator on registration and on each assertion.
+// CredentialId and PublicKey are only present on registration. PublicKey is the cose encoded key
+type WebAuthnAuthData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialId []byte
+	PublicKey    []byte
+}
+
+// ParseWebAuthnAuthData parses the binary authenticator data
+func ParseWebAuthnAuthData(b []byte) (*WebAuthnAuthData, error) {
+	if len(b) < webAuthnAuthDataMin {
+		return nil, NewErrorf("Invalid webauthn authenticator data: too short")
+	}
+	ad := &WebAuthnAuthData{RPIDHash: b[:32], Flags: b[32], SignCount: binary.BigEndian.Uint32(b[33:37])}
+	if ad.Flags&WEBAUTHN_FLAG_ATTESTED == 0 {
+		return ad, nil
+	}
+	rest := b[webAuthnAuthDataMin:]
+	if len(rest) < webAuthnAAGUIDSize+2 {
+		return nil, NewErrorf("Invalid webauthn authenticator data: missing attested credential")
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[webAuthnAAGUIDSize:]))
+	rest = rest[webAuthnAAGUIDSize+2:]
+	if idLen == 0 || idLen > WEBAUTHN_MAX_CREDENTIAL_ID || len(rest) < idLen {
+		return nil, NewErrorf("Invalid webauthn authenticator data: invalid credential id")
+	}
+	ad.CredentialId = rest[:idLen]
+	rest = rest[idLen:]
+	_, after, err := cborDecode(rest, 0)
+	if err != nil {
+		return nil, err
+	}
+	ad.PublicKey = rest[:len(rest)-len(after)]
+	if _, err := parseCOSEKey(ad.PublicKey); err != nil {
+		return nil, err
+	}
+	return ad, nil
+}
+
+// CheckRPID tells if the authenticator data was generated for the relying party id
+func (ad *WebAuthnAuthData) CheckRPID(rpId string) bool {
+	h := sha256.Sum256([]byte(rpId))
+	return bytes.Equal(ad.RPIDHash, h[:])
+}
+
+// ParseWebAuthnAttestation extracts the authenticator data with the new credential from an attestation object.
+// The attestation statement is not verified, which is the same as asking the client for "none" attestation
+func ParseWebAuthnAttestation(attestationObject []byte) (*WebAuthnAuthData, error) {
+	obj, _, err := cborDecode(attestationObject, 0)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := obj.(map[interface{}]interface{})
+	if !ok {
+		return nil, NewErrorf("Invalid webauthn attestation object")
+	}
+	raw, ok := m["authData"].([]byte)
+	if !ok {
+		return nil, NewErrorf("Invalid webauthn attestation object: missing authenticator data")
+	}
+	ad, err := ParseWebAuthnAuthData(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(ad.CredentialId) == 0 {
+		return nil, NewErrorf("Invalid webauthn attestation object: missing credential")
+	}
+	return ad, nil
+}
+
+type webAuthnClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// WebAuthnChallenge returns the challenge a client data was signed for
+func WebAuthnChallenge(clientDataJSON []byte) (string, error) {
+	cd := webAuthnClientData{}
+	if err := json.Unmarshal(clientDataJSON, &cd); err != nil {
+		return "", NewErrorf("Invalid webauthn client data: %s", err)
+	}
+	return cd.Challenge, nil
+}
+
+// CheckWebAuthnClientData verifies the type, challenge and origin of the client data
+func CheckWebAuthnClientData(clientDataJSON []byte, typ, challenge, origin string) error {
+	cd := webAuthnClientData{}
+	if err := json.Unmarshal(clientDataJSON, &cd); err != nil {
+		return NewErrorf("Invalid webauthn client data: %s", err)
+	}
+	if cd.Type != typ {
+		return NewErrorf("Invalid webauthn client data: unexpected type %s", cd.Type)
+	}
+	got, err := base64.RawURLEncoding.DecodeString(cd.Challenge)
+	expected, eerr := base64.RawURLEncoding.DecodeString(challenge)
+	if err != nil || eerr != nil || !bytes.Equal(got, expected) {
+		return NewErrorf("Invalid webauthn client data: challenge does not match")
+	}
+	if cd.Origin != origin {
+		return NewErrorf("Invalid webauthn client data: unexpected origin %s", cd.Origin)
+	}
+	return nil
+}
+
+// VerifyWebAuthnSignature checks an assertion signature over the authenticator data and the client data hash
+func VerifyWebAuthnSignature(coseKey, authData, clientDataJSON, sig []byte) error {
+	pub, err := parseCOSEKey(coseKey)
+	if err != nil {
+		return err
+	}
+	cdh := sha256.Sum256(clientDataJSON)
+	msg := append(append([]byte{}, authData...), cdh[:]...)
+	ok := false
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		h := sha256.Sum256(msg)
+		ok = ecdsa.VerifyASN1(k, h[:], sig)
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(k, msg, sig)
+	case *rsa.PublicKey:
+		h := sha256.Sum256(msg)
+		ok = rsa.VerifyPKCS1v15(k, crypto.SHA256, h[:], sig) == nil
+	}
+	if !ok {
+		return NewErrorf("Invalid webauthn signature")
+	}
+	return nil
+}
+
+// parseCOSEKey supports ES256, EdDSA and RS256 keys which cover the algorithms used by current authenticators
+func parseCOSEKey(b []byte) (crypto.PublicKey, error) {
+	obj, _, err := cborDecode(b, 0)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := obj.(map[interface{}]interface{})
+	if !ok {
+		return nil, NewErrorf("Invalid webauthn public key")
+	}
+	intParam := func(k int64) int64 {
+		v, _ := m[k].(int64)
+		return v
+	}
+	bytesParam := func(k int64) []byte {
+		v, _ := m[k].([]byte)
+		return v
+	}
+	switch {
+	case intParam(coseKeyType) == coseKeyTypeEC2 && intParam(coseKeyAlg) == coseAlgES256 && intParam(coseKeyCrv) == coseCrvP256:
+		x, y := bytesParam(coseKeyX), bytesParam(coseKeyY)
+		if len(x) != 32 || len(y) != 32 {
+			break
+		}
+		k := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !k.Curve.IsOnCurve(k.X, k.Y) {
+			break
+		}
+		return k, nil
+	case intParam(coseKeyType) == coseKeyTypeOKP && intParam(coseKeyAlg) == coseAlgEdDSA && intParam(coseKeyCrv) == coseCrvEd25519:
+		if x := bytesParam(coseKeyX); len(x) == ed25519.PublicKeySize {
+			return ed25519.PublicKey(x), nil
+		}
+	case intParam(coseKeyType) == coseKeyTypeRSA && intParam(coseKeyAlg) == coseAlgRS256:
+		n, e := bytesParam(coseKeyRSAN), bytesParam(coseKeyRSAE)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			break
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	}
+	return nil, NewErrorf("Invalid or unsupported webauthn public key")
+}
+
+// cborDecode decodes the subset of cbor used by webauthn: ints, byte and text strings, arrays, maps and simple
+// values with definite lengths. It returns the value and the remaining bytes
+func cborDecode(b []byte, depth int) (interface{}, []byte, error) {
+	if depth > cborMaxDepth {
+		return nil, nil, NewErrorf("Invalid cbor: too deep")
+	}
+	if len(b) == 0 {
+		return nil, nil, NewErrorf("Invalid cbor: unexpected end")
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	b = b[1:]
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info <= 27:
+		n := 1 << (info - 24)
+		if len(b) < n {
+			return nil, nil, NewErrorf("Invalid cbor: unexpected end")
+		}
+		for _, c := range b[:n] {
+			arg = arg<<8 | uint64(c)
+		}
+		b = b[n:]
+	default:
+		return nil, nil, NewErrorf("Invalid cbor: unsupported length")
+	}
+	switch major {
+	case 0, 1:
+		if arg > 1<<62 {
+			return nil, nil, NewErrorf("Invalid cbor: int out of range")
+		}
+		if major == 1 {
+			return -1 - int64(arg), b, nil
+		}
+		return int64(arg), b, nil
+	case 2, 3:
+		if uint64(len(b)) < arg {
+			return nil, nil, NewErrorf("Invalid cbor: unexpected end")
+		}
+		if major == 3 {
+			return string(b[:arg]), b[arg:], nil
+		}
+		return b[:arg], b[arg:], nil
+	case 4:
+		if uint64(len(b)) < arg {
+			return nil, nil, NewErrorf("Invalid cbor: unexpected end")
+		}
+		items := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			item, rest, err := cborDecode(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+			b = rest
+		}
+		return items, b, nil
+	case 5:
+		if uint64(len(b)) < arg*2 {
+			return nil, nil, NewErrorf("Invalid cbor: unexpected end")
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			k, rest, err := cborDecode(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, nil, NewErrorf("Invalid cbor: unsupported map key")
+			}
+			v, rest, err := cborDecode(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[k] = v
+			b = rest
+		}
+		return m, b, nil
+	case 7:
+		switch arg {
+		case 20:
+			return false, b, nil
+		case 21:
+			return true, b, nil
+		case 22:
+			return nil, b, nil
+		}
+	}
+	return nil, nil, NewErrorf("Invalid cbor: unsupported type")
+}
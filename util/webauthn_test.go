@@ -0,0 +1,66 @@
+package util
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/keydotcat/keycatd/thelpers"
+)
+
+func TestWebAuthnRegistrationAndAssertion(t *testing.T) {
+	fa := thelpers.NewFakeAuthenticator("keycat.example.com", "https://keycat.example.com")
+	ad, err := ParseWebAuthnAttestation(fa.AttestationObject())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ad.CredentialId, fa.CredentialId) || !bytes.Equal(ad.PublicKey, fa.COSEKey()) {
+		t.Fatalf("Unexpected credential in %+v", ad)
+	}
+	if !ad.CheckRPID("keycat.example.com") || ad.CheckRPID("evil.example.com") {
+		t.Errorf("Invalid relying party check")
+	}
+	cd := fa.ClientData(WEBAUTHN_TYPE_CREATE, "Y2hhbGxlbmdl")
+	if err := CheckWebAuthnClientData(cd, WEBAUTHN_TYPE_CREATE, "Y2hhbGxlbmdl", "https://keycat.example.com"); err != nil {
+		t.Error(err)
+	}
+	if err := CheckWebAuthnClientData(cd, WEBAUTHN_TYPE_GET, "Y2hhbGxlbmdl", "https://keycat.example.com"); err == nil {
+		t.Error("Expected the client data type to be checked")
+	}
+	if err := CheckWebAuthnClientData(cd, WEBAUTHN_TYPE_CREATE, "b3RoZXI", "https://keycat.example.com"); err == nil {
+		t.Error("Expected the challenge to be checked")
+	}
+	if err := CheckWebAuthnClientData(cd, WEBAUTHN_TYPE_CREATE, "Y2hhbGxlbmdl", "https://evil.example.com"); err == nil {
+		t.Error("Expected the origin to be checked")
+	}
+	clientData, authData, sig := fa.Assert("Y2hhbGxlbmdl")
+	if err := VerifyWebAuthnSignature(ad.PublicKey, authData, clientData, sig); err != nil {
+		t.Fatal(err)
+	}
+	aad, err := ParseWebAuthnAuthData(authData)
+	if err != nil || aad.SignCount != 1 || aad.Flags&WEBAUTHN_FLAG_USER_PRESENT == 0 {
+		t.Fatalf("Unexpected assertion data %+v (%v)", aad, err)
+	}
+	authData[len(authData)-1]++
+	if err := VerifyWebAuthnSignature(ad.PublicKey, authData, clientData, sig); err == nil {
+		t.Error("Expected a tampered assertion to be rejected")
+	}
+}
+
+func TestCborDecodeRejectsMalformed(t *testing.T) {
+	for _, b := range [][]byte{
+		{},
+		{0x5f},             // indefinite byte string
+		{0x44, 0x01},       // truncated byte string
+		{0xa1, 0x01},       // map without value
+		{0xa1, 0x40, 0x01}, // byte string as map key
+		{0xc0, 0x01},       // tag
+	} {
+		if _, _, err := cborDecode(b, 0); err == nil {
+			t.Errorf("Expected %x to be rejected", b)
+		}
+	}
+	deep := bytes.Repeat([]byte{0x81}, cborMaxDepth+2)
+	if _, _, err := cborDecode(append(deep, 0x01), 0); err == nil {
+		t.Error("Expected deeply nested cbor to be rejected")
+	}
+}